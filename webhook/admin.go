@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// adminhandler serves the /admin/ endpoints, which require the bearer token
+// stored in $ADMIN_SECRET. They are disabled if it is not set.
+type adminhandler struct {
+	clients
+	w         http.ResponseWriter
+	r         *http.Request
+	config    config
+	records   *jobStore  // Optional.
+	budgeter  *budgeter  // Optional.
+	diagStore *diagStore // Optional.
+}
+
+// authorized checks the request's bearer token, writing an error response
+// if it is missing or wrong.
+func (h adminhandler) authorized() bool {
+	if h.config.AdminSecretName == "" {
+		http.Error(h.w, "Admin endpoints are disabled; set $ADMIN_SECRET to enable them.", http.StatusNotFound)
+		return false
+	}
+	token, ok := strings.CutPrefix(h.r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		h.w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(h.w, "Missing bearer token", http.StatusUnauthorized)
+		return false
+	}
+	want, err := h.secrets.readSecret(h.r.Context(), h.config.AdminSecretName)
+	if err != nil {
+		h.serverError("reading $ADMIN_SECRET: %v", err)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(strings.TrimSpace(string(want)))) != 1 {
+		logWarn("Rejected admin request to %s: wrong bearer token.", h.r.URL.Path)
+		http.Error(h.w, "Wrong bearer token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// usage reports vCPU-seconds and GiB-seconds, e.g.,
+// /admin/usage?from=2023-07-01&to=2023-07-31&by=repo,day&format=csv
+func (h adminhandler) usage() {
+	if !h.authorized() {
+		return
+	}
+	if h.records == nil {
+		http.Error(h.w, "Usage is not recorded; set $STATE_URL to record it.", http.StatusNotFound)
+		return
+	}
+	v := h.r.URL.Query()
+	q, err := parseUsageQuery(v.Get("from"), v.Get("to"), v.Get("by"), v.Get("format"), time.Now())
+	if err != nil {
+		h.clientError("%v", err)
+		return
+	}
+	if q.format == "csv" {
+		h.w.Header().Set("Content-Type", "text/csv")
+	} else {
+		h.w.Header().Set("Content-Type", "application/json")
+	}
+	if err := usageReport(h.r.Context(), h.records, q, h.w); err != nil {
+		h.serverError("creating usage report: %v", err)
+	}
+}
+
+// budgetOverrideRequest is the body of a POST to /admin/budgets.
+type budgetOverrideRequest struct {
+	Budget string    `json:"budget"`
+	Until  time.Time `json:"until"` // Defaults to the end of the budget's current period.
+	Reason string    `json:"reason"`
+}
+
+// budgets reports the budgets' spend (GET), lifts a budget (POST a
+// budgetOverrideRequest), or removes an override (DELETE ?budget=name).
+func (h adminhandler) budgets() {
+	if !h.authorized() {
+		return
+	}
+	if h.budgeter == nil {
+		http.Error(h.w, "Budgets are not enforced; set $BUDGET_FILE and $STATE_URL to enforce them.", http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+
+	switch h.r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req budgetOverrideRequest
+		if err := json.NewDecoder(h.r.Body).Decode(&req); err != nil {
+			h.clientError("parsing override: %v", err)
+			return
+		}
+		if req.Reason == "" {
+			h.clientError("an override needs a reason")
+			return
+		}
+		if req.Until.IsZero() {
+			for _, s := range h.budgeter.status(now) {
+				if s.Name == req.Budget {
+					req.Until = s.Resets
+				}
+			}
+		}
+		if !req.Until.IsZero() && !req.Until.After(now) {
+			h.clientError("until %s is in the past", req.Until.Format(time.RFC3339))
+			return
+		}
+		o := &budgetOverride{Until: req.Until, Reason: req.Reason, Created: now}
+		if !h.setOverride(req.Budget, o, now) {
+			return
+		}
+		logAudit(req, "Budget %q lifted until %s: %s", req.Budget, req.Until.Format(time.RFC3339), req.Reason)
+	case http.MethodDelete:
+		name := h.r.URL.Query().Get("budget")
+		if !h.setOverride(name, nil, now) {
+			return
+		}
+		logInfo("Override of budget %q removed.", name)
+	default:
+		h.w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(h.w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(h.w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(h.budgeter.status(now)); err != nil {
+		logError("Writing budgets: %v", err)
+	}
+}
+
+// setOverride writes an error response and returns false if the override
+// cannot be set.
+func (h adminhandler) setOverride(name string, o *budgetOverride, now time.Time) bool {
+	err := h.budgeter.setOverride(h.r.Context(), name, o, now)
+	if errors.Is(err, errNoBudget) {
+		h.w.WriteHeader(http.StatusNotFound)
+		h.w.Write([]byte(fmt.Sprintf("No budget %q", name)))
+		return false
+	}
+	if err != nil {
+		h.serverError("setting override of budget %q: %v", name, err)
+		return false
+	}
+	return true
+}
+
+func (h adminhandler) serverError(template string, args ...any) {
+	logError("Error: "+template, args...)
+	h.w.WriteHeader(http.StatusInternalServerError)
+	h.w.Write([]byte("Server error"))
+}
+
+func (h adminhandler) clientError(template string, args ...any) {
+	msg := "Client error: " + fmt.Sprintf(template, args...)
+	logWarn(msg)
+	h.w.WriteHeader(http.StatusBadRequest)
+	h.w.Write([]byte(msg))
+}
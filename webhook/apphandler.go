@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
@@ -16,6 +17,7 @@ var (
 )
 
 type apphandler struct {
+	clients
 	w      http.ResponseWriter
 	r      *http.Request
 	config config
@@ -52,7 +54,7 @@ func (h apphandler) next() {
 	}
 
 	r := NewRegistration(applicationID, installationID, repo, pk)
-	token, err := r.Token(h.r.Context())
+	token, err := h.github.appRegistrationToken(h.r.Context(), r)
 	if err != nil {
 		h.serverError("generating registration token: %v", err)
 		return
@@ -63,10 +65,14 @@ func (h apphandler) next() {
 }
 
 func (h apphandler) privateKey() (*rsa.PrivateKey, error) {
-	if h.config.AppPrivateKeyName == "" {
+	return readPrivateKey(h.r.Context(), h.secrets, h.config)
+}
+
+func readPrivateKey(ctx context.Context, secrets secretReader, config config) (*rsa.PrivateKey, error) {
+	if config.AppPrivateKeyName == "" {
 		return nil, errors.New("missing GitHub app private key, did you set $GITHUB_APP_PRIVATE_KEY https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/managing-private-keys-for-github-apps#generating-private-keys")
 	}
-	raw, err := readSecret(h.r.Context(), h.config, h.config.AppPrivateKeyName)
+	raw, err := secrets.readSecret(ctx, config.AppPrivateKeyName)
 	if err != nil {
 		return nil, fmt.Errorf("reading private key pem: %v", err)
 	}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	archivePrefix = "deliveries/"
+)
+
+var (
+	archivePruneInterval = time.Hour
+)
+
+// delivery is an archived webhook delivery: enough to replay it exactly.
+type delivery struct {
+	ReceivedAt time.Time   `json:"received_at"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+}
+
+// archiver stores accepted webhook deliveries in a blobStore and prunes
+// those older than the retention period.
+type archiver struct {
+	store     blobStore
+	retention time.Duration
+}
+
+func newArchiver(store blobStore, retention time.Duration) *archiver {
+	return &archiver{store: store, retention: retention}
+}
+
+// archive stores the delivery and returns its key.
+func (a *archiver) archive(ctx context.Context, d delivery) (string, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("marshalling delivery: %v", err)
+	}
+	id := d.Header.Get(deliveryHeader)
+	if id == "" {
+		id = "unknown"
+	}
+	// Keys sort by time, and are grouped by day to make browsing easier.
+	key := fmt.Sprintf("%s%s/%s-%s-%s.json", archivePrefix, d.ReceivedAt.UTC().Format("2006-01-02"), d.ReceivedAt.UTC().Format("150405.000"), d.Header.Get(eventHeader), id)
+	if err := a.store.put(ctx, key, b); err != nil {
+		return "", fmt.Errorf("storing delivery: %v", err)
+	}
+	return key, nil
+}
+
+// prune deletes deliveries older than the retention period.
+func (a *archiver) prune(ctx context.Context) error {
+	if a.retention <= 0 {
+		return nil
+	}
+	blobs, err := a.store.list(ctx, archivePrefix)
+	if err != nil {
+		return fmt.Errorf("listing deliveries: %v", err)
+	}
+	cutoff := time.Now().Add(-a.retention)
+	deleted := 0
+	for _, b := range blobs {
+		if b.modified.After(cutoff) {
+			continue
+		}
+		if err := a.store.delete(ctx, b.key); err != nil {
+			return fmt.Errorf("deleting %q: %v", b.key, err)
+		}
+		deleted++
+	}
+	if deleted > 0 {
+		logInfo("Pruned %d archived deliveries older than %v.", deleted, a.retention)
+	}
+	return nil
+}
+
+// pruneLoop prunes the archive periodically until ctx is done.
+func (a *archiver) pruneLoop(ctx context.Context) {
+	t := time.NewTicker(archivePruneInterval)
+	defer t.Stop()
+	for {
+		if err := a.prune(ctx); err != nil {
+			logError("Pruning delivery archive: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// loadDelivery reads an archived delivery, by key, from the store.
+func loadDelivery(ctx context.Context, store blobStore, key string) (delivery, error) {
+	b, err := store.get(ctx, key)
+	if err != nil {
+		return delivery{}, fmt.Errorf("reading delivery %q: %v", key, err)
+	}
+	var d delivery
+	if err := json.Unmarshal(b, &d); err != nil {
+		return delivery{}, fmt.Errorf("unmarshalling delivery %q: %v", key, err)
+	}
+	return d, nil
+}
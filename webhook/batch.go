@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+// maxBatchWindow keeps deliveries waiting for a batch well within GitHub's
+// 10 second delivery timeout.
+const maxBatchWindow = 5 * time.Second
+
+// batcher coalesces the runners for jobs of the same workflow run, queued
+// within a short window, into one execution with a task per runner. A
+// 50-leg matrix then takes one RunJob call instead of 50.
+type batcher struct {
+	window  time.Duration
+	max     int       // Tasks per execution.
+	records *jobStore // Optional.
+
+	mu      sync.Mutex
+	pending map[string]*batch // By batchKey.
+}
+
+// batch is the runners waiting to be started together.
+type batch struct {
+	key    string
+	job    cloudRunJob
+	opts   runOptions // Of the first job.
+	events []*event
+	ctx    context.Context // Of the first job's request, without its cancellation.
+	timer  *time.Timer
+
+	done chan struct{}
+	exec *runpb.Execution
+	err  error
+}
+
+func newBatcher(window time.Duration, max int, records *jobStore) *batcher {
+	return &batcher{window: window, max: max, records: records, pending: map[string]*batch{}}
+}
+
+// batchKey groups the jobs whose runners can share an execution: the
+// overrides of an execution apply to all of its tasks.
+func batchKey(job cloudRunJob, opts runOptions) string {
+	labels := slices.Clone(opts.labels)
+	slices.Sort(labels)
+	return fmt.Sprintf("%s %s %d %d %s %v", job.jobID(), opts.repo, opts.runID, opts.runAttempt, strings.Join(labels, ","), opts.timeout)
+}
+
+// run adds a runner for the workflow job in ev to a batch and waits for the
+// batch's execution to start.
+func (b *batcher) run(ctx context.Context, job cloudRunJob, opts runOptions, ev *event) (*runpb.Execution, error) {
+	key := batchKey(job, opts)
+	b.mu.Lock()
+	bt, ok := b.pending[key]
+	if !ok {
+		bt = &batch{key: key, job: job, opts: opts, ctx: context.WithoutCancel(ctx), done: make(chan struct{})}
+		b.pending[key] = bt
+		bt.timer = time.AfterFunc(b.window, func() { b.flush(bt) })
+	}
+	bt.events = append(bt.events, ev)
+	full := len(bt.events) >= b.max
+	if full {
+		// Taken out under the lock, so that no more runners join it.
+		delete(b.pending, key)
+		bt.timer.Stop()
+	}
+	b.mu.Unlock()
+	if full {
+		go b.start(bt)
+	}
+
+	select {
+	case <-bt.done:
+		return bt.exec, bt.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// flush starts the batch's execution when its window closes, unless it
+// has already been started.
+func (b *batcher) flush(bt *batch) {
+	b.mu.Lock()
+	if b.pending[bt.key] != bt {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.pending, bt.key)
+	b.mu.Unlock()
+	b.start(bt)
+}
+
+// start starts the execution of a batch taken out of pending, which no
+// runner can join any more.
+func (b *batcher) start(bt *batch) {
+	defer close(bt.done)
+
+	first := bt.events[0].WorkflowJob
+	opts := bt.opts
+	if n := len(bt.events); n > 1 {
+		// Each task registers as "{name}-{task index}"; see createJobRequest.
+		opts.name = fmt.Sprintf("%sbatch-%d", runnerNamePrefix, first.ID)
+		opts.jobID = 0
+		opts.tasks = n
+		logInfo("Starting %d runners for workflow run %d in one execution.", n, first.RunID)
+	}
+	bt.exec, bt.err = bt.job.runJob(bt.ctx, opts)
+	if bt.err != nil || b.records == nil || bt.exec.Name == "" {
+		return
+	}
+	r := newJobRecord(bt.events[0], bt.exec, &bt.job, opts.runnerName(), time.Now())
+	r.Tasks = len(bt.events)
+	if err := b.records.put(bt.ctx, r); err != nil {
+		logError("Recording execution %q: %v", bt.exec.Name, err)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	config := testConfig()
+	ctx := context.Background()
+
+	queued := func(jobID int, runID int64, labels ...string) *event {
+		return &event{
+			Action:      actionQueued,
+			Repository:  eventRepository{FullName: "owner/repo"},
+			WorkflowJob: eventWorkflowJob{ID: jobID, RunID: runID, RunAttempt: 1, Name: "build", WorkflowName: "CI", Labels: labels},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		max       int
+		events    []*event
+		wantTasks []int32 // Per RunJob request, in any order; 0 for a single task.
+	}{
+		{name: "single", max: 50, events: []*event{queued(1, 7, "self-hosted")}, wantTasks: []int32{0}},
+		{name: "matrix", max: 50, events: []*event{queued(1, 7, "self-hosted"), queued(2, 7, "self-hosted"), queued(3, 7, "self-hosted")}, wantTasks: []int32{3}},
+		{name: "different runs", max: 50, events: []*event{queued(1, 7, "self-hosted"), queued(2, 8, "self-hosted"), queued(3, 7, "self-hosted")}, wantTasks: []int32{2, 0}},
+		{name: "different labels", max: 50, events: []*event{queued(1, 7, "self-hosted"), queued(2, 7, "gpu"), queued(3, 7, "self-hosted")}, wantTasks: []int32{2, 0}},
+		{name: "max tasks", max: 2, events: []*event{queued(1, 7), queued(2, 7), queued(3, 7), queued(4, 7)}, wantTasks: []int32{2, 2}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			clients, jobs := testClients(t, config)
+			store, err := newBlobStore(ctx, t.TempDir())
+			if err != nil {
+				t.Fatalf("newBlobStore() failed: %v", err)
+			}
+			records := newJobStore(store)
+			// A long window, so that only the max flushes "max tasks" early.
+			window := 200 * time.Millisecond
+			if tc.max < len(tc.events) {
+				window = time.Hour
+			}
+			b := newBatcher(window, tc.max, records)
+			job := cloudRunJob{config: config, client: clients.jobs}
+
+			var wg sync.WaitGroup
+			for _, ev := range tc.events {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, err := b.run(ctx, job, runOptionsFor(config, ev), ev); err != nil {
+						t.Errorf("run(%d) failed: %v", ev.WorkflowJob.ID, err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			reqs := jobs.runRequests()
+			got := map[int32]int{}
+			for _, req := range reqs {
+				got[req.GetOverrides().GetTaskCount()]++
+				env := overrideEnv(req)
+				if req.GetOverrides().GetTaskCount() > 1 {
+					if env[jobIDEnvVar] != "" || env[runnerNameEnvVar] == "" || env[runIDEnvVar] == "" {
+						t.Errorf("batch env got:%v", env)
+					}
+				} else if env[jobIDEnvVar] == "" {
+					t.Errorf("single env got:%v", env)
+				}
+			}
+			want := map[int32]int{}
+			for _, n := range tc.wantTasks {
+				want[n]++
+			}
+			if len(got) != len(want) {
+				t.Fatalf("task counts got:%v want:%v", got, want)
+			}
+			for n, c := range want {
+				if got[n] != c {
+					t.Errorf("task counts got:%v want:%v", got, want)
+				}
+			}
+
+			recs, err := records.list(ctx, time.Now(), time.Now())
+			if err != nil {
+				t.Fatalf("list() failed: %v", err)
+			}
+			tasks := 0
+			for _, r := range recs {
+				tasks += max(r.Tasks, 1)
+			}
+			if len(recs) != len(reqs) || tasks != len(tc.events) {
+				t.Errorf("records got:%d for %d tasks, want:%d for %d", len(recs), tasks, len(reqs), len(tc.events))
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+)
+
+var (
+	// errBlobNotFound is returned by blobStore.get for missing keys.
+	errBlobNotFound = errors.New("blob not found")
+	// errBlobExists is returned by blobStore.create for existing keys.
+	errBlobExists = errors.New("blob exists")
+)
+
+// blobStore is a minimal object store. Keys are slash-separated paths.
+type blobStore interface {
+	put(ctx context.Context, key string, data []byte) error
+	// create is put, unless the key exists, so that instances can take
+	// turns; errBlobExists if it does.
+	create(ctx context.Context, key string, data []byte) error
+	get(ctx context.Context, key string) ([]byte, error)
+	list(ctx context.Context, prefix string) ([]blobInfo, error)
+	delete(ctx context.Context, key string) error
+}
+
+type blobInfo struct {
+	key      string
+	size     int64
+	modified time.Time
+}
+
+// newBlobStore returns a blobStore for url, which is either "gs://bucket/prefix"
+// for Cloud Storage, or a local directory (optionally "file://dir").
+// $STORAGE_EMULATOR_HOST is honoured for GCS-compatible stores.
+func newBlobStore(ctx context.Context, url string) (blobStore, error) {
+	if rest, ok := strings.CutPrefix(url, "gs://"); ok {
+		bucket, prefix, _ := strings.Cut(rest, "/")
+		if bucket == "" {
+			return nil, fmt.Errorf("missing bucket in %q", url)
+		}
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("creating storage client: %v", err)
+		}
+		return gcsBlobStore{bucket: client.Bucket(bucket), prefix: strings.Trim(prefix, "/")}, nil
+	}
+	dir := strings.TrimPrefix(url, "file://")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating directory %q: %v", dir, err)
+	}
+	return dirBlobStore{dir: dir}, nil
+}
+
+// dirBlobStore stores blobs as files under a local directory. It is
+// intended for testing and single-instance deployments.
+type dirBlobStore struct {
+	dir string
+}
+
+func (s dirBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s dirBlobStore) put(ctx context.Context, key string, data []byte) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("creating directory: %v", err)
+	}
+	if err := os.WriteFile(p, data, 0o644); err != nil {
+		return fmt.Errorf("writing %q: %v", p, err)
+	}
+	return nil
+}
+
+func (s dirBlobStore) create(ctx context.Context, key string, data []byte) error {
+	p := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("creating directory: %v", err)
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		return errBlobExists
+	}
+	if err != nil {
+		return fmt.Errorf("creating %q: %v", p, err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("writing %q: %v", p, err)
+	}
+	return nil
+}
+
+func (s dirBlobStore) get(ctx context.Context, key string) ([]byte, error) {
+	b, err := os.ReadFile(s.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %v", key, err)
+	}
+	return b, nil
+}
+
+func (s dirBlobStore) list(ctx context.Context, prefix string) ([]blobInfo, error) {
+	var blobs []blobInfo
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, blobInfo{key: key, size: info.Size(), modified: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %q: %v", s.dir, err)
+	}
+	sort.Slice(blobs, func(a, b int) bool { return blobs[a].key < blobs[b].key })
+	return blobs, nil
+}
+
+func (s dirBlobStore) delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("deleting %q: %v", key, err)
+	}
+	return nil
+}
+
+// gcsBlobStore stores blobs as objects in a Cloud Storage bucket, under an
+// optional prefix.
+type gcsBlobStore struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+func (s gcsBlobStore) object(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s gcsBlobStore) put(ctx context.Context, key string, data []byte) error {
+	w := s.bucket.Object(s.object(key)).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("writing %q: %v", key, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("closing %q: %v", key, err)
+	}
+	return nil
+}
+
+func (s gcsBlobStore) create(ctx context.Context, key string, data []byte) error {
+	w := s.bucket.Object(s.object(key)).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return fmt.Errorf("writing %q: %v", key, err)
+	}
+	err := w.Close()
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusPreconditionFailed {
+		return errBlobExists
+	}
+	if err != nil {
+		return fmt.Errorf("closing %q: %v", key, err)
+	}
+	return nil
+}
+
+func (s gcsBlobStore) get(ctx context.Context, key string) ([]byte, error) {
+	r, err := s.bucket.Object(s.object(key)).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %q: %v", key, err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func (s gcsBlobStore) list(ctx context.Context, prefix string) ([]blobInfo, error) {
+	var blobs []blobInfo
+	it := s.bucket.Objects(ctx, &storage.Query{Prefix: s.object(prefix)})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("listing %q: %v", prefix, err)
+		}
+		key := attrs.Name
+		if s.prefix != "" {
+			key = strings.TrimPrefix(key, s.prefix+"/")
+		}
+		blobs = append(blobs, blobInfo{key: key, size: attrs.Size, modified: attrs.Updated})
+	}
+	return blobs, nil
+}
+
+func (s gcsBlobStore) delete(ctx context.Context, key string) error {
+	if err := s.bucket.Object(s.object(key)).Delete(ctx); err != nil && !errors.Is(err, storage.ErrObjectNotExist) {
+		return fmt.Errorf("deleting %q: %v", key, err)
+	}
+	return nil
+}
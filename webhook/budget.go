@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Budget actions.
+const (
+	budgetDeny  = "deny"  // Stop dispatching.
+	budgetSmall = "small" // Dispatch on the small profile.
+)
+
+const (
+	budgetOverridesKey = "budgets/overrides.json"
+	budgetNotifyPrefix = "budgets/notified/"
+)
+
+var (
+	// budgetInterval is how often spend is recomputed from the job records.
+	budgetInterval = time.Minute
+
+	// defaultBudgetPrices are Cloud Run's tier 1 prices for jobs, in USD.
+	// See https://cloud.google.com/run/pricing
+	defaultBudgetPrices = budgetPrices{VCPUSecond: 0.000018, GiBSecond: 0.000002}
+
+	budgetNameRE = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+	errNoBudget = errors.New("no such budget")
+)
+
+// budgetPeriod is how often a budget resets. Periods are UTC calendar days
+// and months.
+type budgetPeriod string
+
+const (
+	budgetDaily   budgetPeriod = "daily"
+	budgetMonthly budgetPeriod = "monthly"
+)
+
+// start returns the start of the period containing t.
+func (p budgetPeriod) start(t time.Time) time.Time {
+	t = t.UTC()
+	if p == budgetMonthly {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// next returns the end of the period containing t, when the budget resets.
+func (p budgetPeriod) next(t time.Time) time.Time {
+	if p == budgetMonthly {
+		return p.start(t).AddDate(0, 1, 0)
+	}
+	return p.start(t).AddDate(0, 0, 1)
+}
+
+// budgetFile is the format of $BUDGET_FILE. Each budget covers a repository
+// or all the repositories of an owner, and is a limit on either estimated
+// cost or vCPU-hours. For example:
+//
+//	{
+//	  "prices": {"vcpuSecond": 0.000018, "gibSecond": 0.000002},
+//	  "budgets": [
+//	    {"name": "acme", "organization": "acme", "period": "monthly", "cost": 500, "action": "small"},
+//	    {"name": "widgets", "repository": "acme/widgets", "period": "daily", "vcpuHours": 20}
+//	  ]
+//	}
+type budgetFile struct {
+	Prices  *budgetPrices `json:"prices"` // Defaults to defaultBudgetPrices.
+	Budgets []budgetSpec  `json:"budgets"`
+}
+
+type budgetPrices struct {
+	VCPUSecond float64 `json:"vcpuSecond"`
+	GiBSecond  float64 `json:"gibSecond"`
+}
+
+type budgetSpec struct {
+	Name         string       `json:"name"`
+	Repository   string       `json:"repository"`   // "owner/repo". Exactly one of Repository and Organization.
+	Organization string       `json:"organization"` // Any repository owner, including users.
+	Period       budgetPeriod `json:"period"`
+	Cost         float64      `json:"cost"` // Estimated cost, in the prices' currency. Exactly one of Cost and VCPUHours.
+	VCPUHours    float64      `json:"vcpuHours"`
+	Action       string       `json:"action"` // "deny" (if empty) or "small".
+}
+
+// scope describes what the budget covers, e.g., "repository acme/widgets".
+func (b budgetSpec) scope() string {
+	if b.Repository != "" {
+		return "repository " + b.Repository
+	}
+	return "organization " + b.Organization
+}
+
+// covers reports whether the budget applies to the repository.
+func (b budgetSpec) covers(repo string) bool {
+	if b.Repository != "" {
+		return strings.EqualFold(b.Repository, repo)
+	}
+	owner, _, _ := strings.Cut(repo, "/")
+	return strings.EqualFold(b.Organization, owner)
+}
+
+func (b budgetSpec) limit() float64 {
+	if b.Cost > 0 {
+		return b.Cost
+	}
+	return b.VCPUHours
+}
+
+func (b budgetSpec) unit() string {
+	if b.Cost > 0 {
+		return "cost"
+	}
+	return "vCPU-hours"
+}
+
+// budgetSet is a parsed $BUDGET_FILE.
+type budgetSet struct {
+	budgets []budgetSpec
+	prices  budgetPrices
+}
+
+// loadBudgetSet reads the budgets at path.
+func loadBudgetSet(path string) (*budgetSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading budget file: %v", err)
+	}
+	return parseBudgetSet(b)
+}
+
+func parseBudgetSet(b []byte) (*budgetSet, error) {
+	var bf budgetFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&bf); err != nil {
+		return nil, fmt.Errorf("parsing budgets: %v", err)
+	}
+
+	bs := &budgetSet{prices: defaultBudgetPrices}
+	if bf.Prices != nil {
+		if bf.Prices.VCPUSecond < 0 || bf.Prices.GiBSecond < 0 {
+			return nil, errors.New("prices cannot be negative")
+		}
+		bs.prices = *bf.Prices
+	}
+	names := map[string]bool{}
+	for i, spec := range bf.Budgets {
+		if !budgetNameRE.MatchString(spec.Name) {
+			return nil, fmt.Errorf("budget %d: name %q must match %s", i+1, spec.Name, budgetNameRE)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("budget %q: duplicate name", spec.Name)
+		}
+		names[spec.Name] = true
+		if (spec.Repository == "") == (spec.Organization == "") {
+			return nil, fmt.Errorf("budget %q: set exactly one of repository and organization", spec.Name)
+		}
+		if spec.Repository != "" && strings.Count(spec.Repository, "/") != 1 {
+			return nil, fmt.Errorf("budget %q: repository %q must be \"owner/repo\"", spec.Name, spec.Repository)
+		}
+		if spec.Period != budgetDaily && spec.Period != budgetMonthly {
+			return nil, fmt.Errorf("budget %q: period %q must be %q or %q", spec.Name, spec.Period, budgetDaily, budgetMonthly)
+		}
+		if (spec.Cost > 0) == (spec.VCPUHours > 0) || spec.Cost < 0 || spec.VCPUHours < 0 {
+			return nil, fmt.Errorf("budget %q: set exactly one of a positive cost and vcpuHours", spec.Name)
+		}
+		switch spec.Action {
+		case "":
+			spec.Action = budgetDeny
+		case budgetDeny, budgetSmall:
+		default:
+			return nil, fmt.Errorf("budget %q: action %q must be %q or %q", spec.Name, spec.Action, budgetDeny, budgetSmall)
+		}
+		bs.budgets = append(bs.budgets, spec)
+	}
+	return bs, nil
+}
+
+// usesProfile reports whether any budget can route jobs to profile p. It is
+// safe to call on a nil budget set.
+func (bs *budgetSet) usesProfile(p profile) bool {
+	if bs == nil || p != profileSmall {
+		return false
+	}
+	return slices.ContainsFunc(bs.budgets, func(b budgetSpec) bool { return b.Action == budgetSmall })
+}
+
+// budgetUsage is the resources used by jobs in a budget period.
+type budgetUsage struct {
+	vcpuSeconds float64
+	gibSeconds  float64
+}
+
+// recordUsage is the usage of a job record; executions still running are
+// charged for the time since they were dispatched.
+func recordUsage(r jobRecord, now time.Time) budgetUsage {
+	if r.Completed != nil {
+		return budgetUsage{vcpuSeconds: r.VCPUSeconds, gibSeconds: r.GiBSeconds}
+	}
+	seconds := max(now.Sub(r.Dispatched).Seconds(), 0)
+	return budgetUsage{vcpuSeconds: seconds * r.CPU, gibSeconds: seconds * r.MemoryGiB}
+}
+
+// budgetOverride lifts a budget until a time, set from /admin/budgets.
+type budgetOverride struct {
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+}
+
+// budgetStatus is a budget's use of its current period.
+type budgetStatus struct {
+	spec        budgetSpec
+	Name        string          `json:"name"`
+	Scope       string          `json:"scope"`
+	Period      budgetPeriod    `json:"period"`
+	PeriodStart time.Time       `json:"periodStart"`
+	Resets      time.Time       `json:"resets"`
+	Unit        string          `json:"unit"`
+	Limit       float64         `json:"limit"`
+	Used        float64         `json:"used"`
+	Action      string          `json:"action"`
+	Exceeded    bool            `json:"exceeded"`
+	Override    *budgetOverride `json:"override,omitempty"`
+}
+
+// enforced reports whether the budget's action applies.
+func (s budgetStatus) enforced() bool {
+	return s.Exceeded && s.Override == nil
+}
+
+func (s budgetStatus) String() string {
+	return fmt.Sprintf("%s is over budget %q: %.2f of %.2f %s used this %s period, which resets at %s", s.spec.scope(), s.Name, s.Used, s.Limit, s.Unit, s.Period, s.Resets.Format(time.RFC3339))
+}
+
+// budgeter enforces budgets using the spend recorded in the job records.
+// Spend is recomputed every budgetInterval rather than on each delivery;
+// overrides and notifications are kept in the state store so that they are
+// shared by all instances.
+type budgeter struct {
+	set       *budgetSet
+	records   *jobStore
+	cache     *recordCache // So that refresh reads each completed record once.
+	notifyURL string       // Optional.
+	client    *http.Client
+
+	mu        sync.Mutex
+	usage     map[string]budgetUsage // By budget name, for the periods containing refreshed.
+	refreshed time.Time
+	overrides map[string]budgetOverride
+}
+
+func newBudgeter(set *budgetSet, records *jobStore, notifyURL string, client *http.Client) *budgeter {
+	return &budgeter{set: set, records: records, cache: newRecordCache(records), notifyURL: notifyURL, client: client}
+}
+
+// refresh recomputes each budget's spend in its current period, reloads
+// the overrides and notifies about budgets that have been exceeded.
+func (b *budgeter) refresh(ctx context.Context, now time.Time) error {
+	from := now
+	for _, spec := range b.set.budgets {
+		if s := spec.Period.start(now); s.Before(from) {
+			from = s
+		}
+	}
+	records, err := b.cache.list(ctx, from, now)
+	if err != nil {
+		return err
+	}
+	usage := map[string]budgetUsage{}
+	for _, spec := range b.set.budgets {
+		start := spec.Period.start(now)
+		var u budgetUsage
+		for _, r := range records {
+			if r.Dispatched.Before(start) || !spec.covers(r.Repository) {
+				continue
+			}
+			ru := recordUsage(r, now)
+			u.vcpuSeconds += ru.vcpuSeconds
+			u.gibSeconds += ru.gibSeconds
+		}
+		usage[spec.Name] = u
+	}
+	overrides, err := b.loadOverrides(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.usage, b.refreshed, b.overrides = usage, now, overrides
+	b.mu.Unlock()
+
+	for _, s := range b.status(now) {
+		if s.enforced() {
+			if err := b.notify(ctx, s); err != nil {
+				logError("Notifying about budget %q: %v", s.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loop refreshes periodically until ctx is done.
+func (b *budgeter) loop(ctx context.Context) {
+	t := time.NewTicker(budgetInterval)
+	defer t.Stop()
+	for {
+		if err := b.refresh(ctx, time.Now()); err != nil {
+			logError("Refreshing budgets: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// status returns the state of every budget at now. Spend computed in an
+// earlier period is not carried over, so budgets reset on schedule even
+// before the next refresh.
+func (b *budgeter) status(now time.Time) []budgetStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var statuses []budgetStatus
+	for _, spec := range b.set.budgets {
+		s := budgetStatus{
+			spec:        spec,
+			Name:        spec.Name,
+			Scope:       spec.scope(),
+			Period:      spec.Period,
+			PeriodStart: spec.Period.start(now),
+			Resets:      spec.Period.next(now),
+			Unit:        spec.unit(),
+			Limit:       spec.limit(),
+			Action:      spec.Action,
+		}
+		if u, ok := b.usage[spec.Name]; ok && spec.Period.start(b.refreshed).Equal(s.PeriodStart) {
+			if spec.Cost > 0 {
+				s.Used = u.vcpuSeconds*b.set.prices.VCPUSecond + u.gibSeconds*b.set.prices.GiBSecond
+			} else {
+				s.Used = u.vcpuSeconds / 3600
+			}
+		}
+		s.Exceeded = s.Used >= s.Limit
+		if o, ok := b.overrides[spec.Name]; ok && now.Before(o.Until) {
+			s.Override = &o
+		}
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// apply enforces the budgets covering repo on an allowed decision d. A deny
+// budget takes precedence over routing to the small profile, and jobs on
+// the locked profile stay there.
+func (b *budgeter) apply(repo string, d decision, now time.Time) decision {
+	if !d.allow {
+		return d
+	}
+	var small *budgetStatus
+	for _, s := range b.status(now) {
+		if !s.enforced() || !s.spec.covers(repo) {
+			continue
+		}
+		if s.Action == budgetDeny {
+			return decision{rule: d.rule, budget: s.Name, reason: s.String()}
+		}
+		if small == nil {
+			small = &s
+		}
+	}
+	if small != nil && d.profile == profileDefault {
+		d.profile = profileSmall
+		d.budget = small.Name
+		d.reason = small.String() + "; routed to small profile"
+	}
+	return d
+}
+
+// notify posts a notification that a budget has been exceeded, once per
+// budget period. The period is marked as notified only once the post has
+// succeeded, so that a failed one is retried on the next refresh.
+func (b *budgeter) notify(ctx context.Context, s budgetStatus) error {
+	key := fmt.Sprintf("%s%s/%s", budgetNotifyPrefix, s.PeriodStart.Format("2006-01-02"), s.Name)
+	if _, err := b.records.store.get(ctx, key); err == nil {
+		return nil
+	} else if !errors.Is(err, errBlobNotFound) {
+		return err
+	}
+	msg := fmt.Sprintf("cr-runner: %s; jobs will be %s.", s, map[string]string{budgetDeny: "denied", budgetSmall: "run on the small profile"}[s.Action])
+	logWarn("%s", msg)
+	if b.notifyURL != "" {
+		if err := b.post(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return b.records.store.put(ctx, key, []byte(msg))
+}
+
+// post posts msg to $BUDGET_NOTIFY_URL.
+func (b *budgeter) post(ctx context.Context, msg string) error {
+	// {"text": ...} is understood by Slack and Google Chat incoming webhooks.
+	body, err := json.Marshal(map[string]string{"text": msg})
+	if err != nil {
+		return fmt.Errorf("marshalling notification: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.notifyURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("creating notification request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting notification: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("posting notification: status %s", resp.Status)
+	}
+	return nil
+}
+
+func (b *budgeter) loadOverrides(ctx context.Context) (map[string]budgetOverride, error) {
+	data, err := b.records.store.get(ctx, budgetOverridesKey)
+	if errors.Is(err, errBlobNotFound) {
+		return map[string]budgetOverride{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading budget overrides: %v", err)
+	}
+	overrides := map[string]budgetOverride{}
+	if err := json.Unmarshal(data, &overrides); err != nil {
+		return nil, fmt.Errorf("unmarshalling budget overrides: %v", err)
+	}
+	return overrides, nil
+}
+
+// setOverride lifts the named budget until o.Until, or clears its override
+// if o is nil. Expired overrides are dropped.
+func (b *budgeter) setOverride(ctx context.Context, name string, o *budgetOverride, now time.Time) error {
+	if !slices.ContainsFunc(b.set.budgets, func(s budgetSpec) bool { return s.Name == name }) {
+		return errNoBudget
+	}
+	overrides, err := b.loadOverrides(ctx)
+	if err != nil {
+		return err
+	}
+	delete(overrides, name)
+	if o != nil {
+		overrides[name] = *o
+	}
+	for n, o := range overrides {
+		if !now.Before(o.Until) {
+			delete(overrides, n)
+		}
+	}
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return fmt.Errorf("marshalling budget overrides: %v", err)
+	}
+	if err := b.records.store.put(ctx, budgetOverridesKey, data); err != nil {
+		return fmt.Errorf("storing budget overrides: %v", err)
+	}
+
+	b.mu.Lock()
+	b.overrides = overrides
+	b.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testBudgets = `{
+  "budgets": [
+    {"name": "runner-daily", "repository": "squee1945/self-hosted-runner", "period": "daily", "vcpuHours": 1},
+    {"name": "squee1945", "organization": "squee1945", "period": "monthly", "cost": 0.05, "action": "small"}
+  ]
+}`
+
+func TestParseBudgetSet(t *testing.T) {
+	bs, err := parseBudgetSet([]byte(testBudgets))
+	if err != nil {
+		t.Fatalf("parseBudgetSet() failed: %v", err)
+	}
+	if len(bs.budgets) != 2 || bs.budgets[0].Action != budgetDeny || bs.prices != defaultBudgetPrices {
+		t.Errorf("parseBudgetSet() got:%+v", bs)
+	}
+	if !bs.usesProfile(profileSmall) || bs.usesProfile(profileLocked) {
+		t.Errorf("usesProfile() got:%t,%t want:true,false", bs.usesProfile(profileSmall), bs.usesProfile(profileLocked))
+	}
+
+	bad := map[string]string{
+		"unknown field":  `{"budgets": [{"name": "a", "repository": "o/r", "period": "daily", "cost": 1, "limit": 2}]}`,
+		"no name":        `{"budgets": [{"repository": "o/r", "period": "daily", "cost": 1}]}`,
+		"bad name":       `{"budgets": [{"name": "a/b", "repository": "o/r", "period": "daily", "cost": 1}]}`,
+		"duplicate":      `{"budgets": [{"name": "a", "repository": "o/r", "period": "daily", "cost": 1}, {"name": "a", "organization": "o", "period": "daily", "cost": 1}]}`,
+		"both scopes":    `{"budgets": [{"name": "a", "repository": "o/r", "organization": "o", "period": "daily", "cost": 1}]}`,
+		"bad repository": `{"budgets": [{"name": "a", "repository": "r", "period": "daily", "cost": 1}]}`,
+		"bad period":     `{"budgets": [{"name": "a", "repository": "o/r", "period": "weekly", "cost": 1}]}`,
+		"no limit":       `{"budgets": [{"name": "a", "repository": "o/r", "period": "daily"}]}`,
+		"both limits":    `{"budgets": [{"name": "a", "repository": "o/r", "period": "daily", "cost": 1, "vcpuHours": 1}]}`,
+		"bad action":     `{"budgets": [{"name": "a", "repository": "o/r", "period": "daily", "cost": 1, "action": "warn"}]}`,
+		"negative price": `{"prices": {"vcpuSecond": -1}, "budgets": []}`,
+	}
+	for name, in := range bad {
+		if _, err := parseBudgetSet([]byte(in)); err == nil {
+			t.Errorf("%s: parseBudgetSet() succeeded, want error", name)
+		}
+	}
+}
+
+func TestBudgetPeriod(t *testing.T) {
+	now := time.Date(2023, 12, 31, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		period    budgetPeriod
+		wantStart string
+		wantNext  string
+	}{
+		{budgetDaily, "2023-12-31T00:00:00Z", "2024-01-01T00:00:00Z"},
+		{budgetMonthly, "2023-12-01T00:00:00Z", "2024-01-01T00:00:00Z"},
+	}
+	for _, tc := range tests {
+		if got := tc.period.start(now).Format(time.RFC3339); got != tc.wantStart {
+			t.Errorf("%s start got:%s want:%s", tc.period, got, tc.wantStart)
+		}
+		if got := tc.period.next(now).Format(time.RFC3339); got != tc.wantNext {
+			t.Errorf("%s next got:%s want:%s", tc.period, got, tc.wantNext)
+		}
+	}
+}
+
+// testBudgeter returns a budgeter for testBudgets whose notifications are
+// collected in the returned slice.
+func testBudgeter(t *testing.T) (*budgeter, *jobStore, func() []string) {
+	t.Helper()
+	set, err := parseBudgetSet([]byte(testBudgets))
+	if err != nil {
+		t.Fatalf("parseBudgetSet() failed: %v", err)
+	}
+	store, err := newBlobStore(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	var mu sync.Mutex
+	var notes []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Text string }
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		notes = append(notes, body.Text)
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	records := newJobStore(store)
+	return newBudgeter(set, records, srv.URL, srv.Client()), records, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), notes...)
+	}
+}
+
+func TestBudgeter(t *testing.T) {
+	ctx := context.Background()
+	b, records, notes := testBudgeter(t)
+	now := time.Date(2023, 7, 26, 12, 0, 0, 0, time.UTC)
+	allowed := decision{allow: true, profile: profileDefault, reason: "trusted trigger"}
+
+	put := func(repo string, dispatched time.Time, vcpuSeconds, gibSeconds float64) {
+		t.Helper()
+		end := dispatched.Add(time.Minute)
+		r := jobRecord{Execution: "executions/" + dispatched.Format("150405"), Repository: repo, Dispatched: dispatched, Started: &dispatched, Completed: &end, VCPUSeconds: vcpuSeconds, GiBSeconds: gibSeconds}
+		if err := records.put(ctx, r); err != nil {
+			t.Fatalf("put() failed: %v", err)
+		}
+	}
+
+	// Under budget.
+	put("squee1945/self-hosted-runner", now.Add(-time.Hour), 1800, 900)
+	if err := b.refresh(ctx, now); err != nil {
+		t.Fatalf("refresh() failed: %v", err)
+	}
+	if d := b.apply("squee1945/self-hosted-runner", allowed, now); d != allowed {
+		t.Errorf("under budget got:%+v want:%+v", d, allowed)
+	}
+
+	// The organization's monthly cost budget is exceeded by another
+	// repository, which routes both to the small profile.
+	put("squee1945/other", now.AddDate(0, 0, -5), 3000, 0)
+	if err := b.refresh(ctx, now); err != nil {
+		t.Fatalf("refresh() failed: %v", err)
+	}
+	for _, repo := range []string{"squee1945/self-hosted-runner", "squee1945/other"} {
+		if d := b.apply(repo, allowed, now); !d.allow || d.profile != profileSmall || d.budget != "squee1945" {
+			t.Errorf("%s over organization budget got:%+v", repo, d)
+		}
+	}
+	if d := b.apply("someone/else", allowed, now); d != allowed {
+		t.Errorf("uncovered repository got:%+v want:%+v", d, allowed)
+	}
+	locked := decision{allow: true, profile: profileLocked}
+	if d := b.apply("squee1945/other", locked, now); d.profile != profileLocked {
+		t.Errorf("locked profile got:%+v", d)
+	}
+
+	// The repository's daily budget denies, which takes precedence.
+	put("squee1945/self-hosted-runner", now.Add(-30*time.Minute), 1800, 900)
+	if err := b.refresh(ctx, now); err != nil {
+		t.Fatalf("refresh() failed: %v", err)
+	}
+	if d := b.apply("squee1945/self-hosted-runner", allowed, now); d.allow || d.budget != "runner-daily" || !strings.Contains(d.reason, "1.00 of 1.00 vCPU-hours") {
+		t.Errorf("over repository budget got:%+v", d)
+	}
+
+	// Each budget is notified once per period.
+	if err := b.refresh(ctx, now); err != nil {
+		t.Fatalf("refresh() failed: %v", err)
+	}
+	if got := notes(); len(got) != 2 || !strings.Contains(got[0], `over budget "squee1945"`) || !strings.Contains(got[1], `over budget "runner-daily"`) {
+		t.Errorf("notifications got:%q", got)
+	}
+
+	// Overrides lift a budget until they expire.
+	if err := b.setOverride(ctx, "runner-daily", &budgetOverride{Until: now.Add(time.Hour), Reason: "release day"}, now); err != nil {
+		t.Fatalf("setOverride() failed: %v", err)
+	}
+	if d := b.apply("squee1945/self-hosted-runner", allowed, now); !d.allow || d.profile != profileSmall {
+		t.Errorf("overridden budget got:%+v", d)
+	}
+	if d := b.apply("squee1945/self-hosted-runner", allowed, now.Add(2*time.Hour)); d.allow {
+		t.Errorf("expired override got:%+v", d)
+	}
+	if err := b.setOverride(ctx, "nope", nil, now); err != errNoBudget {
+		t.Errorf("setOverride(unknown) got:%v want:%v", err, errNoBudget)
+	}
+
+	// The daily budget resets at midnight, before the next refresh.
+	tomorrow := now.Add(13 * time.Hour)
+	if d := b.apply("squee1945/self-hosted-runner", allowed, tomorrow); !d.allow || d.budget != "squee1945" {
+		t.Errorf("after reset got:%+v", d)
+	}
+}
+
+func TestHandlerBudget(t *testing.T) {
+	config := testConfig()
+	set, err := parseBudgetSet([]byte(testBudgets))
+	if err != nil {
+		t.Fatalf("parseBudgetSet() failed: %v", err)
+	}
+	config.budgets = set
+	config.SmallJobCpu, config.SmallJobMemory = "1", "512Mi"
+	b, records, _ := testBudgeter(t)
+	b.notifyURL = ""
+	clients, jobs := testClients(t, config)
+	h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL)), records: records, budgets: b}
+	ctx := context.Background()
+	now := time.Now()
+
+	dispatch := func() string {
+		t.Helper()
+		before := len(jobs.runRequests())
+		if w := serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json"))); w.Code != http.StatusOK {
+			t.Fatalf("status got:%d want:%d (body %q)", w.Code, http.StatusOK, w.Body.String())
+		}
+		reqs := jobs.runRequests()
+		if len(reqs) == before {
+			return ""
+		}
+		return reqs[len(reqs)-1].Name
+	}
+
+	if got := dispatch(); !strings.HasSuffix(got, "/jobs/runner-abc") {
+		t.Errorf("under budget ran %q", got)
+	}
+
+	// Exceed the organization's cost budget.
+	r := jobRecord{Execution: "executions/big", Repository: "squee1945/other", Dispatched: now, Completed: &now, VCPUSeconds: 3000}
+	if err := records.put(ctx, r); err != nil {
+		t.Fatalf("put() failed: %v", err)
+	}
+	if err := b.refresh(ctx, now); err != nil {
+		t.Fatalf("refresh() failed: %v", err)
+	}
+	if got := dispatch(); !strings.HasSuffix(got, "/jobs/runner-abc"+smallJobSuffix) {
+		t.Errorf("over organization budget ran %q", got)
+	}
+
+	// Exceed the repository's vCPU-hour budget.
+	r = jobRecord{Execution: "executions/bigger", Repository: "squee1945/self-hosted-runner", Dispatched: now, Completed: &now, VCPUSeconds: 3600}
+	if err := records.put(ctx, r); err != nil {
+		t.Fatalf("put() failed: %v", err)
+	}
+	if err := b.refresh(ctx, now); err != nil {
+		t.Fatalf("refresh() failed: %v", err)
+	}
+	if got := dispatch(); got != "" {
+		t.Errorf("over repository budget ran %q", got)
+	}
+}
+
+func TestBudgetNotifyRetry(t *testing.T) {
+	ctx := context.Background()
+	store, err := newBlobStore(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	var mu sync.Mutex
+	posts, failing := 0, true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		posts++
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	b := newBudgeter(&budgetSet{}, newJobStore(store), srv.URL, srv.Client())
+	s := budgetStatus{Name: "acme", PeriodStart: time.Date(2023, 7, 1, 0, 0, 0, 0, time.UTC), Action: budgetDeny, Exceeded: true}
+
+	if err := b.notify(ctx, s); err == nil {
+		t.Errorf("notify() with a failing URL succeeded")
+	}
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if err := b.notify(ctx, s); err != nil {
+			t.Errorf("notify() failed: %v", err)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if posts != 2 {
+		t.Errorf("posts got:%d want:2, the failed one retried once", posts)
+	}
+}
+
+func TestRecordCache(t *testing.T) {
+	ctx := context.Background()
+	store, err := newBlobStore(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	records := newJobStore(store)
+	cache := newRecordCache(records)
+	now := time.Date(2023, 7, 26, 12, 0, 0, 0, time.UTC)
+	done := jobRecord{Execution: "executions/done", Dispatched: now.Add(-time.Hour), Completed: &now, VCPUSeconds: 60}
+	running := jobRecord{Execution: "executions/running", Dispatched: now.Add(-time.Minute)}
+	for _, r := range []jobRecord{done, running} {
+		if err := records.put(ctx, r); err != nil {
+			t.Fatalf("put() failed: %v", err)
+		}
+	}
+	if got, err := cache.list(ctx, now, now); err != nil || len(got) != 2 {
+		t.Fatalf("list() got:%v, %v want 2 records", got, err)
+	}
+
+	// A completed record is not read again; a running one is.
+	changed := done
+	changed.VCPUSeconds = 120
+	running.Completed, running.VCPUSeconds = &now, 30
+	for _, r := range []jobRecord{changed, running} {
+		if err := records.put(ctx, r); err != nil {
+			t.Fatalf("put() failed: %v", err)
+		}
+	}
+	got, err := cache.list(ctx, now, now)
+	if err != nil || len(got) != 2 || got[0].VCPUSeconds != 60 || got[1].VCPUSeconds != 30 {
+		t.Errorf("list() got:%+v, %v", got, err)
+	}
+	if _, ok := cache.done[records.key(running)]; !ok {
+		t.Errorf("completed record not cached")
+	}
+
+	// Records before the period are dropped from the cache.
+	if _, err := cache.list(ctx, now.AddDate(0, 0, 1), now.AddDate(0, 0, 1)); err != nil || len(cache.done) != 0 {
+		t.Errorf("list() of the next day: cached:%v, %v", cache.done, err)
+	}
+}
+
+func TestAdminBudgets(t *testing.T) {
+	config := testConfig()
+	config.AdminSecretName = testSignatureSecret
+	b, _, _ := testBudgeter(t)
+	clients, _ := testClients(t, config)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+testSecretValue)
+		w := httptest.NewRecorder()
+		adminhandler{clients: clients, w: w, r: r, config: config, budgeter: b}.budgets()
+		return w
+	}
+	statuses := func(w *httptest.ResponseRecorder) map[string]budgetStatus {
+		t.Helper()
+		var got []budgetStatus
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("unmarshalling %q: %v", w.Body.String(), err)
+		}
+		m := map[string]budgetStatus{}
+		for _, s := range got {
+			m[s.Name] = s
+		}
+		return m
+	}
+
+	w := do(http.MethodGet, "/admin/budgets", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET status got:%d want:%d", w.Code, http.StatusOK)
+	}
+	if got := statuses(w); len(got) != 2 || got["runner-daily"].Unit != "vCPU-hours" || got["squee1945"].Override != nil {
+		t.Errorf("GET got:%+v", got)
+	}
+
+	w = do(http.MethodPost, "/admin/budgets", `{"budget": "squee1945", "reason": "quarter end"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST status got:%d want:%d (body %q)", w.Code, http.StatusOK, w.Body.String())
+	}
+	s := statuses(w)["squee1945"]
+	if s.Override == nil || s.Override.Reason != "quarter end" || !s.Override.Until.Equal(s.Resets) {
+		t.Errorf("POST got:%+v", s)
+	}
+
+	for _, tc := range []struct {
+		method, target, body string
+		wantStatus           int
+	}{
+		{http.MethodPost, "/admin/budgets", `{"budget": "squee1945"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/budgets", `{"budget": "squee1945", "reason": "x", "until": "2020-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		{http.MethodPost, "/admin/budgets", `{"budget": "nope", "reason": "x"}`, http.StatusNotFound},
+		{http.MethodPut, "/admin/budgets", "", http.StatusMethodNotAllowed},
+	} {
+		if w := do(tc.method, tc.target, tc.body); w.Code != tc.wantStatus {
+			t.Errorf("%s %s %s status got:%d want:%d", tc.method, tc.target, tc.body, w.Code, tc.wantStatus)
+		}
+	}
+
+	w = do(http.MethodDelete, "/admin/budgets?budget=squee1945", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("DELETE status got:%d want:%d", w.Code, http.StatusOK)
+	}
+	if s := statuses(w)["squee1945"]; s.Override != nil {
+		t.Errorf("DELETE left override %+v", s.Override)
+	}
+}
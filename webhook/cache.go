@@ -0,0 +1,622 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+const (
+	actionsCacheURLEnvVar = "ACTIONS_CACHE_URL"
+	// cacheAPIPath is where the toolkit sends its requests, relative to
+	// $ACTIONS_CACHE_URL.
+	cacheAPIPath = "_apis/artifactcache/"
+	// maxCacheChunk bounds an upload request; the toolkit uploads in 32MiB
+	// chunks, which with their headers only fit a Cloud Run request over
+	// HTTP/2 (see main.go).
+	maxCacheChunk = 64 << 20
+	// cacheReservationTTL is how long an entry can take to be uploaded; older
+	// uncommitted entries are deleted, and their key can be reserved again.
+	cacheReservationTTL = 24 * time.Hour
+	// cacheTokenGrace is how long a cache token outlives the execution's
+	// timeout, for the execution to be scheduled and its image pulled.
+	cacheTokenGrace = time.Hour
+)
+
+var (
+	errCacheNotFound = errors.New("cache entry not found")
+	errCacheExists   = errors.New("cache entry exists or is being uploaded")
+	errCacheTooLarge = errors.New("cache entry is larger than $CACHE_REPO_GIB")
+	errCacheInvalid  = errors.New("invalid cache upload")
+	errCacheReadOnly = errors.New("this runner can only restore cache entries")
+)
+
+// actionsCache serves version 1 of the GitHub Actions cache protocol, which
+// actions/cache and the @actions/cache toolkit speak to $ACTIONS_CACHE_URL,
+// from a blobStore:
+//
+//	GET   cache?keys={key},{restore key}...&version={version}  Looks up an entry.
+//	POST  caches                                             Reserves an entry for upload.
+//	PATCH caches/{id}                                        Uploads a chunk, with Content-Range.
+//	POST  caches/{id}                                        Commits the entry.
+//	GET   artifacts/{id}                                     Downloads the entry.
+//
+// Entries are per repository and, as in GitHub's cache, per ref: runners
+// get a URL with a token for their repository and ref (see cacheScope), and
+// restore entries saved from their own ref or the default branch, but save
+// only to their own. When a repository's committed entries exceed
+// $CACHE_REPO_GIB, the least recently used are evicted.
+//
+// The store holds "entries/{owner}/{repo}/{id}.json", a cacheEntry, and the
+// uploaded chunks as "parts/{owner}/{repo}/{id}/{offset}", which downloads
+// stream in order.
+type actionsCache struct {
+	store blobStore
+	limit int64 // Bytes per repository.
+}
+
+func newActionsCache(store blobStore, limit int64) *actionsCache {
+	return &actionsCache{store: store, limit: limit}
+}
+
+type cacheEntry struct {
+	ID        int64     `json:"id"`
+	Ref       string    `json:"ref"` // See cacheScope.
+	Key       string    `json:"key"`
+	Version   string    `json:"version"`
+	Size      int64     `json:"size"` // Set when committed.
+	Committed bool      `json:"committed"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+func cacheEntryKey(repo string, id int64) string {
+	return fmt.Sprintf("entries/%s/%d.json", strings.ToLower(repo), id)
+}
+
+func cachePartPrefix(repo string, id int64) string {
+	return fmt.Sprintf("parts/%s/%d/", strings.ToLower(repo), id)
+}
+
+func (c *actionsCache) getEntry(ctx context.Context, repo string, id int64) (cacheEntry, error) {
+	b, err := c.store.get(ctx, cacheEntryKey(repo, id))
+	if errors.Is(err, errBlobNotFound) {
+		return cacheEntry{}, errCacheNotFound
+	}
+	if err != nil {
+		return cacheEntry{}, fmt.Errorf("reading cache entry %d: %v", id, err)
+	}
+	var e cacheEntry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return cacheEntry{}, fmt.Errorf("parsing cache entry %d: %v", id, err)
+	}
+	return e, nil
+}
+
+func (c *actionsCache) putEntry(ctx context.Context, repo string, e cacheEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshalling cache entry %d: %v", e.ID, err)
+	}
+	if err := c.store.put(ctx, cacheEntryKey(repo, e.ID), b); err != nil {
+		return fmt.Errorf("writing cache entry %d: %v", e.ID, err)
+	}
+	return nil
+}
+
+// entries returns the repository's entries, newest first.
+func (c *actionsCache) entries(ctx context.Context, repo string) ([]cacheEntry, error) {
+	blobs, err := c.store.list(ctx, "entries/"+strings.ToLower(repo)+"/")
+	if err != nil {
+		return nil, fmt.Errorf("listing cache entries: %v", err)
+	}
+	var entries []cacheEntry
+	for _, b := range blobs {
+		id, err := strconv.ParseInt(strings.TrimSuffix(b.key[strings.LastIndex(b.key, "/")+1:], ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		e, err := c.getEntry(ctx, repo, id)
+		if errors.Is(err, errCacheNotFound) {
+			continue // Evicted since listing.
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Created.After(entries[b].Created) })
+	return entries, nil
+}
+
+// lookup returns the committed entry with the version that matches the
+// first of keys that any does, as the toolkit expects: an entry whose key is
+// the same, or else the newest whose key starts with it. Entries saved from
+// the scope's own ref are looked up before those from the default branch.
+// It returns nil if none matches.
+func (c *actionsCache) lookup(ctx context.Context, scope cacheScope, keys []string, version string, now time.Time) (*cacheEntry, error) {
+	entries, err := c.entries(ctx, scope.Repo)
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range scope.restoreRefs() {
+		for _, k := range keys {
+			for _, exact := range []bool{true, false} {
+				for _, e := range entries {
+					if !e.Committed || e.Ref != ref || e.Version != version || exact && e.Key != k || !strings.HasPrefix(e.Key, k) {
+						continue
+					}
+					e.LastUsed = now
+					// Best effort: the entry is only evicted sooner if this fails.
+					if err := c.putEntry(ctx, scope.Repo, e); err != nil {
+						logWarn("Recording use of cache entry %d for %s: %v", e.ID, scope.Repo, err)
+					}
+					return &e, nil
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// reserve creates an uncommitted entry for upload from the scope's ref and
+// returns its ID.
+func (c *actionsCache) reserve(ctx context.Context, scope cacheScope, key, version string, size int64, now time.Time) (int64, error) {
+	if scope.Ref == "" {
+		return 0, errCacheReadOnly
+	}
+	if size > c.limit {
+		return 0, errCacheTooLarge
+	}
+	entries, err := c.entries(ctx, scope.Repo)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if e.Ref == scope.Ref && e.Key == key && e.Version == version && (e.Committed || now.Sub(e.Created) < cacheReservationTTL) {
+			return 0, errCacheExists
+		}
+	}
+	// The toolkit parses IDs as JavaScript numbers, which are exact to 2^53.
+	e := cacheEntry{ID: rand.Int63n(1<<53-1) + 1, Ref: scope.Ref, Key: key, Version: version, Created: now, LastUsed: now}
+	if err := c.putEntry(ctx, scope.Repo, e); err != nil {
+		return 0, err
+	}
+	return e.ID, nil
+}
+
+// savedEntry returns the entry the scope's ref is saving.
+func (c *actionsCache) savedEntry(ctx context.Context, scope cacheScope, id int64) (cacheEntry, error) {
+	e, err := c.getEntry(ctx, scope.Repo, id)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	if scope.Ref == "" || e.Ref != scope.Ref {
+		return cacheEntry{}, errCacheNotFound
+	}
+	if e.Committed {
+		return cacheEntry{}, errCacheExists
+	}
+	return e, nil
+}
+
+// upload stores a chunk of an uncommitted entry, starting at offset start.
+func (c *actionsCache) upload(ctx context.Context, scope cacheScope, id, start int64, data []byte) error {
+	if _, err := c.savedEntry(ctx, scope, id); err != nil {
+		return err
+	}
+	if err := c.store.put(ctx, fmt.Sprintf("%s%020d", cachePartPrefix(scope.Repo, id), start), data); err != nil {
+		return fmt.Errorf("writing cache entry %d: %v", id, err)
+	}
+	return nil
+}
+
+// parts returns the entry's chunks in order, checking that they cover
+// exactly its first size bytes.
+func (c *actionsCache) parts(ctx context.Context, repo string, id, size int64) ([]blobInfo, error) {
+	parts, err := c.store.list(ctx, cachePartPrefix(repo, id))
+	if err != nil {
+		return nil, fmt.Errorf("listing cache entry %d: %v", id, err)
+	}
+	var next int64
+	for _, p := range parts {
+		start, err := strconv.ParseInt(p.key[strings.LastIndex(p.key, "/")+1:], 10, 64)
+		if err != nil || start != next {
+			return nil, fmt.Errorf("%w: cache entry %d is missing bytes at offset %d", errCacheInvalid, id, next)
+		}
+		next += p.size
+	}
+	if next != size {
+		return nil, fmt.Errorf("%w: cache entry %d has %d bytes, not %d", errCacheInvalid, id, next, size)
+	}
+	return parts, nil
+}
+
+// commit marks an entry that has been uploaded in full as committed, so that
+// lookups find it, then evicts entries if the repository is over its limit.
+func (c *actionsCache) commit(ctx context.Context, scope cacheScope, id, size int64, now time.Time) error {
+	repo := scope.Repo
+	e, err := c.savedEntry(ctx, scope, id)
+	if err != nil {
+		return err
+	}
+	if size > c.limit {
+		return errCacheTooLarge
+	}
+	if _, err := c.parts(ctx, repo, id, size); err != nil {
+		return err
+	}
+	e.Committed, e.Size, e.LastUsed = true, size, now
+	if err := c.putEntry(ctx, repo, e); err != nil {
+		return err
+	}
+	if err := c.evict(ctx, repo, now); err != nil {
+		logError("Evicting cache entries for %s: %v", repo, err)
+	}
+	return nil
+}
+
+// evict deletes the repository's least recently used committed entries
+// until the rest fit its limit, and uncommitted entries older than
+// cacheReservationTTL.
+func (c *actionsCache) evict(ctx context.Context, repo string, now time.Time) error {
+	entries, err := c.entries(ctx, repo)
+	if err != nil {
+		return err
+	}
+	var committed []cacheEntry
+	var total int64
+	for _, e := range entries {
+		switch {
+		case e.Committed:
+			committed = append(committed, e)
+			total += e.Size
+		case now.Sub(e.Created) >= cacheReservationTTL:
+			if err := c.delete(ctx, repo, e.ID); err != nil {
+				return err
+			}
+		}
+	}
+	sort.Slice(committed, func(a, b int) bool { return committed[a].LastUsed.Before(committed[b].LastUsed) })
+	for _, e := range committed {
+		if total <= c.limit {
+			break
+		}
+		if err := c.delete(ctx, repo, e.ID); err != nil {
+			return err
+		}
+		total -= e.Size
+		cacheEvictions.inc(repo)
+		logInfo("Evicted cache entry %q (%d bytes) for %s, last used %v.", e.Key, e.Size, repo, e.LastUsed.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// delete deletes an entry, then its chunks, so that a failure part way
+// does not leave a committed entry that cannot be downloaded.
+func (c *actionsCache) delete(ctx context.Context, repo string, id int64) error {
+	if err := c.store.delete(ctx, cacheEntryKey(repo, id)); err != nil {
+		return fmt.Errorf("deleting cache entry %d: %v", id, err)
+	}
+	parts, err := c.store.list(ctx, cachePartPrefix(repo, id))
+	if err != nil {
+		return fmt.Errorf("listing cache entry %d: %v", id, err)
+	}
+	for _, p := range parts {
+		if err := c.store.delete(ctx, p.key); err != nil {
+			return fmt.Errorf("deleting cache entry %d: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// signToken returns a token for subject: the subject, and an HMAC of it
+// keyed with key.
+func signToken(key []byte, subject string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(subject))
+	return base64.RawURLEncoding.EncodeToString([]byte(subject)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken returns the subject of a token made by signToken, and whether
+// the token is valid.
+func verifyToken(key []byte, token string) (string, bool) {
+	enc, _, _ := strings.Cut(token, ".")
+	b, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil || len(b) == 0 {
+		return "", false
+	}
+	subject := string(b)
+	return subject, hmac.Equal([]byte(token), []byte(signToken(key, subject)))
+}
+
+// cacheScope is what a runner's cache token grants: restoring the
+// repository's entries saved from Ref or from the default branch, and saving
+// entries from Ref, until the token expires. Ref is a branch or tag, or for
+// a pull request "pull/{head repository}:{head branch}", which no branch
+// can be named, so that a pull request cannot save entries that branches
+// restore. It is empty for runners that can only restore.
+type cacheScope struct {
+	Repo    string `json:"repo"`
+	Ref     string `json:"ref"`
+	Default string `json:"default"` // The default branch.
+	Expires int64  `json:"exp"`     // Unix seconds.
+}
+
+// restoreRefs returns the refs whose entries the scope restores, in order.
+func (s cacheScope) restoreRefs() []string {
+	var refs []string
+	for _, ref := range []string{s.Ref, s.Default} {
+		if ref != "" && !slices.Contains(refs, ref) {
+			refs = append(refs, ref)
+		}
+	}
+	return refs
+}
+
+// cacheRef returns the ref that a runner for the workflow job saves cache
+// entries from; empty if the job's trigger was not resolved.
+func cacheRef(ev *event, t trigger) string {
+	switch {
+	case t.run == nil:
+		return ""
+	case slices.Contains(untrustedEvents, t.run.Event):
+		return fmt.Sprintf("pull/%s:%s", strings.ToLower(t.run.HeadRepository.FullName), t.run.HeadBranch)
+	}
+	return ev.WorkflowJob.HeadBranch
+}
+
+// cacheToken is the path segment of a runner's $ACTIONS_CACHE_URL: its scope,
+// signed with $CACHE_SECRET.
+func cacheToken(key []byte, scope cacheScope) string {
+	scope.Repo = strings.ToLower(scope.Repo)
+	b, err := json.Marshal(scope)
+	if err != nil {
+		panic(err) // Cannot fail for a struct of strings and ints.
+	}
+	return signToken(key, string(b))
+}
+
+// parseCacheToken returns the scope of a token made by cacheToken, and
+// whether the token is valid and has not expired at now.
+func parseCacheToken(key []byte, token string, now time.Time) (cacheScope, bool) {
+	subject, ok := verifyToken(key, token)
+	if !ok {
+		return cacheScope{}, false
+	}
+	var scope cacheScope
+	if err := json.Unmarshal([]byte(subject), &scope); err != nil || scope.Repo == "" || now.Unix() >= scope.Expires {
+		return cacheScope{}, false
+	}
+	return scope, true
+}
+
+// actionsCacheEnv returns the env var that points the runner's cache actions
+// at the service, if it serves the cache. The locked profile does not get
+// it, since untrusted code could otherwise poison the repository's entries.
+// Runners whose ref is not known, e.g., those that replace a runner that
+// did not start, can only restore, and warm runners, which do not know the
+// default branch either, do not get it. The token expires cacheTokenGrace
+// after the execution's timeout.
+func (j *cloudRunJob) actionsCacheEnv(opts runOptions, now time.Time) []*runpb.EnvVar {
+	if j.config.CacheURL == "" || opts.repo == "" || opts.cacheRef == "" && opts.defaultBranch == "" || j.profile == profileLocked {
+		return nil
+	}
+	timeout := opts.timeout
+	if timeout <= 0 {
+		timeout = j.config.JobTimeout
+	}
+	scope := cacheScope{Repo: opts.repo, Ref: opts.cacheRef, Default: opts.defaultBranch, Expires: now.Add(timeout + cacheTokenGrace).Unix()}
+	url := strings.TrimSuffix(j.config.CacheServiceURL, "/") + "/cache/" + cacheToken(j.config.cacheKey, scope) + "/"
+	return []*runpb.EnvVar{{Name: actionsCacheURLEnvVar, Values: &runpb.EnvVar_Value{Value: url}}}
+}
+
+// cachehandler serves the cache API under /cache/{token}/_apis/artifactcache/.
+// Runners send their job's runtime token as a bearer token, which the
+// service cannot verify; the path's token authorizes the request instead.
+type cachehandler struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	config config
+	cache  *actionsCache // Optional.
+}
+
+func (h cachehandler) serve() {
+	if h.cache == nil {
+		http.Error(h.w, "The cache service is disabled; set $CACHE_URL to enable it.", http.StatusNotFound)
+		return
+	}
+	token, rest, _ := strings.Cut(strings.TrimPrefix(h.r.URL.Path, "/cache/"), "/")
+	scope, ok := parseCacheToken(h.config.cacheKey, token, time.Now())
+	if !ok {
+		logWarn("Rejected cache request: bad or expired token.")
+		http.Error(h.w, "Bad token", http.StatusForbidden)
+		return
+	}
+	rest, ok = strings.CutPrefix(rest, cacheAPIPath)
+	if !ok {
+		http.NotFound(h.w, h.r)
+		return
+	}
+	resource, id, hasID := strings.Cut(rest, "/")
+	switch {
+	case h.r.Method == http.MethodGet && rest == "cache":
+		h.lookup(scope, token)
+	case h.r.Method == http.MethodPost && rest == "caches":
+		h.reserve(scope)
+	case hasID && resource == "caches" && (h.r.Method == http.MethodPatch || h.r.Method == http.MethodPost),
+		hasID && resource == "artifacts" && h.r.Method == http.MethodGet:
+		n, err := strconv.ParseInt(id, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(h.w, fmt.Sprintf("Bad cache ID %q", id), http.StatusBadRequest)
+			return
+		}
+		switch {
+		case resource == "artifacts":
+			h.download(scope, n)
+		case h.r.Method == http.MethodPatch:
+			h.upload(scope, n)
+		default:
+			h.commit(scope, n)
+		}
+	default:
+		http.NotFound(h.w, h.r)
+	}
+}
+
+// fail writes the response for err.
+func (h cachehandler) fail(repo string, err error) {
+	switch {
+	case errors.Is(err, errCacheNotFound):
+		http.Error(h.w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errCacheExists):
+		http.Error(h.w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errCacheReadOnly):
+		http.Error(h.w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errCacheTooLarge), errors.Is(err, errCacheInvalid):
+		logWarn("Client error: cache for %s: %v", repo, err)
+		http.Error(h.w, err.Error(), http.StatusBadRequest)
+	default:
+		logError("Error: cache for %s: %v", repo, err)
+		http.Error(h.w, "Server error", http.StatusInternalServerError)
+	}
+}
+
+func (h cachehandler) writeJSON(v any) {
+	h.w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(h.w).Encode(v); err != nil {
+		logError("Writing cache response: %v", err)
+	}
+}
+
+// lookup looks up an entry; its archive URL carries the request's token.
+func (h cachehandler) lookup(scope cacheScope, token string) {
+	repo := scope.Repo
+	q := h.r.URL.Query()
+	keys := strings.Split(q.Get("keys"), ",")
+	if q.Get("keys") == "" || q.Get("version") == "" {
+		http.Error(h.w, "keys and version are required", http.StatusBadRequest)
+		return
+	}
+	e, err := h.cache.lookup(h.r.Context(), scope, keys, q.Get("version"), time.Now())
+	if err != nil {
+		h.fail(repo, err)
+		return
+	}
+	if e == nil {
+		cacheMisses.inc(repo)
+		h.w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	cacheHits.inc(repo)
+	base := strings.TrimSuffix(h.config.CacheServiceURL, "/") + "/cache/" + token + "/"
+	h.writeJSON(map[string]any{
+		"cacheKey":        e.Key,
+		"cacheVersion":    e.Version,
+		"creationTime":    e.Created.Format(time.RFC3339),
+		"archiveLocation": fmt.Sprintf("%s%sartifacts/%d", base, cacheAPIPath, e.ID),
+	})
+}
+
+func (h cachehandler) reserve(scope cacheScope) {
+	var req struct {
+		Key       string `json:"key"`
+		Version   string `json:"version"`
+		CacheSize int64  `json:"cacheSize"`
+	}
+	if err := json.NewDecoder(h.r.Body).Decode(&req); err != nil || req.Key == "" || req.Version == "" {
+		http.Error(h.w, "key and version are required", http.StatusBadRequest)
+		return
+	}
+	id, err := h.cache.reserve(h.r.Context(), scope, req.Key, req.Version, req.CacheSize, time.Now())
+	if err != nil {
+		h.fail(scope.Repo, err)
+		return
+	}
+	h.writeJSON(map[string]int64{"cacheId": id})
+}
+
+func (h cachehandler) upload(scope cacheScope, id int64) {
+	// E.g., "bytes 0-33554431/*".
+	var start, end int64
+	if _, err := fmt.Sscanf(h.r.Header.Get("Content-Range"), "bytes %d-%d/*", &start, &end); err != nil || start < 0 || end < start || end-start >= maxCacheChunk {
+		http.Error(h.w, "Bad Content-Range", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(h.w, h.r.Body, maxCacheChunk))
+	if err != nil {
+		http.Error(h.w, fmt.Sprintf("Reading chunk: %v", err), http.StatusBadRequest)
+		return
+	}
+	if int64(len(data)) != end-start+1 {
+		http.Error(h.w, fmt.Sprintf("Chunk has %d bytes, not the %d of its Content-Range", len(data), end-start+1), http.StatusBadRequest)
+		return
+	}
+	if err := h.cache.upload(h.r.Context(), scope, id, start, data); err != nil {
+		h.fail(scope.Repo, err)
+		return
+	}
+	h.w.WriteHeader(http.StatusNoContent)
+}
+
+func (h cachehandler) commit(scope cacheScope, id int64) {
+	var req struct {
+		Size int64 `json:"size"`
+	}
+	if err := json.NewDecoder(h.r.Body).Decode(&req); err != nil {
+		http.Error(h.w, "size is required", http.StatusBadRequest)
+		return
+	}
+	if err := h.cache.commit(h.r.Context(), scope, id, req.Size, time.Now()); err != nil {
+		h.fail(scope.Repo, err)
+		return
+	}
+	h.w.WriteHeader(http.StatusNoContent)
+}
+
+// download streams the entry's chunks. The toolkit sends no credentials
+// for the archive, so its URL carries the token.
+func (h cachehandler) download(scope cacheScope, id int64) {
+	ctx := h.r.Context()
+	repo := scope.Repo
+	e, err := h.cache.getEntry(ctx, repo, id)
+	if err == nil && (!e.Committed || !slices.Contains(scope.restoreRefs(), e.Ref)) {
+		err = errCacheNotFound
+	}
+	if err != nil {
+		h.fail(repo, err)
+		return
+	}
+	parts, err := h.cache.parts(ctx, repo, id, e.Size)
+	if err != nil {
+		h.fail(repo, err)
+		return
+	}
+	h.w.Header().Set("Content-Type", "application/octet-stream")
+	h.w.Header().Set("Content-Length", strconv.FormatInt(e.Size, 10))
+	for _, p := range parts {
+		b, err := h.cache.store.get(ctx, p.key)
+		if err != nil {
+			// Too late for an error response; the short body fails the download.
+			logError("Error: downloading cache entry %d for %s: %v", id, repo, err)
+			return
+		}
+		if _, err := h.w.Write(b); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCacheServer serves the cache from a local directory, with a limit of
+// limit bytes per repository.
+func testCacheServer(t *testing.T, limit int64) (*httptest.Server, config) {
+	t.Helper()
+	store, err := newBlobStore(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	config := testConfig()
+	config.cacheKey = []byte("key")
+	cache := newActionsCache(store, limit)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cachehandler{w: w, r: r, config: config, cache: cache}.serve()
+	}))
+	t.Cleanup(srv.Close)
+	config.CacheServiceURL = srv.URL
+	return srv, config
+}
+
+// branchScope returns the scope of a runner for a job on the repository's
+// ref, whose default branch is main.
+func branchScope(repo, ref string) cacheScope {
+	return cacheScope{Repo: repo, Ref: ref, Default: "main", Expires: time.Now().Add(time.Hour).Unix()}
+}
+
+// cacheRequest sends a request to the scope's cache API and returns the
+// response's status and body.
+func cacheRequest(t *testing.T, srv *httptest.Server, config config, scope cacheScope, method, resource string, body []byte, header ...string) (int, []byte) {
+	t.Helper()
+	url := fmt.Sprintf("%s/cache/%s/%s%s", srv.URL, cacheToken(config.cacheKey, scope), cacheAPIPath, resource)
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, resource, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+// saveCache uploads data as an entry in two chunks, as actions/cache does.
+func saveCache(t *testing.T, srv *httptest.Server, config config, scope cacheScope, key string, data []byte) {
+	t.Helper()
+	status, body := cacheRequest(t, srv, config, scope, http.MethodPost, "caches", []byte(fmt.Sprintf(`{"key":%q,"version":"v1","cacheSize":%d}`, key, len(data))))
+	if status != http.StatusOK {
+		t.Fatalf("reserving %q: status %d: %s", key, status, body)
+	}
+	var reserved struct{ CacheID int64 }
+	if err := json.Unmarshal(body, &reserved); err != nil {
+		t.Fatal(err)
+	}
+	resource := fmt.Sprintf("caches/%d", reserved.CacheID)
+	half := len(data) / 2
+	for _, chunk := range [][2]int{{half, len(data)}, {0, half}} {
+		status, body = cacheRequest(t, srv, config, scope, http.MethodPatch, resource, data[chunk[0]:chunk[1]], "Content-Range", fmt.Sprintf("bytes %d-%d/*", chunk[0], chunk[1]-1))
+		if status != http.StatusNoContent {
+			t.Fatalf("uploading %q: status %d: %s", key, status, body)
+		}
+	}
+	status, body = cacheRequest(t, srv, config, scope, http.MethodPost, resource, []byte(fmt.Sprintf(`{"size":%d}`, len(data))))
+	if status != http.StatusNoContent {
+		t.Fatalf("committing %q: status %d: %s", key, status, body)
+	}
+}
+
+// restoreCache looks up keys and returns the entry's key and contents; empty
+// if none matches.
+func restoreCache(t *testing.T, srv *httptest.Server, config config, scope cacheScope, keys ...string) (string, string) {
+	t.Helper()
+	status, body := cacheRequest(t, srv, config, scope, http.MethodGet, "cache?version=v1&keys="+strings.Join(keys, ","), nil)
+	if status == http.StatusNoContent {
+		return "", ""
+	}
+	if status != http.StatusOK {
+		t.Fatalf("looking up %q: status %d: %s", keys, status, body)
+	}
+	var entry struct{ CacheKey, ArchiveLocation string }
+	if err := json.Unmarshal(body, &entry); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(entry.ArchiveLocation)
+	if err != nil {
+		t.Fatalf("downloading %q failed: %v", entry.CacheKey, err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len(b)) {
+		t.Fatalf("downloading %q: status %d, %d of %d bytes", entry.CacheKey, resp.StatusCode, len(b), resp.ContentLength)
+	}
+	return entry.CacheKey, string(b)
+}
+
+func TestActionsCache(t *testing.T) {
+	srv, config := testCacheServer(t, 1<<20)
+	repo := "Owner/Repo"
+	onMain := branchScope(repo, "main")
+	pr := branchScope(repo, "pull/owner/repo:feature")
+	saveCache(t, srv, config, onMain, "go-linux-abc", []byte("old modules"))
+	time.Sleep(10 * time.Millisecond) // So that the entries' creation times differ.
+	saveCache(t, srv, config, onMain, "go-linux-def", []byte("new modules"))
+	saveCache(t, srv, config, pr, "go-linux-pr", []byte("pr modules"))
+	saveCache(t, srv, config, branchScope(repo, "other"), "go-linux-other", []byte("other modules"))
+
+	tests := []struct {
+		name      string
+		scope     cacheScope
+		keys      []string
+		wantKey   string
+		wantValue string
+	}{
+		{name: "exact", scope: onMain, keys: []string{"go-linux-abc"}, wantKey: "go-linux-abc", wantValue: "old modules"},
+		{name: "restore key takes newest", scope: onMain, keys: []string{"go-linux-xyz", "go-linux-"}, wantKey: "go-linux-def", wantValue: "new modules"},
+		{name: "exact before prefix", scope: onMain, keys: []string{"go-linux-ab", "go-linux-"}, wantKey: "go-linux-abc", wantValue: "old modules"},
+		{name: "repository case", scope: branchScope("owner/repo", "main"), keys: []string{"go-linux-def"}, wantKey: "go-linux-def", wantValue: "new modules"},
+		{name: "miss", scope: onMain, keys: []string{"node-"}},
+		{name: "other repository", scope: branchScope("owner/other", "main"), keys: []string{"go-linux-"}},
+		{name: "pull request's own first", scope: pr, keys: []string{"go-linux-"}, wantKey: "go-linux-pr", wantValue: "pr modules"},
+		{name: "pull request restores default branch", scope: pr, keys: []string{"go-linux-abc"}, wantKey: "go-linux-abc", wantValue: "old modules"},
+		{name: "default branch does not restore pull request", scope: onMain, keys: []string{"go-linux-pr"}},
+		{name: "other branch", scope: pr, keys: []string{"go-linux-other"}},
+		{name: "restore only", scope: branchScope(repo, ""), keys: []string{"go-linux-"}, wantKey: "go-linux-def", wantValue: "new modules"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			key, value := restoreCache(t, srv, config, tc.scope, tc.keys...)
+			if key != tc.wantKey || value != tc.wantValue {
+				t.Errorf("restored got:%q, %q want:%q, %q", key, value, tc.wantKey, tc.wantValue)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name  string
+		key   []byte
+		scope cacheScope
+		body  string
+		want  int
+	}{
+		{name: "existing key", scope: onMain, body: `{"key":"go-linux-abc","version":"v1"}`, want: http.StatusConflict},
+		{name: "existing key on another ref", scope: pr, body: `{"key":"go-linux-abc","version":"v1"}`, want: http.StatusOK},
+		{name: "over the limit", scope: onMain, body: `{"key":"big","version":"v1","cacheSize":2000000}`, want: http.StatusBadRequest},
+		{name: "restore only", scope: branchScope(repo, ""), body: `{"key":"new","version":"v1"}`, want: http.StatusForbidden},
+		{name: "expired token", scope: cacheScope{Repo: repo, Ref: "main", Expires: time.Now().Unix() - 1}, body: `{"key":"new","version":"v1"}`, want: http.StatusForbidden},
+		{name: "bad token", key: []byte("other key"), scope: onMain, body: `{"key":"new","version":"v1"}`, want: http.StatusForbidden},
+	} {
+		c := config
+		if tc.key != nil {
+			c.cacheKey = tc.key
+		}
+		if status, body := cacheRequest(t, srv, c, tc.scope, http.MethodPost, "caches", []byte(tc.body)); status != tc.want {
+			t.Errorf("reserving, %s: status got:%d %s want:%d", tc.name, status, body, tc.want)
+		}
+	}
+}
+
+func TestActionsCacheIncompleteUpload(t *testing.T) {
+	srv, config := testCacheServer(t, 1<<20)
+	scope := branchScope("owner/repo", "main")
+	status, body := cacheRequest(t, srv, config, scope, http.MethodPost, "caches", []byte(`{"key":"k","version":"v1","cacheSize":10}`))
+	if status != http.StatusOK {
+		t.Fatalf("reserving: status %d: %s", status, body)
+	}
+	var reserved struct{ CacheID int64 }
+	if err := json.Unmarshal(body, &reserved); err != nil {
+		t.Fatal(err)
+	}
+	resource := fmt.Sprintf("caches/%d", reserved.CacheID)
+	cacheRequest(t, srv, config, scope, http.MethodPatch, resource, []byte("fghij"), "Content-Range", "bytes 5-9/*")
+	if status, body := cacheRequest(t, srv, config, scope, http.MethodPost, resource, []byte(`{"size":10}`)); status != http.StatusBadRequest || !strings.Contains(string(body), "missing bytes at offset 0") {
+		t.Errorf("committing: got:%d %s want:%d", status, body, http.StatusBadRequest)
+	}
+	if status, _ := cacheRequest(t, srv, config, branchScope("owner/repo", "other"), http.MethodPatch, resource, []byte("abcde"), "Content-Range", "bytes 0-4/*"); status != http.StatusNotFound {
+		t.Errorf("uploading from another ref: status got:%d want:%d", status, http.StatusNotFound)
+	}
+	if key, _ := restoreCache(t, srv, config, scope, "k"); key != "" {
+		t.Errorf("uncommitted entry restored")
+	}
+}
+
+func TestActionsCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	store, err := newBlobStore(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	cache := newActionsCache(store, 25)
+	scope := branchScope("owner/repo", "main")
+	evictions := cacheEvictions.value(scope.Repo)
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	save := func(key string) {
+		t.Helper()
+		now = now.Add(time.Minute)
+		id, err := cache.reserve(ctx, scope, key, "v1", 10, now)
+		if err != nil {
+			t.Fatalf("reserve(%q) failed: %v", key, err)
+		}
+		if err := cache.upload(ctx, scope, id, 0, []byte("0123456789")); err != nil {
+			t.Fatalf("upload(%q) failed: %v", key, err)
+		}
+		if err := cache.commit(ctx, scope, id, 10, now); err != nil {
+			t.Fatalf("commit(%q) failed: %v", key, err)
+		}
+	}
+	save("a")
+	save("b")
+	now = now.Add(time.Minute)
+	if _, err := cache.lookup(ctx, scope, []string{"a"}, "v1", now); err != nil { // Now b is the least recently used.
+		t.Fatalf("lookup() failed: %v", err)
+	}
+	save("c")
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		e, err := cache.lookup(ctx, scope, []string{key}, "v1", now)
+		if err != nil {
+			t.Fatalf("lookup(%q) failed: %v", key, err)
+		}
+		if (e != nil) != want {
+			t.Errorf("entry %q kept got:%t want:%t", key, e != nil, want)
+		}
+	}
+	if got := cacheEvictions.value(scope.Repo) - evictions; got != 1 {
+		t.Errorf("evictions got:%v want:1", got)
+	}
+}
+
+func TestActionsCacheEnv(t *testing.T) {
+	config := testConfig()
+	config.CacheURL, config.CacheServiceURL, config.cacheKey = "gs://cache", "https://cr-runner.example.com/", []byte("key")
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		profile profile
+		want    bool
+	}{{profileDefault, true}, {profileSmall, true}, {profileLocked, false}} {
+		job := cloudRunJob{config: config, profile: tc.profile}
+		env := job.actionsCacheEnv(runOptions{repo: "owner/repo", defaultBranch: "main", cacheRef: "feature", timeout: time.Hour}, now)
+		if (len(env) == 1) != tc.want {
+			t.Errorf("%s: env got:%v want set:%t", tc.profile, env, tc.want)
+			continue
+		}
+		if !tc.want {
+			continue
+		}
+		token, ok := strings.CutPrefix(env[0].GetValue(), "https://cr-runner.example.com/cache/")
+		token = strings.TrimSuffix(token, "/")
+		want := cacheScope{Repo: "owner/repo", Ref: "feature", Default: "main", Expires: now.Add(time.Hour + cacheTokenGrace).Unix()}
+		if scope, valid := parseCacheToken(config.cacheKey, token, now); !ok || !valid || scope != want {
+			t.Errorf("%s: %s got:%q, scope %+v want:%+v", tc.profile, actionsCacheURLEnvVar, env[0].GetValue(), scope, want)
+		}
+		if _, valid := parseCacheToken(config.cacheKey, token, now.Add(time.Hour+cacheTokenGrace)); valid {
+			t.Errorf("%s: token valid after it expires", tc.profile)
+		}
+	}
+
+	job := cloudRunJob{config: config, profile: profileDefault}
+	if env := job.actionsCacheEnv(runOptions{repo: "owner/repo"}, now); env != nil {
+		t.Errorf("runner without a ref or default branch got:%v", env)
+	}
+}
+
+func TestCacheRef(t *testing.T) {
+	ev := mustParseFixture(t, "workflow_job_queued.json")
+	ev.WorkflowJob.HeadBranch = "main"
+	base := eventRepository{FullName: "Owner/Repo"}
+	fork := eventRepository{FullName: "Someone/Repo"}
+	for _, tc := range []struct {
+		name string
+		t    trigger
+		want string
+	}{
+		{name: "unresolved", t: trigger{}, want: ""},
+		{name: "push", t: trigger{run: &eventWorkflowRun{Event: "push", HeadBranch: "main", Repository: base, HeadRepository: base}}, want: "main"},
+		{name: "fork pull request from main", t: trigger{run: &eventWorkflowRun{Event: "pull_request", HeadBranch: "main", Repository: base, HeadRepository: fork}}, want: "pull/someone/repo:main"},
+		{name: "pull request target", t: trigger{run: &eventWorkflowRun{Event: "pull_request_target", HeadBranch: "main", Repository: base, HeadRepository: base}}, want: "pull/owner/repo:main"},
+	} {
+		if got := cacheRef(ev, tc.t); got != tc.want {
+			t.Errorf("%s: cacheRef() got:%q want:%q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// clients are the external services the handlers depend on. They are
+// interfaces so that tests and the simulator can substitute fakes (see
+// fake.go).
+type clients struct {
+	jobs     jobsClient
+	secrets  secretReader
+	github   gitHubClient
+	networks networkClient
+	accounts serviceAccountClient
+}
+
+// newClients creates clients for the real Cloud Run, Secret Manager,
+// GitHub, Compute Engine, Serverless VPC Access and IAM APIs. The returned
+// func closes them.
+func newClients(ctx context.Context, config config) (clients, func(), error) {
+	jobs, err := newCloudRunJobsClient(ctx)
+	if err != nil {
+		return clients{}, nil, err
+	}
+	secrets, err := newSecretManager(ctx, config.Project)
+	if err != nil {
+		jobs.close()
+		return clients{}, nil, fmt.Errorf("creating Secret Manager client: %v", err)
+	}
+	networks, err := newCloudNetworkClient(ctx)
+	if err != nil {
+		jobs.close()
+		secrets.close()
+		return clients{}, nil, err
+	}
+	accounts, err := newIAMServiceAccountClient(ctx)
+	if err != nil {
+		jobs.close()
+		secrets.close()
+		return clients{}, nil, err
+	}
+	closeAll := func() {
+		jobs.close()
+		secrets.close()
+	}
+	return clients{
+		jobs:     jobs,
+		secrets:  secrets,
+		github:   newGitHubAPI(secrets, config.TokenSecretName),
+		networks: networks,
+		accounts: accounts,
+	}, closeAll, nil
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"cloud.google.com/go/iam/apiv1/iampb"
 	"cloud.google.com/go/run/apiv2/runpb"
-	"github.com/googleapis/gax-go/v2/apierror"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/api/iterator"
 	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/types/known/durationpb"
 
@@ -15,119 +22,523 @@ import (
 )
 
 const (
-	// jobVersion is included in the config and can be used to force new Cloud
-	// Run Jobs to be created. The jobID includes a hash of the config, which
-	// is primarily environment variables. So if the CreateJobRequest itself
-	// changes (see cloudrun.go), you must update the jobVersion to generate a
-	// unique jobID which will cause a new Cloud Run Job to be created.
-	jobVersion = "v1"
-
-	tokenSecretEnvVar = "TOKEN_SECRET"
+	tokenSecretEnvVar   = "TOKEN_SECRET"
+	runnerTokenEnvVar   = "RUNNER_TOKEN"   // Set per execution for the locked profile.
+	repositoryURLEnvVar = "REPOSITORY_URL" // Overridden per execution.
+
+	// Set per execution, describing the workflow job the runner is for.
+	runnerNameEnvVar   = "RUNNER_NAME"
+	runnerLabelsEnvVar = "RUNNER_LABELS"
+	repositoryEnvVar   = "WORKFLOW_REPOSITORY"
+	runIDEnvVar        = "WORKFLOW_RUN_ID"
+	jobIDEnvVar        = "WORKFLOW_JOB_ID"
+	runAttemptEnvVar   = "WORKFLOW_RUN_ATTEMPT"
+	headSHAEnvVar      = "WORKFLOW_HEAD_SHA"
+
+	// runnerNamePrefix prefixes the workflow job ID to name runners, so that
+	// GitHub's runner names map to executions. A redelivered job gets the
+	// same name, and the second runner fails to register.
+	runnerNamePrefix = "cloud-run-"
+
+	// timeoutLabelPrefix is the prefix of a job label that sets the task
+	// timeout, e.g., "timeout-30m".
+	timeoutLabelPrefix = "timeout-"
+	// maxTaskTimeout is the longest task timeout Cloud Run allows.
+	maxTaskTimeout = 24 * time.Hour
+
+	lockedJobSuffix = "-locked"
+	smallJobSuffix  = "-small"
+
+	// Labels on the Cloud Run jobs, which are carried into billing exports.
+	managedByLabel = "managed-by"
+	managedBy      = "cr-runner"
+	profileLabel   = "cr-runner-profile"
+	// ownerLabel marks the jobs created by services with the same
+	// $JOB_OWNER_ID, which delete the jobs they have superseded.
+	ownerLabel = "cr-runner-owner"
+	// specLabel holds the specHash of the definition the job was created or
+	// last updated with.
+	specLabel = "cr-runner-spec"
+
+	runnerContainerName = "job"
 )
 
-type cloudRunJob struct {
-	config config
+// jobsClient is the subset of the Cloud Run Admin API used by the service.
+// Long-running operations are waited on before returning, except for
+// runJob, which returns once the execution is created.
+type jobsClient interface {
+	createJob(ctx context.Context, req *runpb.CreateJobRequest) (*runpb.Job, error)
+	getJob(ctx context.Context, req *runpb.GetJobRequest) (*runpb.Job, error)
+	updateJob(ctx context.Context, req *runpb.UpdateJobRequest) (*runpb.Job, error)
+	runJob(ctx context.Context, req *runpb.RunJobRequest) (*runpb.Execution, error)
+	getExecution(ctx context.Context, name string) (*runpb.Execution, error)
+	cancelExecution(ctx context.Context, name string) error
+	// listJobs lists the jobs in parent, "projects/{project}/locations/{location}".
+	listJobs(ctx context.Context, parent string) ([]*runpb.Job, error)
+	deleteJob(ctx context.Context, name string) error
+	// listExecutions lists the executions of the job with the full resource
+	// name job.
+	listExecutions(ctx context.Context, job string) ([]*runpb.Execution, error)
+	testIamPermissions(ctx context.Context, resource string, perms []string) ([]string, error)
 }
 
-func (j *cloudRunJob) ensureJob(ctx context.Context) error {
+// cloudRunJobsClient implements jobsClient with the Cloud Run API.
+type cloudRunJobsClient struct {
+	c *run.JobsClient
+	e *run.ExecutionsClient
+}
+
+func newCloudRunJobsClient(ctx context.Context) (*cloudRunJobsClient, error) {
 	c, err := run.NewJobsClient(ctx)
 	if err != nil {
-		return fmt.Errorf("creating Cloud Run client: %v", err)
+		return nil, fmt.Errorf("creating Cloud Run client: %v", err)
+	}
+	e, err := run.NewExecutionsClient(ctx)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("creating Cloud Run executions client: %v", err)
+	}
+	return &cloudRunJobsClient{c: c, e: e}, nil
+}
+
+func (c *cloudRunJobsClient) close() error {
+	c.e.Close()
+	return c.c.Close()
+}
+
+func (c *cloudRunJobsClient) createJob(ctx context.Context, req *runpb.CreateJobRequest) (*runpb.Job, error) {
+	op, err := c.c.CreateJob(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := op.Wait(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for job operation: %v", err)
+	}
+	return resp, nil
+}
+
+func (c *cloudRunJobsClient) getJob(ctx context.Context, req *runpb.GetJobRequest) (*runpb.Job, error) {
+	return c.c.GetJob(ctx, req)
+}
+
+func (c *cloudRunJobsClient) updateJob(ctx context.Context, req *runpb.UpdateJobRequest) (*runpb.Job, error) {
+	op, err := c.c.UpdateJob(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := op.Wait(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for job operation: %v", err)
+	}
+	return resp, nil
+}
+
+func (c *cloudRunJobsClient) runJob(ctx context.Context, req *runpb.RunJobRequest) (*runpb.Execution, error) {
+	op, err := c.c.RunJob(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	// The operation only completes when the execution does, which is long
+	// after GitHub gives up on the delivery; the metadata names the new
+	// execution.
+	exec, err := op.Metadata()
+	if err != nil {
+		return nil, fmt.Errorf("reading job operation metadata: %v", err)
+	}
+	if exec == nil {
+		return &runpb.Execution{Job: req.Name}, nil
+	}
+	return exec, nil
+}
+
+func (c *cloudRunJobsClient) getExecution(ctx context.Context, name string) (*runpb.Execution, error) {
+	return c.e.GetExecution(ctx, &runpb.GetExecutionRequest{Name: name})
+}
+
+func (c *cloudRunJobsClient) cancelExecution(ctx context.Context, name string) error {
+	op, err := c.e.CancelExecution(ctx, &runpb.CancelExecutionRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	if _, err := op.Wait(ctx); err != nil {
+		return fmt.Errorf("waiting for cancel operation: %v", err)
+	}
+	return nil
+}
+
+func (c *cloudRunJobsClient) listJobs(ctx context.Context, parent string) ([]*runpb.Job, error) {
+	var jobs []*runpb.Job
+	it := c.c.ListJobs(ctx, &runpb.ListJobsRequest{Parent: parent})
+	for {
+		job, err := it.Next()
+		if err == iterator.Done {
+			return jobs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+}
+
+func (c *cloudRunJobsClient) deleteJob(ctx context.Context, name string) error {
+	op, err := c.c.DeleteJob(ctx, &runpb.DeleteJobRequest{Name: name})
+	if err != nil {
+		return err
+	}
+	if _, err := op.Wait(ctx); err != nil {
+		return fmt.Errorf("waiting for delete operation: %v", err)
+	}
+	return nil
+}
+
+func (c *cloudRunJobsClient) listExecutions(ctx context.Context, job string) ([]*runpb.Execution, error) {
+	var execs []*runpb.Execution
+	it := c.e.ListExecutions(ctx, &runpb.ListExecutionsRequest{Parent: job})
+	for {
+		exec, err := it.Next()
+		if err == iterator.Done {
+			return execs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		execs = append(execs, exec)
+	}
+}
+
+func (c *cloudRunJobsClient) testIamPermissions(ctx context.Context, resource string, perms []string) ([]string, error) {
+	resp, err := c.c.TestIamPermissions(ctx, &iampb.TestIamPermissionsRequest{Resource: resource, Permissions: perms})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Permissions, nil
+}
+
+type cloudRunJob struct {
+	config  config
+	client  jobsClient
+	profile profile // Defaults to profileDefault.
+	// account is the service account mapped by $SERVICE_ACCOUNT_FILE that
+	// the job runs as, if any; see serviceaccount.go.
+	account string
+
+	// networks and accounts, if set, check in ensureJob that the profile's
+	// VPC network exists and that the service can use the service account.
+	networks networkClient
+	accounts serviceAccountClient
+}
+
+// runOptions are the per-execution settings for a runner.
+type runOptions struct {
+	repoURL string
+	// runnerToken is a registration token, which the locked profile uses in
+	// place of the personal access token.
+	runnerToken string
+
+	// name overrides the runner name derived from jobID; it names warm
+	// runners, which are not started for a workflow job.
+	name string
+	// tasks is the number of runners to start; each registers as
+	// "{name}-{task index}". Zero or one starts a single runner named name.
+	tasks int
+
+	// The workflow job the runner is for, if known.
+	repo       string // "owner/repo"
+	runID      int64
+	jobID      int
+	runAttempt int
+	headSHA    string
+	labels     []string
+	timeout    time.Duration // Zero uses the job's $JOB_TIMEOUT.
+
+	// The repository's default branch, and the ref the runner saves Actions
+	// cache entries from, if known; see cacheScope.
+	defaultBranch string
+	cacheRef      string
+}
+
+// runOptionsFor returns the settings for a runner for the queued workflow
+// job in ev. A timeout label is capped at $MAX_JOB_TIMEOUT, so that the
+// operator, not the workflow, bounds what a job can cost.
+func runOptionsFor(config config, ev *event) runOptions {
+	job := ev.WorkflowJob
+	opts := runOptions{
+		repoURL:    repoURL(ev.Repository.FullName),
+		repo:       ev.Repository.FullName,
+		runID:      job.RunID,
+		jobID:      job.ID,
+		runAttempt: job.RunAttempt,
+		headSHA:    job.HeadSHA,
+		labels:     job.Labels,
+
+		defaultBranch: ev.Repository.DefaultBranch,
+	}
+	for _, l := range job.Labels {
+		s, ok := strings.CutPrefix(strings.ToLower(l), timeoutLabelPrefix)
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			logWarn("Ignoring label %q on workflow job %d: not a valid timeout.", l, job.ID)
+			continue
+		}
+		opts.timeout = min(d, config.maxJobTimeout())
+	}
+	return opts
+}
+
+// maxJobTimeout is the longest task timeout a job can ask for with a label.
+func (c config) maxJobTimeout() time.Duration {
+	if c.MaxJobTimeout == 0 {
+		return c.JobTimeout
 	}
-	defer c.Close()
+	return c.MaxJobTimeout
+}
+
+// runnerName is the name the runner registers with; empty if neither the
+// name nor the workflow job is known.
+func (o runOptions) runnerName() string {
+	if o.name != "" {
+		return o.name
+	}
+	if o.jobID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s%d", runnerNamePrefix, o.jobID)
+}
 
+func (j *cloudRunJob) ensureJob(ctx context.Context) (err error) {
+	ctx, span := tracer.Start(ctx, "cloudRunJob.ensureJob", trace.WithAttributes(attribute.String("cloudrun.job", j.jobID())))
+	defer func() { endSpan(span, err) }()
+
+	if err := j.checkVPC(ctx); err != nil {
+		return err
+	}
+	if err := j.checkServiceAccount(ctx); err != nil {
+		return err
+	}
 	req, err := j.createJobRequest()
 	if err != nil {
 		return fmt.Errorf("creating job request: %v", err)
 	}
+	hash, err := specHash(req.Job)
+	if err != nil {
+		return err
+	}
+	req.Job.Labels[specLabel] = hash
 
 	logInfo("Creating Cloud Run job with req:\n%s", prototext.Format(req))
-	op, err := c.CreateJob(ctx, req)
-	if err != nil {
-		// If we already have a job by this name, we're done.
-		var aerr *apierror.APIError
-		if errors.As(err, &aerr) && aerr.GRPCStatus().Code() == codes.AlreadyExists {
-			logInfo("Job %q is already created.", j.config.JobID)
-			return nil
-		}
+	resp, err := j.client.createJob(ctx, req)
+	if err == nil {
+		logInfo("Job creation response for %q: %#v", j.jobID(), resp)
+		return nil
+	}
+	if grpcstatus.Code(err) != codes.AlreadyExists {
 		return fmt.Errorf("creating job: %v", err)
 	}
 
-	resp, err := op.Wait(ctx)
+	// We already have a job by this name. Its ID ends in a hash of the
+	// definitions, so a different one was edited outside the service;
+	// restore it.
+	existing, err := j.getJob(ctx)
 	if err != nil {
-		return fmt.Errorf("waiting for job operation: %v", err)
+		return err
 	}
-
-	logInfo("Job creation response for %q: %#v", j.config.JobID, resp)
+	if existing.Labels[specLabel] == hash {
+		logInfo("Job %q is already created and up to date.", j.jobID())
+		return nil
+	}
+	logInfo("Job %q has a different definition; updating it:\n%s", j.jobID(), strings.Join(diffJob(existing, req.Job), "\n"))
+	req.Job.Name = j.jobName()
+	if _, err := j.client.updateJob(ctx, &runpb.UpdateJobRequest{Job: req.Job}); err != nil {
+		return fmt.Errorf("updating job: %v", err)
+	}
+	logInfo("Job %q updated.", j.jobID())
 	return nil
 }
 
-func (j *cloudRunJob) runJob(ctx context.Context) error {
-	c, err := run.NewJobsClient(ctx)
+// runJob starts an execution of the job with a runner registered to opts.repoURL.
+func (j *cloudRunJob) runJob(ctx context.Context, opts runOptions) (_ *runpb.Execution, err error) {
+	ctx, span := tracer.Start(ctx, "cloudRunJob.runJob", trace.WithAttributes(attribute.String("cloudrun.job", j.jobID())))
+	defer func() { endSpan(span, err) }()
+
+	req, err := j.runJobRequest(ctx, opts)
 	if err != nil {
-		return fmt.Errorf("creating Cloud Run client: %v", err)
+		return nil, fmt.Errorf("creating job request: %v", err)
 	}
-	defer c.Close()
 
-	req, err := j.runJobRequest()
+	resp, err := j.client.runJob(ctx, req)
+	if grpcstatus.Code(err) == codes.NotFound {
+		// Deleted since startup, e.g., pruned by another deployment that
+		// shares $JOB_OWNER_ID.
+		logWarn("Job %q not found; creating it again.", j.jobID())
+		if err := j.ensureJob(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = j.client.runJob(ctx, req)
+	}
 	if err != nil {
-		return fmt.Errorf("creating job request: %v", err)
+		return nil, fmt.Errorf("running job: %v", err)
 	}
 
-	op, err := c.RunJob(ctx, req)
+	logInfo("Started execution %q of job %q.", resp.Name, j.jobID())
+	return resp, nil
+}
+
+// getJob fetches the Cloud Run job, which is used to check that it exists.
+func (j *cloudRunJob) getJob(ctx context.Context) (*runpb.Job, error) {
+	job, err := j.client.getJob(ctx, &runpb.GetJobRequest{Name: j.jobName()})
 	if err != nil {
-		return fmt.Errorf("running job: %v", err)
+		return nil, fmt.Errorf("getting job: %v", err)
 	}
+	return job, nil
+}
 
-	resp, err := op.Wait(ctx)
+// testPermissions returns the subset of perms that the caller holds on the Cloud Run job.
+func (j *cloudRunJob) testPermissions(ctx context.Context, perms []string) ([]string, error) {
+	granted, err := j.client.testIamPermissions(ctx, j.jobName(), perms)
 	if err != nil {
-		return fmt.Errorf("waiting for job operation: %v", err)
+		return nil, fmt.Errorf("testing permissions: %v", err)
 	}
+	return granted, nil
+}
 
-	logInfo("Job run response for %q: %#v", j.config.JobID, resp)
-	return nil
+func (j *cloudRunJob) profileOrDefault() profile {
+	if j.profile == "" {
+		return profileDefault
+	}
+	return j.profile
+}
+
+// jobID is the Cloud Run job ID for the profile and service account.
+func (j *cloudRunJob) jobID() string {
+	id := j.config.JobID
+	switch j.profile {
+	case profileLocked:
+		id += lockedJobSuffix
+	case profileSmall:
+		id += smallJobSuffix
+	}
+	if j.account != "" {
+		id += accountSuffix(j.account)
+	}
+	return id
+}
+
+// serviceAccount is the service account the job runs as; empty for the
+// default compute service account.
+func (j *cloudRunJob) serviceAccount() string {
+	if j.account == "" && j.profile == profileLocked {
+		return j.config.LockedServiceAccount
+	}
+	return j.account
+}
+
+// resources returns the CPU and memory limits of the profile's task.
+func (j *cloudRunJob) resources() (cpu, memory string) {
+	if j.profile == profileSmall {
+		return j.config.SmallJobCpu, j.config.SmallJobMemory
+	}
+	return j.config.JobCpu, j.config.JobMemory
+}
+
+func (j *cloudRunJob) labels() map[string]string {
+	labels := map[string]string{managedByLabel: managedBy, profileLabel: string(j.profileOrDefault())}
+	if j.config.JobOwnerID != "" {
+		labels[ownerLabel] = j.config.JobOwnerID
+	}
+	if j.account != "" {
+		id, _, _ := strings.Cut(j.account, "@")
+		labels[serviceAccountLabel] = id
+	}
+	return labels
+}
+
+func (j *cloudRunJob) jobName() string {
+	return fmt.Sprintf("projects/%s/locations/%s/jobs/%s", j.config.Project, j.config.Location, j.jobID())
 }
 
 func (j *cloudRunJob) createJobRequest() (*runpb.CreateJobRequest, error) {
+	// Executions started without a workflow job fall back to the execution
+	// name and the default labels. Executions with several tasks start a
+	// runner per task, each named with its task index.
+	runnerFlags := fmt.Sprintf(`--name "${%s:-$CLOUD_RUN_EXECUTION}$([ "${CLOUD_RUN_TASK_COUNT:-1}" -gt 1 ] && echo "-$CLOUD_RUN_TASK_INDEX")" ${%s:+--labels "$%s"}`, runnerNameEnvVar, runnerLabelsEnvVar, runnerLabelsEnvVar)
+	// Note: some runner logs are found in /home/runner/_diag/*.log, which
+	// are uploaded to $DIAG_URL if set.
+	register := fmt.Sprintf(`./config.sh --unattended --disableupdate --ephemeral --url "$%s" --pat $%s %s`, repositoryURLEnvVar, tokenSecretEnvVar, runnerFlags)
+	env := []*runpb.EnvVar{
+		{
+			Name:   repositoryURLEnvVar,
+			Values: &runpb.EnvVar_Value{Value: j.config.RepositoryURL},
+		},
+		{
+			Name: tokenSecretEnvVar,
+			Values: &runpb.EnvVar_ValueSource{
+				ValueSource: &runpb.EnvVarSource{
+					SecretKeyRef: &runpb.SecretKeySelector{
+						Secret:  j.config.TokenSecretName,
+						Version: "latest",
+					},
+				},
+			},
+		},
+	}
+	if j.profile == profileLocked {
+		// Untrusted jobs do not get the personal access token; they register
+		// with a token passed per execution and run as $LOCKED_SERVICE_ACCOUNT,
+		// unless $SERVICE_ACCOUNT_FILE maps another.
+		register = fmt.Sprintf(`./config.sh --unattended --disableupdate --ephemeral --url "$%s" --token $%s %s`, repositoryURLEnvVar, runnerTokenEnvVar, runnerFlags)
+		env = env[:1]
+	}
+	command := register + " && ./run.sh"
+	if j.config.RunnerEventsURL != "" {
+		// The hooks report to the service; see runnerevents.go.
+		env = append(env,
+			&runpb.EnvVar{Name: runnerEventsURLEnvVar, Values: &runpb.EnvVar_Value{Value: j.config.RunnerEventsURL}},
+			&runpb.EnvVar{Name: runnerEventsScriptEnvVar, Values: &runpb.EnvVar_Value{Value: runnerEventsScript}},
+		)
+		// So does _diag, if kept; see diag.go.
+		var upload diagUpload
+		if j.config.DiagURL != "" {
+			upload = j.config.DiagUpload
+			env = append(env, &runpb.EnvVar{Name: runnerDiagURLEnvVar, Values: &runpb.EnvVar_Value{Value: runnerDiagURL(j.config.RunnerEventsURL)}})
+		}
+		command = runnerEventsCommand(register, upload)
+	}
+
+	cpu, memory := j.resources()
+	vpc, _ := j.vpc()
+	volumes, mounts := j.volumes()
 	req := &runpb.CreateJobRequest{
 		// See https://pkg.go.dev/cloud.google.com/go/run/apiv2/runpb#CreateJobRequest.
 		Parent: fmt.Sprintf("projects/%s/locations/%s", j.config.Project, j.config.Location),
-		JobId:  j.config.JobID,
+		JobId:  j.jobID(),
 		Job: &runpb.Job{
+			Labels: j.labels(),
 			Template: &runpb.ExecutionTemplate{
 				Parallelism: 0, // 0 allows maximum parallelism for the jobs
 				TaskCount:   1,
 				Template: &runpb.TaskTemplate{
 					Containers: []*runpb.Container{
 						{
-							Name:  "job",
-							Image: j.config.RunnerImageURL,
-							Args: []string{
-								"/bin/bash",
-								"-c",
-								// Note: some runner logs are found in /home/runner/_diag/*.log
-								fmt.Sprintf(`./config.sh --unattended --disableupdate --ephemeral --url %q --pat $%s --name $CLOUD_RUN_EXECUTION && ./run.sh`, j.config.RepositoryURL, tokenSecretEnvVar),
-							},
-							Env: []*runpb.EnvVar{
-								{
-									Name: tokenSecretEnvVar,
-									Values: &runpb.EnvVar_ValueSource{
-										ValueSource: &runpb.EnvVarSource{
-											SecretKeyRef: &runpb.SecretKeySelector{
-												Secret:  j.config.TokenSecretName,
-												Version: "latest",
-											},
-										},
-									},
-								},
-							},
+							Name:         runnerContainerName,
+							Image:        j.config.RunnerImageURL,
+							Args:         []string{"/bin/bash", "-c", command},
+							Env:          env,
+							VolumeMounts: mounts,
 							Resources: &runpb.ResourceRequirements{
-								Limits:          map[string]string{"cpu": j.config.JobCpu, "memory": j.config.JobMemory},
+								Limits:          map[string]string{"cpu": cpu, "memory": memory},
 								CpuIdle:         false,
 								StartupCpuBoost: true,
 							},
 						},
 					},
+					ServiceAccount:       j.serviceAccount(),
+					VpcAccess:            vpc.vpcAccess(),
+					Volumes:              volumes,
 					Retries:              &runpb.TaskTemplate_MaxRetries{MaxRetries: 0},
 					Timeout:              durationpb.New(j.config.JobTimeout),
 					ExecutionEnvironment: runpb.ExecutionEnvironment_EXECUTION_ENVIRONMENT_GEN2,
@@ -135,13 +546,72 @@ func (j *cloudRunJob) createJobRequest() (*runpb.CreateJobRequest, error) {
 			},
 		},
 	}
+	if j.config.jobTemplate != nil {
+		job, err := j.config.jobTemplate.render(jobTemplateData{Profile: j.profileOrDefault(), JobID: j.jobID(), Config: j.config})
+		if err != nil {
+			return nil, err
+		}
+		req.Job = withJobTemplate(job, req.Job, j.profileOrDefault())
+	}
 	return req, nil
 }
 
-func (j *cloudRunJob) runJobRequest() (*runpb.RunJobRequest, error) {
-	return &runpb.RunJobRequest{
-		Name: fmt.Sprintf("projects/%s/locations/%s/jobs/%s", j.config.Project, j.config.Location, j.config.JobID),
-	}, nil
+func (j *cloudRunJob) runJobRequest(ctx context.Context, opts runOptions) (*runpb.RunJobRequest, error) {
+	env := []*runpb.EnvVar{
+		{Name: repositoryURLEnvVar, Values: &runpb.EnvVar_Value{Value: opts.repoURL}},
+	}
+	if j.profile == profileLocked {
+		if opts.runnerToken == "" {
+			return nil, fmt.Errorf("the %s profile requires a registration token", profileLocked)
+		}
+		env = append(env, &runpb.EnvVar{Name: runnerTokenEnvVar, Values: &runpb.EnvVar_Value{Value: opts.runnerToken}})
+	}
+
+	if name := opts.runnerName(); name != "" {
+		env = append(env,
+			&runpb.EnvVar{Name: runnerNameEnvVar, Values: &runpb.EnvVar_Value{Value: name}},
+			&runpb.EnvVar{Name: runnerLabelsEnvVar, Values: &runpb.EnvVar_Value{Value: strings.Join(opts.labels, ",")}},
+		)
+	}
+	if opts.runID != 0 {
+		env = append(env,
+			&runpb.EnvVar{Name: repositoryEnvVar, Values: &runpb.EnvVar_Value{Value: opts.repo}},
+			&runpb.EnvVar{Name: runIDEnvVar, Values: &runpb.EnvVar_Value{Value: strconv.FormatInt(opts.runID, 10)}},
+			&runpb.EnvVar{Name: runAttemptEnvVar, Values: &runpb.EnvVar_Value{Value: strconv.Itoa(opts.runAttempt)}},
+			&runpb.EnvVar{Name: headSHAEnvVar, Values: &runpb.EnvVar_Value{Value: opts.headSHA}},
+		)
+	}
+	if opts.jobID != 0 {
+		// Not set for a batch, whose tasks are for different jobs.
+		env = append(env, &runpb.EnvVar{Name: jobIDEnvVar, Values: &runpb.EnvVar_Value{Value: strconv.Itoa(opts.jobID)}})
+	}
+	// The caches on the job's volumes are per repository, so they are set
+	// per execution.
+	env = append(env, j.cacheEnv(opts.repo)...)
+	now := time.Now()
+	env = append(env, j.actionsCacheEnv(opts, now)...)
+	env = append(env, j.runnerEventsEnv(opts, now)...)
+
+	// Hand the trace context to the execution so that runner-side hooks can continue the trace.
+	var traceVars []*runpb.EnvVar
+	for k, v := range traceEnv(ctx) {
+		traceVars = append(traceVars, &runpb.EnvVar{Name: k, Values: &runpb.EnvVar_Value{Value: v}})
+	}
+	sort.Slice(traceVars, func(a, b int) bool { return traceVars[a].Name < traceVars[b].Name })
+	env = append(env, traceVars...)
+
+	overrides := &runpb.RunJobRequest_Overrides{
+		ContainerOverrides: []*runpb.RunJobRequest_Overrides_ContainerOverride{
+			{Name: runnerContainerName, Env: env},
+		},
+	}
+	if opts.timeout > 0 {
+		overrides.Timeout = durationpb.New(opts.timeout)
+	}
+	if opts.tasks > 1 {
+		overrides.TaskCount = int32(opts.tasks)
+	}
+	return &runpb.RunJobRequest{Name: j.jobName(), Overrides: overrides}, nil
 }
 
 /*
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnsureJob(t *testing.T) {
+	config := testConfig()
+	jobs := newFakeJobsClient()
+	job := cloudRunJob{config: config, client: jobs}
+
+	// The second call finds the job already created, which is not an error.
+	for i := 0; i < 2; i++ {
+		if err := job.ensureJob(context.Background()); err != nil {
+			t.Fatalf("ensureJob() #%d failed: %v", i+1, err)
+		}
+	}
+
+	got, err := job.getJob(context.Background())
+	if err != nil {
+		t.Fatalf("getJob() failed: %v", err)
+	}
+	container := got.GetTemplate().GetTemplate().GetContainers()[0]
+	if container.Image != config.RunnerImageURL {
+		t.Errorf("image got:%q want:%q", container.Image, config.RunnerImageURL)
+	}
+	if args := strings.Join(container.Args, " "); !strings.Contains(args, `--url "$`+repositoryURLEnvVar+`"`) {
+		t.Errorf("args %q do not register with $%s", args, repositoryURLEnvVar)
+	}
+}
+
+func TestRunJobRecreatesDeletedJob(t *testing.T) {
+	ctx := context.Background()
+	jobs := newFakeJobsClient()
+	job := cloudRunJob{config: testConfig(), client: jobs}
+	if err := job.ensureJob(ctx); err != nil {
+		t.Fatalf("ensureJob() failed: %v", err)
+	}
+	// E.g., pruned by another deployment.
+	if err := jobs.deleteJob(ctx, job.jobName()); err != nil {
+		t.Fatalf("deleteJob() failed: %v", err)
+	}
+	if _, err := job.runJob(ctx, runOptions{repoURL: job.config.RepositoryURL}); err != nil {
+		t.Fatalf("runJob() failed: %v", err)
+	}
+	if _, err := job.getJob(ctx); err != nil {
+		t.Errorf("job not created again: %v", err)
+	}
+}
+
+func TestRunJobRequestTraceEnv(t *testing.T) {
+	job := cloudRunJob{config: testConfig()}
+
+	// Without an active span there is no trace context to pass on.
+	req, err := job.runJobRequest(context.Background(), runOptions{repoURL: "https://github.com/owner/repo"})
+	if err != nil {
+		t.Fatalf("runJobRequest() failed: %v", err)
+	}
+	env := overrideEnv(req)
+	if _, ok := env[traceParentEnvVar]; ok {
+		t.Errorf("unexpected $%s without a span", traceParentEnvVar)
+	}
+	if got, want := env[repositoryURLEnvVar], "https://github.com/owner/repo"; got != want {
+		t.Errorf("$%s got:%q want:%q", repositoryURLEnvVar, got, want)
+	}
+}
+
+func TestLockedJob(t *testing.T) {
+	config := testConfig()
+	config.LockedServiceAccount = "locked@my-project.iam.gserviceaccount.com"
+	jobs := newFakeJobsClient()
+	job := cloudRunJob{config: config, client: jobs, profile: profileLocked}
+	if err := job.ensureJob(context.Background()); err != nil {
+		t.Fatalf("ensureJob() failed: %v", err)
+	}
+
+	got, err := job.getJob(context.Background())
+	if err != nil {
+		t.Fatalf("getJob() failed: %v", err)
+	}
+	if want := "projects/my-project/locations/us-central1/jobs/runner-abc-locked"; got.Name != want {
+		t.Errorf("job name got:%q want:%q", got.Name, want)
+	}
+	task := got.GetTemplate().GetTemplate()
+	if task.ServiceAccount != config.LockedServiceAccount {
+		t.Errorf("service account got:%q want:%q", task.ServiceAccount, config.LockedServiceAccount)
+	}
+	container := task.GetContainers()[0]
+	for _, e := range container.Env {
+		if e.GetValueSource() != nil {
+			t.Errorf("locked job has secret env var $%s", e.Name)
+		}
+	}
+	if args := strings.Join(container.Args, " "); !strings.Contains(args, "--token $"+runnerTokenEnvVar) {
+		t.Errorf("args %q do not register with $%s", args, runnerTokenEnvVar)
+	}
+
+	if _, err := job.runJobRequest(context.Background(), runOptions{repoURL: config.RepositoryURL}); err == nil {
+		t.Errorf("runJobRequest() without a registration token succeeded, want error")
+	}
+	req, err := job.runJobRequest(context.Background(), runOptions{repoURL: config.RepositoryURL, runnerToken: "registration-token"})
+	if err != nil {
+		t.Fatalf("runJobRequest() failed: %v", err)
+	}
+	if got := overrideEnv(req)[runnerTokenEnvVar]; got != "registration-token" {
+		t.Errorf("$%s got:%q want:%q", runnerTokenEnvVar, got, "registration-token")
+	}
+}
+
+func TestRunOptionsFor(t *testing.T) {
+	config := testConfig()
+	config.JobTimeout, config.MaxJobTimeout = 10*time.Minute, 2*time.Hour
+	tests := []struct {
+		name        string
+		labels      []string
+		noMax       bool // Leaves $MAX_JOB_TIMEOUT unset.
+		wantTimeout time.Duration
+	}{
+		{name: "no timeout", labels: []string{"self-hosted"}},
+		{name: "timeout", labels: []string{"self-hosted", "timeout-30m"}, wantTimeout: 30 * time.Minute},
+		{name: "upper case", labels: []string{"Timeout-1H"}, wantTimeout: time.Hour},
+		{name: "clamped", labels: []string{"timeout-48h"}, wantTimeout: 2 * time.Hour},
+		{name: "clamped to job timeout", labels: []string{"timeout-24h"}, noMax: true, wantTimeout: 10 * time.Minute},
+		{name: "invalid", labels: []string{"timeout-soon"}},
+		{name: "negative", labels: []string{"timeout--5m"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ev := &event{
+				Repository:  eventRepository{FullName: "owner/repo"},
+				WorkflowJob: eventWorkflowJob{ID: 42, RunID: 7, RunAttempt: 2, HeadSHA: "abc123", Labels: tc.labels},
+			}
+			config := config
+			if tc.noMax {
+				config.MaxJobTimeout = 0
+			}
+			opts := runOptionsFor(config, ev)
+			if opts.timeout != tc.wantTimeout {
+				t.Errorf("timeout got:%v want:%v", opts.timeout, tc.wantTimeout)
+			}
+
+			req, err := (&cloudRunJob{config: config}).runJobRequest(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("runJobRequest() failed: %v", err)
+			}
+			if got := req.GetOverrides().GetTimeout().AsDuration(); got != tc.wantTimeout {
+				t.Errorf("timeout override got:%v want:%v", got, tc.wantTimeout)
+			}
+			env := overrideEnv(req)
+			want := map[string]string{
+				repositoryURLEnvVar: "https://github.com/owner/repo",
+				runnerNameEnvVar:    "cloud-run-42",
+				runnerLabelsEnvVar:  strings.Join(tc.labels, ","),
+				repositoryEnvVar:    "owner/repo",
+				runIDEnvVar:         "7",
+				jobIDEnvVar:         "42",
+				runAttemptEnvVar:    "2",
+				headSHAEnvVar:       "abc123",
+			}
+			for k, v := range want {
+				if env[k] != v {
+					t.Errorf("$%s got:%q want:%q", k, env[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureJobUpdatesChangedDefinition(t *testing.T) {
+	ctx := context.Background()
+	jobs := newFakeJobsClient()
+	old := testConfig()
+	old.JobCpu, old.JobMemory = "1", "1Gi"
+	if err := (&cloudRunJob{config: old, client: jobs}).ensureJob(ctx); err != nil {
+		t.Fatalf("ensureJob() failed: %v", err)
+	}
+
+	// The job's definition differs from the one generated for its ID, e.g.,
+	// it was edited in the console.
+	changed := old
+	changed.JobCpu = "2"
+	changed.RunnerImageURL = "us-central1-docker.pkg.dev/some-project/some-repo/actions-runner@sha256:FEDCBA654321"
+	job := &cloudRunJob{config: changed, client: jobs}
+	var logs strings.Builder
+	logOutput = &logs
+	defer func() { logOutput = os.Stdout }()
+	if err := job.ensureJob(ctx); err != nil {
+		t.Fatalf("ensureJob() failed: %v", err)
+	}
+	if jobs.updates != 1 {
+		t.Fatalf("updates got:%d want:1", jobs.updates)
+	}
+	got, err := job.getJob(ctx)
+	if err != nil {
+		t.Fatalf("getJob() failed: %v", err)
+	}
+	container := got.GetTemplate().GetTemplate().GetContainers()[0]
+	if container.Image != changed.RunnerImageURL || container.GetResources().GetLimits()["cpu"] != "2" {
+		t.Errorf("container not updated: %v", container)
+	}
+	// The diff is logged as a JSON string.
+	logged := strings.NewReplacer(`\"`, `"`, `\u003e`, `>`).Replace(logs.String())
+	for _, want := range []string{
+		`template.template.containers[0].image: "us-central1-docker.pkg.dev/some-project/some-repo/actions-runner@sha256:ABCDEF123456" -> "us-central1-docker.pkg.dev/some-project/some-repo/actions-runner@sha256:FEDCBA654321"`,
+		`template.template.containers[0].resources.limits[cpu]: "1" -> "2"`,
+	} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("logs do not contain %s:\n%s", want, logged)
+		}
+	}
+
+	// Unchanged definitions are left alone.
+	if err := job.ensureJob(ctx); err != nil {
+		t.Fatalf("ensureJob() failed: %v", err)
+	}
+	if jobs.updates != 1 {
+		t.Errorf("updates after unchanged ensureJob got:%d want:1", jobs.updates)
+	}
+}
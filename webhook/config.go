@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/sethvargo/go-envconfig"
@@ -18,31 +19,216 @@ type config struct {
 	TokenSecretName string `env:"GITHUB_TOKEN_SECRET,required"` // "{secret_name}" for same project, "projects/{project}/secrets/{secret_name}" for different project.
 
 	// Optional env vars.
-	HookID              string        `env:"HOOK_ID"`                 // Will validate against GitHub header, if provided.
-	SignatureSecretName string        `env:"GITHUB_SIGNATURE_SECRET"` // Will validate against GitHub signatures, if provided. "{secret_name}" for same project, "projects/{project}/secrets/{secret_name}" for different project.
-	JobID               string        `env:"JOB_ID,default=runner"`
-	JobTimeout          time.Duration `env:"JOB_TIMEOUT,default=10m"`
-	JobCpu              string        `env:"JOB_CPU,default=1"`
-	JobMemory           string        `env:"JOB_MEMORY,default=1Gi"`
-	Port                string        `env:"PORT,default=8080"`
-	AppClientSecretName string        `env:"GITHUB_APP_CLIENT_SECRET"`
-	AppPrivateKeyName   string        `env:"GITHUB_APP_PRIVATE_KEY"`
+	HookID               string        `env:"HOOK_ID"`                 // Will validate against GitHub header, if provided.
+	SignatureSecretName  string        `env:"GITHUB_SIGNATURE_SECRET"` // Will validate against GitHub signatures, if provided. "{secret_name}" for same project, "projects/{project}/secrets/{secret_name}" for different project.
+	JobID                string        `env:"JOB_ID,default=runner"`
+	JobTimeout           time.Duration `env:"JOB_TIMEOUT,default=10m"`
+	MaxJobTimeout        time.Duration `env:"MAX_JOB_TIMEOUT"` // The longest timeout a job can ask for with a label; $JOB_TIMEOUT if not provided.
+	JobCpu               string        `env:"JOB_CPU,default=1"`
+	JobMemory            string        `env:"JOB_MEMORY,default=1Gi"`
+	Port                 string        `env:"PORT,default=8080"`
+	AppClientSecretName  string        `env:"GITHUB_APP_CLIENT_SECRET"`
+	AppPrivateKeyName    string        `env:"GITHUB_APP_PRIVATE_KEY"`
+	OTLPEndpoint         string        `env:"OTEL_EXPORTER_OTLP_ENDPOINT"` // Traces are exported via OTLP/gRPC, if provided.
+	ArchiveURL           string        `env:"ARCHIVE_URL"`                 // Deliveries are archived, if provided. "gs://{bucket}/{prefix}" or a local directory.
+	ArchiveRetention     time.Duration `env:"ARCHIVE_RETENTION,default=168h"`
+	ForkPolicy           forkPolicy    `env:"FORK_POLICY,default=deny"` // One of: allow, deny, locked, label. See policy.go.
+	ApprovalLabel        string        `env:"APPROVAL_LABEL,default=safe-to-run"`
+	LockedServiceAccount string        `env:"LOCKED_SERVICE_ACCOUNT"` // Service account for the locked profile's job. Should have no roles.
+	PolicyFile           string        `env:"POLICY_FILE"`            // Dispatch rules in CEL, if provided. See rules.go.
+	StateURL             string        `env:"STATE_URL"`              // Job records are kept, if provided. "gs://{bucket}/{prefix}" or a local directory.
+	AdminSecretName      string        `env:"ADMIN_SECRET"`           // Bearer token for the /admin/ endpoints, which are disabled if not provided. Same format as $GITHUB_SIGNATURE_SECRET.
+	BudgetFile           string        `env:"BUDGET_FILE"`            // Budgets per repository or owner, if provided. Requires $STATE_URL. See budget.go.
+	BudgetNotifyURL      string        `env:"BUDGET_NOTIFY_URL"`      // Incoming webhook notified when a budget is exceeded, if provided.
+	WarmPoolFile         string        `env:"WARM_POOL_FILE"`         // Pools of idle runners to keep registered, if provided. See warmpool.go.
+	BatchWindow          time.Duration `env:"BATCH_WINDOW"`           // Runners for jobs of the same run queued within the window share an execution, if provided. See batch.go.
+	BatchMaxTasks        int           `env:"BATCH_MAX_TASKS,default=50"`
+	StuckJobTimeout      time.Duration `env:"STUCK_JOB_TIMEOUT"` // Runners are replaced for dispatched jobs that have not started within the timeout, if provided. See watchdog.go.
+	StuckJobRetries      int           `env:"STUCK_JOB_RETRIES,default=2"`
+	JobOwnerID           string        `env:"JOB_OWNER_ID"` // Labels the jobs this service creates, so that it can delete those it has superseded; no jobs are deleted if empty. See jobgc.go.
+	JobRetention         time.Duration `env:"JOB_RETENTION,default=24h"`
+	JobGCDryRun          bool          `env:"JOB_GC_DRY_RUN"`          // Superseded jobs are only logged, not deleted.
+	GCInterval           time.Duration `env:"GC_INTERVAL,default=10m"` // How often offline runners and orphaned executions are removed; 0 disables. See gc.go.
+	SmallJobCpu          string        `env:"SMALL_JOB_CPU,default=1"`
+	SmallJobMemory       string        `env:"SMALL_JOB_MEMORY,default=512Mi"`
+	JobTemplateFile      string        `env:"JOB_TEMPLATE_FILE"` // Cloud Run Job resource in YAML or JSON that the jobs are based on, if provided. See jobtemplate.go.
+	VPC                  vpcConfig     // $VPC_*: VPC egress for the default and small profiles, if provided. See vpc.go.
+	LockedVPC            vpcConfig     `env:",prefix=LOCKED_"`           // $LOCKED_VPC_*: VPC egress for the locked profile. All traffic must go through it if the locked profile is used.
+	SmallVPC             vpcConfig     `env:",prefix=SMALL_"`            // $SMALL_VPC_*: VPC egress for the small profile, in place of $VPC_*, if provided.
+	ServiceAccountFile   string        `env:"SERVICE_ACCOUNT_FILE"`      // Service accounts for runners per repository or owner, if provided. See serviceaccount.go.
+	VolumeFile           string        `env:"VOLUME_FILE"`               // Volumes and caches to mount in the runners, if provided. See volume.go.
+	CacheURL             string        `env:"CACHE_URL"`                 // The Actions cache is served at /cache/ and stored here, if provided. "gs://{bucket}/{prefix}" or a local directory. See cache.go.
+	CacheServiceURL      string        `env:"CACHE_SERVICE_URL"`         // This service's URL as the runners reach it. Required with $CACHE_URL.
+	CacheSecretName      string        `env:"CACHE_SECRET"`              // Key that signs the runners' cache URLs. Required with $CACHE_URL. Same format as $GITHUB_SIGNATURE_SECRET.
+	CacheRepoGiB         float64       `env:"CACHE_REPO_GIB,default=50"` // Cache size per repository; the least recently used entries are evicted beyond it.
+	RunnerEventsURL      string        `env:"RUNNER_EVENTS_URL"`         // This service's /runner/events URL as the runners reach it; runners report their lifecycle to it, if provided. See runnerevents.go.
+	EventsSecretName     string        `env:"RUNNER_EVENTS_SECRET"`      // Key that signs the runners' event tokens. Required with $RUNNER_EVENTS_URL.
+	RunnerEventsSummary  bool          `env:"RUNNER_EVENTS_SUMMARY"`     // The runner's timings are appended to each job's summary.
+	DiagURL              string        `env:"DIAG_URL"`                  // The runners' _diag logs are uploaded here, if provided. "gs://{bucket}/{prefix}" or a local directory. Requires $RUNNER_EVENTS_URL and $STATE_URL. See diag.go.
+	DiagUpload           diagUpload    `env:"DIAG_UPLOAD,default=failure"`
 
 	// Pulled from metadata.
 	Project  string
 	Location string
 
-	// JobVersion is used to ensure a unique hash for the JobID when the Cloud Run Job definition changes.
-	JobVersion string
+	// rules are loaded from PolicyFile, budgets from BudgetFile, warmPools
+	// from WarmPoolFile, serviceAccounts from ServiceAccountFile, volumes
+	// from VolumeFile and jobTemplate from JobTemplateFile. Unexported, so
+	// not part of the hash.
+	rules           *ruleSet
+	budgets         *budgetSet
+	warmPools       *warmPoolSet
+	serviceAccounts *serviceAccountSet
+	volumes         *volumeSet
+	jobTemplate     *jobTemplate
+	// cacheKey and runnerEventsKey are read from CacheSecretName and
+	// EventsSecretName when the service starts.
+	cacheKey        []byte
+	runnerEventsKey []byte
 }
 
 func newConfig(ctx context.Context) (config, error) {
-	c := config{
-		JobVersion: jobVersion,
-	}
+	var c config
 	if err := envconfig.Process(ctx, &c); err != nil {
 		return config{}, fmt.Errorf("processing envconfig: %v", err)
 	}
+	if !c.ForkPolicy.valid() {
+		return config{}, fmt.Errorf("$FORK_POLICY %q must be one of %v", c.ForkPolicy, forkPolicies)
+	}
+	if _, err := parseCPU(c.JobCpu); err != nil {
+		return config{}, fmt.Errorf("$JOB_CPU: %v", err)
+	}
+	if _, err := parseMemoryGiB(c.JobMemory); err != nil {
+		return config{}, fmt.Errorf("$JOB_MEMORY: %v", err)
+	}
+	if _, err := parseCPU(c.SmallJobCpu); err != nil {
+		return config{}, fmt.Errorf("$SMALL_JOB_CPU: %v", err)
+	}
+	if _, err := parseMemoryGiB(c.SmallJobMemory); err != nil {
+		return config{}, fmt.Errorf("$SMALL_JOB_MEMORY: %v", err)
+	}
+	if c.BatchWindow < 0 || c.BatchWindow > maxBatchWindow {
+		return config{}, fmt.Errorf("$BATCH_WINDOW %v must be between 0 and %v", c.BatchWindow, maxBatchWindow)
+	}
+	if c.BatchMaxTasks < 1 {
+		return config{}, fmt.Errorf("$BATCH_MAX_TASKS %d must be at least 1", c.BatchMaxTasks)
+	}
+	if c.MaxJobTimeout != 0 && (c.MaxJobTimeout < c.JobTimeout || c.MaxJobTimeout > maxTaskTimeout) {
+		return config{}, fmt.Errorf("$MAX_JOB_TIMEOUT %v must be between $JOB_TIMEOUT %v and %v", c.MaxJobTimeout, c.JobTimeout, maxTaskTimeout)
+	}
+	if c.StuckJobTimeout < 0 {
+		return config{}, fmt.Errorf("$STUCK_JOB_TIMEOUT %v must not be negative", c.StuckJobTimeout)
+	}
+	if c.JobOwnerID != "" && !labelValueRE.MatchString(c.JobOwnerID) {
+		return config{}, fmt.Errorf("$JOB_OWNER_ID %q must be at most 63 lowercase letters, digits, underscores and dashes", c.JobOwnerID)
+	}
+	if c.JobRetention < 0 {
+		return config{}, fmt.Errorf("$JOB_RETENTION %v must not be negative", c.JobRetention)
+	}
+	if c.GCInterval < 0 {
+		return config{}, fmt.Errorf("$GC_INTERVAL %v must not be negative", c.GCInterval)
+	}
+	if c.StuckJobRetries < 0 {
+		return config{}, fmt.Errorf("$STUCK_JOB_RETRIES %d must not be negative", c.StuckJobRetries)
+	}
+	for _, v := range []struct {
+		prefix string
+		vpc    vpcConfig
+	}{{"", c.VPC}, {"LOCKED_", c.LockedVPC}, {"SMALL_", c.SmallVPC}} {
+		if err := v.vpc.validate(v.prefix); err != nil {
+			return config{}, err
+		}
+	}
+	if c.PolicyFile != "" {
+		rules, err := loadRuleSet(c.PolicyFile)
+		if err != nil {
+			return config{}, fmt.Errorf("loading $POLICY_FILE %q: %v", c.PolicyFile, err)
+		}
+		if failures := rules.runTests(); len(failures) > 0 {
+			return config{}, fmt.Errorf("$POLICY_FILE %q tests failed:\n%s", c.PolicyFile, strings.Join(failures, "\n"))
+		}
+		c.rules = rules
+	}
+	if c.BudgetFile != "" {
+		if c.StateURL == "" {
+			return config{}, errors.New("$BUDGET_FILE requires $STATE_URL, where spend is recorded")
+		}
+		budgets, err := loadBudgetSet(c.BudgetFile)
+		if err != nil {
+			return config{}, fmt.Errorf("loading $BUDGET_FILE %q: %v", c.BudgetFile, err)
+		}
+		c.budgets = budgets
+	}
+	if c.WarmPoolFile != "" {
+		if c.StateURL == "" {
+			return config{}, errors.New("$WARM_POOL_FILE requires $STATE_URL, where instances share their claims on warm runners")
+		}
+		pools, err := loadWarmPoolSet(c.WarmPoolFile, repoFromURL(c.RepositoryURL))
+		if err != nil {
+			return config{}, fmt.Errorf("loading $WARM_POOL_FILE %q: %v", c.WarmPoolFile, err)
+		}
+		c.warmPools = pools
+		// GitHub gives a queued job to any idle runner with its labels, so a
+		// warm runner would take jobs the policy denies or locks down.
+		if c.ForkPolicy != forkPolicyAllow || c.rules.canDeny() || c.rules.usesProfile(profileLocked) {
+			return config{}, errors.New("$WARM_POOL_FILE requires $FORK_POLICY=allow and a $POLICY_FILE, if any, that neither denies jobs nor routes them to the locked profile")
+		}
+	}
+	if c.ServiceAccountFile != "" {
+		accounts, err := loadServiceAccountSet(c.ServiceAccountFile)
+		if err != nil {
+			return config{}, fmt.Errorf("loading $SERVICE_ACCOUNT_FILE %q: %v", c.ServiceAccountFile, err)
+		}
+		c.serviceAccounts = accounts
+	}
+	if c.LockedServiceAccount == "" && slices.Contains(jobProfiles(c), profileLocked) {
+		// Otherwise untrusted code would run as the default compute service
+		// account, which usually has the Editor role.
+		return config{}, errors.New("$LOCKED_SERVICE_ACCOUNT is required when $FORK_POLICY is locked or $POLICY_FILE routes jobs to the locked profile")
+	}
+	if c.LockedVPC.Egress != vpcEgressAll && slices.Contains(jobProfiles(c), profileLocked) {
+		// Otherwise untrusted code would have Cloud Run's unrestricted
+		// internet egress. The network's firewall rules and Cloud NAT decide
+		// what it can reach.
+		return config{}, errors.New("$LOCKED_VPC_EGRESS=all-traffic, through $LOCKED_VPC_NETWORK, $LOCKED_VPC_SUBNETWORK or $LOCKED_VPC_CONNECTOR, is required when $FORK_POLICY is locked or $POLICY_FILE routes jobs to the locked profile")
+	}
+	if c.VolumeFile != "" {
+		volumes, err := loadVolumeSet(c.VolumeFile)
+		if err != nil {
+			return config{}, fmt.Errorf("loading $VOLUME_FILE %q: %v", c.VolumeFile, err)
+		}
+		c.volumes = volumes
+	}
+	if c.CacheURL != "" {
+		if c.CacheServiceURL == "" || c.CacheSecretName == "" {
+			return config{}, errors.New("$CACHE_URL requires $CACHE_SERVICE_URL and $CACHE_SECRET")
+		}
+		if u, err := url.Parse(c.CacheServiceURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return config{}, fmt.Errorf("$CACHE_SERVICE_URL %q must be an http(s) URL", c.CacheServiceURL)
+		}
+		if c.CacheRepoGiB <= 0 {
+			return config{}, fmt.Errorf("$CACHE_REPO_GIB %v must be positive", c.CacheRepoGiB)
+		}
+	}
+	if c.RunnerEventsURL != "" {
+		if c.EventsSecretName == "" {
+			return config{}, errors.New("$RUNNER_EVENTS_URL requires $RUNNER_EVENTS_SECRET")
+		}
+		if u, err := url.Parse(c.RunnerEventsURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return config{}, fmt.Errorf("$RUNNER_EVENTS_URL %q must be an http(s) URL", c.RunnerEventsURL)
+		}
+	}
+	if c.DiagURL != "" {
+		if c.RunnerEventsURL == "" {
+			return config{}, errors.New("$DIAG_URL requires $RUNNER_EVENTS_URL, which the runners upload through")
+		}
+		if c.StateURL == "" {
+			return config{}, errors.New("$DIAG_URL requires $STATE_URL, whose job records uploads are checked against")
+		}
+		if c.DiagUpload != diagUploadAlways && c.DiagUpload != diagUploadFailure {
+			return config{}, fmt.Errorf("$DIAG_UPLOAD %q must be %q or %q", c.DiagUpload, diagUploadAlways, diagUploadFailure)
+		}
+	}
 
 	var err error
 	if c.Project, err = projectID(ctx); err != nil {
@@ -52,17 +238,27 @@ func newConfig(ctx context.Context) (config, error) {
 		return config{}, fmt.Errorf("fetching location from metadata server: %v", err)
 	}
 
-	// Hash the config and use it as the suffix to the JobID.
-	// The ensures a new job is created when the env var settings change.
-	b, err := json.Marshal(c)
+	// The job IDs end in a hash of the job definitions, so that a change to
+	// them, in the settings, the template or the code, creates new jobs
+	// rather than changing the jobs that other revisions use. The template
+	// is checked again once the job IDs, which it may use, are final.
+	if c.JobTemplateFile != "" {
+		tmpl, err := loadJobTemplate(c.JobTemplateFile)
+		if err != nil {
+			return config{}, fmt.Errorf("loading $JOB_TEMPLATE_FILE %q: %v", c.JobTemplateFile, err)
+		}
+		c.jobTemplate = tmpl
+	}
+	hash, err := jobsHash(c)
 	if err != nil {
-		return config{}, fmt.Errorf("marshalling config: %v", err)
+		return config{}, err
 	}
-	h := md5.New()
-	if _, err := io.WriteString(h, string(b)); err != nil {
-		return config{}, fmt.Errorf("writing to hash: %v", err)
+	c.JobID += "-" + hash
+	if c.jobTemplate != nil {
+		if err := c.jobTemplate.validate(c); err != nil {
+			return config{}, fmt.Errorf("$JOB_TEMPLATE_FILE %q: %v", c.JobTemplateFile, err)
+		}
 	}
-	c.JobID += fmt.Sprintf("-%x", h.Sum(nil))
 
 	logInfo("Config: %#v", c)
 	return c, nil
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// diagUpload is when runners upload their diagnostic logs, which are in
+// _diag in the runner's directory and are lost with the container.
+type diagUpload string
+
+const (
+	diagUploadAlways  diagUpload = "always"
+	diagUploadFailure diagUpload = "failure" // When config.sh or the runner exits non-zero.
+
+	runnerDiagURLEnvVar = "RUNNER_DIAG_URL"
+
+	maxDiagSize = 64 << 20
+)
+
+// runnerDiagCommand returns the part of the container's command that uploads
+// _diag as a gzipped tar to $RUNNER_DIAG_URL, once the runner has exited
+// with $status, if upload says to. Like the events, a failed upload is only
+// logged.
+func runnerDiagCommand(upload diagUpload) string {
+	cond := `[ "$status" -ne 0 ]`
+	if upload == diagUploadAlways {
+		cond = "true"
+	}
+	return fmt.Sprintf(`if %s && [ -n "$%s" ] && [ -d _diag ]; then `+
+		`tar -czf /tmp/cr-runner/diag.tar.gz _diag && `+
+		`curl -fsS --max-time 60 -H "Authorization: Bearer $%[2]s" -H "Content-Type: application/gzip" --data-binary @/tmp/cr-runner/diag.tar.gz `+
+		`"$%[3]s?execution=$CLOUD_RUN_EXECUTION&task=${CLOUD_RUN_TASK_INDEX:-0}&repository=$%[4]s&run_id=${%[5]s:-0}&job_id=${%[6]s:-0}" `+
+		`|| echo "Uploading _diag to $%[3]s failed." >&2; fi`,
+		cond, runnerEventsTokenEnvVar, runnerDiagURLEnvVar, repositoryEnvVar, runIDEnvVar, jobIDEnvVar)
+}
+
+// runnerDiagURL is where runners upload _diag: /runner/diag, next to
+// $RUNNER_EVENTS_URL.
+func runnerDiagURL(eventsURL string) string {
+	u, err := url.Parse(eventsURL)
+	if err != nil {
+		return ""
+	}
+	return u.ResolveReference(&url.URL{Path: "diag"}).String()
+}
+
+// diagStore keeps the runners' diagnostic logs in a blobStore, as
+// "executions/{execution ID}/{task index}.tar.gz". For runners started for
+// a single workflow job, "jobs/{job ID}" holds the key of its logs.
+type diagStore struct {
+	store blobStore
+}
+
+func newDiagStore(store blobStore) *diagStore {
+	return &diagStore{store: store}
+}
+
+func diagKey(execution string, task int) string {
+	return fmt.Sprintf("executions/%s/%d.tar.gz", execution, task)
+}
+
+func (s *diagStore) put(ctx context.Context, execution string, task, jobID int, data []byte) error {
+	key := diagKey(execution, task)
+	if err := s.store.put(ctx, key, data); err != nil {
+		return fmt.Errorf("storing diagnostic logs: %v", err)
+	}
+	if jobID != 0 {
+		if err := s.store.put(ctx, fmt.Sprintf("jobs/%d", jobID), []byte(key)); err != nil {
+			return fmt.Errorf("indexing diagnostic logs: %v", err)
+		}
+	}
+	return nil
+}
+
+// forJob returns the logs of the runner started for the workflow job, and
+// the execution's key; errBlobNotFound if there are none.
+func (s *diagStore) forJob(ctx context.Context, jobID int) ([]byte, string, error) {
+	key, err := s.store.get(ctx, fmt.Sprintf("jobs/%d", jobID))
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := s.store.get(ctx, string(key))
+	return data, string(key), err
+}
+
+// forExecution returns the logs of the execution's task; errBlobNotFound if
+// there are none.
+func (s *diagStore) forExecution(ctx context.Context, execution string, task int) ([]byte, error) {
+	return s.store.get(ctx, diagKey(execution, task))
+}
+
+// diag stores the _diag a runner uploads to /runner/diag, with the token
+// its execution was started with. The execution's job record must be for
+// the token's repository and run, and for the workflow job, if any, so that
+// a runner cannot store logs for, or index logs as, another's.
+func (h runnerhandler) diag() {
+	if h.diagStore == nil {
+		http.Error(h.w, "Diagnostic logs are not kept; set $DIAG_URL to keep them.", http.StatusNotFound)
+		return
+	}
+	if h.r.Method != http.MethodPost {
+		http.Error(h.w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(h.r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		h.w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(h.w, "Missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	scope, ok := parseRunnerEventsToken(h.config.runnerEventsKey, token, time.Now())
+	if !ok {
+		logWarn("Rejected diagnostic logs: bad or expired token.")
+		http.Error(h.w, "Bad or expired token", http.StatusForbidden)
+		return
+	}
+
+	q := h.r.URL.Query()
+	execution, repo := q.Get("execution"), q.Get("repository")
+	task, err1 := strconv.Atoi(q.Get("task"))
+	runID, err2 := strconv.ParseInt(q.Get("run_id"), 10, 64)
+	jobID, err3 := strconv.Atoi(q.Get("job_id"))
+	switch {
+	case !executionIDRE.MatchString(execution) || errors.Join(err1, err2, err3) != nil || task < 0 || jobID < 0:
+		http.Error(h.w, "execution, task, repository, run_id and job_id are required", http.StatusBadRequest)
+		return
+	case !scope.allows(repo, runID):
+		logWarn("Rejected diagnostic logs from execution %q: token is not for %s run %d.", execution, repo, runID)
+		http.Error(h.w, "Token is not for the logs' repository and run", http.StatusForbidden)
+		return
+	}
+	rec, err := h.records.find(h.r.Context(), execution, time.Now())
+	if err != nil {
+		logError("Error: finding the job record of execution %q: %v", execution, err)
+		http.Error(h.w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	if rec == nil || !recordedFor(*rec, scope) || task >= max(rec.Tasks, 1) || jobID != 0 && (rec.Tasks > 1 || jobID != rec.WorkflowJobID) {
+		logWarn("Rejected diagnostic logs from execution %q, task %d, for %s run %d job %d: no such runner was started.", execution, task, repo, runID, jobID)
+		http.Error(h.w, "No runner was started for the logs' execution, task and job with the token", http.StatusForbidden)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(h.w, h.r.Body, maxDiagSize))
+	if err != nil {
+		http.Error(h.w, fmt.Sprintf("Reading logs: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.diagStore.put(h.r.Context(), execution, task, jobID, data); err != nil {
+		logError("Error: diagnostic logs of execution %q: %v", execution, err)
+		http.Error(h.w, "Server error", http.StatusInternalServerError)
+		return
+	}
+	logInfo("Stored diagnostic logs of execution %s, task %d, for %s run %d job %d (%d bytes).", execution, task, repo, runID, jobID, len(data))
+	h.w.WriteHeader(http.StatusNoContent)
+}
+
+// diag returns a runner's diagnostic logs as a gzipped tar, e.g.,
+// /admin/diag?job_id=123, or /admin/diag?execution=runner-abc-x7k2p&task=0
+// for runners not started for a single workflow job.
+func (h adminhandler) diag() {
+	if !h.authorized() {
+		return
+	}
+	if h.diagStore == nil {
+		http.Error(h.w, "Diagnostic logs are not kept; set $DIAG_URL to keep them.", http.StatusNotFound)
+		return
+	}
+	ctx := h.r.Context()
+	q := h.r.URL.Query()
+	var data []byte
+	var name string
+	var err error
+	switch {
+	case q.Get("job_id") != "":
+		jobID, perr := strconv.Atoi(q.Get("job_id"))
+		if perr != nil || jobID <= 0 {
+			h.clientError("bad job_id %q", q.Get("job_id"))
+			return
+		}
+		var key string
+		data, key, err = h.diagStore.forJob(ctx, jobID)
+		name = strings.ReplaceAll(strings.TrimSuffix(strings.TrimPrefix(key, "executions/"), ".tar.gz"), "/", "-")
+	case q.Get("execution") != "":
+		execution := q.Get("execution")
+		task, perr := strconv.Atoi(q.Get("task"))
+		if q.Get("task") == "" {
+			task, perr = 0, nil
+		}
+		if !executionIDRE.MatchString(execution) || perr != nil || task < 0 {
+			h.clientError("bad execution %q or task %q", execution, q.Get("task"))
+			return
+		}
+		data, err = h.diagStore.forExecution(ctx, execution, task)
+		name = fmt.Sprintf("%s-%d", execution, task)
+	default:
+		h.clientError("job_id or execution is required")
+		return
+	}
+	if errors.Is(err, errBlobNotFound) {
+		http.Error(h.w, "No diagnostic logs found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.serverError("reading diagnostic logs: %v", err)
+		return
+	}
+	h.w.Header().Set("Content-Type", "application/gzip")
+	h.w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-diag.tar.gz"`, name))
+	h.w.Write(data)
+}
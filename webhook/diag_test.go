@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiagJob(t *testing.T) {
+	config := testConfig()
+	config.RunnerEventsURL, config.runnerEventsKey = "https://gha-runner.example.com/runner/events", []byte("key")
+	for _, tc := range []struct {
+		diagURL string
+		upload  diagUpload
+		want    string // In the command; empty for no upload.
+	}{
+		{},
+		{diagURL: "gs://logs/diag", upload: diagUploadFailure, want: `if [ "$status" -ne 0 ] && [ -n "$RUNNER_EVENTS_TOKEN" ]`},
+		{diagURL: "gs://logs/diag", upload: diagUploadAlways, want: `if true && [ -n "$RUNNER_EVENTS_TOKEN" ]`},
+	} {
+		config.DiagURL, config.DiagUpload = tc.diagURL, tc.upload
+		req, err := (&cloudRunJob{config: config}).createJobRequest()
+		if err != nil {
+			t.Fatalf("createJobRequest() failed: %v", err)
+		}
+		runner := req.Job.Template.Template.Containers[0]
+		command := runner.Args[2]
+		var diagURL string
+		for _, e := range runner.Env {
+			if e.Name == runnerDiagURLEnvVar {
+				diagURL = e.GetValue()
+			}
+		}
+		if tc.want == "" {
+			if strings.Contains(command, "_diag") || diagURL != "" {
+				t.Errorf("no $DIAG_URL: command uploads _diag to %q: %s", diagURL, command)
+			}
+			continue
+		}
+		if !strings.Contains(command, tc.want) || !strings.HasSuffix(command, "exit $status") {
+			t.Errorf("%s: command got:%s want:%q", tc.upload, command, tc.want)
+		}
+		if want := "https://gha-runner.example.com/runner/diag"; diagURL != want {
+			t.Errorf("%s: %s got:%q want:%q", tc.upload, runnerDiagURLEnvVar, diagURL, want)
+		}
+	}
+}
+
+func TestDiag(t *testing.T) {
+	store, err := newBlobStore(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	diag := newDiagStore(store)
+	records := newJobStore(store)
+	now := time.Now()
+	for _, r := range []jobRecord{
+		{Execution: "runner-abc-x7k2p", Repository: "Owner/Repo", RunID: 42, WorkflowJobID: 7, Dispatched: now},
+		{Execution: "runner-abc-b4tch", Repository: "Owner/Repo", RunID: 42, WorkflowJobID: 5, Tasks: 2, Dispatched: now},
+		{Execution: "runner-abc-other", Repository: "someone/else", RunID: 42, WorkflowJobID: 9, Dispatched: now},
+	} {
+		if err := records.put(context.Background(), r); err != nil {
+			t.Fatalf("put() failed: %v", err)
+		}
+	}
+	config := testConfig()
+	config.AdminSecretName = testSignatureSecret
+	config.RunnerEventsURL, config.runnerEventsKey = "https://gha-runner.example.com/runner/events", []byte("key")
+	clients, _ := testClients(t, config)
+	token := runnerEventsToken(config.runnerEventsKey, runnerEventsScope{Repo: "owner/repo", RunID: 42, Expires: now.Add(time.Hour).Unix()})
+	expired := runnerEventsToken(config.runnerEventsKey, runnerEventsScope{Repo: "owner/repo", RunID: 42, Expires: now.Add(-time.Second).Unix()})
+
+	upload := func(token, query, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/runner/diag?"+query, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		runnerhandler{w: w, r: r, config: config, records: records, diagStore: diag}.diag()
+		return w.Code
+	}
+	fetch := func(query string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/admin/diag?"+query, nil)
+		r.Header.Set("Authorization", "Bearer "+testSecretValue)
+		w := httptest.NewRecorder()
+		adminhandler{clients: clients, w: w, r: r, config: config, diagStore: diag}.diag()
+		return w
+	}
+
+	if got := upload(token, "execution=runner-abc-x7k2p&task=0&repository=owner/repo&run_id=42&job_id=7", "job 7 logs"); got != http.StatusNoContent {
+		t.Fatalf("uploading: status got:%d want:%d", got, http.StatusNoContent)
+	}
+	if got := upload(token, "execution=runner-abc-b4tch&task=1&repository=owner/repo&run_id=42&job_id=0", "batch task 1 logs"); got != http.StatusNoContent {
+		t.Fatalf("uploading a batch's: status got:%d want:%d", got, http.StatusNoContent)
+	}
+	for name, tc := range map[string]struct {
+		token, query string
+		want         int
+	}{
+		"bad token":                    {token: token + "x", query: "execution=runner-abc-x7k2p&task=0&repository=owner/repo&run_id=42&job_id=8", want: http.StatusForbidden},
+		"expired token":                {token: expired, query: "execution=runner-abc-x7k2p&task=0&repository=owner/repo&run_id=42&job_id=7", want: http.StatusForbidden},
+		"other run":                    {token: token, query: "execution=runner-abc-x7k2p&task=0&repository=owner/repo&run_id=43&job_id=8", want: http.StatusForbidden},
+		"bad execution":                {token: token, query: "execution=../../jobs&task=0&repository=owner/repo&run_id=42&job_id=8", want: http.StatusBadRequest},
+		"missing task":                 {token: token, query: "execution=runner-abc-x7k2p&repository=owner/repo&run_id=42&job_id=8", want: http.StatusBadRequest},
+		"other job":                    {token: token, query: "execution=runner-abc-x7k2p&task=0&repository=owner/repo&run_id=42&job_id=8", want: http.StatusForbidden},
+		"other task":                   {token: token, query: "execution=runner-abc-x7k2p&task=1&repository=owner/repo&run_id=42&job_id=7", want: http.StatusForbidden},
+		"batch job":                    {token: token, query: "execution=runner-abc-b4tch&task=0&repository=owner/repo&run_id=42&job_id=5", want: http.StatusForbidden},
+		"unknown execution":            {token: token, query: "execution=runner-abc-zzzzz&task=0&repository=owner/repo&run_id=42&job_id=0", want: http.StatusForbidden},
+		"other repository's execution": {token: token, query: "execution=runner-abc-other&task=0&repository=owner/repo&run_id=42&job_id=9", want: http.StatusForbidden},
+	} {
+		if got := upload(tc.token, tc.query, "forged"); got != tc.want {
+			t.Errorf("%s: status got:%d want:%d", name, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		query      string
+		wantStatus int
+		wantBody   string
+	}{
+		{query: "job_id=7", wantStatus: http.StatusOK, wantBody: "job 7 logs"},
+		{query: "execution=runner-abc-b4tch&task=1", wantStatus: http.StatusOK, wantBody: "batch task 1 logs"},
+		{query: "execution=runner-abc-x7k2p", wantStatus: http.StatusOK, wantBody: "job 7 logs"},
+		{query: "job_id=8", wantStatus: http.StatusNotFound},
+		{query: "job_id=9", wantStatus: http.StatusNotFound},
+		{query: "execution=runner-abc-other", wantStatus: http.StatusNotFound},
+		{query: "execution=runner-abc-b4tch&task=0", wantStatus: http.StatusNotFound},
+		{query: "job_id=x", wantStatus: http.StatusBadRequest},
+		{query: "", wantStatus: http.StatusBadRequest},
+	} {
+		w := fetch(tc.query)
+		if w.Code != tc.wantStatus || tc.wantBody != "" && w.Body.String() != tc.wantBody {
+			t.Errorf("%q: got:%d %q want:%d %q", tc.query, w.Code, w.Body.String(), tc.wantStatus, tc.wantBody)
+		}
+	}
+	if got := fetch("job_id=7").Header().Get("Content-Disposition"); got != `attachment; filename="runner-abc-x7k2p-0-diag.tar.gz"` {
+		t.Errorf("Content-Disposition got:%q", got)
+	}
+}
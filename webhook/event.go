@@ -3,42 +3,115 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
-	// actionCompleted  = "completed"
-	// actionInProgress = "in_progress"
-	actionQueued  = "queued"
-	actionCreated = "created"
-	// actionWaiting    = "waiting"
-
-	// jobStatusQueued     = "queued"
-	// jobStatusInProgress = "in_progress"
-	// jobStatusCompleted  = "completed"
-	// jobStatusWaiting    = "waiting"
-
-	// stepConclusionFailure   = "failure"
-	// stepConclusionSkipped   = "skipped"
-	// stepConclusionSuccess   = "success"
-	// stepConclusionCancelled = "cancelled"
-	// stepConclusionNull      = "null"
-
-	// stepStatusCompleted  = "completed"
-	// stepStatusInProgress = "in_progress"
-	// stepStatusQueued     = "queued"
-	// stepStatusPending    = "pending"
-	// stepStatusWaiting    = "waiting"
+	actionCompleted  = "completed"
+	actionInProgress = "in_progress"
+	actionQueued     = "queued"
+	actionWaiting    = "waiting"
+	actionCreated    = "created"
+
+	actionDeleted   = "deleted"
+	actionSuspend   = "suspend"
+	actionUnsuspend = "unsuspend"
+	actionAdded     = "added"
+	actionRemoved   = "removed"
+)
+
+// status is the status of a workflow job, step or run.
+type status string
+
+const (
+	statusRequested  status = "requested" // Runs only.
+	statusQueued     status = "queued"
+	statusInProgress status = "in_progress"
+	statusCompleted  status = "completed"
+	statusWaiting    status = "waiting"
+	statusPending    status = "pending" // Steps only.
+)
+
+// conclusion is the outcome of a completed workflow job, step or run. It is
+// null in the payload until the status is completed, so fields of this type
+// are pointers.
+type conclusion string
+
+const (
+	conclusionSuccess        conclusion = "success"
+	conclusionFailure        conclusion = "failure"
+	conclusionCancelled      conclusion = "cancelled"
+	conclusionSkipped        conclusion = "skipped"
+	conclusionNeutral        conclusion = "neutral"
+	conclusionTimedOut       conclusion = "timed_out"
+	conclusionActionRequired conclusion = "action_required"
 )
 
+// String returns the conclusion, or "null" if there is none yet.
+func (c *conclusion) String() string {
+	if c == nil {
+		return "null"
+	}
+	return string(*c)
+}
+
+// timestamp is a time sent by GitHub, either as an RFC 3339 string (e.g.,
+// "2023-06-11T22:08:00Z", "2023-07-25T15:29:55.000-07:00") or, in some
+// payloads, as Unix seconds. Fields that GitHub sends as null are *timestamp.
+type timestamp struct {
+	time.Time
+}
+
+func (t *timestamp) UnmarshalJSON(b []byte) error {
+	s := string(b)
+	if s == "null" || s == `""` {
+		t.Time = time.Time{}
+		return nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		t.Time = time.Unix(secs, 0).UTC()
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(b, &str); err != nil {
+		return fmt.Errorf("timestamp must be a string or integer, got %s", s)
+	}
+	parsed, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return fmt.Errorf("parsing timestamp: %v", err)
+	}
+	t.Time = parsed
+	return nil
+}
+
+func (t timestamp) MarshalJSON() ([]byte, error) {
+	if t.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(t.Time.Format(time.RFC3339))
+}
+
 func parseEvent(body []byte) (*event, error) {
 	// logInfo("Raw event:\n%s\n", string(body))
 	var e event
-	if err := json.Unmarshal(body, &e); err != nil {
-		return nil, fmt.Errorf("unmarshalling json: %v", err)
+	if err := parsePayload(body, &e); err != nil {
+		return nil, err
 	}
 	return &e, nil
 }
 
+// parsePayload unmarshals a webhook body into one of the typed event models.
+func parsePayload(body []byte, v any) error {
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("unmarshalling json: %v", err)
+	}
+	return nil
+}
+
+// event holds the fields of interest from any webhook payload. Sample
+// payloads are in testdata/.
 type event struct {
 	Action       string            `json:"action"`
 	Sender       gitHubUser        `json:"sender"`
@@ -50,92 +123,6 @@ type event struct {
 	// Deployment   eventDeployment   `json:"deployment"`
 }
 
-/*
-  App Installation event:
-
-{
-  "action": "created",
-  "installation": {
-    "id": 40041419,
-    "account": {
-      "login": "squee1945",
-      "id": 1146523,
-      "node_id": "MDQ6VXNlcjExNDY1MjM=",
-      "avatar_url": "https://avatars.githubusercontent.com/u/1146523?v=4",
-      "gravatar_id": "",
-      "url": "https://api.github.com/users/squee1945",
-      "html_url": "https://github.com/squee1945",
-      "followers_url": "https://api.github.com/users/squee1945/followers",
-      "following_url": "https://api.github.com/users/squee1945/following{/other_user}",
-      "gists_url": "https://api.github.com/users/squee1945/gists{/gist_id}",
-      "starred_url": "https://api.github.com/users/squee1945/starred{/owner}{/repo}",
-      "subscriptions_url": "https://api.github.com/users/squee1945/subscriptions",
-      "organizations_url": "https://api.github.com/users/squee1945/orgs",
-      "repos_url": "https://api.github.com/users/squee1945/repos",
-      "events_url": "https://api.github.com/users/squee1945/events{/privacy}",
-      "received_events_url": "https://api.github.com/users/squee1945/received_events",
-      "type": "User",
-      "site_admin": false
-    },
-    "repository_selection": "selected",
-    "access_tokens_url": "https://api.github.com/app/installations/40041419/access_tokens",
-    "repositories_url": "https://api.github.com/installation/repositories",
-    "html_url": "https://github.com/settings/installations/40041419",
-    "app_id": 366691,
-    "app_slug": "actions-runner-experiment",
-    "target_id": 1146523,
-    "target_type": "User",
-    "permissions": {
-      "actions": "write",
-      "metadata": "read",
-      "administration": "write"
-    },
-    "events": [
-      "workflow_job"
-    ],
-    "created_at": "2023-07-25T15:29:55.000-07:00",
-    "updated_at": "2023-07-25T15:29:55.000-07:00",
-    "single_file_name": null,
-    "has_multiple_single_files": false,
-    "single_file_paths": [
-
-    ],
-    "suspended_by": null,
-    "suspended_at": null
-  },
-  "repositories": [
-    {
-      "id": 652279005,
-      "node_id": "R_kgDOJuD83Q",
-      "name": "self-hosted-runner",
-      "full_name": "squee1945/self-hosted-runner",
-      "private": false
-    }
-  ],
-  "requester": null,
-  "sender": {
-    "login": "squee1945",
-    "id": 1146523,
-    "node_id": "MDQ6VXNlcjExNDY1MjM=",
-    "avatar_url": "https://avatars.githubusercontent.com/u/1146523?v=4",
-    "gravatar_id": "",
-    "url": "https://api.github.com/users/squee1945",
-    "html_url": "https://github.com/squee1945",
-    "followers_url": "https://api.github.com/users/squee1945/followers",
-    "following_url": "https://api.github.com/users/squee1945/following{/other_user}",
-    "gists_url": "https://api.github.com/users/squee1945/gists{/gist_id}",
-    "starred_url": "https://api.github.com/users/squee1945/starred{/owner}{/repo}",
-    "subscriptions_url": "https://api.github.com/users/squee1945/subscriptions",
-    "organizations_url": "https://api.github.com/users/squee1945/orgs",
-    "repos_url": "https://api.github.com/users/squee1945/repos",
-    "events_url": "https://api.github.com/users/squee1945/events{/privacy}",
-    "received_events_url": "https://api.github.com/users/squee1945/received_events",
-    "type": "User",
-    "site_admin": false
-  }
-}
-*/
-
 // https://docs.github.com/en/rest/repos/repos?apiVersion=2022-11-28#get-a-repository
 /*
   "repository": {
@@ -221,15 +208,21 @@ type event struct {
   },
 */
 type eventRepository struct {
-	ID       int    `json:"id"`        // "id": 1296269,
-	NodeID   string `json:"node_id"`   // "node_id": "MDEwOlJlcG9zaXRvcnkxMjk2MjY5",
-	Name     string `json:"name"`      // "name": "Hello-World",
-	FullName string `json:"full_name"` // "full_name": "octocat/Hello-World",
-	HtmlURL  string `json:"html_url"`  // "html_url": "https://github.com/squee1945/self-hosted-runner"
+	ID       int        `json:"id"`        // "id": 1296269,
+	NodeID   string     `json:"node_id"`   // "node_id": "MDEwOlJlcG9zaXRvcnkxMjk2MjY5",
+	Name     string     `json:"name"`      // "name": "Hello-World",
+	FullName string     `json:"full_name"` // "full_name": "octocat/Hello-World",
+	HtmlURL  string     `json:"html_url"`  // "html_url": "https://github.com/squee1945/self-hosted-runner"
+	Private  bool       `json:"private"`   // "private": false,
+	Fork     bool       `json:"fork"`      // "fork": false,
+	Owner    gitHubUser `json:"owner"`
+
+	DefaultBranch string `json:"default_branch"` // "default_branch": "main"
 }
 
 // https://docs.github.com/en/rest/orgs/orgs?apiVersion=2022-11-28#get-an-organization
 type eventOrganization struct {
+	Login  string `json:"login"`   // "login": "github",
 	ID     int    `json:"id"`      // "id": 1,
 	NodeID string `json:"node_id"` // "node_id": "MDEyOk9yZ2FuaXphdGlvbjE=",
 	URL    string `json:"url"`     // "url": "https://api.github.com/orgs/github",
@@ -275,41 +268,47 @@ type eventWorkflowJob struct {
 	HeadSHA         string              `json:"head_sha"`
 	URL             string              `json:"url"`
 	HtmlURL         string              `json:"html_url"`
-	Status          string              `json:"status"` // One of: queued, in_progress, completed, waiting
-	Conclusion      string              `json:"conclusion"`
-	CreatedAt       string              `json:"created_at"`
-	StartedAt       string              `json:"started_at"`
-	CompletedAt     string              `json:"completed_at"` // "2011-01-26T19:06:43Z"
+	Status          status              `json:"status"` // One of: queued, in_progress, completed, waiting
+	Conclusion      *conclusion         `json:"conclusion"`
+	CreatedAt       timestamp           `json:"created_at"`
+	StartedAt       timestamp           `json:"started_at"`
+	CompletedAt     *timestamp          `json:"completed_at"` // "2011-01-26T19:06:43Z"
 	Name            string              `json:"name"`
 	Steps           []eventWorkflowStep `json:"steps"`
 	CheckRunURL     string              `json:"check_run_url"`
 	Labels          []string            `json:"labels"`
-	RunnerID        int                 `json:"runner_id"`
+	RunnerID        *int64              `json:"runner_id"`
 	RunnerName      string              `json:"runner_name"`
-	RunnerGroupID   int                 `json:"runner_group_id"`
+	RunnerGroupID   *int64              `json:"runner_group_id"`
 	RunnerGroupName string              `json:"runner_group_name"`
 }
 
-// https://docs.github.com/en/webhooks-and-events/webhooks/webhook-events-and-payloads?actionType=waiting#workflow_job
-/*
-{
-	{CompletedAt:"2023-06-11T22:34:45.000Z", Conclusion:"success", Name:"Set up job", Number:1, StartedAt:"2023-06-11T22:34:43.000Z", Status:"completed"},
-	{CompletedAt:"2023-06-11T22:34:46.000Z", Conclusion:"success", Name:"Run actions/checkout@v3", Number:2, StartedAt:"2023-06-11T22:34:45.000Z", Status:"completed"},
-	{CompletedAt:"2023-06-11T22:34:53.000Z", Conclusion:"success", Name:"Set up Go", Number:3, StartedAt:"2023-06-11T22:34:47.000Z", Status:"completed"},
-	{CompletedAt:"2023-06-11T22:34:54.000Z", Conclusion:"success", Name:"Build", Number:4, StartedAt:"2023-06-11T22:34:53.000Z", Status:"completed"},
-	{CompletedAt:"2023-06-11T22:34:55.000Z", Conclusion:"success", Name:"Test", Number:5, StartedAt:"2023-06-11T22:34:54.000Z", Status:"completed"},
-	{CompletedAt:"2023-06-11T22:34:56.000Z", Conclusion:"success", Name:"Post Set up Go", Number:9, StartedAt:"2023-06-11T22:34:56.000Z", Status:"completed"},
-	{CompletedAt:"2023-06-11T22:34:56.000Z", Conclusion:"success", Name:"Post Run actions/checkout@v3", Number:10, StartedAt:"2023-06-11T22:34:56.000Z", Status:"completed"},
-	{CompletedAt:"2023-06-11T22:34:56.000Z", Conclusion:"success", Name:"Complete job", Number:11, StartedAt:"2023-06-11T22:34:55.000Z", Status:"completed"},
+// queueDuration is how long the job waited for a runner. It is only known
+// once the job has started.
+func (j eventWorkflowJob) queueDuration() (time.Duration, bool) {
+	if j.Status == statusQueued || j.Status == statusWaiting || j.StartedAt.IsZero() || j.CreatedAt.IsZero() {
+		return 0, false
+	}
+	return j.StartedAt.Sub(j.CreatedAt.Time), true
 }
-*/
+
+// runDuration is how long the job ran on the runner. It is only known once
+// the job has completed.
+func (j eventWorkflowJob) runDuration() (time.Duration, bool) {
+	if j.CompletedAt == nil || j.CompletedAt.IsZero() || j.StartedAt.IsZero() {
+		return 0, false
+	}
+	return j.CompletedAt.Sub(j.StartedAt.Time), true
+}
+
+// https://docs.github.com/en/webhooks-and-events/webhooks/webhook-events-and-payloads?actionType=waiting#workflow_job
 type eventWorkflowStep struct {
-	CompletedAt string `json:"completed_at"`
-	Conclusion  string `json:"conclusion"` // One of: failure, skipped, success, cancelled, null
-	Name        string `json:"name"`
-	Number      int    `json:"number"`
-	StartedAt   string `json:"started_at"`
-	Status      string `json:"status"` // One of: completed, in_progress, queued, pending, waiting
+	CompletedAt *timestamp  `json:"completed_at"`
+	Conclusion  *conclusion `json:"conclusion"` // One of: failure, skipped, success, cancelled, null
+	Name        string      `json:"name"`
+	Number      int         `json:"number"`
+	StartedAt   *timestamp  `json:"started_at"`
+	Status      status      `json:"status"` // One of: completed, in_progress, queued, pending, waiting
 }
 
 // type eventDeployment struct {
@@ -382,159 +381,6 @@ type gitHubUser struct {
 	StarredAt string `json:"starred_at"`
 }
 
-/*
-{
-  "action": "queued",
-  "workflow_job": {
-    "id": 14171575672,
-    "run_id": 5237732760,
-    "workflow_name": "Go",
-    "head_branch": "main",
-    "run_url": "https://api.github.com/repos/squee1945/self-hosted-runner/actions/runs/5237732760",
-    "run_attempt": 1,
-    "node_id": "CR_kwDOJuD83c8AAAADTLEVeA",
-    "head_sha": "720bd4aae6521bfce13488b41b93919c64088420",
-    "url": "https://api.github.com/repos/squee1945/self-hosted-runner/actions/jobs/14171575672",
-    "html_url": "https://github.com/squee1945/self-hosted-runner/actions/runs/5237732760/jobs/9456107741",
-    "status": "queued",
-    "conclusion": null,
-    "created_at": "2023-06-11T22:08:00Z",
-    "started_at": "2023-06-11T22:07:59Z",
-    "completed_at": null,
-    "name": "build",
-    "steps": [],
-    "check_run_url": "https://api.github.com/repos/squee1945/self-hosted-runner/check-runs/14171575672",
-    "labels": [
-      "ubuntu-latest"
-    ],
-    "runner_id": null,
-    "runner_name": null,
-    "runner_group_id": null,
-    "runner_group_name": null
-  },
-  "repository": {
-    "id": 652279005,
-    "node_id": "R_kgDOJuD83Q",
-    "name": "self-hosted-runner",
-    "full_name": "squee1945/self-hosted-runner",
-    "private": false,
-    "owner": {
-      "login": "squee1945",
-      "id": 1146523,
-      "node_id": "MDQ6VXNlcjExNDY1MjM=",
-      "avatar_url": "https://avatars.githubusercontent.com/u/1146523?v=4",
-      "gravatar_id": "",
-      "url": "https://api.github.com/users/squee1945",
-      "html_url": "https://github.com/squee1945",
-      "followers_url": "https://api.github.com/users/squee1945/followers",
-      "following_url": "https://api.github.com/users/squee1945/following{/other_user}",
-      "gists_url": "https://api.github.com/users/squee1945/gists{/gist_id}",
-      "starred_url": "https://api.github.com/users/squee1945/starred{/owner}{/repo}",
-      "subscriptions_url": "https://api.github.com/users/squee1945/subscriptions",
-      "organizations_url": "https://api.github.com/users/squee1945/orgs",
-      "repos_url": "https://api.github.com/users/squee1945/repos",
-      "events_url": "https://api.github.com/users/squee1945/events{/privacy}",
-      "received_events_url": "https://api.github.com/users/squee1945/received_events",
-      "type": "User",
-      "site_admin": false
-    },
-    "html_url": "https://github.com/squee1945/self-hosted-runner",
-    "description": null,
-    "fork": false,
-    "url": "https://api.github.com/repos/squee1945/self-hosted-runner",
-    "forks_url": "https://api.github.com/repos/squee1945/self-hosted-runner/forks",
-    "keys_url": "https://api.github.com/repos/squee1945/self-hosted-runner/keys{/key_id}",
-    "collaborators_url": "https://api.github.com/repos/squee1945/self-hosted-runner/collaborators{/collaborator}",
-    "teams_url": "https://api.github.com/repos/squee1945/self-hosted-runner/teams",
-    "hooks_url": "https://api.github.com/repos/squee1945/self-hosted-runner/hooks",
-    "issue_events_url": "https://api.github.com/repos/squee1945/self-hosted-runner/issues/events{/number}",
-    "events_url": "https://api.github.com/repos/squee1945/self-hosted-runner/events",
-    "assignees_url": "https://api.github.com/repos/squee1945/self-hosted-runner/assignees{/user}",
-    "branches_url": "https://api.github.com/repos/squee1945/self-hosted-runner/branches{/branch}",
-    "tags_url": "https://api.github.com/repos/squee1945/self-hosted-runner/tags",
-    "blobs_url": "https://api.github.com/repos/squee1945/self-hosted-runner/git/blobs{/sha}",
-    "git_tags_url": "https://api.github.com/repos/squee1945/self-hosted-runner/git/tags{/sha}",
-    "git_refs_url": "https://api.github.com/repos/squee1945/self-hosted-runner/git/refs{/sha}",
-    "trees_url": "https://api.github.com/repos/squee1945/self-hosted-runner/git/trees{/sha}",
-    "statuses_url": "https://api.github.com/repos/squee1945/self-hosted-runner/statuses/{sha}",
-    "languages_url": "https://api.github.com/repos/squee1945/self-hosted-runner/languages",
-    "stargazers_url": "https://api.github.com/repos/squee1945/self-hosted-runner/stargazers",
-    "contributors_url": "https://api.github.com/repos/squee1945/self-hosted-runner/contributors",
-    "subscribers_url": "https://api.github.com/repos/squee1945/self-hosted-runner/subscribers",
-    "subscription_url": "https://api.github.com/repos/squee1945/self-hosted-runner/subscription",
-    "commits_url": "https://api.github.com/repos/squee1945/self-hosted-runner/commits{/sha}",
-    "git_commits_url": "https://api.github.com/repos/squee1945/self-hosted-runner/git/commits{/sha}",
-    "comments_url": "https://api.github.com/repos/squee1945/self-hosted-runner/comments{/number}",
-    "issue_comment_url": "https://api.github.com/repos/squee1945/self-hosted-runner/issues/comments{/number}",
-    "contents_url": "https://api.github.com/repos/squee1945/self-hosted-runner/contents/{+path}",
-    "compare_url": "https://api.github.com/repos/squee1945/self-hosted-runner/compare/{base}...{head}",
-    "merges_url": "https://api.github.com/repos/squee1945/self-hosted-runner/merges",
-    "archive_url": "https://api.github.com/repos/squee1945/self-hosted-runner/{archive_format}{/ref}",
-    "downloads_url": "https://api.github.com/repos/squee1945/self-hosted-runner/downloads",
-    "issues_url": "https://api.github.com/repos/squee1945/self-hosted-runner/issues{/number}",
-    "pulls_url": "https://api.github.com/repos/squee1945/self-hosted-runner/pulls{/number}",
-    "milestones_url": "https://api.github.com/repos/squee1945/self-hosted-runner/milestones{/number}",
-    "notifications_url": "https://api.github.com/repos/squee1945/self-hosted-runner/notifications{?since,all,participating}",
-    "labels_url": "https://api.github.com/repos/squee1945/self-hosted-runner/labels{/name}",
-    "releases_url": "https://api.github.com/repos/squee1945/self-hosted-runner/releases{/id}",
-    "deployments_url": "https://api.github.com/repos/squee1945/self-hosted-runner/deployments",
-    "created_at": "2023-06-11T16:44:18Z",
-    "updated_at": "2023-06-11T16:58:53Z",
-    "pushed_at": "2023-06-11T22:07:56Z",
-    "git_url": "git://github.com/squee1945/self-hosted-runner.git",
-    "ssh_url": "git@github.com:squee1945/self-hosted-runner.git",
-    "clone_url": "https://github.com/squee1945/self-hosted-runner.git",
-    "svn_url": "https://github.com/squee1945/self-hosted-runner",
-    "homepage": null,
-    "size": 2,
-    "stargazers_count": 0,
-    "watchers_count": 0,
-    "language": "Go",
-    "has_issues": true,
-    "has_projects": true,
-    "has_downloads": true,
-    "has_wiki": true,
-    "has_pages": false,
-    "has_discussions": false,
-    "forks_count": 0,
-    "mirror_url": null,
-    "archived": false,
-    "disabled": false,
-    "open_issues_count": 0,
-    "license": null,
-    "allow_forking": true,
-    "is_template": false,
-    "web_commit_signoff_required": false,
-    "topics": [],
-    "visibility": "public",
-    "forks": 0,
-    "open_issues": 0,
-    "watchers": 0,
-    "default_branch": "main"
-  },
-  "sender": {
-    "login": "squee1945",
-    "id": 1146523,
-    "node_id": "MDQ6VXNlcjExNDY1MjM=",
-    "avatar_url": "https://avatars.githubusercontent.com/u/1146523?v=4",
-    "gravatar_id": "",
-    "url": "https://api.github.com/users/squee1945",
-    "html_url": "https://github.com/squee1945",
-    "followers_url": "https://api.github.com/users/squee1945/followers",
-    "following_url": "https://api.github.com/users/squee1945/following{/other_user}",
-    "gists_url": "https://api.github.com/users/squee1945/gists{/gist_id}",
-    "starred_url": "https://api.github.com/users/squee1945/starred{/owner}{/repo}",
-    "subscriptions_url": "https://api.github.com/users/squee1945/subscriptions",
-    "organizations_url": "https://api.github.com/users/squee1945/orgs",
-    "repos_url": "https://api.github.com/users/squee1945/repos",
-    "events_url": "https://api.github.com/users/squee1945/events{/privacy}",
-    "received_events_url": "https://api.github.com/users/squee1945/received_events",
-    "type": "User",
-    "site_admin": false
-  }
-}
-*/
-
 /*
 	"installation": {
 	  "id": 40041419,
@@ -586,14 +432,138 @@ type gitHubUser struct {
 	},
 */
 type eventInstallation struct {
-	ID                  int64      `json:"id"`
-	Account             gitHubUser `json:"account"`
-	RepositorySelection string     `json:"repository_selection"`
-	AccessTokensURL     string     `json:"access_tokens_url"`
-	RepositoriesURL     string     `json:"repositories_url"`
-	HTMLURL             string     `json:"html_url"`
-	AppID               int64      `json:"app_id"`
-	AppSlug             string     `json:"app_slug"`
-	TargetID            int64      `json:"target_id"`
-	TargetType          string     `json:"target_type"`
+	ID                  int64       `json:"id"`
+	Account             gitHubUser  `json:"account"`
+	RepositorySelection string      `json:"repository_selection"`
+	AccessTokensURL     string      `json:"access_tokens_url"`
+	RepositoriesURL     string      `json:"repositories_url"`
+	HTMLURL             string      `json:"html_url"`
+	AppID               int64       `json:"app_id"`
+	AppSlug             string      `json:"app_slug"`
+	TargetID            int64       `json:"target_id"`
+	TargetType          string      `json:"target_type"`
+	CreatedAt           timestamp   `json:"created_at"`
+	UpdatedAt           timestamp   `json:"updated_at"`
+	SuspendedAt         *timestamp  `json:"suspended_at"`
+	SuspendedBy         *gitHubUser `json:"suspended_by"`
+}
+
+// https://docs.github.com/en/webhooks-and-events/webhooks/webhook-events-and-payloads#ping
+type pingEvent struct {
+	Zen        string          `json:"zen"`
+	HookID     int64           `json:"hook_id"`
+	Hook       eventHook       `json:"hook"`
+	Repository eventRepository `json:"repository"`
+	Sender     gitHubUser      `json:"sender"`
+}
+
+type eventHook struct {
+	Type   string          `json:"type"` // One of: Repository, Organization, App
+	ID     int64           `json:"id"`
+	Name   string          `json:"name"`
+	Active bool            `json:"active"`
+	Events []string        `json:"events"`
+	Config eventHookConfig `json:"config"`
+	AppID  int64           `json:"app_id"`
+}
+
+type eventHookConfig struct {
+	ContentType string `json:"content_type"` // One of: json, form
+	InsecureSSL string `json:"insecure_ssl"` // "0" or "1"
+	URL         string `json:"url"`
+}
+
+// https://docs.github.com/en/webhooks-and-events/webhooks/webhook-events-and-payloads#installation
+type installationEvent struct {
+	Action       string            `json:"action"` // One of: created, deleted, suspend, unsuspend, new_permissions_accepted
+	Installation eventInstallation `json:"installation"`
+	Repositories []eventRepository `json:"repositories"`
+	Sender       gitHubUser        `json:"sender"`
+}
+
+// https://docs.github.com/en/webhooks-and-events/webhooks/webhook-events-and-payloads#installation_repositories
+type installationRepositoriesEvent struct {
+	Action              string            `json:"action"` // One of: added, removed
+	Installation        eventInstallation `json:"installation"`
+	RepositorySelection string            `json:"repository_selection"`
+	RepositoriesAdded   []eventRepository `json:"repositories_added"`
+	RepositoriesRemoved []eventRepository `json:"repositories_removed"`
+	Sender              gitHubUser        `json:"sender"`
+}
+
+// https://docs.github.com/en/webhooks-and-events/webhooks/webhook-events-and-payloads#workflow_run
+type workflowRunEvent struct {
+	Action       string            `json:"action"` // One of: requested, in_progress, completed
+	WorkflowRun  eventWorkflowRun  `json:"workflow_run"`
+	Repository   eventRepository   `json:"repository"`
+	Organization eventOrganization `json:"organization"`
+	Sender       gitHubUser        `json:"sender"`
+}
+
+// https://docs.github.com/en/rest/actions/workflow-runs?apiVersion=2022-11-28#get-a-workflow-run
+type eventWorkflowRun struct {
+	ID              int64                 `json:"id"`
+	Name            string                `json:"name"`
+	NodeID          string                `json:"node_id"`
+	HeadBranch      string                `json:"head_branch"`
+	HeadSHA         string                `json:"head_sha"`
+	Path            string                `json:"path"`
+	RunNumber       int                   `json:"run_number"`
+	RunAttempt      int                   `json:"run_attempt"`
+	Event           string                `json:"event"` // The triggering event, e.g., push, pull_request
+	Status          status                `json:"status"`
+	Conclusion      *conclusion           `json:"conclusion"`
+	WorkflowID      int64                 `json:"workflow_id"`
+	URL             string                `json:"url"`
+	HtmlURL         string                `json:"html_url"`
+	CreatedAt       timestamp             `json:"created_at"`
+	UpdatedAt       timestamp             `json:"updated_at"`
+	RunStartedAt    *timestamp            `json:"run_started_at"`
+	Actor           gitHubUser            `json:"actor"`
+	TriggeringActor gitHubUser            `json:"triggering_actor"`
+	PullRequests    []eventPullRequestRef `json:"pull_requests"`
+	Repository      eventRepository       `json:"repository"`
+	HeadRepository  eventRepository       `json:"head_repository"`
+}
+
+type eventPullRequestRef struct {
+	ID     int64  `json:"id"`
+	Number int    `json:"number"`
+	URL    string `json:"url"`
+}
+
+// https://docs.github.com/en/rest/pulls/pulls?apiVersion=2022-11-28#list-pull-requests
+type pullRequest struct {
+	ID                int64          `json:"id"`
+	Number            int            `json:"number"`
+	State             string         `json:"state"` // One of: open, closed
+	Title             string         `json:"title"`
+	User              gitHubUser     `json:"user"`
+	AuthorAssociation string         `json:"author_association"` // One of: COLLABORATOR, CONTRIBUTOR, FIRST_TIMER, FIRST_TIME_CONTRIBUTOR, MANNEQUIN, MEMBER, NONE, OWNER
+	Labels            []label        `json:"labels"`
+	Head              pullRequestRef `json:"head"`
+	Base              pullRequestRef `json:"base"`
+	HtmlURL           string         `json:"html_url"`
+}
+
+type pullRequestRef struct {
+	Label string          `json:"label"` // "octocat:new-topic"
+	Ref   string          `json:"ref"`
+	SHA   string          `json:"sha"`
+	Repo  eventRepository `json:"repo"`
+}
+
+type label struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// hasLabel reports whether the pull request is labelled name.
+func (pr pullRequest) hasLabel(name string) bool {
+	for _, l := range pr.Labels {
+		if strings.EqualFold(l.Name, name) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEventFixtures(t *testing.T) {
+	tests := []struct {
+		fixture        string
+		wantAction     string
+		wantStatus     status
+		wantConclusion string
+		wantRunnerID   bool
+		wantQueued     time.Duration
+		wantRan        time.Duration
+	}{
+		{
+			fixture:        "workflow_job_queued.json",
+			wantAction:     actionQueued,
+			wantStatus:     statusQueued,
+			wantConclusion: "null",
+		},
+		{
+			fixture:        "workflow_job_completed.json",
+			wantAction:     actionCompleted,
+			wantStatus:     statusCompleted,
+			wantConclusion: string(conclusionSuccess),
+			wantRunnerID:   true,
+			wantQueued:     26*time.Minute + 42*time.Second,
+			wantRan:        14 * time.Second,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			ev, err := parseEvent(readFixture(t, tc.fixture))
+			if err != nil {
+				t.Fatalf("parseEvent() failed: %v", err)
+			}
+			job := ev.WorkflowJob
+			if ev.Action != tc.wantAction {
+				t.Errorf("action got:%q want:%q", ev.Action, tc.wantAction)
+			}
+			if job.Status != tc.wantStatus {
+				t.Errorf("status got:%q want:%q", job.Status, tc.wantStatus)
+			}
+			if got := job.Conclusion.String(); got != tc.wantConclusion {
+				t.Errorf("conclusion got:%q want:%q", got, tc.wantConclusion)
+			}
+			if got := job.RunnerID != nil; got != tc.wantRunnerID {
+				t.Errorf("has runner ID got:%t want:%t", got, tc.wantRunnerID)
+			}
+			if want := time.Date(2023, 6, 11, 22, 8, 0, 0, time.UTC); !job.CreatedAt.Equal(want) {
+				t.Errorf("created at got:%v want:%v", job.CreatedAt, want)
+			}
+			if got, _ := job.queueDuration(); got != tc.wantQueued {
+				t.Errorf("queueDuration() got:%v want:%v", got, tc.wantQueued)
+			}
+			if got, _ := job.runDuration(); got != tc.wantRan {
+				t.Errorf("runDuration() got:%v want:%v", got, tc.wantRan)
+			}
+		})
+	}
+}
+
+func TestTimestampUnmarshal(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: `"2023-06-11T22:08:00Z"`, want: time.Date(2023, 6, 11, 22, 8, 0, 0, time.UTC)},
+		{in: `"2023-07-25T15:29:55.000-07:00"`, want: time.Date(2023, 7, 25, 22, 29, 55, 0, time.UTC)},
+		{in: `1690324195`, want: time.Date(2023, 7, 25, 22, 29, 55, 0, time.UTC)},
+		{in: `null`},
+		{in: `"yesterday"`, wantErr: true},
+		{in: `true`, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.in, func(t *testing.T) {
+			var ts timestamp
+			err := ts.UnmarshalJSON([]byte(tc.in))
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("UnmarshalJSON() error got:%v wantErr:%t", err, tc.wantErr)
+			}
+			if !ts.Equal(tc.want) {
+				t.Errorf("UnmarshalJSON() got:%v want:%v", ts.Time, tc.want)
+			}
+		})
+	}
+}
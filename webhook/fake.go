@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// fakeJobsClient is an in-memory jobsClient for tests and the simulator.
+type fakeJobsClient struct {
+	mu         sync.Mutex
+	jobs       map[string]*runpb.Job // By full resource name.
+	runs       []*runpb.RunJobRequest
+	updates    int                         // UpdateJob calls.
+	executions map[string]*runpb.Execution // By full resource name.
+
+	// runErr, if set, is returned by runJob.
+	runErr error
+	// granted, if non-nil, limits the permissions reported by testIamPermissions.
+	granted []string
+}
+
+func newFakeJobsClient() *fakeJobsClient {
+	return &fakeJobsClient{jobs: map[string]*runpb.Job{}, executions: map[string]*runpb.Execution{}}
+}
+
+func (c *fakeJobsClient) createJob(ctx context.Context, req *runpb.CreateJobRequest) (*runpb.Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name := req.Parent + "/jobs/" + req.JobId
+	if _, ok := c.jobs[name]; ok {
+		return nil, grpcstatus.Errorf(codes.AlreadyExists, "job %q already exists", name)
+	}
+	job := proto.Clone(req.Job).(*runpb.Job)
+	job.Name = name
+	job.CreateTime = timestamppb.Now()
+	c.jobs[name] = job
+	return job, nil
+}
+
+func (c *fakeJobsClient) getJob(ctx context.Context, req *runpb.GetJobRequest) (*runpb.Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	job, ok := c.jobs[req.Name]
+	if !ok {
+		return nil, grpcstatus.Errorf(codes.NotFound, "job %q not found", req.Name)
+	}
+	return job, nil
+}
+
+func (c *fakeJobsClient) listJobs(ctx context.Context, parent string) ([]*runpb.Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var jobs []*runpb.Job
+	for name, job := range c.jobs {
+		if strings.HasPrefix(name, parent+"/jobs/") {
+			jobs = append(jobs, proto.Clone(job).(*runpb.Job))
+		}
+	}
+	sort.Slice(jobs, func(a, b int) bool { return jobs[a].Name < jobs[b].Name })
+	return jobs, nil
+}
+
+func (c *fakeJobsClient) deleteJob(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.jobs[name]; !ok {
+		return grpcstatus.Errorf(codes.NotFound, "job %q not found", name)
+	}
+	delete(c.jobs, name)
+	return nil
+}
+
+func (c *fakeJobsClient) updateJob(ctx context.Context, req *runpb.UpdateJobRequest) (*runpb.Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, ok := c.jobs[req.Job.Name]
+	if !ok {
+		return nil, grpcstatus.Errorf(codes.NotFound, "job %q not found", req.Job.Name)
+	}
+	job := proto.Clone(req.Job).(*runpb.Job)
+	job.CreateTime, job.LatestCreatedExecution = old.CreateTime, old.LatestCreatedExecution
+	c.jobs[job.Name] = job
+	c.updates++
+	return job, nil
+}
+
+func (c *fakeJobsClient) runJob(ctx context.Context, req *runpb.RunJobRequest) (*runpb.Execution, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.runErr != nil {
+		return nil, c.runErr
+	}
+	if _, ok := c.jobs[req.Name]; !ok {
+		return nil, grpcstatus.Errorf(codes.NotFound, "job %q not found", req.Name)
+	}
+	c.runs = append(c.runs, req)
+	exec := &runpb.Execution{
+		Name:       fmt.Sprintf("%s/executions/fake-%05d", req.Name, len(c.runs)),
+		Job:        req.Name,
+		CreateTime: timestamppb.Now(),
+	}
+	c.executions[exec.Name] = exec
+	c.jobs[req.Name].LatestCreatedExecution = &runpb.ExecutionReference{Name: exec.Name, CreateTime: exec.CreateTime}
+	return proto.Clone(exec).(*runpb.Execution), nil
+}
+
+func (c *fakeJobsClient) getExecution(ctx context.Context, name string) (*runpb.Execution, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exec, ok := c.executions[name]
+	if !ok {
+		return nil, grpcstatus.Errorf(codes.NotFound, "execution %q not found", name)
+	}
+	return proto.Clone(exec).(*runpb.Execution), nil
+}
+
+func (c *fakeJobsClient) cancelExecution(ctx context.Context, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exec, ok := c.executions[name]
+	if !ok {
+		return grpcstatus.Errorf(codes.NotFound, "execution %q not found", name)
+	}
+	if exec.CompletionTime == nil {
+		exec.CompletionTime = timestamppb.Now()
+		exec.CancelledCount = 1
+	}
+	return nil
+}
+
+func (c *fakeJobsClient) listExecutions(ctx context.Context, job string) ([]*runpb.Execution, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var execs []*runpb.Execution
+	for _, exec := range c.executions {
+		if exec.Job == job {
+			execs = append(execs, proto.Clone(exec).(*runpb.Execution))
+		}
+	}
+	sort.Slice(execs, func(a, b int) bool { return execs[a].Name < execs[b].Name })
+	return execs, nil
+}
+
+// finishExecution marks an execution as having run from start to end.
+func (c *fakeJobsClient) finishExecution(name string, start, end time.Time, succeeded bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	exec, ok := c.executions[name]
+	if !ok {
+		return
+	}
+	exec.StartTime = timestamppb.New(start)
+	exec.CompletionTime = timestamppb.New(end)
+	if succeeded {
+		exec.SucceededCount = 1
+	} else {
+		exec.FailedCount = 1
+	}
+}
+
+func (c *fakeJobsClient) testIamPermissions(ctx context.Context, resource string, perms []string) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.granted == nil {
+		return perms, nil
+	}
+	return c.granted, nil
+}
+
+// runRequests returns the RunJob requests received so far.
+func (c *fakeJobsClient) runRequests() []*runpb.RunJobRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]*runpb.RunJobRequest(nil), c.runs...)
+}
+
+// fakeSecrets is an in-memory secretReader, keyed by secret name as configured.
+type fakeSecrets map[string][]byte
+
+func (s fakeSecrets) readSecret(ctx context.Context, name string) ([]byte, error) {
+	v, ok := s[name]
+	if !ok {
+		return nil, grpcstatus.Errorf(codes.NotFound, "secret %q not found", name)
+	}
+	return v, nil
+}
+
+func (s fakeSecrets) testPermissions(ctx context.Context, name string, perms []string) ([]string, error) {
+	if _, ok := s[name]; !ok {
+		return nil, nil
+	}
+	return perms, nil
+}
+
+// fakeNetworks is an in-memory networkClient holding the networks,
+// subnetworks and connectors by their full resource names, e.g.,
+// "projects/{project}/global/networks/{name}".
+type fakeNetworks map[string]bool
+
+func (n fakeNetworks) get(name string) error {
+	if !n[name] {
+		return &googleapi.Error{Code: http.StatusNotFound, Message: fmt.Sprintf("%q not found", name)}
+	}
+	return nil
+}
+
+func (n fakeNetworks) getNetwork(ctx context.Context, project, name string) error {
+	return n.get(fmt.Sprintf("projects/%s/global/networks/%s", project, name))
+}
+
+func (n fakeNetworks) getSubnetwork(ctx context.Context, project, region, name string) error {
+	return n.get(fmt.Sprintf("projects/%s/regions/%s/subnetworks/%s", project, region, name))
+}
+
+func (n fakeNetworks) getConnector(ctx context.Context, name string) error {
+	return n.get(name)
+}
+
+// fakeServiceAccounts is an in-memory serviceAccountClient holding the
+// permissions granted on each service account, by email.
+type fakeServiceAccounts map[string][]string
+
+func (s fakeServiceAccounts) testPermissions(ctx context.Context, email string, perms []string) ([]string, error) {
+	var granted []string
+	for _, p := range perms {
+		if slices.Contains(s[email], p) {
+			granted = append(granted, p)
+		}
+	}
+	return granted, nil
+}
+
+// fakeGitHub is an in-memory gitHubClient.
+type fakeGitHub struct {
+	// repoAccessErr, if set, is returned by checkRepoAccess.
+	repoAccessErr error
+	// token is returned by appRegistrationToken and registrationToken.
+	token string
+	// runs are returned by getWorkflowRun, keyed by run URL.
+	runs map[string]*eventWorkflowRun
+	// pulls are returned by listPullRequests, keyed by "repo head".
+	pulls map[string][]pullRequest
+
+	mu sync.Mutex
+	// runners are returned by listRunners, keyed by repo.
+	runners map[string][]selfHostedRunner
+	// workflowJobs are returned by getWorkflowJob, keyed by ID.
+	workflowJobs map[int]*eventWorkflowJob
+	// workflowJobErr, if set, is returned by getWorkflowJob.
+	workflowJobErr error
+}
+
+func (g *fakeGitHub) checkRepoAccess(ctx context.Context, repo string) error {
+	return g.repoAccessErr
+}
+
+func (g *fakeGitHub) appRegistrationToken(ctx context.Context, r Registration) (string, error) {
+	return g.token, nil
+}
+
+func (g *fakeGitHub) registrationToken(ctx context.Context, repo string) (string, error) {
+	return g.token, nil
+}
+
+func (g *fakeGitHub) getWorkflowRun(ctx context.Context, runURL string) (*eventWorkflowRun, error) {
+	run, ok := g.runs[runURL]
+	if !ok {
+		return nil, &gitHubError{StatusCode: http.StatusNotFound, Message: "Not Found"}
+	}
+	return run, nil
+}
+
+func (g *fakeGitHub) getWorkflowJob(ctx context.Context, repo string, id int) (*eventWorkflowJob, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.workflowJobErr != nil {
+		return nil, g.workflowJobErr
+	}
+	job, ok := g.workflowJobs[id]
+	if !ok {
+		return nil, &gitHubError{StatusCode: http.StatusNotFound, Message: "Not Found"}
+	}
+	j := *job
+	return &j, nil
+}
+
+// setWorkflowJobStatus sets the status getWorkflowJob reports for job id.
+func (g *fakeGitHub) setWorkflowJobStatus(id int, s status) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.workflowJobs == nil {
+		g.workflowJobs = map[int]*eventWorkflowJob{}
+	}
+	g.workflowJobs[id] = &eventWorkflowJob{ID: id, Status: s}
+}
+
+func (g *fakeGitHub) listRunners(ctx context.Context, repo string) ([]selfHostedRunner, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]selfHostedRunner(nil), g.runners[repo]...), nil
+}
+
+func (g *fakeGitHub) deleteRunner(ctx context.Context, repo string, id int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, r := range g.runners[repo] {
+		if r.ID != id {
+			continue
+		}
+		if r.Busy {
+			return &gitHubError{StatusCode: http.StatusUnprocessableEntity, Message: "Bad request - Runner is still running a job"}
+		}
+		g.runners[repo] = slices.Delete(g.runners[repo], i, i+1)
+		return nil
+	}
+	return &gitHubError{StatusCode: http.StatusNotFound, Message: "Not Found"}
+}
+
+// setRunners replaces the runners registered to repo.
+func (g *fakeGitHub) setRunners(repo string, runners ...selfHostedRunner) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.runners == nil {
+		g.runners = map[string][]selfHostedRunner{}
+	}
+	g.runners[repo] = runners
+}
+
+func (g *fakeGitHub) listPullRequests(ctx context.Context, repo, head string) ([]pullRequest, error) {
+	return g.pulls[repo+" "+head], nil
+}
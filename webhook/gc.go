@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+var (
+	// gcMinExecutionAge leaves executions alone while their runner may still
+	// be starting.
+	gcMinExecutionAge = 15 * time.Minute
+)
+
+// gcReport is what a sweep removed.
+type gcReport struct {
+	runners    []string // "owner/repo runner-name"
+	executions []string // Full resource names.
+}
+
+func (r gcReport) String() string {
+	return fmt.Sprintf("removed %d offline runners %v and cancelled %d orphaned executions %v", len(r.runners), r.runners, len(r.executions), r.executions)
+}
+
+// collector periodically removes what crashed runners leave behind:
+//
+//   - Offline registrations of runners named by this service, whose runner
+//     crashed before it could take a job. A runner is only removed once two
+//     sweeps have seen it offline, so that runners still registering are
+//     left alone.
+//   - Running executions whose workflow job is no longer queued or in
+//     progress, and whose runner is not busy with another job. Executions are
+//     matched to workflow jobs by their job records, so this needs
+//     $STATE_URL; warm runners and batches, which are not started for a
+//     single workflow job, are left to their pool and task timeout.
+type collector struct {
+	clients
+	config  config
+	repos   *repoSet
+	records *jobStore // Optional.
+
+	mu      sync.Mutex
+	offline map[string]bool // Runners seen offline by the last sweep, by "owner/repo runner-name".
+}
+
+func newCollector(clients clients, config config, repos *repoSet, records *jobStore) *collector {
+	return &collector{clients: clients, config: config, repos: repos, records: records, offline: map[string]bool{}}
+}
+
+func (c *collector) loop(ctx context.Context) {
+	t := time.NewTicker(c.config.GCInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		report, err := c.sweep(ctx, time.Now())
+		if err != nil {
+			logError("Garbage collection: %v", err)
+		}
+		if len(report.runners) > 0 || len(report.executions) > 0 {
+			logInfo("Garbage collection %s.", report)
+		}
+	}
+}
+
+// sweep removes offline runners and orphaned executions. It carries on past
+// errors, returning the first.
+func (c *collector) sweep(ctx context.Context, now time.Time) (gcReport, error) {
+	var report gcReport
+	var errs []error
+	repos, err := c.sweptRepos(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, repo := range repos {
+		removed, err := c.sweepRunners(ctx, repo)
+		report.runners = append(report.runners, removed...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("removing offline runners from %q: %v", repo, err))
+		}
+	}
+	if c.records != nil {
+		cancelled, err := c.sweepExecutions(ctx, now)
+		report.executions = cancelled
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cancelling orphaned executions: %v", err))
+		}
+	}
+	if len(errs) > 0 {
+		return report, errs[0]
+	}
+	return report, nil
+}
+
+// sweptRepos are the served repositories and those of the warm pools.
+func (c *collector) sweptRepos(ctx context.Context) ([]string, error) {
+	repos, err := c.repos.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if c.config.warmPools != nil {
+		for _, p := range c.config.warmPools.pools {
+			if r := strings.ToLower(p.Repository); !slices.Contains(repos, r) {
+				repos = append(repos, r)
+			}
+		}
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+// sweepRunners removes the runners of repo named by this service that were
+// offline in this sweep and the last.
+func (c *collector) sweepRunners(ctx context.Context, repo string) ([]string, error) {
+	runners, err := c.github.listRunners(ctx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	offline := map[string]bool{}
+	var removed []string
+	for _, r := range runners {
+		if r.Status != "offline" || r.Busy || !strings.HasPrefix(r.Name, runnerNamePrefix) {
+			continue
+		}
+		key := repo + " " + r.Name
+		if !c.offline[key] {
+			offline[key] = true
+			continue
+		}
+		if err := c.github.deleteRunner(ctx, repo, r.ID); err != nil {
+			logWarn("Removing offline runner %q from %q: %v", r.Name, repo, err)
+			offline[key] = true
+			continue
+		}
+		logInfo("Removed offline runner %q from %q.", r.Name, repo)
+		gcRunnersDeleted.inc(repo)
+		removed = append(removed, key)
+	}
+	for key := range c.offline {
+		if strings.HasPrefix(key, repo+" ") {
+			delete(c.offline, key)
+		}
+	}
+	for key := range offline {
+		c.offline[key] = true
+	}
+	return removed, nil
+}
+
+// sweepExecutions cancels the running executions whose workflow job has
+// finished or gone.
+func (c *collector) sweepExecutions(ctx context.Context, now time.Time) ([]string, error) {
+	records, err := c.records.incomplete(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byExecution := map[string]jobRecord{}
+	for _, r := range records {
+		byExecution[r.Execution] = r
+	}
+
+	var cancelled []string
+	for _, job := range configuredJobs(c.config, c.jobs) {
+		execs, err := c.jobs.listExecutions(ctx, job.jobName())
+		if err != nil {
+			return cancelled, fmt.Errorf("listing executions of %q: %v", job.jobID(), err)
+		}
+		for _, exec := range execs {
+			r, ok := byExecution[exec.Name]
+			if !ok || !c.orphaned(ctx, exec, r, now) {
+				continue
+			}
+			if err := c.jobs.cancelExecution(ctx, exec.Name); err != nil {
+				logWarn("Cancelling orphaned execution %q: %v", exec.Name, err)
+				continue
+			}
+			logInfo("Cancelled execution %q: workflow job %d (%q) in %q is no longer queued or in progress.", exec.Name, r.WorkflowJobID, r.WorkflowJob, r.Repository)
+			gcExecutionsCancelled.inc(r.Repository)
+			cancelled = append(cancelled, exec.Name)
+		}
+	}
+	return cancelled, nil
+}
+
+// orphaned reports whether the running execution exec, described by r, has
+// no live workflow job. If its runner is registered and idle, the runner is
+// removed first, so that it cannot take a job while it is being cancelled.
+func (c *collector) orphaned(ctx context.Context, exec *runpb.Execution, r jobRecord, now time.Time) bool {
+	if exec.GetCompletionTime() != nil || now.Sub(exec.GetCreateTime().AsTime()) < gcMinExecutionAge {
+		return false
+	}
+	if r.WorkflowJobID == 0 || r.Tasks > 1 || r.Runner == "" {
+		return false
+	}
+
+	ghJob, err := c.github.getWorkflowJob(ctx, r.Repository, r.WorkflowJobID)
+	var ghErr *gitHubError
+	switch {
+	case errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusNotFound:
+	case err != nil:
+		logWarn("Checking workflow job %d of execution %q: %v", r.WorkflowJobID, exec.Name, err)
+		return false
+	case ghJob.Status != statusCompleted:
+		return false
+	}
+
+	// An ephemeral runner takes any queued job with matching labels, so
+	// it can be busy with another one.
+	runners, err := c.github.listRunners(ctx, r.Repository)
+	if err != nil {
+		logWarn("Listing runners of %q: %v", r.Repository, err)
+		return false
+	}
+	for _, runner := range runners {
+		if runner.Name != r.Runner {
+			continue
+		}
+		if runner.Busy {
+			return false
+		}
+		if err := c.github.deleteRunner(ctx, r.Repository, runner.ID); err != nil {
+			// Most likely it has just taken a job.
+			logWarn("Removing runner %q of execution %q: %v", runner.Name, exec.Name, err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCollectorRunners(t *testing.T) {
+	const repo = "owner/gc-runners"
+	config := testConfig()
+	clients, _ := testClients(t, config)
+	gh := clients.github.(*fakeGitHub)
+	gh.setRunners(repo,
+		selfHostedRunner{ID: 1, Name: "cloud-run-1", Status: "offline"},
+		selfHostedRunner{ID: 2, Name: "cloud-run-2", Status: "online"},
+		selfHostedRunner{ID: 3, Name: "laptop", Status: "offline"},
+		selfHostedRunner{ID: 4, Name: "cloud-run-4", Status: "offline", Busy: true},
+		selfHostedRunner{ID: 5, Name: "cloud-run-warm-linux-1700000000000", Status: "offline"},
+	)
+	c := newCollector(clients, config, newRepoSet(nil, repo), nil)
+	ctx := context.Background()
+
+	// The first sweep only notes the offline runners.
+	report, err := c.sweep(ctx, time.Now())
+	if err != nil {
+		t.Fatalf("sweep() failed: %v", err)
+	}
+	if len(report.runners) != 0 {
+		t.Fatalf("first sweep removed %v", report.runners)
+	}
+
+	// A runner that came online in between is kept.
+	gh.setRunners(repo,
+		selfHostedRunner{ID: 1, Name: "cloud-run-1", Status: "offline"},
+		selfHostedRunner{ID: 2, Name: "cloud-run-2", Status: "online"},
+		selfHostedRunner{ID: 3, Name: "laptop", Status: "offline"},
+		selfHostedRunner{ID: 4, Name: "cloud-run-4", Status: "offline", Busy: true},
+		selfHostedRunner{ID: 5, Name: "cloud-run-warm-linux-1700000000000", Status: "online"},
+		selfHostedRunner{ID: 6, Name: "cloud-run-6", Status: "offline"},
+	)
+	before := gcRunnersDeleted.value(repo)
+	if report, err = c.sweep(ctx, time.Now()); err != nil {
+		t.Fatalf("sweep() failed: %v", err)
+	}
+	if want := []string{repo + " cloud-run-1"}; !slices.Equal(report.runners, want) {
+		t.Errorf("second sweep removed %v want:%v", report.runners, want)
+	}
+	if got := gcRunnersDeleted.value(repo) - before; got != 1 {
+		t.Errorf("counter got:+%g want:+1", got)
+	}
+
+	// Seen offline twice now.
+	if report, err = c.sweep(ctx, time.Now()); err != nil {
+		t.Fatalf("sweep() failed: %v", err)
+	}
+	if want := []string{repo + " cloud-run-6"}; !slices.Equal(report.runners, want) {
+		t.Errorf("third sweep removed %v want:%v", report.runners, want)
+	}
+	runners, _ := gh.listRunners(ctx, repo)
+	if len(runners) != 4 {
+		t.Errorf("runners left got:%v", runners)
+	}
+}
+
+func TestCollectorExecutions(t *testing.T) {
+	const repo = "owner/gc-executions"
+	ctx := context.Background()
+	config := testConfig()
+	clients, jobs := testClients(t, config)
+	gh := clients.github.(*fakeGitHub)
+	store, err := newBlobStore(ctx, t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	records := newJobStore(store)
+	job := cloudRunJob{config: config, client: jobs}
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		jobID      int
+		status     status // Of the workflow job on GitHub; empty if not found.
+		runner     *selfHostedRunner
+		noRecord   bool
+		finished   bool
+		wantCancel bool
+	}{
+		{name: "completed", jobID: 1, status: statusCompleted, wantCancel: true},
+		{name: "in progress", jobID: 2, status: statusInProgress},
+		{name: "queued", jobID: 3, status: statusQueued},
+		{name: "runner busy with another job", jobID: 4, status: statusCompleted, runner: &selfHostedRunner{ID: 40, Status: "online", Busy: true}},
+		{name: "runner idle", jobID: 5, status: statusCompleted, runner: &selfHostedRunner{ID: 50, Status: "online"}, wantCancel: true},
+		{name: "job gone", jobID: 6, wantCancel: true},
+		{name: "warm runner", jobID: 0},
+		{name: "no record", jobID: 8, status: statusCompleted, noRecord: true},
+		{name: "already finished", jobID: 9, status: statusCompleted, finished: true},
+	}
+	execs := map[string]string{} // Test name by execution.
+	var registered []selfHostedRunner
+	for _, tc := range tests {
+		ev := &event{Repository: eventRepository{FullName: repo}, WorkflowJob: eventWorkflowJob{ID: tc.jobID, Name: tc.name}}
+		opts := runOptionsFor(config, ev)
+		if tc.jobID == 0 {
+			opts.name = "cloud-run-warm-linux-1700000000000"
+		}
+		exec, err := job.runJob(ctx, opts)
+		if err != nil {
+			t.Fatalf("runJob() failed: %v", err)
+		}
+		execs[exec.Name] = tc.name
+		if tc.status != "" {
+			gh.setWorkflowJobStatus(tc.jobID, tc.status)
+		}
+		if tc.runner != nil {
+			r := *tc.runner
+			r.Name = opts.runnerName()
+			registered = append(registered, r)
+		}
+		if tc.finished {
+			jobs.finishExecution(exec.Name, now, now, true)
+		}
+		if !tc.noRecord {
+			if err := records.put(ctx, newJobRecord(ev, exec, &job, opts.runnerName(), now)); err != nil {
+				t.Fatalf("put() failed: %v", err)
+			}
+		}
+	}
+	gh.setRunners(repo, registered...)
+
+	c := newCollector(clients, config, newRepoSet(nil), records)
+	// Too soon after the executions started.
+	report, err := c.sweep(ctx, now)
+	if err != nil {
+		t.Fatalf("sweep() failed: %v", err)
+	}
+	if len(report.executions) != 0 {
+		t.Fatalf("early sweep cancelled %v", report.executions)
+	}
+
+	report, err = c.sweep(ctx, now.Add(gcMinExecutionAge+time.Minute))
+	if err != nil {
+		t.Fatalf("sweep() failed: %v", err)
+	}
+	var cancelled []string
+	for _, name := range report.executions {
+		cancelled = append(cancelled, execs[name])
+	}
+	var want []string
+	for _, tc := range tests {
+		if tc.wantCancel {
+			want = append(want, tc.name)
+		}
+	}
+	slices.Sort(cancelled)
+	slices.Sort(want)
+	if !slices.Equal(cancelled, want) {
+		t.Errorf("cancelled got:%q want:%q", cancelled, want)
+	}
+
+	// The idle runner was removed before its execution was cancelled.
+	runners, _ := gh.listRunners(ctx, repo)
+	if len(runners) != 1 || runners[0].ID != 40 {
+		t.Errorf("runners left got:%v", runners)
+	}
+}
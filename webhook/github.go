@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	gitHubAPIURL     = "https://api.github.com"
+	gitHubAPIVersion = "2022-11-28"
+)
+
+// gitHubClient is the subset of the GitHub API used by the service.
+type gitHubClient interface {
+	// checkRepoAccess verifies that the token can manage self-hosted runners
+	// on repo ("owner/repo").
+	checkRepoAccess(ctx context.Context, repo string) error
+	// appRegistrationToken creates a runner registration token as a GitHub app.
+	appRegistrationToken(ctx context.Context, r Registration) (string, error)
+	// registrationToken creates a short-lived runner registration token for
+	// repo ("owner/repo") with the personal access token.
+	registrationToken(ctx context.Context, repo string) (string, error)
+	// getWorkflowRun fetches the workflow run at runURL, a workflow job's
+	// run_url.
+	getWorkflowRun(ctx context.Context, runURL string) (*eventWorkflowRun, error)
+	// getWorkflowJob fetches workflow job id in repo ("owner/repo").
+	getWorkflowJob(ctx context.Context, repo string, id int) (*eventWorkflowJob, error)
+	// listPullRequests lists the open pull requests in repo ("owner/repo")
+	// from head ("owner:branch").
+	listPullRequests(ctx context.Context, repo, head string) ([]pullRequest, error)
+	// listRunners lists the self-hosted runners registered to repo
+	// ("owner/repo").
+	listRunners(ctx context.Context, repo string) ([]selfHostedRunner, error)
+	// deleteRunner removes a self-hosted runner from repo ("owner/repo").
+	// GitHub refuses to remove a runner that is running a job.
+	deleteRunner(ctx context.Context, repo string, id int64) error
+}
+
+// selfHostedRunner is a runner registered with GitHub.
+type selfHostedRunner struct {
+	ID     int64   `json:"id"`
+	Name   string  `json:"name"`
+	Status string  `json:"status"` // "online" or "offline".
+	Busy   bool    `json:"busy"`
+	Labels []label `json:"labels"`
+}
+
+// gitHubAPI implements gitHubClient with the GitHub REST API, authenticating
+// with the personal access token from $GITHUB_TOKEN_SECRET.
+type gitHubAPI struct {
+	secrets         secretReader
+	tokenSecretName string
+	baseURL         string
+}
+
+func newGitHubAPI(secrets secretReader, tokenSecretName string) gitHubAPI {
+	return gitHubAPI{secrets: secrets, tokenSecretName: tokenSecretName, baseURL: gitHubAPIURL}
+}
+
+// gitHubError is returned for non-2xx responses from the GitHub API.
+type gitHubError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *gitHubError) Error() string {
+	return fmt.Sprintf("GitHub API returned status %d: %s", e.StatusCode, e.Message)
+}
+
+func (g gitHubAPI) appRegistrationToken(ctx context.Context, r Registration) (string, error) {
+	r.baseURL = g.baseURL
+	return r.Token(ctx)
+}
+
+func (g gitHubAPI) checkRepoAccess(ctx context.Context, repo string) error {
+	// https://docs.github.com/en/rest/actions/self-hosted-runners?apiVersion=2022-11-28#list-self-hosted-runners-for-a-repository
+	return g.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/actions/runners?per_page=1", repo), nil, nil)
+}
+
+func (g gitHubAPI) registrationToken(ctx context.Context, repo string) (string, error) {
+	// https://docs.github.com/en/rest/actions/self-hosted-runners?apiVersion=2022-11-28#create-a-registration-token-for-a-repository
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := g.do(ctx, http.MethodPost, fmt.Sprintf("/repos/%s/actions/runners/registration-token", repo), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Token, nil
+}
+
+func (g gitHubAPI) getWorkflowRun(ctx context.Context, runURL string) (*eventWorkflowRun, error) {
+	// https://docs.github.com/en/rest/actions/workflow-runs?apiVersion=2022-11-28#get-a-workflow-run
+	// The run URL comes from the webhook payload; only follow it to the API
+	// we hold a token for.
+	path, ok := strings.CutPrefix(runURL, g.baseURL+"/")
+	if !ok {
+		return nil, fmt.Errorf("run URL %q is not on %q", runURL, g.baseURL)
+	}
+	var run eventWorkflowRun
+	if err := g.do(ctx, http.MethodGet, "/"+path, nil, &run); err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (g gitHubAPI) getWorkflowJob(ctx context.Context, repo string, id int) (*eventWorkflowJob, error) {
+	// https://docs.github.com/en/rest/actions/workflow-jobs?apiVersion=2022-11-28#get-a-job-for-a-workflow-run
+	var job eventWorkflowJob
+	if err := g.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/actions/jobs/%d", repo, id), nil, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (g gitHubAPI) listPullRequests(ctx context.Context, repo, head string) ([]pullRequest, error) {
+	// https://docs.github.com/en/rest/pulls/pulls?apiVersion=2022-11-28#list-pull-requests
+	var prs []pullRequest
+	if err := g.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/pulls?state=open&head=%s", repo, url.QueryEscape(head)), nil, &prs); err != nil {
+		return nil, err
+	}
+	return prs, nil
+}
+
+func (g gitHubAPI) listRunners(ctx context.Context, repo string) ([]selfHostedRunner, error) {
+	// https://docs.github.com/en/rest/actions/self-hosted-runners?apiVersion=2022-11-28#list-self-hosted-runners-for-a-repository
+	const perPage = 100
+	var runners []selfHostedRunner
+	for page := 1; ; page++ {
+		var resp struct {
+			TotalCount int                `json:"total_count"`
+			Runners    []selfHostedRunner `json:"runners"`
+		}
+		if err := g.do(ctx, http.MethodGet, fmt.Sprintf("/repos/%s/actions/runners?per_page=%d&page=%d", repo, perPage, page), nil, &resp); err != nil {
+			return nil, err
+		}
+		runners = append(runners, resp.Runners...)
+		if len(resp.Runners) < perPage || len(runners) >= resp.TotalCount {
+			return runners, nil
+		}
+	}
+}
+
+func (g gitHubAPI) deleteRunner(ctx context.Context, repo string, id int64) error {
+	// https://docs.github.com/en/rest/actions/self-hosted-runners?apiVersion=2022-11-28#delete-a-self-hosted-runner-from-a-repository
+	return g.do(ctx, http.MethodDelete, fmt.Sprintf("/repos/%s/actions/runners/%d", repo, id), nil, nil)
+}
+
+// do calls the GitHub API. If in is non-nil, it is sent as the JSON body; if
+// out is non-nil, the JSON response is unmarshalled into it.
+func (g gitHubAPI) do(ctx context.Context, method, path string, in, out any) (err error) {
+	ctx, span := tracer.Start(ctx, "gitHubAPI "+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.String("url.path", path)))
+	defer func() { endSpan(span, err) }()
+
+	token, err := g.secrets.readSecret(ctx, g.tokenSecretName)
+	if err != nil {
+		return fmt.Errorf("reading $GITHUB_TOKEN_SECRET secret: %v", err)
+	}
+
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("marshalling request: %v", err)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, g.baseURL+path, body)
+	if err != nil {
+		return fmt.Errorf("creating http request: %v", err)
+	}
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Add("X-GitHub-Api-Version", gitHubAPIVersion)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling %s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("reading response body: %v", err)
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var ghErr struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal(b, &ghErr)
+		return &gitHubError{StatusCode: res.StatusCode, Message: ghErr.Message}
+	}
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("unmarshalling response: %v", err)
+	}
+	return nil
+}
+
+// repoFromURL returns "owner/repo" from a URL like "https://github.com/owner/repo".
+func repoFromURL(url string) string {
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+	parts := strings.Split(url, "/")
+	if len(parts) < 2 {
+		return url
+	}
+	return parts[len(parts)-2] + "/" + parts[len(parts)-1]
+}
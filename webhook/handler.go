@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
@@ -8,37 +9,64 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strings"
+	"time"
 
+	"cloud.google.com/go/run/apiv2/runpb"
 	"github.com/kr/pretty"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
 )
 
 const (
-	eventHeader  = "X-GitHub-Event"   // X-Github-Event: workflow_job
-	hookIDHeader = "X-Github-Hook-Id" // X-Github-Hook-Id: 419040544
-	sig256Header = "X-Hub-Signature-256"
-	// deliveryHeader   = "X-GitHub-Delivery"                      // X-Github-Delivery: 2e4a3250-08a3-11ee-8cc8-00632da95790
+	eventHeader    = "X-GitHub-Event"   // X-Github-Event: workflow_job
+	hookIDHeader   = "X-Github-Hook-Id" // X-Github-Hook-Id: 419040544
+	sig256Header   = "X-Hub-Signature-256"
+	deliveryHeader = "X-GitHub-Delivery" // X-Github-Delivery: 2e4a3250-08a3-11ee-8cc8-00632da95790
 	// targetIDHeader   = "X-Github-Hook-Installation-Target-Id"   // X-Github-Hook-Installation-Target-Id: 652279005
 	// targetTypeHeader = "X-Github-Hook-Installation-Target-Type" // X-Github-Hook-Installation-Target-Type: repository
 	// sigHeader        = "X-Hub-Signature"
 
-	eventWorkFlowJob     = "workflow_job"
-	eventAppInstallation = "installation"
+	eventWorkFlowJob              = "workflow_job"
+	eventAppInstallation          = "installation"
+	eventPing                     = "ping"
+	eventInstallationRepositories = "installation_repositories"
+	eventWorkFlowRun              = "workflow_run"
 )
 
 var (
 	validEvents = map[string]bool{
-		eventWorkFlowJob:     true,
-		eventAppInstallation: true,
+		eventWorkFlowJob:              true,
+		eventAppInstallation:          true,
+		eventPing:                     true,
+		eventInstallationRepositories: true,
+		eventWorkFlowRun:              true,
 	}
 )
 
 type handler struct {
-	w      http.ResponseWriter
-	r      *http.Request
-	config config
+	clients
+	w        http.ResponseWriter
+	r        *http.Request
+	config   config
+	repos    *repoSet
+	archive  *archiver  // Optional.
+	records  *jobStore  // Optional.
+	budgets  *budgeter  // Optional.
+	warm     *warmPools // Optional.
+	batches  *batcher   // Optional.
+	watchdog *watchdog  // Optional.
 }
 
 func (h handler) next() {
+	// GitHub does not send trace headers, but honour them if present (e.g., from the replay tool).
+	ctx := otel.GetTextMapPropagator().Extract(h.r.Context(), propagation.HeaderCarrier(h.r.Header))
+	ctx, span := tracer.Start(ctx, "handler.next")
+	defer span.End()
+	h.r = h.r.WithContext(ctx)
+
 	if h.r.Method != http.MethodPost {
 		h.clientError("bad method %v", h.r.Method)
 		return
@@ -49,6 +77,7 @@ func (h handler) next() {
 	}
 
 	eh := h.r.Header.Get(eventHeader)
+	span.SetAttributes(attribute.String("github.event", eh))
 	if !validEvents[eh] {
 		h.clientError("unexpected event type %q", eh)
 		return
@@ -57,55 +86,282 @@ func (h handler) next() {
 	body, err := io.ReadAll(h.r.Body)
 	if err != nil {
 		h.serverError("reading body: %v", err)
+		return
 	}
 	h.r.Body.Close()
 
-	if err := h.validateSignature(body); err != nil {
+	if err := h.validateSignature(ctx, body); err != nil {
 		h.clientError("validating signature: %v", err)
 		return
 	}
 
+	if h.archive != nil {
+		// Archiving is best effort; it must not block dispatch.
+		key, err := h.archive.archive(ctx, delivery{ReceivedAt: time.Now(), Header: h.r.Header.Clone(), Body: body})
+		if err != nil {
+			logError("Archiving delivery %q: %v", h.r.Header.Get(deliveryHeader), err)
+		} else {
+			logInfo("Archived delivery %q as %q", h.r.Header.Get(deliveryHeader), key)
+		}
+	}
+
 	ev, err := parseEvent(body)
 	if err != nil {
 		h.serverError("parsing event: %v", err)
 		return
 	}
 
+	span.SetAttributes(attribute.String("github.action", ev.Action), attribute.String("github.repository", ev.Repository.FullName))
+
 	switch eh {
 	case eventWorkFlowJob:
 		h.handleWorkFlowJob(ev)
 	case eventAppInstallation:
-		h.handleAppInstallation(ev)
+		h.handleAppInstallation(body)
+	case eventPing:
+		h.handlePing(body)
+	case eventInstallationRepositories:
+		h.handleInstallationRepositories(body)
+	case eventWorkFlowRun:
+		h.handleWorkflowRun(body)
 	default:
 		h.serverError("Unhandled event: %q", eh)
 	}
 }
 
 func (h *handler) handleWorkFlowJob(ev *event) {
+	if ev.Action == actionInProgress && h.warm != nil {
+		h.warm.consumed(h.r.Context(), ev.WorkflowJob.RunnerName)
+	}
+	if (ev.Action == actionInProgress || ev.Action == actionCompleted) && h.watchdog != nil {
+		h.watchdog.started(ev.WorkflowJob.ID)
+	}
+	if ev.Action == actionCompleted {
+		job := ev.WorkflowJob
+		queued, _ := job.queueDuration()
+		ran, _ := job.runDuration()
+		logInfo("Workflow job %d (%q) on runner %q completed with conclusion %q; queued for %v, ran for %v.", job.ID, job.Name, job.RunnerName, job.Conclusion, queued, ran)
+	}
 	if ev.Action != actionQueued {
 		logInfo("Event action %q not %q. Ignoring.", ev.Action, actionQueued)
 		return
 	}
 
+	ctx := h.r.Context()
+	served, err := h.repos.has(ctx, ev.Repository.FullName)
+	if err != nil {
+		h.serverError("%v", err)
+		return
+	}
+	if !served {
+		logInfo("Repository %q is not served by this service. Ignoring.", ev.Repository.FullName)
+		return
+	}
+
 	logInfo("Processing event:\n%s\n", pretty.Sprint(ev))
 
-	crJob := cloudRunJob{config: h.config}
-	if err := crJob.runJob(h.r.Context()); err != nil {
-		h.serverError("running job %q: %v", h.config.JobID, err)
+	d, t, err := h.authorize(ctx, ev)
+	if err != nil {
+		h.serverError("applying fork policy to workflow job %d: %v", ev.WorkflowJob.ID, err)
+		return
+	}
+	if !d.allow {
+		return
+	}
+
+	if h.warm != nil && d.profile != profileLocked {
+		if name := h.warm.claim(ctx, ev, d.profile); name != "" {
+			logInfo("Workflow job %d (%q) left to warm runner %q.", ev.WorkflowJob.ID, ev.WorkflowJob.Name, name)
+			return
+		}
+	}
+
+	opts := runOptionsFor(h.config, ev)
+	opts.cacheRef = cacheRef(ev, t)
+	if d.profile == profileLocked {
+		if opts.runnerToken, err = h.github.registrationToken(ctx, ev.Repository.FullName); err != nil {
+			h.serverError("creating registration token for %q: %v", ev.Repository.FullName, err)
+			return
+		}
+	}
+	crJob := jobFor(h.config, h.jobs, d.profile, ev.Repository.FullName)
+	if h.batches != nil {
+		// The batch records its execution.
+		exec, err := h.batches.run(ctx, crJob, opts, ev)
+		if err != nil {
+			h.serverError("running job %q: %v", crJob.jobID(), err)
+			return
+		}
+		h.watch(ev, d.profile, exec)
+		return
+	}
+	exec, err := crJob.runJob(ctx, opts)
+	if err != nil {
+		h.serverError("running job %q: %v", crJob.jobID(), err)
+		return
+	}
+
+	if h.records != nil && exec.Name != "" {
+		// Best effort: the runner is already starting.
+		if err := h.records.put(ctx, newJobRecord(ev, exec, &crJob, opts.runnerName(), time.Now())); err != nil {
+			logError("Recording execution %q: %v", exec.Name, err)
+		}
+	}
+	h.watch(ev, d.profile, exec)
+}
+
+// watch has the watchdog, if any, replace the runner if the job does not
+// start.
+func (h *handler) watch(ev *event, p profile, exec *runpb.Execution) {
+	if h.watchdog != nil {
+		h.watchdog.watch(ev, p, exec.GetName(), time.Now())
+	}
+}
+
+// authorize applies the fork policy, the $POLICY_FILE rules and the
+// $BUDGET_FILE budgets to a queued workflow job and logs the decision as an
+// audit event. It also returns the job's trigger, if it was resolved.
+func (h *handler) authorize(ctx context.Context, ev *event) (decision, trigger, error) {
+	d, t, err := h.decide(ctx, ev)
+	if err != nil {
+		return decision{}, trigger{}, err
+	}
+	verdict := "denied"
+	if d.allow {
+		verdict = fmt.Sprintf("allowed on the %s profile", d.profile)
+	}
+	logAudit(newAuditEvent(ev, t, h.config.ForkPolicy, d), "Workflow job %d (%q) in %q %s: %s.", ev.WorkflowJob.ID, ev.WorkflowJob.Name, ev.Repository.FullName, verdict, d.reason)
+	return d, t, nil
+}
+
+// decide applies the fork policy, then the rules and budgets, if any. The
+// triggering run is only looked up when one of them, or the Actions cache,
+// which scopes pull requests' entries (see cacheRef), needs it.
+func (h handler) decide(ctx context.Context, ev *event) (decision, trigger, error) {
+	var t trigger
+	if h.config.ForkPolicy != forkPolicyAllow || h.config.rules.needsTrigger() || h.config.CacheURL != "" {
+		var err error
+		if t, err = resolveTrigger(ctx, h.github, ev); err != nil {
+			return decision{}, trigger{}, err
+		}
+	}
+	d := forkDecision(h.config.ForkPolicy, h.config.ApprovalLabel, t)
+	if d.allow && h.config.rules != nil {
+		d = h.config.rules.evaluate(ruleVars(ev, t)).apply(d)
+	}
+	if h.budgets != nil {
+		d = h.budgets.apply(ev.Repository.FullName, d, time.Now())
+	}
+	return d, t, nil
+}
+
+func (h *handler) handleAppInstallation(body []byte) {
+	var ev installationEvent
+	if err := parsePayload(body, &ev); err != nil {
+		h.serverError("parsing installation event: %v", err)
 		return
 	}
+
+	ctx := h.r.Context()
+	repos := repoNames(ev.Repositories)
+	var err error
+	switch ev.Action {
+	case actionCreated, actionUnsuspend:
+		err = h.repos.add(ctx, repos...)
+	case actionDeleted, actionSuspend:
+		err = h.repos.remove(ctx, repos...)
+	default:
+		logInfo("Installation action %q for %q. Ignoring.", ev.Action, ev.Installation.Account.Login)
+		return
+	}
+	if err != nil {
+		h.serverError("installation %d %s: %v", ev.Installation.ID, ev.Action, err)
+		return
+	}
+	logInfo("Installation %d %s by %q for %v.", ev.Installation.ID, ev.Action, ev.Sender.Login, repos)
 }
 
-func (h *handler) handleAppInstallation(ev *event) {
-	if ev.Action != actionCreated {
-		logInfo("Event action %q not %q. Ignoring.", ev.Action, actionCreated)
+func (h *handler) handleInstallationRepositories(body []byte) {
+	var ev installationRepositoriesEvent
+	if err := parsePayload(body, &ev); err != nil {
+		h.serverError("parsing installation_repositories event: %v", err)
 		return
 	}
 
-	logInfo("Received installation event: %#v", *ev)
+	switch ev.Action {
+	case actionAdded, actionRemoved:
+	default:
+		logInfo("Installation repositories action %q. Ignoring.", ev.Action)
+		return
+	}
+	ctx := h.r.Context()
+	if err := errors.Join(h.repos.add(ctx, repoNames(ev.RepositoriesAdded)...), h.repos.remove(ctx, repoNames(ev.RepositoriesRemoved)...)); err != nil {
+		h.serverError("installation %d repositories %s: %v", ev.Installation.ID, ev.Action, err)
+		return
+	}
+	logInfo("Installation %d repositories %s by %q (added %v, removed %v).", ev.Installation.ID, ev.Action, ev.Sender.Login, repoNames(ev.RepositoriesAdded), repoNames(ev.RepositoriesRemoved))
 }
 
-func (h handler) validateSignature(body []byte) error {
+// handlePing answers the ping GitHub sends when a hook is created, failing
+// if the hook is configured in a way this service cannot use. GitHub shows
+// the response body in the hook's "Recent Deliveries".
+func (h *handler) handlePing(body []byte) {
+	var ev pingEvent
+	if err := parsePayload(body, &ev); err != nil {
+		h.serverError("parsing ping event: %v", err)
+		return
+	}
+
+	if problems := h.hookProblems(ev); len(problems) > 0 {
+		h.clientError("hook %d is misconfigured: %s", ev.HookID, strings.Join(problems, "; "))
+		return
+	}
+
+	logInfo("Ping from hook %d (%s) by %q: %s", ev.HookID, ev.Hook.Type, ev.Sender.Login, ev.Zen)
+	h.w.Write([]byte("pong"))
+}
+
+func (h *handler) hookProblems(ev pingEvent) []string {
+	// next has already checked the hook ID and the signature.
+	var problems []string
+	if !ev.Hook.Active {
+		problems = append(problems, "hook is not active")
+	}
+	if ct := ev.Hook.Config.ContentType; ct != "" && ct != "json" {
+		problems = append(problems, fmt.Sprintf("content type is %q, must be \"json\"", ct))
+	}
+	// App hooks report their events on the app, not the hook.
+	if ev.Hook.Type != "App" && !slices.Contains(ev.Hook.Events, eventWorkFlowJob) && !slices.Contains(ev.Hook.Events, "*") {
+		problems = append(problems, fmt.Sprintf("hook does not send %q events (sends %v)", eventWorkFlowJob, ev.Hook.Events))
+	}
+	return problems
+}
+
+func (h *handler) handleWorkflowRun(body []byte) {
+	var ev workflowRunEvent
+	if err := parsePayload(body, &ev); err != nil {
+		h.serverError("parsing workflow_run event: %v", err)
+		return
+	}
+
+	served, err := h.repos.has(h.r.Context(), ev.Repository.FullName)
+	if err != nil {
+		h.serverError("%v", err)
+		return
+	}
+	if !served {
+		logInfo("Repository %q is not served by this service. Ignoring.", ev.Repository.FullName)
+		return
+	}
+
+	run := ev.WorkflowRun
+	logInfo("Workflow run %d (%q #%d attempt %d, triggered by %s on %q) %s: status=%q conclusion=%q", run.ID, run.Name, run.RunNumber, run.RunAttempt, run.Event, run.HeadBranch, ev.Action, run.Status, run.Conclusion)
+}
+
+func (h handler) validateSignature(ctx context.Context, body []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "handler.validateSignature")
+	defer func() { endSpan(span, err) }()
+
 	if h.config.SignatureSecretName == "" {
 		// Signature validation not configured.
 		return nil
@@ -117,23 +373,24 @@ func (h handler) validateSignature(body []byte) error {
 		return errors.New("$GITHUB_SIGNATURE_SECRET is set, but webhook message did not have signature. Did you configure the `Secret` in the GitHub webhook?")
 	}
 
-	signatureSecret, err := h.readSecret(h.config.SignatureSecretName)
+	signatureSecret, err := h.secrets.readSecret(ctx, h.config.SignatureSecretName)
 	if err != nil {
 		return fmt.Errorf("reading $GITHUB_SIGNATURE_SECRET secret: %v", err)
 	}
 
-	mac := hmac.New(sha256.New, signatureSecret)
-	mac.Write(body)
-	expectedMACBytes := mac.Sum(nil)
-
-	expectedMAC := "sha256=" + hex.EncodeToString(expectedMACBytes)
-
-	if messageMAC != expectedMAC {
+	if !hmac.Equal([]byte(messageMAC), []byte(signature(signatureSecret, body))) {
 		return errors.New("signatures do not match")
 	}
 	return nil
 }
 
+// signature returns the X-Hub-Signature-256 value for body.
+func signature(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
 func (h handler) serverError(template string, args ...any) {
 	logError("Error: "+template, args...)
 	h.w.WriteHeader(http.StatusInternalServerError)
@@ -145,7 +402,3 @@ func (h handler) clientError(template string, args ...any) {
 	h.w.WriteHeader(http.StatusBadRequest)
 	h.w.Write([]byte("Client error"))
 }
-
-func (h handler) readSecret(name string) ([]byte, error) {
-	return readSecret(h.r.Context(), h.config, name)
-}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+const (
+	testSignatureSecret = "gha-signature"
+	testSecretValue     = "It's a Secret to Everybody"
+	testHookID          = "419040544"
+	testRunURL          = "https://api.github.com/repos/squee1945/self-hosted-runner/actions/runs/5237732760" // From the workflow_job fixtures.
+)
+
+func testConfig() config {
+	return config{
+		RepositoryURL:   "https://github.com/squee1945/self-hosted-runner",
+		RunnerImageURL:  "us-central1-docker.pkg.dev/some-project/some-repo/actions-runner@sha256:ABCDEF123456",
+		TokenSecretName: "gha-runner",
+		JobID:           "runner-abc",
+		Project:         "my-project",
+		Location:        "us-central1",
+		ForkPolicy:      forkPolicyDeny,
+		ApprovalLabel:   "safe-to-run",
+	}
+}
+
+// testClients returns fakes with the Cloud Run jobs for config already
+// created. The fixtures' workflow run was triggered by a push.
+func testClients(t *testing.T, config config) (clients, *fakeJobsClient) {
+	t.Helper()
+	jobs := newFakeJobsClient()
+	for _, job := range configuredJobs(config, jobs) {
+		if err := job.ensureJob(context.Background()); err != nil {
+			t.Fatalf("ensureJob() failed: %v", err)
+		}
+	}
+	repo := eventRepository{FullName: "squee1945/self-hosted-runner", Owner: gitHubUser{Login: "squee1945"}}
+	return clients{
+		jobs:    jobs,
+		secrets: fakeSecrets{"gha-runner": []byte("ghp_token"), testSignatureSecret: []byte(testSecretValue)},
+		github: &fakeGitHub{
+			token: "registration-token",
+			runs:  map[string]*eventWorkflowRun{testRunURL: {ID: 5237732760, Event: "push", HeadBranch: "main", Repository: repo, HeadRepository: repo}},
+		},
+	}, jobs
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+	return b
+}
+
+func newDelivery(event string, body []byte) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+	r.Header.Set(eventHeader, event)
+	r.Header.Set(hookIDHeader, testHookID)
+	r.Header.Set(deliveryHeader, "2e4a3250-08a3-11ee-8cc8-00632da95790")
+	return r
+}
+
+func serve(h handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.w, h.r = w, r
+	h.next()
+	return w
+}
+
+func TestHandlerSignature(t *testing.T) {
+	body := readFixture(t, "workflow_job_queued.json")
+
+	tests := []struct {
+		name          string
+		signatureName string
+		signature     string
+		wantStatus    int
+		wantRuns      int
+	}{
+		{name: "not configured", wantStatus: http.StatusOK, wantRuns: 1},
+		{name: "not configured, ignores signature", signature: "sha256=bogus", wantStatus: http.StatusOK, wantRuns: 1},
+		{name: "valid", signatureName: testSignatureSecret, signature: signature([]byte(testSecretValue), body), wantStatus: http.StatusOK, wantRuns: 1},
+		{name: "missing", signatureName: testSignatureSecret, wantStatus: http.StatusBadRequest},
+		{name: "wrong secret", signatureName: testSignatureSecret, signature: signature([]byte("wrong"), body), wantStatus: http.StatusBadRequest},
+		{name: "unreadable secret", signatureName: "missing-secret", signature: signature([]byte(testSecretValue), body), wantStatus: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.SignatureSecretName = tc.signatureName
+			clients, jobs := testClients(t, config)
+			h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL))}
+
+			r := newDelivery(eventWorkFlowJob, body)
+			if tc.signature != "" {
+				r.Header.Set(sig256Header, tc.signature)
+			}
+			w := serve(h, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("status got:%d want:%d (body %q)", w.Code, tc.wantStatus, w.Body.String())
+			}
+			if got := len(jobs.runRequests()); got != tc.wantRuns {
+				t.Errorf("runs got:%d want:%d", got, tc.wantRuns)
+			}
+		})
+	}
+}
+
+func TestHandlerHookID(t *testing.T) {
+	body := readFixture(t, "workflow_job_queued.json")
+
+	tests := []struct {
+		name       string
+		configured string
+		header     string
+		wantStatus int
+	}{
+		{name: "not configured", header: "123", wantStatus: http.StatusOK},
+		{name: "match", configured: testHookID, header: testHookID, wantStatus: http.StatusOK},
+		{name: "mismatch", configured: testHookID, header: "123", wantStatus: http.StatusBadRequest},
+		{name: "missing", configured: testHookID, wantStatus: http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.HookID = tc.configured
+			clients, _ := testClients(t, config)
+			h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL))}
+
+			r := newDelivery(eventWorkFlowJob, body)
+			r.Header.Set(hookIDHeader, tc.header)
+			w := serve(h, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("status got:%d want:%d (body %q)", w.Code, tc.wantStatus, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandlerDispatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		event      string
+		fixture    string
+		body       string
+		repos      []string
+		runErr     error
+		wantStatus int
+		wantRuns   int
+		wantRepos  []string
+	}{
+		{name: "queued", event: eventWorkFlowJob, fixture: "workflow_job_queued.json", wantStatus: http.StatusOK, wantRuns: 1},
+		{name: "completed", event: eventWorkFlowJob, fixture: "workflow_job_completed.json", wantStatus: http.StatusOK},
+		{name: "queued for unserved repo", event: eventWorkFlowJob, fixture: "workflow_job_queued.json", repos: []string{"someone/else"}, wantStatus: http.StatusOK},
+		{name: "run fails", event: eventWorkFlowJob, fixture: "workflow_job_queued.json", runErr: errors.New("quota exceeded"), wantStatus: http.StatusInternalServerError},
+		{name: "bad method", method: http.MethodGet, event: eventWorkFlowJob, fixture: "workflow_job_queued.json", wantStatus: http.StatusBadRequest},
+		{name: "unknown event", event: "push", body: "{}", wantStatus: http.StatusBadRequest},
+		{name: "malformed body", event: eventWorkFlowJob, body: "{", wantStatus: http.StatusInternalServerError},
+		{name: "installation created", event: eventAppInstallation, fixture: "installation_created.json", repos: []string{}, wantStatus: http.StatusOK, wantRepos: []string{"squee1945/self-hosted-runner"}},
+		{name: "installation deleted", event: eventAppInstallation, body: `{"action":"deleted","repositories":[{"full_name":"squee1945/self-hosted-runner"}]}`, wantStatus: http.StatusOK, wantRepos: nil},
+		{name: "repositories added", event: eventInstallationRepositories, body: `{"action":"added","repositories_added":[{"full_name":"squee1945/Other"}]}`, wantStatus: http.StatusOK, wantRepos: []string{"squee1945/other", "squee1945/self-hosted-runner"}},
+		{name: "ping", event: eventPing, body: `{"hook_id":419040544,"hook":{"type":"Repository","active":true,"events":["workflow_job"],"config":{"content_type":"json"}}}`, wantStatus: http.StatusOK},
+		{name: "ping with form content", event: eventPing, body: `{"hook_id":419040544,"hook":{"type":"Repository","active":true,"events":["workflow_job"],"config":{"content_type":"form"}}}`, wantStatus: http.StatusBadRequest},
+		{name: "ping without workflow_job", event: eventPing, body: `{"hook_id":419040544,"hook":{"type":"Repository","active":true,"events":["push"],"config":{"content_type":"json"}}}`, wantStatus: http.StatusBadRequest},
+		{name: "workflow run", event: eventWorkFlowRun, body: `{"action":"requested","workflow_run":{"id":1},"repository":{"full_name":"squee1945/self-hosted-runner"}}`, wantStatus: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			clients, jobs := testClients(t, config)
+			jobs.runErr = tc.runErr
+			repos := newRepoSet(nil, repoFromURL(config.RepositoryURL))
+			if tc.repos != nil {
+				repos = newRepoSet(nil, tc.repos...)
+			}
+			h := handler{clients: clients, config: config, repos: repos}
+
+			body := []byte(tc.body)
+			if tc.fixture != "" {
+				body = readFixture(t, tc.fixture)
+			}
+			r := newDelivery(tc.event, body)
+			if tc.method != "" {
+				r.Method = tc.method
+			}
+			w := serve(h, r)
+
+			if w.Code != tc.wantStatus {
+				t.Errorf("status got:%d want:%d (body %q)", w.Code, tc.wantStatus, w.Body.String())
+			}
+			if got := len(jobs.runRequests()); got != tc.wantRuns {
+				t.Errorf("runs got:%d want:%d", got, tc.wantRuns)
+			}
+			if tc.wantRepos != nil || strings.Contains(tc.name, "installation") {
+				if got, _ := repos.list(context.Background()); strings.Join(got, ",") != strings.Join(tc.wantRepos, ",") {
+					t.Errorf("repos got:%v want:%v", got, tc.wantRepos)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerRepoSetStore(t *testing.T) {
+	store, err := newBlobStore(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	config := testConfig()
+	clients, jobs := testClients(t, config)
+	base := repoFromURL(config.RepositoryURL)
+	// Two instances, or one before and after a restart.
+	added := handler{clients: clients, config: config, repos: newRepoSet(store, base)}
+	other := handler{clients: clients, config: config, repos: newRepoSet(store, base)}
+
+	if w := serve(added, newDelivery(eventInstallationRepositories, []byte(`{"action":"added","repositories_added":[{"full_name":"squee1945/Other"}]}`))); w.Code != http.StatusOK {
+		t.Fatalf("repositories added: status got:%d want:%d (body %q)", w.Code, http.StatusOK, w.Body.String())
+	}
+	queued := bytes.ReplaceAll(readFixture(t, "workflow_job_queued.json"), []byte(`"full_name": "squee1945/self-hosted-runner"`), []byte(`"full_name": "squee1945/other"`))
+	if w := serve(other, newDelivery(eventWorkFlowJob, queued)); w.Code != http.StatusOK || len(jobs.runRequests()) != 1 {
+		t.Errorf("queued for added repository: got:%d with %d runs want:%d with 1 run", w.Code, len(jobs.runRequests()), http.StatusOK)
+	}
+	if got, _ := other.repos.list(context.Background()); strings.Join(got, ",") != "squee1945/other,squee1945/self-hosted-runner" {
+		t.Errorf("repos got:%v", got)
+	}
+
+	if w := serve(other, newDelivery(eventInstallationRepositories, []byte(`{"action":"removed","repositories_removed":[{"full_name":"squee1945/other"}]}`))); w.Code != http.StatusOK {
+		t.Fatalf("repositories removed: status got:%d want:%d", w.Code, http.StatusOK)
+	}
+	if served, err := added.repos.has(context.Background(), "squee1945/other"); served || err != nil {
+		t.Errorf("removed repository: has() got:%t, %v want:false", served, err)
+	}
+}
+
+func TestHandlerDispatchOverrides(t *testing.T) {
+	config := testConfig()
+	clients, jobs := testClients(t, config)
+	h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL))}
+
+	if w := serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json"))); w.Code != http.StatusOK {
+		t.Fatalf("status got:%d want:%d (body %q)", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	runs := jobs.runRequests()
+	if len(runs) != 1 {
+		t.Fatalf("runs got:%d want:1", len(runs))
+	}
+	if got, want := runs[0].Name, "projects/my-project/locations/us-central1/jobs/runner-abc"; got != want {
+		t.Errorf("job name got:%q want:%q", got, want)
+	}
+	env := overrideEnv(runs[0])
+	for k, want := range map[string]string{
+		repositoryURLEnvVar: "https://github.com/squee1945/self-hosted-runner",
+		runnerNameEnvVar:    "cloud-run-14171575672",
+		runnerLabelsEnvVar:  "ubuntu-latest",
+		runIDEnvVar:         "5237732760",
+		headSHAEnvVar:       "720bd4aae6521bfce13488b41b93919c64088420",
+	} {
+		if env[k] != want {
+			t.Errorf("$%s got:%q want:%q", k, env[k], want)
+		}
+	}
+}
+
+// overrideEnv returns the runner container's env var overrides.
+func overrideEnv(req *runpb.RunJobRequest) map[string]string {
+	env := map[string]string{}
+	for _, co := range req.GetOverrides().GetContainerOverrides() {
+		if co.Name != runnerContainerName {
+			continue
+		}
+		for _, e := range co.Env {
+			env[e.Name] = e.GetValue()
+		}
+	}
+	return env
+}
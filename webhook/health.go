@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// readyCacheTTL bounds how often readiness probes and diagnostics hit
+	// Cloud Run, Secret Manager and GitHub.
+	readyCacheTTL = time.Minute
+
+	// jobPermissions are the permissions the service needs on the Cloud Run job.
+	jobPermissions = []permission{
+		{"run.jobs.get", "look up the Cloud Run job", "Cloud Run Viewer (roles/run.viewer)"},
+		{"run.jobs.run", "start executions of the Cloud Run job", "Cloud Run Invoker (roles/run.invoker)"},
+		{"run.jobs.runWithOverrides", "start executions of the Cloud Run job with per-execution settings", "Cloud Run Developer (roles/run.developer)"},
+		{"run.jobs.update", "update the Cloud Run job when its definition changes", "Cloud Run Developer (roles/run.developer)"},
+	}
+
+	// serviceAccountPermissions are the permissions the service needs on
+	// each service account the jobs run as.
+	serviceAccountPermissions = []permission{
+		{actAsPermission, "run Cloud Run jobs as the service account", "Service Account User (roles/iam.serviceAccountUser)"},
+	}
+
+	// secretPermissions are the permissions the service needs on each configured secret.
+	secretPermissions = []permission{
+		{"secretmanager.versions.access", "read the secret value", "Secret Manager Secret Accessor (roles/secretmanager.secretAccessor)"},
+	}
+)
+
+type permission struct {
+	name string
+	does string // Completes the sentence "The service can ..."
+	role string // A predefined role that grants the permission.
+}
+
+// check is the outcome of a single readiness or diagnostics check.
+type check struct {
+	ok     bool
+	detail string
+}
+
+func (c check) String() string {
+	if c.ok {
+		return "[OK]      " + c.detail
+	}
+	return "[PROBLEM] " + c.detail
+}
+
+// cachedReport caches the outcome of checks that are too expensive to run on
+// every request, running them at most once per readyCacheTTL. The lock is not
+// held while they run: requests that come in meanwhile wait for that run,
+// rather than start their own.
+type cachedReport[T any] struct {
+	run func(ctx context.Context) T
+
+	mu      sync.Mutex
+	checked time.Time
+	value   T
+	running chan struct{} // Closed when the current run finishes; nil if none is running.
+}
+
+func newCachedReport[T any](run func(ctx context.Context) T) *cachedReport[T] {
+	return &cachedReport[T]{run: run}
+}
+
+// get returns the cached outcome, running the checks if it is stale. ok is
+// false if ctx is done before a run the request waits for finishes.
+func (c *cachedReport[T]) get(ctx context.Context) (value T, ok bool) {
+	c.mu.Lock()
+	if time.Since(c.checked) <= readyCacheTTL {
+		defer c.mu.Unlock()
+		return c.value, true
+	}
+	if done := c.running; done != nil {
+		c.mu.Unlock()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return value, false
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.value, true
+	}
+	done := make(chan struct{})
+	c.running = done
+	c.mu.Unlock()
+
+	// Others may be waiting for the outcome, so it does not depend on this
+	// request staying around.
+	value = c.run(context.WithoutCancel(ctx))
+
+	c.mu.Lock()
+	c.value, c.checked, c.running = value, time.Now(), nil
+	c.mu.Unlock()
+	close(done)
+	return value, true
+}
+
+// newReadiness caches the readiness checks.
+func newReadiness(clients clients, config config) *cachedReport[[]check] {
+	return newCachedReport(func(ctx context.Context) []check { return readinessChecks(ctx, clients, config) })
+}
+
+// newDiagnostics caches the diagnostics report.
+func newDiagnostics(clients clients, config config) *cachedReport[string] {
+	return newCachedReport(func(ctx context.Context) string { return diagnosticsReport(ctx, clients, config) })
+}
+
+// healthhandler serves /healthz and /metrics, and /readyz and /diagnostics,
+// whose details name the service account, the secrets and the permissions
+// the service is missing, and so require the bearer token in $ADMIN_SECRET.
+type healthhandler struct {
+	clients
+	w         http.ResponseWriter
+	r         *http.Request
+	config    config
+	readiness *cachedReport[[]check]
+	diagnosis *cachedReport[string]
+}
+
+// admin checks the request's bearer token like the /admin/ endpoints,
+// writing an error response if it is missing or wrong.
+func (h healthhandler) admin() bool {
+	return adminhandler{clients: h.clients, w: h.w, r: h.r, config: h.config}.authorized()
+}
+
+// healthz reports that the process is up and serving.
+func (h healthhandler) healthz() {
+	h.w.Write([]byte("ok"))
+}
+
+// readyz reports whether the service can dispatch runners: the Cloud Run job
+// exists, the secrets are readable and the GitHub credentials are valid.
+// Probes, which send no bearer token, only get the status; requests with
+// the admin token get the checks.
+func (h healthhandler) readyz() {
+	checks, ok := h.readiness.get(h.r.Context())
+	if !ok {
+		checks = []check{{detail: "The readiness checks did not finish in time."}}
+	}
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.ok {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if h.r.Header.Get("Authorization") == "" {
+		h.w.WriteHeader(status)
+		h.w.Write([]byte(http.StatusText(status) + "\n"))
+		return
+	}
+	if !h.admin() {
+		return
+	}
+	h.w.WriteHeader(status)
+	h.w.Write([]byte(formatChecks(checks)))
+}
+
+// diagnostics reports which IAM permissions the service is missing, in plain language.
+func (h healthhandler) diagnostics() {
+	if !h.admin() {
+		return
+	}
+	report, ok := h.diagnosis.get(h.r.Context())
+	if !ok {
+		http.Error(h.w, "The diagnostics did not finish in time.", http.StatusServiceUnavailable)
+		return
+	}
+	h.w.Write([]byte(report))
+}
+
+// metrics reports the service's counters in the Prometheus text format.
+func (h healthhandler) metrics() {
+	h.w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, c := range counters {
+		c.write(h.w)
+	}
+}
+
+func readinessChecks(ctx context.Context, clients clients, config config) []check {
+	var checks []check
+
+	for _, job := range configuredJobs(config, clients.jobs) {
+		if _, err := job.getJob(ctx); err != nil {
+			checks = append(checks, check{detail: fmt.Sprintf("Cloud Run job %q could not be found: %v", job.jobID(), err)})
+		} else {
+			checks = append(checks, check{ok: true, detail: fmt.Sprintf("Cloud Run job %q exists.", job.jobID())})
+		}
+	}
+
+	for _, s := range configuredSecrets(config) {
+		if _, err := clients.secrets.readSecret(ctx, s.name); err != nil {
+			checks = append(checks, check{detail: fmt.Sprintf("Secret %q (%s) could not be read: %v", s.name, s.envVar, err)})
+		} else {
+			checks = append(checks, check{ok: true, detail: fmt.Sprintf("Secret %q (%s) is readable.", s.name, s.envVar)})
+		}
+	}
+
+	checks = append(checks, gitHubTokenCheck(ctx, clients, config))
+
+	if config.AppPrivateKeyName != "" {
+		if _, err := readPrivateKey(ctx, clients.secrets, config); err != nil {
+			checks = append(checks, check{detail: fmt.Sprintf("GitHub app private key is not usable: %v", err)})
+		} else {
+			checks = append(checks, check{ok: true, detail: "GitHub app private key is valid."})
+		}
+	}
+	return checks
+}
+
+func gitHubTokenCheck(ctx context.Context, clients clients, config config) check {
+	repo := repoFromURL(config.RepositoryURL)
+	err := clients.github.checkRepoAccess(ctx, repo)
+	var ghErr *gitHubError
+	switch {
+	case err == nil:
+		return check{ok: true, detail: fmt.Sprintf("GitHub token can manage runners for %q.", repo)}
+	case errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusUnauthorized:
+		return check{detail: "GitHub token was rejected; it may have expired or been revoked."}
+	case errors.As(err, &ghErr) && (ghErr.StatusCode == http.StatusForbidden || ghErr.StatusCode == http.StatusNotFound):
+		return check{detail: fmt.Sprintf("GitHub token cannot manage runners for %q; it needs the \"repo\" scope and admin access to the repository (%v).", repo, err)}
+	default:
+		return check{detail: fmt.Sprintf("GitHub token could not be checked: %v", err)}
+	}
+}
+
+type configuredSecret struct {
+	envVar string
+	name   string
+}
+
+func configuredSecrets(config config) []configuredSecret {
+	secrets := []configuredSecret{{"$GITHUB_TOKEN_SECRET", config.TokenSecretName}}
+	if config.SignatureSecretName != "" {
+		secrets = append(secrets, configuredSecret{"$GITHUB_SIGNATURE_SECRET", config.SignatureSecretName})
+	}
+	if config.AppClientSecretName != "" {
+		secrets = append(secrets, configuredSecret{"$GITHUB_APP_CLIENT_SECRET", config.AppClientSecretName})
+	}
+	if config.AppPrivateKeyName != "" {
+		secrets = append(secrets, configuredSecret{"$GITHUB_APP_PRIVATE_KEY", config.AppPrivateKeyName})
+	}
+	if config.AdminSecretName != "" {
+		secrets = append(secrets, configuredSecret{"$ADMIN_SECRET", config.AdminSecretName})
+	}
+	if config.CacheSecretName != "" {
+		secrets = append(secrets, configuredSecret{"$CACHE_SECRET", config.CacheSecretName})
+	}
+	if config.EventsSecretName != "" {
+		secrets = append(secrets, configuredSecret{"$RUNNER_EVENTS_SECRET", config.EventsSecretName})
+	}
+	return secrets
+}
+
+// diagnosticsReport checks the IAM permissions on the Cloud Run job and the
+// secrets and describes any that are missing.
+func diagnosticsReport(ctx context.Context, clients clients, config config) string {
+	identity, err := serviceAccountEmail(ctx)
+	if err != nil || identity == "" {
+		identity = "the service's service account"
+	}
+
+	var checks []check
+
+	var accounts []string
+	for _, job := range configuredJobs(config, clients.jobs) {
+		granted, err := job.testPermissions(ctx, permissionNames(jobPermissions))
+		if err != nil {
+			checks = append(checks, check{detail: fmt.Sprintf("Could not check permissions on Cloud Run job %q: %v", job.jobID(), err)})
+		} else {
+			checks = append(checks, permissionChecks(identity, fmt.Sprintf("Cloud Run job %q", job.jobID()), jobPermissions, granted)...)
+		}
+		if a := job.serviceAccount(); a != "" && !slices.Contains(accounts, a) {
+			accounts = append(accounts, a)
+		}
+	}
+
+	for _, a := range accounts {
+		if clients.accounts == nil {
+			break
+		}
+		granted, err := clients.accounts.testPermissions(ctx, a, permissionNames(serviceAccountPermissions))
+		if err != nil {
+			checks = append(checks, check{detail: fmt.Sprintf("Could not check permissions on service account %q: %v", a, err)})
+			continue
+		}
+		checks = append(checks, permissionChecks(identity, fmt.Sprintf("service account %q", a), serviceAccountPermissions, granted)...)
+	}
+
+	for _, s := range configuredSecrets(config) {
+		granted, err := clients.secrets.testPermissions(ctx, s.name, permissionNames(secretPermissions))
+		if err != nil {
+			checks = append(checks, check{detail: fmt.Sprintf("Could not check permissions on secret %q (%s): %v", s.name, s.envVar, err)})
+			continue
+		}
+		checks = append(checks, permissionChecks(identity, fmt.Sprintf("secret %q (%s)", s.name, s.envVar), secretPermissions, granted)...)
+	}
+
+	checks = append(checks, gitHubTokenCheck(ctx, clients, config))
+
+	return fmt.Sprintf("Diagnostics for %s:\n\n%s", identity, formatChecks(checks))
+}
+
+func permissionChecks(identity, resource string, want []permission, granted []string) []check {
+	has := map[string]bool{}
+	for _, g := range granted {
+		has[g] = true
+	}
+	var checks []check
+	for _, p := range want {
+		if has[p.name] {
+			checks = append(checks, check{ok: true, detail: fmt.Sprintf("The service can %s on %s.", p.does, resource)})
+			continue
+		}
+		checks = append(checks, check{detail: fmt.Sprintf("The service cannot %s on %s; it is missing %s. Grant %s the %s role on it.", p.does, resource, p.name, identity, p.role)})
+	}
+	return checks
+}
+
+func permissionNames(perms []permission) []string {
+	var names []string
+	for _, p := range perms {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+func formatChecks(checks []check) string {
+	var b strings.Builder
+	for _, c := range checks {
+		b.WriteString(c.String() + "\n")
+	}
+	return b.String()
+}
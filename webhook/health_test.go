@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCachedReport(t *testing.T) {
+	var runs atomic.Int32
+	release := make(chan struct{})
+	report := newCachedReport(func(ctx context.Context) int {
+		<-release
+		return int(runs.Add(1))
+	})
+
+	var wg sync.WaitGroup
+	got := make([]int, 5)
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got[i], _ = report.get(context.Background())
+		}()
+	}
+	// A request that gives up waiting does not hold up the others.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for running := false; !running; time.Sleep(time.Millisecond) {
+		report.mu.Lock()
+		running = report.running != nil
+		report.mu.Unlock()
+	}
+	if _, ok := report.get(ctx); ok {
+		t.Errorf("get() with a cancelled context got ok")
+	}
+	close(release)
+	wg.Wait()
+	for i, v := range got {
+		if v != 1 {
+			t.Errorf("get() %d got:%d want:1", i, v)
+		}
+	}
+	if v, _ := report.get(context.Background()); v != 1 || runs.Load() != 1 {
+		t.Errorf("cached get() got:%d after %d runs, want:1 after 1", v, runs.Load())
+	}
+}
+
+func TestReadyzAndDiagnostics(t *testing.T) {
+	config := testConfig()
+	config.AdminSecretName = testSignatureSecret
+	clients, _ := testClients(t, config)
+	readiness := newReadiness(clients, config)
+	diagnosis := newCachedReport(func(ctx context.Context) string { return "Diagnostics for someone" })
+	serve := func(path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h := healthhandler{clients: clients, w: w, r: r, config: config, readiness: readiness, diagnosis: diagnosis}
+		if path == "/readyz" {
+			h.readyz()
+		} else {
+			h.diagnostics()
+		}
+		return w
+	}
+
+	for _, tc := range []struct {
+		path, token string
+		wantStatus  int
+		wantBody    string
+	}{
+		{path: "/readyz", wantStatus: http.StatusOK, wantBody: "OK\n"},
+		{path: "/readyz", token: testSecretValue, wantStatus: http.StatusOK, wantBody: "[OK]      Secret \"gha-runner\""},
+		{path: "/readyz", token: "wrong", wantStatus: http.StatusForbidden},
+		{path: "/diagnostics", wantStatus: http.StatusUnauthorized},
+		{path: "/diagnostics", token: "wrong", wantStatus: http.StatusForbidden},
+		{path: "/diagnostics", token: testSecretValue, wantStatus: http.StatusOK, wantBody: "Diagnostics for someone"},
+	} {
+		w := serve(tc.path, tc.token)
+		if w.Code != tc.wantStatus || !strings.Contains(w.Body.String(), tc.wantBody) {
+			t.Errorf("%s with token %q: got:%d %q want:%d %q", tc.path, tc.token, w.Code, w.Body.String(), tc.wantStatus, tc.wantBody)
+		}
+		if tc.token != testSecretValue && strings.Contains(w.Body.String(), "gha-runner") {
+			t.Errorf("%s with token %q: details leaked: %q", tc.path, tc.token, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+var (
+	// labelValueRE matches the Cloud Run label values used for owner IDs.
+	labelValueRE = regexp.MustCompile(`^[a-z0-9_-]{1,63}$`)
+)
+
+// pruneJobs deletes the Cloud Run jobs with this service's owner label that
+// the current config has superseded: every config change creates new jobs.
+// A job is kept while it has running executions, and for $JOB_RETENTION
+// after it was created or last ran, so that a rollback can still use it.
+// With $JOB_GC_DRY_RUN, the jobs are only logged. It returns the IDs of the
+// jobs it deleted, or would have.
+func pruneJobs(ctx context.Context, client jobsClient, config config, now time.Time) ([]string, error) {
+	if config.JobOwnerID == "" {
+		return nil, nil
+	}
+	var current []string
+	for _, job := range configuredJobs(config, client) {
+		current = append(current, job.jobName())
+	}
+
+	parent := fmt.Sprintf("projects/%s/locations/%s", config.Project, config.Location)
+	jobs, err := client.listJobs(ctx, parent)
+	if err != nil {
+		return nil, fmt.Errorf("listing jobs in %q: %v", parent, err)
+	}
+	var pruned []string
+	for _, job := range jobs {
+		labels := job.GetLabels()
+		if labels[managedByLabel] != managedBy || labels[ownerLabel] != config.JobOwnerID || slices.Contains(current, job.Name) {
+			continue
+		}
+		id := path.Base(job.Name)
+		if used := lastUsed(job); now.Sub(used) < config.JobRetention {
+			logInfo("Keeping superseded job %q until %v.", id, used.Add(config.JobRetention).Format(time.RFC3339))
+			continue
+		}
+		running, err := runningExecutions(ctx, client, job.Name)
+		if err != nil {
+			logWarn("Listing executions of superseded job %q: %v", id, err)
+			continue
+		}
+		if running > 0 {
+			logInfo("Keeping superseded job %q while it has %d running executions.", id, running)
+			continue
+		}
+		if config.JobGCDryRun {
+			logInfo("Would delete superseded job %q ($JOB_GC_DRY_RUN is set).", id)
+			pruned = append(pruned, id)
+			continue
+		}
+		if err := client.deleteJob(ctx, job.Name); err != nil {
+			logWarn("Deleting superseded job %q: %v", id, err)
+			continue
+		}
+		logInfo("Deleted superseded job %q.", id)
+		pruned = append(pruned, id)
+	}
+	return pruned, nil
+}
+
+// lastUsed is when the job was created or last started an execution,
+// whichever is later.
+func lastUsed(job *runpb.Job) time.Time {
+	used := job.GetCreateTime().AsTime()
+	if t := job.GetLatestCreatedExecution().GetCreateTime(); t != nil && t.AsTime().After(used) {
+		used = t.AsTime()
+	}
+	return used
+}
+
+func runningExecutions(ctx context.Context, client jobsClient, job string) (int, error) {
+	execs, err := client.listExecutions(ctx, job)
+	if err != nil {
+		return 0, err
+	}
+	running := 0
+	for _, exec := range execs {
+		if exec.GetCompletionTime() == nil {
+			running++
+		}
+	}
+	return running, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestPruneJobs(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		dryRun     bool
+		noOwner    bool // $JOB_OWNER_ID unset for the current jobs.
+		wantPruned []string
+		wantLeft   []string
+	}{
+		{
+			name:       "delete",
+			wantPruned: []string{"runner-old"},
+			wantLeft:   []string{"legacy-old", "other-old", "runner-busy", "runner-new", "runner-recent"},
+		},
+		{
+			name:     "no owner",
+			noOwner:  true,
+			wantLeft: []string{"legacy-old", "other-old", "runner-busy", "runner-new", "runner-old", "runner-recent"},
+		},
+		{
+			name:       "dry run",
+			dryRun:     true,
+			wantPruned: []string{"runner-old"},
+			wantLeft:   []string{"legacy-old", "other-old", "runner-busy", "runner-new", "runner-old", "runner-recent"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			jobs := newFakeJobsClient()
+			ensure := func(jobID, owner string) cloudRunJob {
+				config := testConfig()
+				config.JobID, config.JobOwnerID = jobID, owner
+				job := cloudRunJob{config: config, client: jobs}
+				if err := job.ensureJob(ctx); err != nil {
+					t.Fatalf("ensureJob(%q) failed: %v", jobID, err)
+				}
+				jobs.jobs[job.jobName()].CreateTime = timestamppb.New(now.Add(-2 * time.Hour))
+				return job
+			}
+			ensure("runner-old", "runner")
+			ensure("other-old", "other")
+			ensure("legacy-old", "")
+			busy := ensure("runner-busy", "runner")
+			if _, err := busy.runJob(ctx, runOptions{}); err != nil {
+				t.Fatalf("runJob() failed: %v", err)
+			}
+			recent := ensure("runner-recent", "runner")
+			exec, err := recent.runJob(ctx, runOptions{})
+			if err != nil {
+				t.Fatalf("runJob() failed: %v", err)
+			}
+			jobs.finishExecution(exec.Name, now, now, true)
+			jobs.jobs[recent.jobName()].LatestCreatedExecution.CreateTime = timestamppb.New(now.Add(-30 * time.Minute))
+
+			current := ensure("runner-new", "runner")
+			if got := jobs.jobs[current.jobName()].Labels[ownerLabel]; got != "runner" {
+				t.Errorf("owner label got:%q want:%q", got, "runner")
+			}
+			config := current.config
+			config.JobRetention = time.Hour
+			config.JobGCDryRun = tc.dryRun
+			if tc.noOwner {
+				config.JobOwnerID = ""
+			}
+
+			pruned, err := pruneJobs(ctx, jobs, config, now)
+			if err != nil {
+				t.Fatalf("pruneJobs() failed: %v", err)
+			}
+			if !slices.Equal(pruned, tc.wantPruned) {
+				t.Errorf("pruned got:%q want:%q", pruned, tc.wantPruned)
+			}
+			var left []string
+			for name := range jobs.jobs {
+				left = append(left, path.Base(name))
+			}
+			slices.Sort(left)
+			if !slices.Equal(left, tc.wantLeft) {
+				t.Errorf("jobs left got:%q want:%q", left, tc.wantLeft)
+			}
+		})
+	}
+}
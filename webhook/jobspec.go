@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// specHash is a hash of the job definition, apart from its spec label, as
+// a label value. The Cloud Run job is labelled with it, so that a job
+// edited outside the service is detected and restored; see also jobsHash.
+func specHash(job *runpb.Job) (string, error) {
+	job = proto.Clone(job).(*runpb.Job)
+	delete(job.Labels, specLabel)
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(job)
+	if err != nil {
+		return "", fmt.Errorf("marshalling job: %v", err)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:32], nil
+}
+
+// jobsHash is a hash of the definitions of the configured jobs, rendered
+// with config's job ID before the hash is appended to it. Settings that only
+// change what the service does, such as $PORT or $STATE_URL, are not part of
+// the definitions, so changing them does not create new jobs.
+func jobsHash(config config) (string, error) {
+	h := md5.New()
+	for _, j := range configuredJobs(config, nil) {
+		req, err := j.createJobRequest()
+		if err != nil {
+			return "", fmt.Errorf("job %q: %v", j.jobID(), err)
+		}
+		hash, err := specHash(req.Job)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", j.jobID(), hash)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// diffJob describes the fields of want that differ from got, one per line,
+// e.g., `template.template.containers[0].image: "a" -> "b"`. Fields only
+// set on got are not compared, since Cloud Run fills in defaults and output
+// fields.
+func diffJob(got, want *runpb.Job) []string {
+	return diffMessage("", got.ProtoReflect(), want.ProtoReflect())
+}
+
+func diffMessage(path string, got, want protoreflect.Message) []string {
+	var diffs []string
+	want.Range(func(fd protoreflect.FieldDescriptor, wv protoreflect.Value) bool {
+		p := string(fd.Name())
+		if path != "" {
+			p = path + "." + p
+		}
+		if !got.Has(fd) {
+			diffs = append(diffs, fmt.Sprintf("%s: unset -> %s", p, formatValue(fd, wv)))
+			return true
+		}
+		gv := got.Get(fd)
+		switch {
+		case fd.IsList():
+			diffs = append(diffs, diffList(p, fd, gv.List(), wv.List())...)
+		case fd.IsMap():
+			diffs = append(diffs, diffMap(p, fd, gv.Map(), wv.Map())...)
+		case fd.Message() != nil:
+			diffs = append(diffs, diffMessage(p, gv.Message(), wv.Message())...)
+		case !gv.Equal(wv):
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> %s", p, formatValue(fd, gv), formatValue(fd, wv)))
+		}
+		return true
+	})
+	return diffs
+}
+
+func diffList(path string, fd protoreflect.FieldDescriptor, got, want protoreflect.List) []string {
+	var diffs []string
+	for i := 0; i < want.Len(); i++ {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= got.Len():
+			diffs = append(diffs, fmt.Sprintf("%s: added %s", p, formatElem(fd, want.Get(i))))
+		case fd.Message() != nil:
+			diffs = append(diffs, diffMessage(p, got.Get(i).Message(), want.Get(i).Message())...)
+		case !got.Get(i).Equal(want.Get(i)):
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> %s", p, formatElem(fd, got.Get(i)), formatElem(fd, want.Get(i))))
+		}
+	}
+	for i := want.Len(); i < got.Len(); i++ {
+		diffs = append(diffs, fmt.Sprintf("%s[%d]: removed %s", path, i, formatElem(fd, got.Get(i))))
+	}
+	return diffs
+}
+
+func diffMap(path string, fd protoreflect.FieldDescriptor, got, want protoreflect.Map) []string {
+	keys := map[string]protoreflect.MapKey{}
+	addKey := func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys[k.String()] = k
+		return true
+	}
+	want.Range(addKey)
+	got.Range(addKey)
+	var sorted []string
+	for ks := range keys {
+		sorted = append(sorted, ks)
+	}
+	sort.Strings(sorted)
+	vd := fd.MapValue()
+	var diffs []string
+	for _, ks := range sorted {
+		k := keys[ks]
+		p := fmt.Sprintf("%s[%s]", path, ks)
+		switch {
+		case !got.Has(k):
+			diffs = append(diffs, fmt.Sprintf("%s: unset -> %s", p, formatValue(vd, want.Get(k))))
+		case !want.Has(k):
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> unset", p, formatValue(vd, got.Get(k))))
+		case vd.Message() != nil:
+			diffs = append(diffs, diffMessage(p, got.Get(k).Message(), want.Get(k).Message())...)
+		case !got.Get(k).Equal(want.Get(k)):
+			diffs = append(diffs, fmt.Sprintf("%s: %s -> %s", p, formatValue(vd, got.Get(k)), formatValue(vd, want.Get(k))))
+		}
+	}
+	return diffs
+}
+
+// formatValue formats the value of field fd, summarizing lists and maps.
+func formatValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch {
+	case fd.IsList():
+		return fmt.Sprintf("%d items", v.List().Len())
+	case fd.IsMap():
+		return fmt.Sprintf("%d entries", v.Map().Len())
+	}
+	return formatElem(fd, v)
+}
+
+// formatElem formats a single scalar or message of field fd's type.
+func formatElem(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch {
+	case fd.Message() != nil:
+		return fmt.Sprintf("{%v}", v.Message().Interface())
+	case fd.Kind() == protoreflect.StringKind:
+		return fmt.Sprintf("%q", v.String())
+	case fd.Kind() == protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+	}
+	return v.String()
+}
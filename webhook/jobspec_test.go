@@ -0,0 +1,100 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+func TestDiffJob(t *testing.T) {
+	got := &runpb.Job{
+		Name:   "projects/p/locations/l/jobs/j", // Output only; not in want.
+		Labels: map[string]string{"a": "1", "b": "2"},
+		Template: &runpb.ExecutionTemplate{
+			TaskCount: 1,
+			Template: &runpb.TaskTemplate{
+				Containers: []*runpb.Container{{Image: "img", Args: []string{"x", "y"}}},
+			},
+		},
+	}
+	want := &runpb.Job{
+		Labels: map[string]string{"a": "1", "c": "3"},
+		Template: &runpb.ExecutionTemplate{
+			TaskCount: 2,
+			Template: &runpb.TaskTemplate{
+				Containers:           []*runpb.Container{{Image: "img", Args: []string{"x"}, Env: []*runpb.EnvVar{{Name: "E"}}}},
+				Retries:              &runpb.TaskTemplate_MaxRetries{MaxRetries: 3},
+				ExecutionEnvironment: runpb.ExecutionEnvironment_EXECUTION_ENVIRONMENT_GEN2,
+			},
+		},
+	}
+	wantDiffs := []string{
+		`labels[b]: "2" -> unset`,
+		`labels[c]: unset -> "3"`,
+		`template.task_count: 1 -> 2`,
+		`template.template.containers[0].args[1]: removed "y"`,
+		`template.template.containers[0].env: unset -> 1 items`,
+		`template.template.max_retries: unset -> 3`,
+		`template.template.execution_environment: unset -> EXECUTION_ENVIRONMENT_GEN2`,
+	}
+	diffs := diffJob(got, want)
+	slices.Sort(diffs)
+	slices.Sort(wantDiffs)
+	if !slices.Equal(diffs, wantDiffs) {
+		t.Errorf("diffJob() got:\n%q\nwant:\n%q", diffs, wantDiffs)
+	}
+
+	if diffs := diffJob(want, want); len(diffs) != 0 {
+		t.Errorf("diffJob() of equal jobs got:%q", diffs)
+	}
+
+	h1, err := specHash(want)
+	if err != nil {
+		t.Fatalf("specHash() failed: %v", err)
+	}
+	want.Labels[specLabel] = h1
+	if h2, _ := specHash(want); h2 != h1 {
+		t.Errorf("specHash() depends on the spec label: %q != %q", h2, h1)
+	}
+	if h3, _ := specHash(got); h3 == h1 {
+		t.Errorf("specHash() of different jobs are equal")
+	}
+}
+
+func TestJobsHash(t *testing.T) {
+	base := testConfig()
+	want, err := jobsHash(base)
+	if err != nil {
+		t.Fatalf("jobsHash() failed: %v", err)
+	}
+	tmpl, err := parseJobTemplate([]byte(`{"template": {"parallelism": 5}}`))
+	if err != nil {
+		t.Fatalf("parseJobTemplate() failed: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		change func(*config)
+		same   bool
+	}{
+		{name: "unchanged", change: func(*config) {}, same: true},
+		{name: "port", change: func(c *config) { c.Port = "9090" }, same: true},
+		{name: "state", change: func(c *config) { c.StateURL = "gs://bucket/state" }, same: true},
+		{name: "cpu", change: func(c *config) { c.JobCpu = "4" }},
+		{name: "image", change: func(c *config) { c.RunnerImageURL += "0" }},
+		{name: "template", change: func(c *config) { c.jobTemplate = tmpl }},
+		{name: "locked profile", change: func(c *config) {
+			c.ForkPolicy, c.LockedServiceAccount = forkPolicyLocked, "locked@p.iam.gserviceaccount.com"
+		}},
+	} {
+		c := base
+		tc.change(&c)
+		got, err := jobsHash(c)
+		if err != nil {
+			t.Fatalf("%s: jobsHash() failed: %v", tc.name, err)
+		}
+		if (got == want) != tc.same {
+			t.Errorf("%s: hash got:%q, base:%q, want same:%t", tc.name, got, want, tc.same)
+		}
+	}
+}
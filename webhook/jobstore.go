@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	jobRecordPrefix = "jobs/"
+
+	// jobRunningPrefix indexes the records that have not completed, as
+	// "running/{day}/{execution ID}", so that the loops that poll them do
+	// not read every record.
+	jobRunningPrefix = "running/"
+)
+
+// jobRecord is what the service knows about a runner execution it started.
+// Records are written at dispatch and completed once the execution has
+// finished.
+type jobRecord struct {
+	Execution     string `json:"execution"` // Full resource name.
+	Job           string `json:"job"`       // Cloud Run job ID.
+	Profile       string `json:"profile"`
+	Repository    string `json:"repository"`
+	Organization  string `json:"organization,omitempty"`
+	Workflow      string `json:"workflow"`
+	WorkflowJob   string `json:"workflow_job"`
+	WorkflowJobID int    `json:"workflow_job_id"`
+	RunID         int64  `json:"run_id"`
+	RunAttempt    int    `json:"run_attempt"`
+	Runner        string `json:"runner,omitempty"` // Name the runner registers with; for batches, the prefix of the task index.
+	// ServiceAccount is the account the execution ran as, if mapped by
+	// $SERVICE_ACCOUNT_FILE.
+	ServiceAccount string `json:"service_account,omitempty"`
+
+	// Resources allocated to the task, from $JOB_CPU and $JOB_MEMORY, or
+	// $SMALL_JOB_CPU and $SMALL_JOB_MEMORY for the small profile.
+	CPU       float64 `json:"cpu"`
+	MemoryGiB float64 `json:"memory_gib"`
+	Tasks     int     `json:"tasks,omitempty"` // Runners in the execution, if more than one; see batch.go.
+
+	Dispatched time.Time  `json:"dispatched"`
+	Started    *time.Time `json:"started,omitempty"`
+	Completed  *time.Time `json:"completed,omitempty"` // Nil while the execution is running.
+	Succeeded  bool       `json:"succeeded"`
+
+	// Usage, computed from the execution's duration once it has completed.
+	VCPUSeconds float64 `json:"vcpu_seconds"`
+	GiBSeconds  float64 `json:"gib_seconds"`
+
+	// Reported by the runner's hooks if $RUNNER_EVENTS_URL is set; for
+	// batches, by task 0's. See runnerevents.go.
+	ContainerStarted *time.Time `json:"container_started,omitempty"`
+	Registered       *time.Time `json:"registered,omitempty"`
+	JobStarted       *time.Time `json:"job_started,omitempty"`
+	JobCompleted     *time.Time `json:"job_completed,omitempty"`
+	ExitCode         *int       `json:"exit_code,omitempty"` // The runner's.
+}
+
+// executionID is the last part of the execution's resource name.
+func (r jobRecord) executionID() string {
+	return path.Base(r.Execution)
+}
+
+// day is the UTC day the job was dispatched, "2006-01-02".
+func (r jobRecord) day() string {
+	return r.Dispatched.UTC().Format("2006-01-02")
+}
+
+// owner is the organization or user that owns the repository; the
+// organization is not set for repositories of users.
+func (r jobRecord) owner() string {
+	if r.Organization != "" {
+		return r.Organization
+	}
+	owner, _, _ := strings.Cut(r.Repository, "/")
+	return owner
+}
+
+// jobStore keeps jobRecords in a blobStore, grouped by dispatch day.
+type jobStore struct {
+	store blobStore
+}
+
+func newJobStore(store blobStore) *jobStore {
+	return &jobStore{store: store}
+}
+
+func (s *jobStore) key(r jobRecord) string {
+	return fmt.Sprintf("%s%s/%s.json", jobRecordPrefix, r.day(), r.executionID())
+}
+
+func (s *jobStore) runningKey(r jobRecord) string {
+	return fmt.Sprintf("%s%s/%s", jobRunningPrefix, r.day(), r.executionID())
+}
+
+// put creates or replaces the record, and adds it to or removes it from
+// the index of incomplete records.
+func (s *jobStore) put(ctx context.Context, r jobRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("marshalling job record: %v", err)
+	}
+	if err := s.store.put(ctx, s.key(r), b); err != nil {
+		return fmt.Errorf("storing job record: %v", err)
+	}
+	if r.Completed == nil {
+		err = s.store.put(ctx, s.runningKey(r), nil)
+	} else {
+		err = s.store.delete(ctx, s.runningKey(r))
+	}
+	if err != nil {
+		return fmt.Errorf("indexing job record: %v", err)
+	}
+	return nil
+}
+
+// read returns the record stored under key.
+func (s *jobStore) read(ctx context.Context, key string) (jobRecord, error) {
+	var r jobRecord
+	data, err := s.store.get(ctx, key)
+	if err != nil {
+		return r, fmt.Errorf("reading job record %q: %w", key, err)
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, fmt.Errorf("unmarshalling job record %q: %v", key, err)
+	}
+	return r, nil
+}
+
+// update re-reads r's record, applies fn to it and stores it, so that
+// writers that set different fields, e.g., usageTracker and runner events,
+// do not undo each other's changes. If the record is gone, fn applies to r.
+func (s *jobStore) update(ctx context.Context, r jobRecord, fn func(*jobRecord)) error {
+	data, err := s.store.get(ctx, s.key(r))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("unmarshalling job record %q: %v", s.key(r), err)
+		}
+	case !errors.Is(err, errBlobNotFound):
+		return fmt.Errorf("reading job record %q: %v", s.key(r), err)
+	}
+	fn(&r)
+	return s.put(ctx, r)
+}
+
+// find returns the record of the execution with the ID, dispatched within
+// usageLookback of now, or nil if there is none.
+func (s *jobStore) find(ctx context.Context, executionID string, now time.Time) (*jobRecord, error) {
+	for day := now.UTC(); !day.Before(now.Add(-usageLookback).UTC().Truncate(24 * time.Hour)); day = day.Add(-24 * time.Hour) {
+		key := fmt.Sprintf("%s%s/%s.json", jobRecordPrefix, day.Format("2006-01-02"), executionID)
+		data, err := s.store.get(ctx, key)
+		if errors.Is(err, errBlobNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading job record %q: %v", key, err)
+		}
+		var r jobRecord
+		if err := json.Unmarshal(data, &r); err != nil {
+			return nil, fmt.Errorf("unmarshalling job record %q: %v", key, err)
+		}
+		return &r, nil
+	}
+	return nil, nil
+}
+
+// list returns the records of jobs dispatched on the UTC days from through
+// to, inclusive, oldest first.
+func (s *jobStore) list(ctx context.Context, from, to time.Time) ([]jobRecord, error) {
+	var records []jobRecord
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to.UTC()); day = day.Add(24 * time.Hour) {
+		blobs, err := s.store.list(ctx, jobRecordPrefix+day.Format("2006-01-02")+"/")
+		if err != nil {
+			return nil, fmt.Errorf("listing job records: %v", err)
+		}
+		for _, b := range blobs {
+			r, err := s.read(ctx, b.key)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Dispatched.Before(records[b].Dispatched) })
+	return records, nil
+}
+
+// incomplete returns the records that have not completed, from the index,
+// oldest first. Index entries whose record has completed or gone are
+// removed.
+func (s *jobStore) incomplete(ctx context.Context) ([]jobRecord, error) {
+	blobs, err := s.store.list(ctx, jobRunningPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("listing incomplete job records: %v", err)
+	}
+	var records []jobRecord
+	for _, b := range blobs {
+		r, err := s.read(ctx, jobRecordPrefix+strings.TrimPrefix(b.key, jobRunningPrefix)+".json")
+		if err != nil && !errors.Is(err, errBlobNotFound) {
+			return nil, err
+		}
+		if err != nil || r.Completed != nil {
+			if err := s.store.delete(ctx, b.key); err != nil {
+				return nil, fmt.Errorf("removing %q from the index: %v", b.key, err)
+			}
+			continue
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Dispatched.Before(records[b].Dispatched) })
+	return records, nil
+}
+
+// recordCache lists the records of a period for callers that poll them.
+// Completed records do not change, so they are read once and then served
+// from memory; each poll reads only the records dispatched or still running
+// since the last.
+type recordCache struct {
+	records *jobStore
+
+	mu   sync.Mutex
+	done map[string]jobRecord // Completed records, by key.
+}
+
+func newRecordCache(records *jobStore) *recordCache {
+	return &recordCache{records: records, done: map[string]jobRecord{}}
+}
+
+// list is jobStore.list, with completed records from the cache. Records
+// dispatched before from are dropped from it.
+func (c *recordCache) list(ctx context.Context, from, to time.Time) ([]jobRecord, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	from = from.UTC().Truncate(24 * time.Hour)
+	for key, r := range c.done {
+		if r.Dispatched.Before(from) {
+			delete(c.done, key)
+		}
+	}
+	var records []jobRecord
+	for day := from; !day.After(to.UTC()); day = day.Add(24 * time.Hour) {
+		blobs, err := c.records.store.list(ctx, jobRecordPrefix+day.Format("2006-01-02")+"/")
+		if err != nil {
+			return nil, fmt.Errorf("listing job records: %v", err)
+		}
+		for _, b := range blobs {
+			r, ok := c.done[b.key]
+			if !ok {
+				if r, err = c.records.read(ctx, b.key); err != nil {
+					return nil, err
+				}
+				if r.Completed != nil {
+					c.done[b.key] = r
+				}
+			}
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(a, b int) bool { return records[a].Dispatched.Before(records[b].Dispatched) })
+	return records, nil
+}
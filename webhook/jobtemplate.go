@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"text/template"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	"google.golang.org/protobuf/encoding/protojson"
+	"gopkg.in/yaml.v3"
+)
+
+// jobTemplate is $JOB_TEMPLATE_FILE: a Cloud Run Job resource, in YAML or
+// JSON, that the jobs are based on. See
+// https://cloud.google.com/run/docs/reference/rest/v2/projects.locations.jobs#Job.
+// The file is a Go template, rendered with jobTemplateData for each profile,
+// so that e.g., the locked profile can be left without a VPC connector.
+//
+// The template can add anything the Job resource allows: VPC access,
+// volumes, sidecar containers, extra env vars, a service account, retries,
+// parallelism and so on. withJobTemplate sets the fields the service relies
+// on over it.
+type jobTemplate struct {
+	tmpl *template.Template
+}
+
+// jobTemplateData is what $JOB_TEMPLATE_FILE is rendered with, e.g.,
+// {{.Profile}} or {{.Config.Project}}.
+type jobTemplateData struct {
+	Profile profile
+	JobID   string // The Cloud Run job ID, which differs by profile.
+	Config  config
+}
+
+func loadJobTemplate(path string) (*jobTemplate, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading job template: %v", err)
+	}
+	return parseJobTemplate(b)
+}
+
+func parseJobTemplate(b []byte) (*jobTemplate, error) {
+	tmpl, err := template.New("job").Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("parsing job template: %v", err)
+	}
+	return &jobTemplate{tmpl: tmpl}, nil
+}
+
+// render renders the template and parses the result as a Job resource.
+// Unknown fields are an error, so that a misspelt field is not silently
+// dropped.
+func (t *jobTemplate) render(data jobTemplateData) (*runpb.Job, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("rendering job template: %v", err)
+	}
+	// JSON is YAML, so both are read as YAML and handed to protojson, which
+	// knows the Job resource's field names and well-known types.
+	var v any
+	if err := yaml.Unmarshal(buf.Bytes(), &v); err != nil {
+		return nil, fmt.Errorf("parsing rendered job template: %v", err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("converting rendered job template: %v", err)
+	}
+	job := &runpb.Job{}
+	if v != nil {
+		if err := protojson.Unmarshal(b, job); err != nil {
+			return nil, fmt.Errorf("parsing rendered job template as a Job: %v", err)
+		}
+	}
+	return job, nil
+}
+
+// validate renders the template for each of the jobs, so that errors
+// show up when the service starts.
+func (t *jobTemplate) validate(config config) error {
+	for _, j := range configuredJobs(config, nil) {
+		if _, err := j.createJobRequest(); err != nil {
+			return fmt.Errorf("job %q: %v", j.jobID(), err)
+		}
+	}
+	return nil
+}
+
+// withJobTemplate returns job, rendered from the template, with the fields
+// of gen, the job the service generates, that runners rely on:
+//
+//   - gen's labels, which replace the template's labels with the same keys.
+//   - The task count, and the timeout, which is $JOB_TIMEOUT.
+//   - The runner container, named "job", which is added if the template
+//     does not have it. Its image, command and args are gen's; its env
+//     vars are the template's, apart from those gen sets, followed by gen's;
+//     its resources are gen's, since usage and budgets are based on its CPU
+//     and memory, with the template's other limits, e.g., GPUs, added.
+//   - The service account, if $SERVICE_ACCOUNT_FILE maps one, and always for
+//     the locked profile, whose default is $LOCKED_SERVICE_ACCOUNT.
+//   - The VPC access, if the profile has $VPC_* settings.
+//   - The $VOLUME_FILE volumes, and their mounts in the runner container,
+//     which replace the template's with the same names or mount paths.
+//
+// Retries and the execution environment are gen's unless the template sets
+// them. Everything else,
+// including parallelism, is the template's.
+func withJobTemplate(job, gen *runpb.Job, p profile) *runpb.Job {
+	if job.Labels == nil {
+		job.Labels = map[string]string{}
+	}
+	for k, v := range gen.Labels {
+		job.Labels[k] = v
+	}
+	if job.Template == nil {
+		job.Template = &runpb.ExecutionTemplate{}
+	}
+	job.Template.TaskCount = gen.Template.TaskCount
+	if job.Template.Template == nil {
+		job.Template.Template = &runpb.TaskTemplate{}
+	}
+	task, genTask := job.Template.Template, gen.Template.Template
+	task.Timeout = genTask.Timeout
+	if task.Retries == nil {
+		task.Retries = genTask.Retries
+	}
+	if task.ExecutionEnvironment == runpb.ExecutionEnvironment_EXECUTION_ENVIRONMENT_UNSPECIFIED {
+		task.ExecutionEnvironment = genTask.ExecutionEnvironment
+	}
+	if p == profileLocked || genTask.ServiceAccount != "" {
+		task.ServiceAccount = genTask.ServiceAccount
+	}
+	if genTask.VpcAccess != nil {
+		task.VpcAccess = genTask.VpcAccess
+	}
+	task.Volumes = slices.DeleteFunc(task.Volumes, func(v *runpb.Volume) bool {
+		return slices.ContainsFunc(genTask.Volumes, func(g *runpb.Volume) bool { return g.Name == v.Name })
+	})
+	task.Volumes = append(task.Volumes, genTask.Volumes...)
+
+	genRunner := genTask.Containers[0]
+	i := slices.IndexFunc(task.Containers, func(c *runpb.Container) bool { return c.Name == runnerContainerName })
+	if i < 0 {
+		task.Containers = append([]*runpb.Container{{}}, task.Containers...)
+		i = 0
+	}
+	runner := task.Containers[i]
+	runner.Name, runner.Image, runner.Command, runner.Args = genRunner.Name, genRunner.Image, genRunner.Command, genRunner.Args
+	runner.Env = slices.DeleteFunc(runner.Env, func(e *runpb.EnvVar) bool {
+		return slices.ContainsFunc(genRunner.Env, func(g *runpb.EnvVar) bool { return g.Name == e.Name })
+	})
+	runner.Env = append(runner.Env, genRunner.Env...)
+	runner.VolumeMounts = slices.DeleteFunc(runner.VolumeMounts, func(m *runpb.VolumeMount) bool {
+		return slices.ContainsFunc(genRunner.VolumeMounts, func(g *runpb.VolumeMount) bool { return g.Name == m.Name || g.MountPath == m.MountPath })
+	})
+	runner.VolumeMounts = append(runner.VolumeMounts, genRunner.VolumeMounts...)
+	resources := genRunner.Resources
+	for k, v := range runner.GetResources().GetLimits() {
+		if _, ok := resources.Limits[k]; !ok {
+			resources.Limits[k] = v
+		}
+	}
+	runner.Resources = resources
+	return job
+}
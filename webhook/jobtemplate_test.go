@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+func TestJobTemplate(t *testing.T) {
+	tmpl, err := loadJobTemplate("testdata/job_template.yaml")
+	if err != nil {
+		t.Fatalf("loadJobTemplate() failed: %v", err)
+	}
+	config := testConfig()
+	config.JobCpu, config.JobMemory, config.JobTimeout = "2", "4Gi", 30*time.Minute
+	config.ForkPolicy = forkPolicyLocked
+	config.LockedServiceAccount = "locked@my-project.iam.gserviceaccount.com"
+	config.jobTemplate = tmpl
+	if err := tmpl.validate(config); err != nil {
+		t.Fatalf("validate() failed: %v", err)
+	}
+	jobs := newFakeJobsClient()
+
+	tests := []struct {
+		profile            profile
+		wantServiceAccount string
+		wantConnector      string
+	}{
+		{profile: profileDefault, wantServiceAccount: "runner@my-project.iam.gserviceaccount.com", wantConnector: "projects/my-project/locations/us-central1/connectors/ci"},
+		{profile: profileLocked, wantServiceAccount: config.LockedServiceAccount},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.profile), func(t *testing.T) {
+			job := cloudRunJob{config: config, client: jobs, profile: tc.profile}
+			if err := job.ensureJob(context.Background()); err != nil {
+				t.Fatalf("ensureJob() failed: %v", err)
+			}
+			got, err := job.getJob(context.Background())
+			if err != nil {
+				t.Fatalf("getJob() failed: %v", err)
+			}
+
+			if got.Labels["team"] != "ci" || got.Labels[managedByLabel] != managedBy || got.Labels[specLabel] == "" {
+				t.Errorf("labels got:%v", got.Labels)
+			}
+			if got.Template.Parallelism != 5 || got.Template.TaskCount != 1 {
+				t.Errorf("parallelism, task count got:%d, %d want:5, 1", got.Template.Parallelism, got.Template.TaskCount)
+			}
+			task := got.Template.Template
+			if task.GetMaxRetries() != 1 {
+				t.Errorf("max retries got:%d want:1", task.GetMaxRetries())
+			}
+			if task.Timeout.AsDuration() != config.JobTimeout {
+				t.Errorf("timeout got:%v want:%v", task.Timeout.AsDuration(), config.JobTimeout)
+			}
+			if task.ExecutionEnvironment != runpb.ExecutionEnvironment_EXECUTION_ENVIRONMENT_GEN2 {
+				t.Errorf("execution environment got:%v", task.ExecutionEnvironment)
+			}
+			if task.ServiceAccount != tc.wantServiceAccount {
+				t.Errorf("service account got:%q want:%q", task.ServiceAccount, tc.wantServiceAccount)
+			}
+			if got := task.GetVpcAccess().GetConnector(); got != tc.wantConnector {
+				t.Errorf("VPC connector got:%q want:%q", got, tc.wantConnector)
+			}
+			if len(task.Volumes) != 1 || len(task.Containers) != 2 || task.Containers[1].Name != "docker" {
+				t.Fatalf("volumes, containers got:%v, %v", task.Volumes, task.Containers)
+			}
+
+			runner := task.Containers[0]
+			if runner.Name != runnerContainerName || runner.Image != config.RunnerImageURL || !strings.Contains(strings.Join(runner.Args, " "), "./config.sh") {
+				t.Errorf("runner container got:%v", runner)
+			}
+			if len(runner.VolumeMounts) != 1 {
+				t.Errorf("volume mounts got:%v", runner.VolumeMounts)
+			}
+			env := map[string][]string{}
+			for _, e := range runner.Env {
+				env[e.Name] = append(env[e.Name], e.GetValue())
+			}
+			if got := env[repositoryURLEnvVar]; len(got) != 1 || got[0] != config.RepositoryURL {
+				t.Errorf("$%s got:%q want:%q", repositoryURLEnvVar, got, config.RepositoryURL)
+			}
+			if got := env["RUNNER_TOOL_CACHE"]; len(got) != 1 || got[0] != "/cache" {
+				t.Errorf("$RUNNER_TOOL_CACHE got:%q", got)
+			}
+			if _, ok := env[tokenSecretEnvVar]; ok == (tc.profile == profileLocked) {
+				t.Errorf("$%s set:%v for profile %q", tokenSecretEnvVar, ok, tc.profile)
+			}
+			limits := runner.Resources.Limits
+			if limits["cpu"] != "2" || limits["memory"] != "4Gi" || limits["nvidia.com/gpu"] != "1" {
+				t.Errorf("limits got:%v", limits)
+			}
+		})
+	}
+}
+
+func TestJobTemplateJSON(t *testing.T) {
+	tmpl, err := parseJobTemplate([]byte(`{"template": {"template": {"vpcAccess": {"networkInterfaces": [{"network": "{{.JobID}}"}]}}}}`))
+	if err != nil {
+		t.Fatalf("parseJobTemplate() failed: %v", err)
+	}
+	config := testConfig()
+	config.jobTemplate = tmpl
+	job := cloudRunJob{config: config}
+	req, err := job.createJobRequest()
+	if err != nil {
+		t.Fatalf("createJobRequest() failed: %v", err)
+	}
+	task := req.Job.Template.Template
+	if got := task.GetVpcAccess().GetNetworkInterfaces()[0].GetNetwork(); got != config.JobID {
+		t.Errorf("network got:%q want:%q", got, config.JobID)
+	}
+	if task.GetMaxRetries() != 0 || len(task.Containers) != 1 {
+		t.Errorf("task got:%v", task)
+	}
+}
+
+func TestJobTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "syntax", content: "labels: {{.Profile", wantErr: "parsing job template"},
+		{name: "missing value", content: "labels: {a: {{.Nope}}}", wantErr: "rendering job template"},
+		{name: "yaml", content: "labels: [", wantErr: "parsing rendered job template"},
+		{name: "unknown field", content: "template: {template: {vpc: {}}}", wantErr: "parsing rendered job template as a Job"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := parseJobTemplate([]byte(tc.content))
+			if err == nil {
+				config := testConfig()
+				config.jobTemplate = tmpl
+				err = tmpl.validate(config)
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error got:%v want:%q", err, tc.wantErr)
+			}
+		})
+	}
+}
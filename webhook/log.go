@@ -3,6 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	// logOutput is where logs are written; Cloud Run collects stdout.
+	logOutput io.Writer = os.Stdout
 )
 
 func logInfo(template string, args ...any) {
@@ -17,22 +24,34 @@ func logError(template string, args ...any) {
 	logStructured("ERROR", template, args...)
 }
 
+// logAudit logs an audit record, such as a dispatch decision, as structured
+// data alongside the message.
+func logAudit(audit any, template string, args ...any) {
+	logStructuredWith("NOTICE", audit, template, args...)
+}
+
 type structuredLog struct {
 	Severity string `json:"severity"`
 	Message  string `json:"message"`
+	Audit    any    `json:"audit,omitempty"`
 }
 
 func logStructured(severity string, template string, args ...any) {
+	logStructuredWith(severity, nil, template, args...)
+}
+
+func logStructuredWith(severity string, audit any, template string, args ...any) {
 	msg := fmt.Sprintf(template, args...)
 	sl := structuredLog{
 		Severity: severity,
 		Message:  msg,
+		Audit:    audit,
 	}
 	content, err := json.Marshal(sl)
 	if err != nil {
-		fmt.Printf("Failed to log (message below): %v\n", err)
-		fmt.Println(msg)
+		fmt.Fprintf(logOutput, "Failed to log (message below): %v\n", err)
+		fmt.Fprintln(logOutput, msg)
 		return
 	}
-	fmt.Println(string(content))
+	fmt.Fprintln(logOutput, string(content))
 }
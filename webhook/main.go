@@ -1,14 +1,28 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func main() {
 	log.SetFlags(0)
 
+	if len(os.Args) > 1 {
+		subcommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	logInfo("Starting server...")
 
 	config, err := newConfig(context.Background())
@@ -16,21 +30,133 @@ func main() {
 		log.Fatalf("Bad config: %v", err)
 	}
 
-	// Ensure we have the Cloud Run Job created.
-	job := cloudRunJob{config: config}
-	if err := job.ensureJob(context.Background()); err != nil {
-		log.Fatalf("Failed to create Cloud Run job %q: %v", config.JobID, err)
+	shutdownTracing, err := initTracing(context.Background(), config)
+	if err != nil {
+		log.Fatalf("Failed to initialize tracing: %v", err)
 	}
+	defer shutdownTracing(context.Background())
+
+	clients, closeClients, err := newClients(context.Background(), config)
+	if err != nil {
+		log.Fatalf("Failed to create clients: %v", err)
+	}
+	defer closeClients()
+	if config.CacheURL != "" {
+		key, err := clients.secrets.readSecret(context.Background(), config.CacheSecretName)
+		if err != nil {
+			log.Fatalf("Failed to read $CACHE_SECRET: %v", err)
+		}
+		config.cacheKey = bytes.TrimSpace(key)
+	}
+	if config.RunnerEventsURL != "" {
+		key, err := clients.secrets.readSecret(context.Background(), config.EventsSecretName)
+		if err != nil {
+			log.Fatalf("Failed to read $RUNNER_EVENTS_SECRET: %v", err)
+		}
+		config.runnerEventsKey = bytes.TrimSpace(key)
+	}
+
+	// Ensure we have the Cloud Run Jobs created.
+	for _, job := range configuredJobs(config, clients.jobs) {
+		job.networks, job.accounts = clients.networks, clients.accounts
+		if err := job.ensureJob(context.Background()); err != nil {
+			logError("Startup diagnostics:\n%s", diagnosticsReport(context.Background(), clients, config))
+			log.Fatalf("Failed to create Cloud Run job %q: %v", job.jobID(), err)
+		}
+	}
+	logInfo("Startup diagnostics:\n%s", diagnosticsReport(context.Background(), clients, config))
+	go func() {
+		// Best effort: the jobs are deleted by a later start if this fails.
+		if _, err := pruneJobs(context.Background(), clients.jobs, config, time.Now()); err != nil {
+			logError("Deleting superseded Cloud Run jobs: %v", err)
+		}
+	}()
 
 	// Start HTTP server.
-	http.HandleFunc("/app/token", func(w http.ResponseWriter, r *http.Request) {
-		apphandler{w: w, r: r, config: config}.next()
-	})
-	http.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
-		handler{w: w, r: r, config: config}.next()
-	})
+	var archive *archiver
+	if config.ArchiveURL != "" {
+		store, err := newBlobStore(context.Background(), config.ArchiveURL)
+		if err != nil {
+			log.Fatalf("Failed to open delivery archive %q: %v", config.ArchiveURL, err)
+		}
+		archive = newArchiver(store, config.ArchiveRetention)
+		go archive.pruneLoop(context.Background())
+	}
+	var records *jobStore
+	if config.StateURL != "" {
+		store, err := newBlobStore(context.Background(), config.StateURL)
+		if err != nil {
+			log.Fatalf("Failed to open state store %q: %v", config.StateURL, err)
+		}
+		records = newJobStore(store)
+		go usageTracker{records: records, client: clients.jobs}.loop(context.Background())
+	}
+	s := newServer(clients, config, archive, records)
+	if config.CacheURL != "" {
+		store, err := newBlobStore(context.Background(), config.CacheURL)
+		if err != nil {
+			log.Fatalf("Failed to open cache store %q: %v", config.CacheURL, err)
+		}
+		s.cache = newActionsCache(store, int64(config.CacheRepoGiB*(1<<30)))
+	}
+	if config.DiagURL != "" {
+		store, err := newBlobStore(context.Background(), config.DiagURL)
+		if err != nil {
+			log.Fatalf("Failed to open diagnostic log store %q: %v", config.DiagURL, err)
+		}
+		s.diag = newDiagStore(store)
+	}
+	if s.budgets != nil {
+		go s.budgets.loop(context.Background())
+	}
+	if s.warm != nil {
+		go s.warm.loop(context.Background())
+	}
+	if s.watchdog != nil {
+		go s.watchdog.loop(context.Background())
+	}
+	if s.collector != nil {
+		go s.collector.loop(context.Background())
+	}
+
+	// Cloud Run limits HTTP/1 requests to 32MiB, which the Actions cache's
+	// chunks exceed; deployed with --use-http2, it sends unencrypted
+	// HTTP/2, which has no limit. HTTP/1 requests are still served.
+	srv := &http.Server{Addr: ":" + config.Port, Handler: h2c.NewHandler(s.mux(), &http2.Server{})}
+	go func() {
+		// Cloud Run sends SIGTERM before shutting down an instance; drain
+		// requests so that pending spans are flushed on exit.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		logInfo("Shutting down server...")
+		if err := srv.Shutdown(context.Background()); err != nil {
+			logError("Shutting down server: %v", err)
+		}
+	}()
+
 	logInfo("Listening on port %s", config.Port)
-	if err := http.ListenAndServe(":"+config.Port, nil); err != nil {
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatal(err)
 	}
 }
+
+// subcommand runs one of the command line tools and exits.
+func subcommand(name string, args []string) {
+	var err error
+	switch name {
+	case "replay":
+		err = replayMain(context.Background(), args)
+	case "simulate":
+		err = simulateMain(context.Background(), args)
+	case "policy":
+		err = policyMain(args)
+	case "usage":
+		err = usageMain(context.Background(), args)
+	default:
+		log.Fatalf("Unknown subcommand %q; available: policy, replay, simulate, usage", name)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+}
@@ -21,6 +21,10 @@ func location(ctx context.Context) (string, error) {
 	return parts[len(parts)-1], nil
 }
 
+func serviceAccountEmail(ctx context.Context) (string, error) {
+	return metadataQuery(ctx, "/instance/service-accounts/default/email")
+}
+
 func metadataQuery(ctx context.Context, path string) (string, error) {
 	url := "http://metadata.google.internal/computeMetadata/v1" + path
 	req, err := http.NewRequest(http.MethodGet, url, nil)
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	stuckJobsRedispatched = newCounter("cr_runner_stuck_jobs_redispatched_total", "Replacement runners started for dispatched workflow jobs that did not start.", "repository")
+	stuckJobsFailed       = newCounter("cr_runner_stuck_jobs_failed_total", "Dispatched workflow jobs that did not start after $STUCK_JOB_RETRIES replacement runners.", "repository")
+
+	gcRunnersDeleted      = newCounter("cr_runner_gc_runners_deleted_total", "Offline runner registrations removed by garbage collection.", "repository")
+	gcExecutionsCancelled = newCounter("cr_runner_gc_executions_cancelled_total", "Executions cancelled by garbage collection because their workflow job had finished.", "repository")
+
+	cacheHits      = newCounter("cr_runner_cache_hits_total", "Actions cache lookups that found an entry.", "repository")
+	cacheMisses    = newCounter("cr_runner_cache_misses_total", "Actions cache lookups that found no entry.", "repository")
+	cacheEvictions = newCounter("cr_runner_cache_evictions_total", "Actions cache entries evicted because the repository was over $CACHE_REPO_GIB.", "repository")
+
+	// counters are served by /metrics, in this order.
+	counters = []*counter{stuckJobsRedispatched, stuckJobsFailed, gcRunnersDeleted, gcExecutionsCancelled, cacheHits, cacheMisses, cacheEvictions}
+
+	labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// counter is a count that only goes up, per value of a single label. The
+// counts are per instance and start from zero when it starts.
+type counter struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]float64 // By label value.
+}
+
+func newCounter(name, help, label string) *counter {
+	return &counter{name: name, help: help, label: label, values: map[string]float64{}}
+}
+
+func (c *counter) inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue]++
+}
+
+func (c *counter) value(labelValue string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+// write writes the counter in the Prometheus text exposition format.
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	var labels []string
+	for l := range c.values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %g\n", c.name, c.label, labelValueEscaper.Replace(l), c.values[l])
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// forkPolicy is what to do with workflow jobs from untrusted pull requests:
+// those from forks or from first-time contributors. Self-hosted runners
+// should not run arbitrary code from strangers; see
+// https://docs.github.com/en/actions/hosting-your-own-runners/managing-self-hosted-runners/about-self-hosted-runners#self-hosted-runner-security
+type forkPolicy string
+
+const (
+	forkPolicyAllow  forkPolicy = "allow"  // Run them like any other job.
+	forkPolicyDeny   forkPolicy = "deny"   // Do not start a runner.
+	forkPolicyLocked forkPolicy = "locked" // Run them with the locked-down profile.
+	forkPolicyLabel  forkPolicy = "label"  // Run them only if the pull request has the approval label.
+)
+
+var forkPolicies = []forkPolicy{forkPolicyAllow, forkPolicyDeny, forkPolicyLocked, forkPolicyLabel}
+
+func (p forkPolicy) valid() bool {
+	return slices.Contains(forkPolicies, p)
+}
+
+// profile selects the Cloud Run job a runner is started in.
+type profile string
+
+const (
+	// profileDefault runs the runner in the job configured by the env vars.
+	profileDefault profile = "default"
+	// profileLocked runs the runner in a job with no access to the GitHub
+	// token secret or any other secret, registering with a short-lived
+	// registration token instead, as $LOCKED_SERVICE_ACCOUNT.
+	profileLocked profile = "locked"
+	// profileSmall runs the runner with $SMALL_JOB_CPU and $SMALL_JOB_MEMORY,
+	// for repositories over a budget with the "small" action.
+	profileSmall profile = "small"
+)
+
+// jobProfiles returns the profiles that need a Cloud Run job with config.
+func jobProfiles(config config) []profile {
+	profiles := []profile{profileDefault}
+	if config.ForkPolicy == forkPolicyLocked || config.rules.usesProfile(profileLocked) {
+		profiles = append(profiles, profileLocked)
+	}
+	if config.budgets.usesProfile(profileSmall) || config.warmPools.usesProfile(profileSmall) {
+		profiles = append(profiles, profileSmall)
+	}
+	return profiles
+}
+
+var (
+	// untrustedEvents are the workflow triggers that run code, or act on
+	// input, from a pull request's author.
+	untrustedEvents = []string{"pull_request", "pull_request_target", "pull_request_review", "pull_request_review_comment"}
+
+	// untrustedAssociations are the author associations of first-time
+	// contributors.
+	untrustedAssociations = []string{"FIRST_TIMER", "FIRST_TIME_CONTRIBUTOR", "NONE"}
+)
+
+// decision is the outcome of a dispatch policy for a workflow job.
+type decision struct {
+	allow   bool
+	profile profile
+	rule    string // The $POLICY_FILE rule that applied, if any.
+	budget  string // The $BUDGET_FILE budget that applied, if any.
+	reason  string
+}
+
+// trigger describes what triggered a workflow job, resolved from its run.
+type trigger struct {
+	run          *eventWorkflowRun // Nil if not resolved.
+	pullRequests []pullRequest
+	fork         bool
+	firstTimer   bool
+}
+
+func (t trigger) untrusted() bool {
+	return t.run != nil && slices.Contains(untrustedEvents, t.run.Event) && (t.fork || t.firstTimer)
+}
+
+// resolveTrigger looks up the workflow run behind a queued job and, if it
+// was triggered by a pull request, the pull requests from its head branch.
+func resolveTrigger(ctx context.Context, github gitHubClient, ev *event) (trigger, error) {
+	run, err := github.getWorkflowRun(ctx, ev.WorkflowJob.RunURL)
+	if err != nil {
+		return trigger{}, fmt.Errorf("getting workflow run %q: %v", ev.WorkflowJob.RunURL, err)
+	}
+	t := trigger{run: run}
+	if !slices.Contains(untrustedEvents, run.Event) {
+		return t, nil
+	}
+
+	// Not head.Fork, which is also set for branches of a repository that is
+	// itself a fork.
+	head := run.HeadRepository
+	t.fork = !strings.EqualFold(head.FullName, run.Repository.FullName)
+	// GitHub leaves pull_requests empty for runs from forks, so find them by head branch.
+	owner := head.Owner.Login
+	if owner == "" {
+		owner, _, _ = strings.Cut(head.FullName, "/")
+	}
+	prs, err := github.listPullRequests(ctx, run.Repository.FullName, owner+":"+run.HeadBranch)
+	if err != nil {
+		return trigger{}, fmt.Errorf("listing pull requests for %s:%s: %v", owner, run.HeadBranch, err)
+	}
+	for _, pr := range prs {
+		if pr.Head.SHA != "" && pr.Head.SHA != run.HeadSHA {
+			continue
+		}
+		t.pullRequests = append(t.pullRequests, pr)
+		if slices.Contains(untrustedAssociations, pr.AuthorAssociation) {
+			t.firstTimer = true
+		}
+	}
+	return t, nil
+}
+
+// forkDecision applies policy to a workflow job with trigger t.
+func forkDecision(policy forkPolicy, approvalLabel string, t trigger) decision {
+	if policy == forkPolicyAllow {
+		return decision{allow: true, profile: profileDefault, reason: "fork policy is allow"}
+	}
+	if !t.untrusted() {
+		return decision{allow: true, profile: profileDefault, reason: "trusted trigger"}
+	}
+	who := "fork pull request"
+	if !t.fork {
+		who = "first-time contributor pull request"
+	}
+	switch policy {
+	case forkPolicyLocked:
+		return decision{allow: true, profile: profileLocked, reason: who + " routed to locked profile"}
+	case forkPolicyLabel:
+		for _, pr := range t.pullRequests {
+			if pr.hasLabel(approvalLabel) {
+				return decision{allow: true, profile: profileDefault, reason: fmt.Sprintf("%s #%d approved with label %q", who, pr.Number, approvalLabel)}
+			}
+		}
+		return decision{reason: fmt.Sprintf("%s is missing approval label %q", who, approvalLabel)}
+	default:
+		return decision{reason: who + " denied by policy"}
+	}
+}
+
+// auditEvent records a dispatch decision. It is logged as structured data
+// so that decisions can be queried in Cloud Logging.
+type auditEvent struct {
+	Type              string   `json:"type"`
+	Repository        string   `json:"repository"`
+	WorkflowJobID     int      `json:"workflowJobId"`
+	WorkflowJobName   string   `json:"workflowJobName"`
+	RunID             int64    `json:"runId"`
+	Trigger           string   `json:"trigger,omitempty"`
+	Actor             string   `json:"actor,omitempty"`
+	HeadRepository    string   `json:"headRepository,omitempty"`
+	PullRequests      []int    `json:"pullRequests,omitempty"`
+	AuthorAssociation []string `json:"authorAssociation,omitempty"`
+	Fork              bool     `json:"fork"`
+	FirstTimer        bool     `json:"firstTimer"`
+	Policy            string   `json:"policy"`
+	Allowed           bool     `json:"allowed"`
+	Profile           string   `json:"profile,omitempty"`
+	Rule              string   `json:"rule,omitempty"`
+	Budget            string   `json:"budget,omitempty"`
+	Reason            string   `json:"reason"`
+}
+
+func newAuditEvent(ev *event, t trigger, policy forkPolicy, d decision) auditEvent {
+	a := auditEvent{
+		Type:            "dispatch",
+		Repository:      ev.Repository.FullName,
+		WorkflowJobID:   ev.WorkflowJob.ID,
+		WorkflowJobName: ev.WorkflowJob.Name,
+		RunID:           ev.WorkflowJob.RunID,
+		Fork:            t.fork,
+		FirstTimer:      t.firstTimer,
+		Policy:          string(policy),
+		Allowed:         d.allow,
+		Rule:            d.rule,
+		Budget:          d.budget,
+		Reason:          d.reason,
+	}
+	if d.allow {
+		a.Profile = string(d.profile)
+	}
+	if t.run != nil {
+		a.Trigger = t.run.Event
+		a.Actor = t.run.TriggeringActor.Login
+		a.HeadRepository = t.run.HeadRepository.FullName
+	}
+	for _, pr := range t.pullRequests {
+		a.PullRequests = append(a.PullRequests, pr.Number)
+		a.AuthorAssociation = append(a.AuthorAssociation, pr.AuthorAssociation)
+	}
+	return a
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestForkPolicy(t *testing.T) {
+	base := eventRepository{FullName: "squee1945/self-hosted-runner", Owner: gitHubUser{Login: "squee1945"}}
+	fork := eventRepository{FullName: "stranger/self-hosted-runner", Fork: true, Owner: gitHubUser{Login: "stranger"}}
+	// A repository that is itself a fork of another.
+	forked := eventRepository{FullName: "squee1945/self-hosted-runner", Fork: true, Owner: gitHubUser{Login: "squee1945"}}
+	const sha = "720bd4aae6521bfce13488b41b93919c64088420"
+
+	runs := map[string]*eventWorkflowRun{
+		"push":        {Event: "push", HeadBranch: "main", HeadSHA: sha, Repository: base, HeadRepository: base},
+		"member pr":   {Event: "pull_request", HeadBranch: "feature", HeadSHA: sha, Repository: base, HeadRepository: base},
+		"first timer": {Event: "pull_request", HeadBranch: "typo", HeadSHA: sha, Repository: base, HeadRepository: base},
+		"fork pr":     {Event: "pull_request", HeadBranch: "main", HeadSHA: sha, Repository: base, HeadRepository: fork},
+		"forked repo": {Event: "pull_request", HeadBranch: "feature", HeadSHA: sha, Repository: forked, HeadRepository: forked},
+	}
+	pulls := map[string][]pullRequest{
+		"squee1945/self-hosted-runner squee1945:feature": {{Number: 1, AuthorAssociation: "MEMBER", Head: pullRequestRef{SHA: sha}}},
+		"squee1945/self-hosted-runner squee1945:typo":    {{Number: 2, AuthorAssociation: "FIRST_TIME_CONTRIBUTOR", Head: pullRequestRef{SHA: sha}}},
+		"squee1945/self-hosted-runner stranger:main":     {{Number: 3, AuthorAssociation: "CONTRIBUTOR", Head: pullRequestRef{SHA: sha}}},
+	}
+	labelled := map[string][]pullRequest{
+		"squee1945/self-hosted-runner stranger:main": {{Number: 3, AuthorAssociation: "CONTRIBUTOR", Head: pullRequestRef{SHA: sha}, Labels: []label{{Name: "Safe-To-Run"}}}},
+	}
+	stale := map[string][]pullRequest{
+		"squee1945/self-hosted-runner stranger:main": {{Number: 3, AuthorAssociation: "CONTRIBUTOR", Head: pullRequestRef{SHA: "0000"}, Labels: []label{{Name: "safe-to-run"}}}},
+	}
+
+	tests := []struct {
+		name        string
+		policy      forkPolicy
+		run         string // Key into runs; empty if the run cannot be found.
+		pulls       map[string][]pullRequest
+		wantStatus  int
+		wantJob     string // Job ID run, if any.
+		wantAllowed bool
+	}{
+		{name: "push", policy: forkPolicyDeny, run: "push", wantStatus: http.StatusOK, wantJob: "runner-abc", wantAllowed: true},
+		{name: "member pull request", policy: forkPolicyDeny, run: "member pr", wantStatus: http.StatusOK, wantJob: "runner-abc", wantAllowed: true},
+		{name: "fork denied", policy: forkPolicyDeny, run: "fork pr", wantStatus: http.StatusOK},
+		{name: "pull request within a forked repository", policy: forkPolicyDeny, run: "forked repo", wantStatus: http.StatusOK, wantJob: "runner-abc", wantAllowed: true},
+		{name: "first timer denied", policy: forkPolicyDeny, run: "first timer", wantStatus: http.StatusOK},
+		{name: "fork allowed", policy: forkPolicyAllow, wantStatus: http.StatusOK, wantJob: "runner-abc", wantAllowed: true},
+		{name: "fork locked", policy: forkPolicyLocked, run: "fork pr", wantStatus: http.StatusOK, wantJob: "runner-abc-locked", wantAllowed: true},
+		{name: "push not locked", policy: forkPolicyLocked, run: "push", wantStatus: http.StatusOK, wantJob: "runner-abc", wantAllowed: true},
+		{name: "fork without label", policy: forkPolicyLabel, run: "fork pr", wantStatus: http.StatusOK},
+		{name: "fork with label", policy: forkPolicyLabel, run: "fork pr", pulls: labelled, wantStatus: http.StatusOK, wantJob: "runner-abc", wantAllowed: true},
+		{name: "label on another commit", policy: forkPolicyLabel, run: "fork pr", pulls: stale, wantStatus: http.StatusOK},
+		{name: "run not found", policy: forkPolicyDeny, wantStatus: http.StatusInternalServerError},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.ForkPolicy = tc.policy
+			clients, jobs := testClients(t, config)
+			gh := clients.github.(*fakeGitHub)
+			gh.runs = map[string]*eventWorkflowRun{}
+			if tc.run != "" {
+				gh.runs[testRunURL] = runs[tc.run]
+			}
+			gh.pulls = pulls
+			if tc.pulls != nil {
+				gh.pulls = tc.pulls
+			}
+			h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL))}
+
+			var logs bytes.Buffer
+			logOutput = &logs
+			w := serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json")))
+			logOutput = os.Stdout
+
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status got:%d want:%d (body %q)", w.Code, tc.wantStatus, w.Body.String())
+			}
+			reqs := jobs.runRequests()
+			switch {
+			case tc.wantJob == "" && len(reqs) != 0:
+				t.Errorf("runs got:%d want:0", len(reqs))
+			case tc.wantJob != "" && len(reqs) != 1:
+				t.Errorf("runs got:%d want:1", len(reqs))
+			case tc.wantJob != "":
+				if want := "projects/my-project/locations/us-central1/jobs/" + tc.wantJob; reqs[0].Name != want {
+					t.Errorf("job got:%q want:%q", reqs[0].Name, want)
+				}
+				_, hasToken := overrideEnv(reqs[0])[runnerTokenEnvVar]
+				if want := tc.wantJob == "runner-abc-locked"; hasToken != want {
+					t.Errorf("has $%s got:%t want:%t", runnerTokenEnvVar, hasToken, want)
+				}
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			audit, ok := findAudit(logs.String())
+			if !ok {
+				t.Fatalf("no audit event logged:\n%s", logs.String())
+			}
+			if audit.Allowed != tc.wantAllowed {
+				t.Errorf("audit allowed got:%t want:%t (reason %q)", audit.Allowed, tc.wantAllowed, audit.Reason)
+			}
+			if audit.Policy != string(tc.policy) || audit.WorkflowJobID != 14171575672 {
+				t.Errorf("audit got:%+v", audit)
+			}
+		})
+	}
+}
+
+// findAudit returns the first audit event in the structured logs.
+func findAudit(logs string) (auditEvent, bool) {
+	for _, line := range strings.Split(logs, "\n") {
+		var entry struct {
+			Audit *auditEvent `json:"audit"`
+		}
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Audit != nil {
+			return *entry.Audit, true
+		}
+	}
+	return auditEvent{}, false
+}
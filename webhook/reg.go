@@ -11,6 +11,10 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Registration struct {
@@ -18,6 +22,7 @@ type Registration struct {
 	installationID int64
 	repo           string
 	pk             *rsa.PrivateKey
+	baseURL        string
 }
 
 func NewRegistration(applicationID, installationID int64, repo string, pk *rsa.PrivateKey) Registration {
@@ -26,10 +31,14 @@ func NewRegistration(applicationID, installationID int64, repo string, pk *rsa.P
 		installationID: installationID,
 		repo:           repo,
 		pk:             pk,
+		baseURL:        gitHubAPIURL,
 	}
 }
 
-func (r Registration) Token(ctx context.Context) (string, error) {
+func (r Registration) Token(ctx context.Context) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "Registration.Token", trace.WithAttributes(attribute.String("github.repository", r.repo)))
+	defer func() { endSpan(span, err) }()
+
 	jwt, err := r.generateJWT(ctx)
 	if err != nil {
 		return "", fmt.Errorf("generating JWT: %v", err)
@@ -56,9 +65,12 @@ func (r Registration) generateJWT(ctx context.Context) (string, error) {
 	return token.SignedString(r.pk)
 }
 
-func (r Registration) appAccessToken(ctx context.Context, jwt string) (string, error) {
-	url := fmt.Sprintf("https://api.github.com/app/installations/%d/access_tokens", r.installationID)
-	req, err := http.NewRequest(http.MethodPost, url, nil)
+func (r Registration) appAccessToken(ctx context.Context, jwt string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "Registration.appAccessToken", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	url := fmt.Sprintf("%s/app/installations/%d/access_tokens", r.baseURL, r.installationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return "", fmt.Errorf("creating http request: %v", err)
 	}
@@ -66,10 +78,14 @@ func (r Registration) appAccessToken(ctx context.Context, jwt string) (string, e
 	req.Header.Add("Authorization", "Bearer "+jwt)
 	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
 
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("calling access_tokens API (status %d): %v", res.StatusCode, err)
+		return "", fmt.Errorf("calling access_tokens API: %v", err)
 	}
+	defer res.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
 
 	tokenBytes, err := io.ReadAll(res.Body)
 	if err != nil {
@@ -93,10 +109,13 @@ func (r Registration) appAccessToken(ctx context.Context, jwt string) (string, e
 	return ght.Token, nil
 }
 
-func (r Registration) appRegistrationToken(ctx context.Context, appAccessToken string) (string, error) {
+func (r Registration) appRegistrationToken(ctx context.Context, appAccessToken string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "Registration.appRegistrationToken", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
 	// https://docs.github.com/en/rest/actions/self-hosted-runners?apiVersion=2022-11-28#create-a-registration-token-for-a-repository
-	url := fmt.Sprintf("https://api.github.com/repos/%s/actions/runners/registration-token", r.repo)
-	req, err := http.NewRequest(http.MethodPost, url, nil)
+	url := fmt.Sprintf("%s/repos/%s/actions/runners/registration-token", r.baseURL, r.repo)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
 	if err != nil {
 		return "", fmt.Errorf("creating http request: %v", err)
 	}
@@ -104,10 +123,14 @@ func (r Registration) appRegistrationToken(ctx context.Context, appAccessToken s
 	req.Header.Add("Authorization", "token "+appAccessToken)
 	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
 
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("calling registration-token API (status %d): %v", res.StatusCode, err)
+		return "", fmt.Errorf("calling registration-token API: %v", err)
 	}
+	defer res.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", res.StatusCode))
 
 	tokenBytes, err := io.ReadAll(res.Body)
 	if err != nil {
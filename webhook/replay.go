@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayMain implements the "replay" subcommand, which re-signs archived
+// deliveries and POSTs them to a webhook instance.
+//
+//	webhook replay -archive gs://bucket/prefix -url https://my-service.run.app/webhook -secret-file secret.txt deliveries/2023-07-26/...json
+func replayMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	archiveURL := fs.String("archive", os.Getenv("ARCHIVE_URL"), `Archive holding the deliveries, "gs://bucket/prefix" or a local directory.`)
+	targetURL := fs.String("url", "http://localhost:8080/webhook", "Webhook URL to POST the deliveries to.")
+	secretFile := fs.String("secret-file", "", "File holding the webhook secret used to re-sign deliveries, byte for byte as in Secret Manager.")
+	secretName := fs.String("secret-name", "", `Secret Manager secret holding the webhook secret, "projects/{project}/secrets/{secret_name}".`)
+	prefix := fs.String("prefix", "", `Replay every delivery whose key starts with this (e.g., "deliveries/2023-07-26/") instead of listing keys.`)
+	count := fs.Int("count", 1, "Number of times to send each delivery (for load testing).")
+	concurrency := fs.Int("concurrency", 1, "Number of deliveries to send in parallel.")
+	fs.Parse(args)
+
+	if *archiveURL == "" {
+		return errors.New("-archive is required")
+	}
+	if *concurrency < 1 {
+		return fmt.Errorf("-concurrency %d must be at least 1", *concurrency)
+	}
+	if *count < 1 {
+		return fmt.Errorf("-count %d must be at least 1", *count)
+	}
+	store, err := newBlobStore(ctx, *archiveURL)
+	if err != nil {
+		return fmt.Errorf("opening archive: %v", err)
+	}
+
+	var secret []byte
+	switch {
+	case *secretFile != "":
+		if secret, err = os.ReadFile(*secretFile); err != nil {
+			return fmt.Errorf("reading secret file: %v", err)
+		}
+	case *secretName != "":
+		sm, err := newSecretManager(ctx, "")
+		if err != nil {
+			return fmt.Errorf("creating Secret Manager client: %v", err)
+		}
+		defer sm.close()
+		if secret, err = sm.readSecret(ctx, *secretName); err != nil {
+			return fmt.Errorf("reading secret: %v", err)
+		}
+	}
+	// The server signs with the secret's bytes as they are, so a trailing
+	// newline is part of the secret.
+
+	keys := fs.Args()
+	if *prefix != "" {
+		blobs, err := store.list(ctx, *prefix)
+		if err != nil {
+			return fmt.Errorf("listing archive: %v", err)
+		}
+		for _, b := range blobs {
+			keys = append(keys, b.key)
+		}
+	}
+	if len(keys) == 0 {
+		return errors.New("no deliveries to replay; pass keys as arguments or use -prefix")
+	}
+
+	var deliveries []delivery
+	for _, key := range keys {
+		d, err := loadDelivery(ctx, store, key)
+		if err != nil {
+			return err
+		}
+		deliveries = append(deliveries, d)
+	}
+
+	work := make(chan delivery)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures int
+	)
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range work {
+				if err := replayDelivery(ctx, *targetURL, secret, d); err != nil {
+					logError("Replaying delivery %q: %v", d.Header.Get(deliveryHeader), err)
+					mu.Lock()
+					failures++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	start := time.Now()
+	for i := 0; i < *count; i++ {
+		for _, d := range deliveries {
+			work <- d
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	total := *count * len(deliveries)
+	logInfo("Replayed %d deliveries in %v, %d failed.", total, time.Since(start), failures)
+	if failures > 0 {
+		return fmt.Errorf("%d of %d deliveries failed", failures, total)
+	}
+	return nil
+}
+
+// replayDelivery POSTs d to url with its original headers, re-signed with
+// secret (if any) the same way GitHub signs deliveries.
+func replayDelivery(ctx context.Context, url string, secret []byte, d delivery) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(d.Body))
+	if err != nil {
+		return fmt.Errorf("creating request: %v", err)
+	}
+	for k, vs := range d.Header {
+		// Only replay GitHub's headers; hop-by-hop and proxy headers do not apply.
+		if !strings.HasPrefix(strings.ToLower(k), "x-github-") && !strings.EqualFold(k, "Content-Type") && !strings.EqualFold(k, "User-Agent") {
+			continue
+		}
+		for _, v := range vs {
+			req.Header.Add(k, v)
+		}
+	}
+	if len(secret) > 0 {
+		req.Header.Set(sig256Header, signature(secret, d.Body))
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("posting delivery: %v", err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	logInfo("Replayed delivery %q (%s): %s %s", d.Header.Get(deliveryHeader), d.Header.Get(eventHeader), res.Status, body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const repoSetPrefix = "repos/"
+
+// repoSet is the set of repositories ("owner/repo") this service launches
+// runners for. It starts with $REPOSITORY_URL and follows GitHub app
+// installation changes. With a store, $STATE_URL, the repositories added by
+// installation changes are kept in it as "repos/{owner}/{repo}", so that
+// they survive restarts and every instance serves them; without one, they
+// are held in memory, and each instance learns about installation changes
+// independently. Removing $REPOSITORY_URL only lasts until a restart.
+type repoSet struct {
+	store blobStore // Optional.
+
+	mu    sync.RWMutex
+	repos map[string]bool
+}
+
+func newRepoSet(store blobStore, repos ...string) *repoSet {
+	s := &repoSet{store: store, repos: map[string]bool{}}
+	for _, r := range repos {
+		s.repos[strings.ToLower(r)] = true
+	}
+	return s
+}
+
+func repoSetKey(repo string) string {
+	return repoSetPrefix + strings.ToLower(repo)
+}
+
+func (s *repoSet) add(ctx context.Context, repos ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range repos {
+		if s.store == nil {
+			s.repos[strings.ToLower(r)] = true
+			continue
+		}
+		// Not held in memory too, so that another instance can remove it.
+		if err := s.store.put(ctx, repoSetKey(r), nil); err != nil {
+			return fmt.Errorf("storing repository %q: %v", r, err)
+		}
+	}
+	return nil
+}
+
+func (s *repoSet) remove(ctx context.Context, repos ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range repos {
+		if s.store != nil {
+			if err := s.store.delete(ctx, repoSetKey(r)); err != nil {
+				return fmt.Errorf("deleting repository %q: %v", r, err)
+			}
+		}
+		delete(s.repos, strings.ToLower(r))
+	}
+	return nil
+}
+
+// has reports whether the repository is served. With a store, repositories
+// not known to this instance are looked up in it, since another may have
+// added them.
+func (s *repoSet) has(ctx context.Context, repo string) (bool, error) {
+	s.mu.RLock()
+	ok := s.repos[strings.ToLower(repo)]
+	s.mu.RUnlock()
+	if ok || s.store == nil {
+		return ok, nil
+	}
+	if _, err := s.store.get(ctx, repoSetKey(repo)); err != nil {
+		if errors.Is(err, errBlobNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("looking up repository %q: %v", repo, err)
+	}
+	return true, nil
+}
+
+func (s *repoSet) list(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	set := map[string]bool{}
+	for r := range s.repos {
+		set[r] = true
+	}
+	s.mu.RUnlock()
+	if s.store != nil {
+		blobs, err := s.store.list(ctx, repoSetPrefix)
+		if err != nil {
+			return nil, fmt.Errorf("listing repositories: %v", err)
+		}
+		for _, b := range blobs {
+			set[strings.TrimPrefix(b.key, repoSetPrefix)] = true
+		}
+	}
+	var repos []string
+	for r := range set {
+		repos = append(repos, r)
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
+
+func repoNames(repos []eventRepository) []string {
+	var names []string
+	for _, r := range repos {
+		names = append(names, r.FullName)
+	}
+	return names
+}
+
+// repoURL returns the URL runners use to register with repo ("owner/repo").
+func repoURL(repo string) string {
+	return "https://github.com/" + repo
+}
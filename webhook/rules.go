@@ -0,0 +1,482 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+)
+
+// Rule actions.
+const (
+	ruleAllow = "allow"
+	ruleDeny  = "deny"
+)
+
+// policyFile is the format of $POLICY_FILE. Rules are evaluated in order and
+// the first whose "when" expression is true decides; if none match, the
+// default applies. For example:
+//
+//	{
+//	  "rules": [
+//	    {"name": "no-bots", "when": "sender.login == 'dependabot[bot]'", "action": "deny"},
+//	    {"name": "gpu", "when": "repo.full_name.startsWith('acme/') && 'gpu' in job.labels", "action": "allow"},
+//	    {"name": "untrusted", "when": "trigger.fork", "action": "allow", "profile": "locked"}
+//	  ],
+//	  "default": "deny",
+//	  "tests": [
+//	    {"name": "gpu job", "event": {...workflow_job payload...}, "want": "allow", "wantRule": "gpu"}
+//	  ]
+//	}
+type policyFile struct {
+	Rules   []ruleSpec `json:"rules"`
+	Default string     `json:"default"` // "allow" (if empty) or "deny".
+	Tests   []ruleTest `json:"tests"`
+}
+
+type ruleSpec struct {
+	Name    string  `json:"name"`
+	When    string  `json:"when"`    // A CEL expression over the variables in ruleVars.
+	Action  string  `json:"action"`  // "allow" or "deny".
+	Profile profile `json:"profile"` // For "allow"; defaults to profileDefault.
+}
+
+// ruleTest is a test case for a rule set, run at startup and by the
+// "policy" subcommand.
+type ruleTest struct {
+	Name        string          `json:"name"`
+	Event       json.RawMessage `json:"event"`   // A workflow_job payload.
+	Trigger     map[string]any  `json:"trigger"` // Overrides for the trigger variable, which is unresolved by default.
+	Want        string          `json:"want"`    // "allow" or "deny".
+	WantProfile profile         `json:"wantProfile"`
+	WantRule    string          `json:"wantRule"` // "" for the default.
+}
+
+// ruleSet is a compiled dispatch policy.
+type ruleSet struct {
+	rules        []rule
+	defaultAllow bool
+	tests        []ruleTest
+	usesTrigger  bool // Whether any rule refers to the trigger variable.
+}
+
+type rule struct {
+	ruleSpec
+	prg cel.Program
+}
+
+// ruleResult is the outcome of evaluating a rule set.
+type ruleResult struct {
+	rule    string // The matching rule; "" for the default.
+	allow   bool
+	profile profile
+	err     error // Evaluation failed; the result is a deny.
+}
+
+// ruleEnv declares the variables rules can refer to; see ruleVars.
+func ruleEnv() (*cel.Env, error) {
+	obj := cel.MapType(cel.StringType, cel.DynType)
+	return cel.NewEnv(
+		cel.Variable("repo", obj),
+		cel.Variable("organization", obj),
+		cel.Variable("sender", obj),
+		cel.Variable("job", obj),
+		cel.Variable("branch", cel.StringType),
+		cel.Variable("trigger", obj),
+	)
+}
+
+// loadRuleSet reads and compiles the policy at path.
+func loadRuleSet(path string) (*ruleSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading policy file: %v", err)
+	}
+	return parseRuleSet(b)
+}
+
+func parseRuleSet(b []byte) (*ruleSet, error) {
+	var pf policyFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&pf); err != nil {
+		return nil, fmt.Errorf("parsing policy: %v", err)
+	}
+
+	rs := &ruleSet{tests: pf.Tests}
+	switch pf.Default {
+	case "", ruleAllow:
+		rs.defaultAllow = true
+	case ruleDeny:
+	default:
+		return nil, fmt.Errorf("default %q must be %q or %q", pf.Default, ruleAllow, ruleDeny)
+	}
+
+	env, err := ruleEnv()
+	if err != nil {
+		return nil, fmt.Errorf("creating CEL environment: %v", err)
+	}
+	for i, spec := range pf.Rules {
+		if spec.Name == "" {
+			spec.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		switch spec.Action {
+		case ruleAllow:
+			if spec.Profile == "" {
+				spec.Profile = profileDefault
+			}
+			if spec.Profile != profileDefault && spec.Profile != profileLocked {
+				return nil, fmt.Errorf("rule %q: profile %q must be %q or %q", spec.Name, spec.Profile, profileDefault, profileLocked)
+			}
+		case ruleDeny:
+			if spec.Profile != "" {
+				return nil, fmt.Errorf("rule %q: deny rules cannot have a profile", spec.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %q: action %q must be %q or %q", spec.Name, spec.Action, ruleAllow, ruleDeny)
+		}
+
+		ast, iss := env.Compile(spec.When)
+		if iss.Err() != nil {
+			return nil, fmt.Errorf("rule %q: %v", spec.Name, iss.Err())
+		}
+		if t := ast.OutputType(); t != cel.BoolType && t != cel.DynType {
+			return nil, fmt.Errorf("rule %q: expression is %v, must be bool", spec.Name, t)
+		}
+		for _, ref := range ast.NativeRep().ReferenceMap() {
+			if ref.Name == "trigger" {
+				rs.usesTrigger = true
+			}
+		}
+		prg, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %v", spec.Name, err)
+		}
+		rs.rules = append(rs.rules, rule{ruleSpec: spec, prg: prg})
+	}
+	return rs, nil
+}
+
+// needsTrigger reports whether evaluating the rules requires the workflow
+// run to be looked up. It is safe to call on a nil rule set.
+func (rs *ruleSet) needsTrigger() bool {
+	return rs != nil && rs.usesTrigger
+}
+
+// usesProfile reports whether any rule can choose profile p. It is safe to
+// call on a nil rule set.
+func (rs *ruleSet) usesProfile(p profile) bool {
+	if rs == nil {
+		return false
+	}
+	return slices.ContainsFunc(rs.rules, func(r rule) bool { return r.Action == ruleAllow && r.Profile == p })
+}
+
+// canDeny reports whether the rules can deny a job, by a rule or the
+// default. It is safe to call on a nil rule set.
+func (rs *ruleSet) canDeny() bool {
+	if rs == nil {
+		return false
+	}
+	return !rs.defaultAllow || slices.ContainsFunc(rs.rules, func(r rule) bool { return r.Action == ruleDeny })
+}
+
+// evaluate returns the outcome of the first matching rule, or the default.
+// Evaluation errors, such as a reference to a missing field, deny.
+func (rs *ruleSet) evaluate(vars map[string]any) ruleResult {
+	for _, r := range rs.rules {
+		out, _, err := r.prg.Eval(vars)
+		if err != nil {
+			return ruleResult{rule: r.Name, err: err}
+		}
+		if out.Type() != types.BoolType {
+			return ruleResult{rule: r.Name, err: fmt.Errorf("returned %v, not bool", out.Type())}
+		}
+		if out != types.True {
+			continue
+		}
+		return ruleResult{rule: r.Name, allow: r.Action == ruleAllow, profile: r.Profile}
+	}
+	if rs.defaultAllow {
+		return ruleResult{allow: true, profile: profileDefault}
+	}
+	return ruleResult{}
+}
+
+// apply combines the rule result with the fork policy decision d. Rules can
+// deny a job or move it to a more restricted profile, but cannot undo a
+// fork policy decision.
+func (r ruleResult) apply(d decision) decision {
+	d.rule = r.rule
+	name := "default rule"
+	if r.rule != "" {
+		name = fmt.Sprintf("rule %q", r.rule)
+	}
+	switch {
+	case r.err != nil:
+		return decision{rule: r.rule, reason: fmt.Sprintf("%s failed: %v", name, r.err)}
+	case !r.allow:
+		return decision{rule: r.rule, reason: name + " denies"}
+	case r.profile == profileLocked && d.profile != profileLocked:
+		d.profile = profileLocked
+		d.reason = name + " routed to locked profile"
+	default:
+		d.reason += "; allowed by " + name
+	}
+	return d
+}
+
+// ruleVars are the CEL variables for a workflow job event.
+func ruleVars(ev *event, t trigger) map[string]any {
+	job := ev.WorkflowJob
+	labels := job.Labels
+	if labels == nil {
+		labels = []string{}
+	}
+	vars := map[string]any{
+		"repo": map[string]any{
+			"full_name": ev.Repository.FullName,
+			"name":      ev.Repository.Name,
+			"owner":     ev.Repository.Owner.Login,
+			"private":   ev.Repository.Private,
+			"fork":      ev.Repository.Fork,
+		},
+		"organization": map[string]any{
+			"login": ev.Organization.Login,
+		},
+		"sender": map[string]any{
+			"login": ev.Sender.Login,
+			"type":  ev.Sender.Type,
+		},
+		"job": map[string]any{
+			"id":            int64(job.ID),
+			"name":          job.Name,
+			"labels":        labels,
+			"workflow_name": job.WorkflowName,
+			"head_branch":   job.HeadBranch,
+			"head_sha":      job.HeadSHA,
+			"run_id":        job.RunID,
+			"run_attempt":   int64(job.RunAttempt),
+		},
+		"branch":  job.HeadBranch,
+		"trigger": triggerVars(t),
+	}
+	return vars
+}
+
+// triggerVars describes the resolved trigger; "resolved" is false if the
+// workflow run was not looked up.
+func triggerVars(t trigger) map[string]any {
+	vars := map[string]any{
+		"resolved":        t.run != nil,
+		"event":           "",
+		"actor":           "",
+		"head_repository": "",
+		"fork":            t.fork,
+		"first_timer":     t.firstTimer,
+		"untrusted":       t.untrusted(),
+		"pull_requests":   []any{},
+	}
+	if t.run != nil {
+		vars["event"] = t.run.Event
+		vars["actor"] = t.run.TriggeringActor.Login
+		vars["head_repository"] = t.run.HeadRepository.FullName
+	}
+	var prs []any
+	for _, pr := range t.pullRequests {
+		var labels []string
+		for _, l := range pr.Labels {
+			labels = append(labels, l.Name)
+		}
+		if labels == nil {
+			labels = []string{}
+		}
+		prs = append(prs, map[string]any{
+			"number":             int64(pr.Number),
+			"author":             pr.User.Login,
+			"author_association": pr.AuthorAssociation,
+			"labels":             labels,
+		})
+	}
+	if prs != nil {
+		vars["pull_requests"] = prs
+	}
+	return vars
+}
+
+// runTests runs the rule set's test cases and describes any failures.
+func (rs *ruleSet) runTests() []string {
+	var failures []string
+	for i, tc := range rs.tests {
+		name := tc.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i+1)
+		}
+		ev, err := parseEvent(tc.Event)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: parsing event: %v", name, err))
+			continue
+		}
+		vars := ruleVars(ev, trigger{})
+		tv := vars["trigger"].(map[string]any)
+		for k, v := range tc.Trigger {
+			tv[k] = v
+		}
+		got := rs.evaluate(vars)
+
+		want := tc.Want == ruleAllow
+		wantProfile := tc.WantProfile
+		if want && wantProfile == "" {
+			wantProfile = profileDefault
+		}
+		switch {
+		case got.err != nil:
+			failures = append(failures, fmt.Sprintf("%s: %s failed: %v", name, ruleName(got.rule), got.err))
+		case got.allow != want:
+			failures = append(failures, fmt.Sprintf("%s: got %s by %s, want %s", name, ruleAction(got.allow), ruleName(got.rule), tc.Want))
+		case got.allow && got.profile != wantProfile:
+			failures = append(failures, fmt.Sprintf("%s: got profile %q by %s, want %q", name, got.profile, ruleName(got.rule), wantProfile))
+		case tc.WantRule != "" && got.rule != tc.WantRule:
+			failures = append(failures, fmt.Sprintf("%s: got %s, want rule %q", name, ruleName(got.rule), tc.WantRule))
+		}
+	}
+	return failures
+}
+
+func ruleAction(allow bool) string {
+	if allow {
+		return ruleAllow
+	}
+	return ruleDeny
+}
+
+func ruleName(rule string) string {
+	if rule == "" {
+		return "the default"
+	}
+	return fmt.Sprintf("rule %q", rule)
+}
+
+// policyMain implements the "policy" subcommand, which checks a policy file
+// and runs its tests, and optionally evaluates workflow_job payloads against
+// it. The trigger variable is unresolved.
+//
+//	webhook policy -file policy.json testdata/workflow_job_queued.json
+func policyMain(args []string) error {
+	fs := flag.NewFlagSet("policy", flag.ExitOnError)
+	file := fs.String("file", os.Getenv("POLICY_FILE"), "Policy file to check.")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	rs, err := loadRuleSet(*file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d rules, %d tests.\n", *file, len(rs.rules), len(rs.tests))
+	failures := rs.runTests()
+	for _, f := range failures {
+		fmt.Println("FAIL " + f)
+	}
+
+	for _, path := range fs.Args() {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading event: %v", err)
+		}
+		ev, err := parseEvent(b)
+		if err != nil {
+			return fmt.Errorf("parsing %s: %v", path, err)
+		}
+		got := rs.evaluate(ruleVars(ev, trigger{}))
+		if got.err != nil {
+			fmt.Printf("%s: deny, %s failed: %v\n", path, ruleName(got.rule), got.err)
+			continue
+		}
+		fmt.Printf("%s: %s by %s", path, ruleAction(got.allow), ruleName(got.rule))
+		if got.allow {
+			fmt.Printf(" on the %s profile", got.profile)
+		}
+		fmt.Println()
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%d of %d tests failed", len(failures), len(rs.tests))
+	}
+	return nil
+}
+
+// evaluation is the dry-run response.
+type evaluation struct {
+	Allowed    bool     `json:"allowed"`
+	Profile    string   `json:"profile,omitempty"`
+	Rule       string   `json:"rule,omitempty"`
+	Reason     string   `json:"reason"`
+	ForkPolicy string   `json:"forkPolicy"`
+	Trigger    any      `json:"trigger"`
+	Variables  any      `json:"variables"`
+	Warnings   []string `json:"warnings,omitempty"`
+}
+
+// evaluate is the dry-run endpoint: it applies the fork policy and rules to
+// a POSTed workflow_job payload without starting a runner. The payload must
+// be signed like a delivery if $GITHUB_SIGNATURE_SECRET is set.
+func (h handler) evaluate() {
+	ctx := h.r.Context()
+	if h.r.Method != http.MethodPost {
+		h.clientError("Invalid method %q", h.r.Method)
+		return
+	}
+	body, err := io.ReadAll(h.r.Body)
+	if err != nil {
+		h.serverError("reading body: %v", err)
+		return
+	}
+	if err := h.validateSignature(ctx, body); err != nil {
+		h.clientError("validating signature: %v", err)
+		return
+	}
+	ev, err := parseEvent(body)
+	if err != nil {
+		h.clientError("parsing event: %v", err)
+		return
+	}
+
+	d, t, err := h.decide(ctx, ev)
+	if err != nil {
+		h.serverError("evaluating policy: %v", err)
+		return
+	}
+	e := evaluation{
+		Allowed:    d.allow,
+		Rule:       d.rule,
+		Reason:     d.reason,
+		ForkPolicy: string(h.config.ForkPolicy),
+		Trigger:    triggerVars(t),
+		Variables:  ruleVars(ev, t),
+	}
+	if d.allow {
+		e.Profile = string(d.profile)
+	}
+	if ev.Action != actionQueued {
+		e.Warnings = append(e.Warnings, fmt.Sprintf("action is %q; only %q jobs are dispatched", ev.Action, actionQueued))
+	}
+	if served, err := h.repos.has(h.r.Context(), ev.Repository.FullName); err != nil {
+		e.Warnings = append(e.Warnings, fmt.Sprintf("could not check whether repository %q is served: %v", ev.Repository.FullName, err))
+	} else if !served {
+		e.Warnings = append(e.Warnings, fmt.Sprintf("repository %q is not served by this service", ev.Repository.FullName))
+	}
+	h.w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(h.w)
+	enc.SetIndent("", "  ")
+	enc.Encode(e)
+}
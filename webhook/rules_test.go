@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRuleSetFile(t *testing.T) {
+	rs, err := loadRuleSet("testdata/policy.json")
+	if err != nil {
+		t.Fatalf("loadRuleSet() failed: %v", err)
+	}
+	if failures := rs.runTests(); len(failures) > 0 {
+		t.Errorf("runTests() failures:\n%s", strings.Join(failures, "\n"))
+	}
+	if !rs.needsTrigger() {
+		t.Errorf("needsTrigger() got:false want:true")
+	}
+	if !rs.usesProfile(profileLocked) {
+		t.Errorf("usesProfile(%q) got:false want:true", profileLocked)
+	}
+	if !rs.canDeny() {
+		t.Errorf("canDeny() got:false want:true")
+	}
+	allowing, err := parseRuleSet([]byte(`{"rules":[{"when":"'gpu' in job.labels","action":"allow"}]}`))
+	if err != nil {
+		t.Fatalf("parseRuleSet() failed: %v", err)
+	}
+	if allowing.canDeny() {
+		t.Errorf("canDeny() of allow-only rules got:true want:false")
+	}
+}
+
+func TestParseRuleSetErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{name: "syntax", policy: `{"rules":[{"when":"repo.full_name ==","action":"allow"}]}`, want: "Syntax error"},
+		{name: "unknown variable", policy: `{"rules":[{"when":"pusher.login == 'x'","action":"allow"}]}`, want: "undeclared reference"},
+		{name: "not bool", policy: `{"rules":[{"when":"branch","action":"allow"}]}`, want: "must be bool"},
+		{name: "bad action", policy: `{"rules":[{"when":"true","action":"maybe"}]}`, want: `action "maybe"`},
+		{name: "bad profile", policy: `{"rules":[{"when":"true","action":"allow","profile":"gpu"}]}`, want: `profile "gpu"`},
+		{name: "deny with profile", policy: `{"rules":[{"when":"true","action":"deny","profile":"locked"}]}`, want: "cannot have a profile"},
+		{name: "bad default", policy: `{"default":"maybe"}`, want: `default "maybe"`},
+		{name: "unknown field", policy: `{"rule":[]}`, want: "unknown field"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseRuleSet([]byte(tc.policy))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("parseRuleSet() error got:%v want containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuleSetTestFailures(t *testing.T) {
+	rs, err := parseRuleSet([]byte(`{
+		"rules": [{"name": "gpu", "when": "'gpu' in job.labels", "action": "allow"}],
+		"default": "deny",
+		"tests": [
+			{"name": "wrong want", "event": {"workflow_job": {"labels": ["gpu"]}}, "want": "deny"},
+			{"name": "wrong profile", "event": {"workflow_job": {"labels": ["gpu"]}}, "want": "allow", "wantProfile": "locked"},
+			{"name": "wrong rule", "event": {"workflow_job": {"labels": []}}, "want": "deny", "wantRule": "gpu"},
+			{"name": "passes", "event": {"workflow_job": {"labels": ["gpu"]}}, "want": "allow", "wantRule": "gpu"}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("parseRuleSet() failed: %v", err)
+	}
+	failures := rs.runTests()
+	if len(failures) != 3 {
+		t.Fatalf("runTests() got %d failures, want 3:\n%s", len(failures), strings.Join(failures, "\n"))
+	}
+	for i, want := range []string{"wrong want", "wrong profile", "wrong rule"} {
+		if !strings.HasPrefix(failures[i], want+":") {
+			t.Errorf("failure %d got:%q want prefix %q", i, failures[i], want)
+		}
+	}
+}
+
+func TestRulesDispatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     string
+		wantJob    string // Job ID run, if any.
+		wantReason string
+	}{
+		{name: "allowed", policy: `{"rules":[{"name":"runner","when":"job.name == 'build'","action":"allow"}],"default":"deny"}`, wantJob: "runner-abc"},
+		{name: "denied", policy: `{"rules":[{"name":"main","when":"branch != 'main'","action":"allow"}],"default":"deny"}`, wantReason: "default rule denies"},
+		{name: "locked", policy: `{"rules":[{"name":"ubuntu","when":"'ubuntu-latest' in job.labels","action":"allow","profile":"locked"}]}`, wantJob: "runner-abc-locked"},
+		{name: "missing field", policy: `{"rules":[{"name":"typo","when":"job.lables.size() > 0","action":"allow"}]}`, wantReason: `rule "typo" failed`},
+		{name: "trigger", policy: `{"rules":[{"name":"push","when":"trigger.event == 'push'","action":"deny"}]}`, wantReason: `rule "push" denies`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rs, err := parseRuleSet([]byte(tc.policy))
+			if err != nil {
+				t.Fatalf("parseRuleSet() failed: %v", err)
+			}
+			config := testConfig()
+			config.ForkPolicy = forkPolicyAllow
+			config.rules = rs
+			clients, jobs := testClients(t, config)
+			h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL))}
+
+			d, _, err := h.decide(context.Background(), mustParseFixture(t, "workflow_job_queued.json"))
+			if err != nil {
+				t.Fatalf("decide() failed: %v", err)
+			}
+			if tc.wantReason != "" && !strings.Contains(d.reason, tc.wantReason) {
+				t.Errorf("reason got:%q want containing %q", d.reason, tc.wantReason)
+			}
+
+			if w := serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json"))); w.Code != http.StatusOK {
+				t.Fatalf("status got:%d want:%d (body %q)", w.Code, http.StatusOK, w.Body.String())
+			}
+			reqs := jobs.runRequests()
+			switch {
+			case tc.wantJob == "" && len(reqs) != 0:
+				t.Errorf("runs got:%d want:0", len(reqs))
+			case tc.wantJob != "" && len(reqs) != 1:
+				t.Errorf("runs got:%d want:1", len(reqs))
+			case tc.wantJob != "":
+				if want := "projects/my-project/locations/us-central1/jobs/" + tc.wantJob; reqs[0].Name != want {
+					t.Errorf("job got:%q want:%q", reqs[0].Name, want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateEndpoint(t *testing.T) {
+	config := testConfig()
+	config.SignatureSecretName = testSignatureSecret
+	rs, err := loadRuleSet("testdata/policy.json")
+	if err != nil {
+		t.Fatalf("loadRuleSet() failed: %v", err)
+	}
+	config.rules = rs
+	clients, jobs := testClients(t, config)
+	mux := newServer(clients, config, nil, nil).mux()
+
+	body := readFixture(t, "workflow_job_queued.json")
+	r := httptest.NewRequest(http.MethodPost, "/policy/evaluate", bytes.NewReader(body))
+	r.Header.Set(sig256Header, signature([]byte(testSecretValue), body))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status got:%d want:%d (body %q)", w.Code, http.StatusOK, w.Body.String())
+	}
+	var got evaluation
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("unmarshalling response: %v", err)
+	}
+	if got.Allowed || got.Rule != "" || got.ForkPolicy != string(forkPolicyDeny) {
+		t.Errorf("evaluation got:%+v", got)
+	}
+	if n := len(jobs.runRequests()); n != 0 {
+		t.Errorf("runs got:%d want:0", n)
+	}
+
+	// Unsigned requests are rejected like deliveries.
+	r = httptest.NewRequest(http.MethodPost, "/policy/evaluate", bytes.NewReader(body))
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unsigned status got:%d want:%d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func mustParseFixture(t *testing.T, name string) *event {
+	t.Helper()
+	ev, err := parseEvent(readFixture(t, name))
+	if err != nil {
+		t.Fatalf("parseEvent() failed: %v", err)
+	}
+	return ev
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+const (
+	runnerEventsURLEnvVar    = "RUNNER_EVENTS_URL"
+	runnerEventsScriptEnvVar = "RUNNER_EVENTS_SCRIPT"
+	runnerEventsTokenEnvVar  = "RUNNER_EVENTS_TOKEN" // Set per execution.
+
+	// Set by the container's command, in Unix seconds.
+	containerStartedEnvVar = "RUNNER_CONTAINER_STARTED"
+	registeredEnvVar       = "RUNNER_REGISTERED"
+
+	// The events the runner reports.
+	runnerEventJobStarted   = "job_started"   // By the job started hook.
+	runnerEventJobCompleted = "job_completed" // By the job completed hook.
+	runnerEventExited       = "runner_exited" // When the runner, or config.sh, exits.
+
+	maxRunnerEventSize = 64 << 10
+
+	// runnerEventsTokenGrace is how long an event token outlives the
+	// execution's timeout, for the execution to be scheduled and its image
+	// pulled, and for the last event and _diag to be uploaded.
+	runnerEventsTokenGrace = time.Hour
+)
+
+var executionIDRE = regexp.MustCompile(`^[a-z0-9][-a-z0-9]*$`)
+
+// runnerEventsScript reports a runner event to $RUNNER_EVENTS_URL. The job
+// started and completed hooks run it, as does the container's command once
+// the runner exits. A response body is appended to the job's summary.
+const runnerEventsScript = `# Reports a runner event to the service: $1 is the event, and $2 the
+# runner's exit status for runner_exited. It never fails, so that a hook
+# cannot fail the job.
+[ -n "$RUNNER_EVENTS_TOKEN" ] || exit 0
+out=$(mktemp)
+body=$(printf '{"event":"%s","execution":"%s","task_index":%d,"repository":"%s","run_id":%d,"job_id":%d,"container_started":%d,"registered":%d,"time":%d,"exit_code":%d}' \
+  "$1" "$CLOUD_RUN_EXECUTION" "${CLOUD_RUN_TASK_INDEX:-0}" "$WORKFLOW_REPOSITORY" "${WORKFLOW_RUN_ID:-0}" "${WORKFLOW_JOB_ID:-0}" \
+  "${RUNNER_CONTAINER_STARTED:-0}" "${RUNNER_REGISTERED:-0}" "$(date +%s)" "${2:-0}")
+if curl -fsS --max-time 10 -H "Authorization: Bearer $RUNNER_EVENTS_TOKEN" -H "Content-Type: application/json" -d "$body" -o "$out" "$RUNNER_EVENTS_URL"; then
+  if [ -s "$out" ] && [ -n "$GITHUB_STEP_SUMMARY" ]; then cat "$out" >> "$GITHUB_STEP_SUMMARY"; fi
+else
+  echo "Reporting $1 to $RUNNER_EVENTS_URL failed." >&2
+fi
+rm -f "$out"
+exit 0`
+
+// runnerEventsCommand returns the container's command with the hooks set
+// up: it writes the script from $RUNNER_EVENTS_SCRIPT and the hooks that run
+// it, records when the container started and when register, which runs
+// config.sh, finished, and reports the runner's exit status. It then uploads
+// _diag, if upload is set; see diag.go.
+func runnerEventsCommand(register string, upload diagUpload) string {
+	diag := ""
+	if upload != "" {
+		diag = runnerDiagCommand(upload) + "; "
+	}
+	return fmt.Sprintf(`export %[1]s=$(date +%%s); mkdir -p /tmp/cr-runner && printf '%%s\n' "$%[2]s" > /tmp/cr-runner/event.sh && `+
+		`echo 'bash /tmp/cr-runner/event.sh %[3]s' > /tmp/cr-runner/job-started.sh && echo 'bash /tmp/cr-runner/event.sh %[4]s' > /tmp/cr-runner/job-completed.sh && `+
+		`export ACTIONS_RUNNER_HOOK_JOB_STARTED=/tmp/cr-runner/job-started.sh ACTIONS_RUNNER_HOOK_JOB_COMPLETED=/tmp/cr-runner/job-completed.sh; `+
+		`{ %[5]s && export %[6]s=$(date +%%s) && ./run.sh; }; status=$?; bash /tmp/cr-runner/event.sh %[7]s $status; %[8]sexit $status`,
+		containerStartedEnvVar, runnerEventsScriptEnvVar, runnerEventJobStarted, runnerEventJobCompleted, register, registeredEnvVar, runnerEventExited, diag)
+}
+
+// runnerEventsScope is what an execution's event token is signed for: the
+// repository and run it was started for, and when the token expires. Run 0
+// allows any of the repository's runs.
+type runnerEventsScope struct {
+	Repo    string `json:"repo"`
+	RunID   int64  `json:"run"`
+	Expires int64  `json:"exp"` // Unix seconds.
+}
+
+// allows reports whether the scope covers the repository's run.
+func (s runnerEventsScope) allows(repo string, runID int64) bool {
+	return s.Repo == strings.ToLower(repo) && (s.RunID == 0 || s.RunID == runID)
+}
+
+// recordedFor reports whether the execution of r was started with a token
+// for scope: one for the same repository and run.
+func recordedFor(r jobRecord, scope runnerEventsScope) bool {
+	return scope.Repo == strings.ToLower(r.Repository) && scope.RunID == r.RunID
+}
+
+// runnerEventsToken returns the execution's event token: its scope, signed
+// with $RUNNER_EVENTS_SECRET.
+func runnerEventsToken(key []byte, scope runnerEventsScope) string {
+	scope.Repo = strings.ToLower(scope.Repo)
+	b, err := json.Marshal(scope)
+	if err != nil {
+		panic(err) // Cannot fail for a struct of strings and ints.
+	}
+	return signToken(key, string(b))
+}
+
+// parseRunnerEventsToken returns the scope of a token made by
+// runnerEventsToken, and whether the token is valid and has not expired at
+// now.
+func parseRunnerEventsToken(key []byte, token string, now time.Time) (runnerEventsScope, bool) {
+	subject, ok := verifyToken(key, token)
+	if !ok {
+		return runnerEventsScope{}, false
+	}
+	var scope runnerEventsScope
+	if err := json.Unmarshal([]byte(subject), &scope); err != nil || scope.Repo == "" || now.Unix() >= scope.Expires {
+		return runnerEventsScope{}, false
+	}
+	return scope, true
+}
+
+// runnerEventsEnv returns the env var with the execution's event token, if
+// runners report events. Runners not started for a repository do not get
+// one, and so do not report; nor does the locked profile, since untrusted
+// code could read the token from its env. The token expires
+// runnerEventsTokenGrace after the execution's timeout.
+func (j *cloudRunJob) runnerEventsEnv(opts runOptions, now time.Time) []*runpb.EnvVar {
+	if j.config.RunnerEventsURL == "" || opts.repo == "" || j.profile == profileLocked {
+		return nil
+	}
+	timeout := opts.timeout
+	if timeout <= 0 {
+		timeout = j.config.JobTimeout
+	}
+	scope := runnerEventsScope{Repo: opts.repo, RunID: opts.runID, Expires: now.Add(timeout + runnerEventsTokenGrace).Unix()}
+	token := runnerEventsToken(j.config.runnerEventsKey, scope)
+	return []*runpb.EnvVar{{Name: runnerEventsTokenEnvVar, Values: &runpb.EnvVar_Value{Value: token}}}
+}
+
+// runnerEvent is what runnerEventsScript posts. Times are in Unix seconds;
+// zero if unknown.
+type runnerEvent struct {
+	Event            string `json:"event"`
+	Execution        string `json:"execution"` // The execution ID.
+	TaskIndex        int    `json:"task_index"`
+	Repository       string `json:"repository"`
+	RunID            int64  `json:"run_id"`
+	JobID            int    `json:"job_id"` // Zero for batches.
+	ContainerStarted int64  `json:"container_started"`
+	Registered       int64  `json:"registered"`
+	Time             int64  `json:"time"`
+	ExitCode         int    `json:"exit_code"` // For runner_exited.
+}
+
+func unixTime(sec int64) *time.Time {
+	if sec <= 0 {
+		return nil
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t
+}
+
+// apply records the event's timings in r.
+func (e runnerEvent) apply(r *jobRecord) {
+	if t := unixTime(e.ContainerStarted); t != nil {
+		r.ContainerStarted = t
+	}
+	if t := unixTime(e.Registered); t != nil {
+		r.Registered = t
+	}
+	switch e.Event {
+	case runnerEventJobStarted:
+		r.JobStarted = unixTime(e.Time)
+	case runnerEventJobCompleted:
+		r.JobCompleted = unixTime(e.Time)
+	case runnerEventExited:
+		code := e.ExitCode
+		r.ExitCode = &code
+	}
+}
+
+// runnerSummary is the Markdown appended to the job's summary: how long the
+// image took to start after dispatch, config.sh took to configure and
+// register the runner, the runner waited for the job, and the job took.
+func runnerSummary(r jobRecord) string {
+	since := func(from, to *time.Time) string {
+		if from == nil || to == nil || to.Before(*from) {
+			return "-"
+		}
+		return to.Sub(*from).Round(time.Second).String()
+	}
+	var dispatched *time.Time
+	if !r.Dispatched.IsZero() {
+		dispatched = &r.Dispatched
+	}
+	profile := r.Profile
+	if profile == "" {
+		profile = "-"
+	}
+	return fmt.Sprintf("### Cloud Run runner\n\n"+
+		"| Execution | Profile | Image start | Registration | Waiting for the job | Job |\n"+
+		"| --- | --- | --- | --- | --- | --- |\n"+
+		"| `%s` | %s | %s | %s | %s | %s |\n",
+		path.Base(r.Execution), profile, since(dispatched, r.ContainerStarted), since(r.ContainerStarted, r.Registered),
+		since(r.Registered, r.JobStarted), since(r.JobStarted, r.JobCompleted))
+}
+
+// runnerhandler serves /runner/events, which the runners' hooks post to with
+// the token their execution was started with.
+type runnerhandler struct {
+	w         http.ResponseWriter
+	r         *http.Request
+	config    config
+	records   *jobStore  // Optional.
+	diagStore *diagStore // Optional.
+}
+
+func (h runnerhandler) events() {
+	if h.config.RunnerEventsURL == "" {
+		http.Error(h.w, "Runner events are disabled; set $RUNNER_EVENTS_URL to enable them.", http.StatusNotFound)
+		return
+	}
+	if h.r.Method != http.MethodPost {
+		http.Error(h.w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	token, ok := strings.CutPrefix(h.r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		h.w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(h.w, "Missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	scope, ok := parseRunnerEventsToken(h.config.runnerEventsKey, token, time.Now())
+	if !ok {
+		logWarn("Rejected runner event: bad or expired token.")
+		http.Error(h.w, "Bad or expired token", http.StatusForbidden)
+		return
+	}
+
+	var ev runnerEvent
+	dec := json.NewDecoder(http.MaxBytesReader(h.w, h.r.Body, maxRunnerEventSize))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ev); err != nil {
+		http.Error(h.w, fmt.Sprintf("Bad event: %v", err), http.StatusBadRequest)
+		return
+	}
+	switch {
+	case ev.Event != runnerEventJobStarted && ev.Event != runnerEventJobCompleted && ev.Event != runnerEventExited:
+		http.Error(h.w, fmt.Sprintf("Unknown event %q", ev.Event), http.StatusBadRequest)
+		return
+	case !executionIDRE.MatchString(ev.Execution):
+		http.Error(h.w, fmt.Sprintf("Bad execution %q", ev.Execution), http.StatusBadRequest)
+		return
+	case !scope.allows(ev.Repository, ev.RunID):
+		logWarn("Rejected runner event from execution %q: token is not for %s run %d.", ev.Execution, ev.Repository, ev.RunID)
+		http.Error(h.w, "Token is not for the event's repository and run", http.StatusForbidden)
+		return
+	}
+	logInfo("Runner event %s from execution %s, task %d, for %s run %d job %d (exit code %d).", ev.Event, ev.Execution, ev.TaskIndex, ev.Repository, ev.RunID, ev.JobID, ev.ExitCode)
+
+	rec := &jobRecord{Execution: ev.Execution}
+	if h.records != nil {
+		ctx := h.r.Context()
+		found, err := h.records.find(ctx, ev.Execution, time.Now())
+		if err != nil {
+			logError("Error: finding the job record of execution %q: %v", ev.Execution, err)
+			http.Error(h.w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if found != nil && !recordedFor(*found, scope) {
+			logWarn("Rejected runner event for execution %q: it was started for %s run %d.", ev.Execution, found.Repository, found.RunID)
+			http.Error(h.w, "Token is not for the execution's repository and run", http.StatusForbidden)
+			return
+		}
+		if found != nil {
+			rec = found
+			if rec.Tasks <= 1 || ev.TaskIndex == 0 {
+				if err := h.records.update(ctx, *rec, ev.apply); err != nil {
+					logError("Error: recording runner event for execution %q: %v", ev.Execution, err)
+					http.Error(h.w, "Server error", http.StatusInternalServerError)
+					return
+				}
+			}
+		}
+	}
+	ev.apply(rec)
+
+	if ev.Event != runnerEventJobCompleted || !h.config.RunnerEventsSummary {
+		h.w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	h.w.Header().Set("Content-Type", "text/markdown")
+	h.w.Write([]byte(runnerSummary(*rec)))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunnerEventsJob(t *testing.T) {
+	config := testConfig()
+	config.RunnerEventsURL, config.runnerEventsKey = "https://gha-runner.example.com/runner/events", []byte("key")
+	for _, p := range []profile{profileDefault, profileLocked} {
+		job := cloudRunJob{config: config, profile: p}
+		req, err := job.createJobRequest()
+		if err != nil {
+			t.Fatalf("%s: createJobRequest() failed: %v", p, err)
+		}
+		runner := req.Job.Template.Template.Containers[0]
+		command := runner.Args[2]
+		for _, want := range []string{"ACTIONS_RUNNER_HOOK_JOB_STARTED=", "./config.sh", "export RUNNER_REGISTERED=$(date +%s) && ./run.sh", "event.sh runner_exited $status"} {
+			if !strings.Contains(command, want) {
+				t.Errorf("%s: command missing %q: %s", p, want, command)
+			}
+		}
+		env := map[string]string{}
+		for _, e := range runner.Env {
+			env[e.Name] = e.GetValue()
+		}
+		if env[runnerEventsURLEnvVar] != config.RunnerEventsURL || env[runnerEventsScriptEnvVar] != runnerEventsScript {
+			t.Errorf("%s: env got:%v", p, env)
+		}
+
+		now := time.Now()
+		run, err := job.runJobRequest(context.Background(), runOptions{repoURL: config.RepositoryURL, runnerToken: "t", repo: "Owner/Repo", runID: 42, timeout: time.Hour})
+		if err != nil {
+			t.Fatalf("%s: runJobRequest() failed: %v", p, err)
+		}
+		var token string
+		for _, e := range run.Overrides.ContainerOverrides[0].Env {
+			if e.Name == runnerEventsTokenEnvVar {
+				token = e.GetValue()
+			}
+		}
+		if p == profileLocked {
+			if token != "" {
+				t.Errorf("%s: got token %q", p, token)
+			}
+			continue
+		}
+		scope, ok := parseRunnerEventsToken(config.runnerEventsKey, token, now)
+		if want := now.Add(time.Hour + runnerEventsTokenGrace).Unix(); !ok || scope.Repo != "owner/repo" || scope.RunID != 42 || scope.Expires < want || scope.Expires > want+60 {
+			t.Errorf("%s: token scope got:%+v, %t", p, scope, ok)
+		}
+		if _, ok := parseRunnerEventsToken(config.runnerEventsKey, token, time.Unix(scope.Expires, 0)); ok {
+			t.Errorf("%s: token valid at its expiry", p)
+		}
+	}
+}
+
+func TestRunnerEvents(t *testing.T) {
+	store, err := newBlobStore(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	records := newJobStore(store)
+	now := time.Now().Truncate(time.Second)
+	rec := jobRecord{
+		Execution:  "projects/my-project/locations/us-central1/jobs/runner-abc/executions/runner-abc-x7k2p",
+		Profile:    "default",
+		Repository: "owner/repo",
+		RunID:      42,
+		Dispatched: now.Add(-2 * time.Minute),
+	}
+	other := jobRecord{
+		Execution:  "projects/my-project/locations/us-central1/jobs/runner-abc/executions/runner-abc-other",
+		Profile:    "default",
+		Repository: "someone/else",
+		RunID:      7,
+		Dispatched: now.Add(-2 * time.Minute),
+	}
+	for _, r := range []jobRecord{rec, other} {
+		if err := records.put(context.Background(), r); err != nil {
+			t.Fatalf("put() failed: %v", err)
+		}
+	}
+	config := testConfig()
+	config.RunnerEventsURL, config.RunnerEventsSummary, config.runnerEventsKey = "https://gha-runner.example.com/runner/events", true, []byte("key")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		runnerhandler{w: w, r: r, config: config, records: records}.events()
+	}))
+	defer srv.Close()
+
+	post := func(token, body string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, srv.URL, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("posting event failed: %v", err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	event := func(name string, at time.Time, exitCode int) string {
+		return fmt.Sprintf(`{"event":%q,"execution":"runner-abc-x7k2p","task_index":0,"repository":"owner/repo","run_id":42,"job_id":7,"container_started":%d,"registered":%d,"time":%d,"exit_code":%d}`,
+			name, now.Add(-90*time.Second).Unix(), now.Add(-80*time.Second).Unix(), at.Unix(), exitCode)
+	}
+	tokenFor := func(key []byte, runID int64, expires time.Time) string {
+		return runnerEventsToken(key, runnerEventsScope{Repo: "Owner/Repo", RunID: runID, Expires: expires.Unix()})
+	}
+	token := tokenFor(config.runnerEventsKey, 42, now.Add(time.Hour))
+
+	if status, _ := post(token, event(runnerEventJobStarted, now.Add(-78*time.Second), 0)); status != http.StatusNoContent {
+		t.Errorf("job_started: status got:%d want:%d", status, http.StatusNoContent)
+	}
+	status, summary := post(token, event(runnerEventJobCompleted, now.Add(-18*time.Second), 0))
+	if status != http.StatusOK {
+		t.Errorf("job_completed: status got:%d want:%d", status, http.StatusOK)
+	}
+	if want := "| `runner-abc-x7k2p` | default | 30s | 10s | 2s | 1m0s |"; !strings.Contains(summary, want) {
+		t.Errorf("summary got:%q want:%q", summary, want)
+	}
+	if status, _ := post(token, event(runnerEventExited, now, 3)); status != http.StatusNoContent {
+		t.Errorf("runner_exited: status got:%d want:%d", status, http.StatusNoContent)
+	}
+
+	got, err := records.find(context.Background(), "runner-abc-x7k2p", now)
+	if err != nil || got == nil {
+		t.Fatalf("find() got:%v, %v", got, err)
+	}
+	if got.ContainerStarted == nil || got.Registered == nil || got.JobStarted == nil || !got.JobCompleted.Equal(now.Add(-18*time.Second)) || got.ExitCode == nil || *got.ExitCode != 3 {
+		t.Errorf("record got:%+v", got)
+	}
+
+	for name, tc := range map[string]struct {
+		token, body string
+		want        int
+	}{
+		"bad token":                    {token: token + "x", body: event(runnerEventJobStarted, now, 0), want: http.StatusForbidden},
+		"other run":                    {token: tokenFor(config.runnerEventsKey, 41, now.Add(time.Hour)), body: event(runnerEventJobStarted, now, 0), want: http.StatusForbidden},
+		"other key":                    {token: tokenFor([]byte("other"), 42, now.Add(time.Hour)), body: event(runnerEventJobStarted, now, 0), want: http.StatusForbidden},
+		"expired token":                {token: tokenFor(config.runnerEventsKey, 42, now.Add(-time.Second)), body: event(runnerEventJobStarted, now, 0), want: http.StatusForbidden},
+		"unknown event":                {token: token, body: event("job_queued", now, 0), want: http.StatusBadRequest},
+		"bad execution":                {token: token, body: strings.Replace(event(runnerEventJobStarted, now, 0), "runner-abc-x7k2p", "../x", 1), want: http.StatusBadRequest},
+		"unknown record":               {token: token, body: strings.Replace(event(runnerEventJobStarted, now, 0), "runner-abc-x7k2p", "runner-abc-zzzzz", 1), want: http.StatusNoContent},
+		"other repository's execution": {token: token, body: strings.Replace(event(runnerEventExited, now, 1), "runner-abc-x7k2p", "runner-abc-other", 1), want: http.StatusForbidden},
+	} {
+		if status, body := post(tc.token, tc.body); status != tc.want {
+			t.Errorf("%s: status got:%d want:%d: %s", name, status, tc.want, bytes.TrimSpace([]byte(body)))
+		}
+	}
+	if got, err := records.find(context.Background(), "runner-abc-other", now); err != nil || got == nil || got.ExitCode != nil {
+		t.Errorf("other repository's record got:%+v, %v", got, err)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+)
+
+// server holds the state shared by the HTTP handlers.
+type server struct {
+	clients
+	config    config
+	repos     *repoSet
+	archive   *archiver     // Optional.
+	records   *jobStore     // Optional.
+	budgets   *budgeter     // Optional; requires records.
+	warm      *warmPools    // Optional.
+	batches   *batcher      // Optional.
+	watchdog  *watchdog     // Optional.
+	collector *collector    // Optional.
+	cache     *actionsCache // Optional.
+	diag      *diagStore    // Optional.
+	readiness *cachedReport[[]check]
+	diagnosis *cachedReport[string]
+}
+
+func newServer(clients clients, config config, archive *archiver, records *jobStore) *server {
+	var budgets *budgeter
+	if config.budgets != nil && records != nil {
+		budgets = newBudgeter(config.budgets, records, config.BudgetNotifyURL, http.DefaultClient)
+	}
+	var warm *warmPools
+	if config.warmPools != nil {
+		warm = newWarmPools(clients, config, records, budgets)
+	}
+	var batches *batcher
+	if config.BatchWindow > 0 {
+		batches = newBatcher(config.BatchWindow, config.BatchMaxTasks, records)
+	}
+	var wd *watchdog
+	if config.StuckJobTimeout > 0 {
+		wd = newWatchdog(clients, config, records)
+	}
+	// The repositories added by app installations are kept with the job
+	// records, if they are.
+	var state blobStore
+	if records != nil {
+		state = records.store
+	}
+	repos := newRepoSet(state, repoFromURL(config.RepositoryURL))
+	var gc *collector
+	if config.GCInterval > 0 {
+		gc = newCollector(clients, config, repos, records)
+	}
+	return &server{
+		clients:   clients,
+		config:    config,
+		repos:     repos,
+		archive:   archive,
+		records:   records,
+		budgets:   budgets,
+		warm:      warm,
+		batches:   batches,
+		watchdog:  wd,
+		collector: gc,
+		readiness: newReadiness(clients, config),
+		diagnosis: newDiagnostics(clients, config),
+	}
+}
+
+// mux routes requests to a new handler for each request.
+func (s *server) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		healthhandler{clients: s.clients, w: w, r: r, config: s.config, readiness: s.readiness, diagnosis: s.diagnosis}.healthz()
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		healthhandler{clients: s.clients, w: w, r: r, config: s.config, readiness: s.readiness, diagnosis: s.diagnosis}.readyz()
+	})
+	mux.HandleFunc("/diagnostics", func(w http.ResponseWriter, r *http.Request) {
+		healthhandler{clients: s.clients, w: w, r: r, config: s.config, readiness: s.readiness, diagnosis: s.diagnosis}.diagnostics()
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		healthhandler{clients: s.clients, w: w, r: r, config: s.config, readiness: s.readiness, diagnosis: s.diagnosis}.metrics()
+	})
+	mux.HandleFunc("/app/token", func(w http.ResponseWriter, r *http.Request) {
+		apphandler{clients: s.clients, w: w, r: r, config: s.config}.next()
+	})
+	mux.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		handler{clients: s.clients, w: w, r: r, config: s.config, repos: s.repos, archive: s.archive, records: s.records, budgets: s.budgets, warm: s.warm, batches: s.batches, watchdog: s.watchdog}.next()
+	})
+	mux.HandleFunc("/policy/evaluate", func(w http.ResponseWriter, r *http.Request) {
+		handler{clients: s.clients, w: w, r: r, config: s.config, repos: s.repos, budgets: s.budgets}.evaluate()
+	})
+	mux.HandleFunc("/admin/usage", func(w http.ResponseWriter, r *http.Request) {
+		adminhandler{clients: s.clients, w: w, r: r, config: s.config, records: s.records}.usage()
+	})
+	mux.HandleFunc("/admin/budgets", func(w http.ResponseWriter, r *http.Request) {
+		adminhandler{clients: s.clients, w: w, r: r, config: s.config, budgeter: s.budgets}.budgets()
+	})
+	mux.HandleFunc("/admin/diag", func(w http.ResponseWriter, r *http.Request) {
+		adminhandler{clients: s.clients, w: w, r: r, config: s.config, diagStore: s.diag}.diag()
+	})
+	mux.HandleFunc("/runner/events", func(w http.ResponseWriter, r *http.Request) {
+		runnerhandler{w: w, r: r, config: s.config, records: s.records}.events()
+	})
+	mux.HandleFunc("/runner/diag", func(w http.ResponseWriter, r *http.Request) {
+		runnerhandler{w: w, r: r, config: s.config, records: s.records, diagStore: s.diag}.diag()
+	})
+	mux.HandleFunc("/cache/", func(w http.ResponseWriter, r *http.Request) {
+		cachehandler{w: w, r: r, config: s.config, cache: s.cache}.serve()
+	})
+	return mux
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	iam "google.golang.org/api/iam/v1"
+)
+
+const (
+	// serviceAccountLabel labels the jobs that run as a mapped service
+	// account with the account's ID, the part of the email before the "@".
+	serviceAccountLabel = "cr-runner-service-account"
+	// actAsPermission lets the service create jobs that run as a service
+	// account. It is in the Service Account User role.
+	actAsPermission = "iam.serviceAccounts.actAs"
+)
+
+// serviceAccountFile is the format of $SERVICE_ACCOUNT_FILE. Each mapping
+// runs the runners of a repository, or of all the repositories of an owner,
+// as a service account, so that workflows only get the permissions they
+// need. For example:
+//
+//	{
+//	  "serviceAccounts": [
+//	    {"repository": "acme/deploy", "serviceAccount": "deploy-ci@acme-prod.iam.gserviceaccount.com"},
+//	    {"organization": "acme", "profile": "locked", "serviceAccount": "untrusted-ci@acme-ci.iam.gserviceaccount.com"},
+//	    {"organization": "acme", "serviceAccount": "ci@acme-ci.iam.gserviceaccount.com"}
+//	  ]
+//	}
+//
+// The first mapping that covers the repository and the profile applies. A
+// mapping without a profile applies to the default and small profiles; the
+// locked profile runs as $LOCKED_SERVICE_ACCOUNT unless a mapping names it.
+// Cloud Run cannot override the service account of an execution, so each
+// account gets its own Cloud Run job per profile.
+type serviceAccountFile struct {
+	ServiceAccounts []serviceAccountSpec `json:"serviceAccounts"`
+}
+
+type serviceAccountSpec struct {
+	Repository     string  `json:"repository"`   // "owner/repo". Exactly one of Repository and Organization.
+	Organization   string  `json:"organization"` // Any repository owner, including users.
+	Profile        profile `json:"profile"`      // Empty for the default and small profiles.
+	ServiceAccount string  `json:"serviceAccount"`
+}
+
+// covers reports whether the mapping applies to the repository's runners on
+// the profile.
+func (s serviceAccountSpec) covers(repo string, p profile) bool {
+	if s.Profile == "" && p == profileLocked || s.Profile != "" && s.Profile != p {
+		return false
+	}
+	if s.Repository != "" {
+		return strings.EqualFold(s.Repository, repo)
+	}
+	owner, _, _ := strings.Cut(repo, "/")
+	return strings.EqualFold(s.Organization, owner)
+}
+
+// serviceAccountSet is a parsed $SERVICE_ACCOUNT_FILE.
+type serviceAccountSet struct {
+	specs []serviceAccountSpec
+}
+
+func loadServiceAccountSet(path string) (*serviceAccountSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading service account file: %v", err)
+	}
+	return parseServiceAccountSet(b)
+}
+
+func parseServiceAccountSet(b []byte) (*serviceAccountSet, error) {
+	var sf serviceAccountFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&sf); err != nil {
+		return nil, fmt.Errorf("parsing service accounts: %v", err)
+	}
+	for i, spec := range sf.ServiceAccounts {
+		if (spec.Repository == "") == (spec.Organization == "") {
+			return nil, fmt.Errorf("mapping %d: exactly one of repository and organization must be set", i+1)
+		}
+		if spec.Repository != "" && strings.Count(spec.Repository, "/") != 1 {
+			return nil, fmt.Errorf("mapping %d: repository %q must be \"owner/repo\"", i+1, spec.Repository)
+		}
+		switch spec.Profile {
+		case "", profileDefault, profileSmall, profileLocked:
+		default:
+			return nil, fmt.Errorf("mapping %d: profile %q must be one of %q, %q or %q", i+1, spec.Profile, profileDefault, profileSmall, profileLocked)
+		}
+		id, domain, ok := strings.Cut(spec.ServiceAccount, "@")
+		if !ok || !labelValueRE.MatchString(id) || !strings.HasSuffix(domain, ".gserviceaccount.com") {
+			return nil, fmt.Errorf("mapping %d: serviceAccount %q must be a service account email", i+1, spec.ServiceAccount)
+		}
+	}
+	return &serviceAccountSet{specs: sf.ServiceAccounts}, nil
+}
+
+// lookup returns the service account mapped to the repository's runners on
+// the profile; empty if none is.
+func (s *serviceAccountSet) lookup(repo string, p profile) string {
+	if s == nil {
+		return ""
+	}
+	for _, spec := range s.specs {
+		if spec.covers(repo, p) {
+			return spec.ServiceAccount
+		}
+	}
+	return ""
+}
+
+// accounts returns the service accounts mapped for the profile, each once.
+func (s *serviceAccountSet) accounts(p profile) []string {
+	if s == nil {
+		return nil
+	}
+	var accounts []string
+	for _, spec := range s.specs {
+		if (spec.Profile == p || spec.Profile == "" && p != profileLocked) && !slices.Contains(accounts, spec.ServiceAccount) {
+			accounts = append(accounts, spec.ServiceAccount)
+		}
+	}
+	return accounts
+}
+
+// configuredJobs returns the Cloud Run jobs the service needs: one for each
+// profile, and one for each profile and service account mapped for it.
+func configuredJobs(config config, client jobsClient) []cloudRunJob {
+	var jobs []cloudRunJob
+	for _, p := range jobProfiles(config) {
+		jobs = append(jobs, cloudRunJob{config: config, client: client, profile: p})
+		for _, a := range config.serviceAccounts.accounts(p) {
+			jobs = append(jobs, cloudRunJob{config: config, client: client, profile: p, account: a})
+		}
+	}
+	return jobs
+}
+
+// jobFor returns the Cloud Run job that runs the repository's runners on the
+// profile.
+func jobFor(config config, client jobsClient, p profile, repo string) cloudRunJob {
+	return cloudRunJob{config: config, client: client, profile: p, account: config.serviceAccounts.lookup(repo, p)}
+}
+
+// accountSuffix distinguishes the job IDs of the jobs that run as a mapped
+// service account. Job IDs are limited to 63 characters, so it is a hash.
+func accountSuffix(account string) string {
+	return fmt.Sprintf("-sa-%x", sha256.Sum256([]byte(account)))[:len("-sa-")+8]
+}
+
+// serviceAccountClient tests the service's permissions on service accounts.
+type serviceAccountClient interface {
+	// testPermissions returns the subset of perms that the caller holds on
+	// the service account with the email.
+	testPermissions(ctx context.Context, email string, perms []string) ([]string, error)
+}
+
+// iamServiceAccountClient implements serviceAccountClient with the IAM API.
+type iamServiceAccountClient struct {
+	s *iam.Service
+}
+
+func newIAMServiceAccountClient(ctx context.Context) (*iamServiceAccountClient, error) {
+	s, err := iam.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating IAM client: %v", err)
+	}
+	return &iamServiceAccountClient{s: s}, nil
+}
+
+func (c *iamServiceAccountClient) testPermissions(ctx context.Context, email string, perms []string) ([]string, error) {
+	resp, err := c.s.Projects.ServiceAccounts.TestIamPermissions("projects/-/serviceAccounts/"+email, &iam.TestIamPermissionsRequest{Permissions: perms}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return resp.Permissions, nil
+}
+
+// checkServiceAccount checks that the service can create the job to run as
+// its service account, if it has one. A check that fails to run is only
+// logged, since Cloud Run refuses to create the job anyway.
+func (j *cloudRunJob) checkServiceAccount(ctx context.Context) error {
+	account := j.serviceAccount()
+	if j.accounts == nil || account == "" {
+		return nil
+	}
+	granted, err := j.accounts.testPermissions(ctx, account, []string{actAsPermission})
+	if err != nil {
+		logWarn("Could not check %s on service account %q: %v", actAsPermission, account, err)
+		return nil
+	}
+	if !slices.Contains(granted, actAsPermission) {
+		return fmt.Errorf("the service cannot run job %q as service account %q; it is missing %s. Grant the service's service account the Service Account User role (roles/iam.serviceAccountUser) on %q", j.jobID(), account, actAsPermission, account)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testServiceAccounts = `{
+  "serviceAccounts": [
+    {"repository": "squee1945/deploy", "serviceAccount": "deploy-ci@my-project.iam.gserviceaccount.com"},
+    {"organization": "squee1945", "profile": "locked", "serviceAccount": "untrusted-ci@my-project.iam.gserviceaccount.com"},
+    {"organization": "SQUEE1945", "serviceAccount": "ci@my-project.iam.gserviceaccount.com"}
+  ]
+}`
+
+func TestParseServiceAccountSet(t *testing.T) {
+	s, err := parseServiceAccountSet([]byte(testServiceAccounts))
+	if err != nil {
+		t.Fatalf("parseServiceAccountSet() failed: %v", err)
+	}
+	lookups := []struct {
+		repo    string
+		profile profile
+		want    string
+	}{
+		{repo: "squee1945/deploy", profile: profileDefault, want: "deploy-ci@my-project.iam.gserviceaccount.com"},
+		{repo: "squee1945/deploy", profile: profileSmall, want: "deploy-ci@my-project.iam.gserviceaccount.com"},
+		{repo: "squee1945/deploy", profile: profileLocked, want: "untrusted-ci@my-project.iam.gserviceaccount.com"},
+		{repo: "squee1945/self-hosted-runner", profile: profileDefault, want: "ci@my-project.iam.gserviceaccount.com"},
+		{repo: "someone/else", profile: profileDefault},
+		{repo: "someone/else", profile: profileLocked},
+	}
+	for _, l := range lookups {
+		if got := s.lookup(l.repo, l.profile); got != l.want {
+			t.Errorf("lookup(%q, %q) got:%q want:%q", l.repo, l.profile, got, l.want)
+		}
+	}
+	if got := s.accounts(profileLocked); len(got) != 1 {
+		t.Errorf("accounts(%q) got:%q", profileLocked, got)
+	}
+
+	errTests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "unknown field", content: `{"serviceAccounts": [{"repo": "a/b"}]}`, wantErr: "unknown field"},
+		{name: "no scope", content: `{"serviceAccounts": [{"serviceAccount": "ci@p.iam.gserviceaccount.com"}]}`, wantErr: "exactly one of repository and organization"},
+		{name: "bad repository", content: `{"serviceAccounts": [{"repository": "a", "serviceAccount": "ci@p.iam.gserviceaccount.com"}]}`, wantErr: `must be "owner/repo"`},
+		{name: "bad profile", content: `{"serviceAccounts": [{"organization": "a", "profile": "big", "serviceAccount": "ci@p.iam.gserviceaccount.com"}]}`, wantErr: `profile "big"`},
+		{name: "user email", content: `{"serviceAccounts": [{"organization": "a", "serviceAccount": "me@example.com"}]}`, wantErr: "must be a service account email"},
+	}
+	for _, tc := range errTests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseServiceAccountSet([]byte(tc.content)); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error got:%v want:%q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandlerServiceAccount(t *testing.T) {
+	accounts, err := parseServiceAccountSet([]byte(testServiceAccounts))
+	if err != nil {
+		t.Fatalf("parseServiceAccountSet() failed: %v", err)
+	}
+	config := testConfig()
+	config.serviceAccounts = accounts
+	clients, jobs := testClients(t, config)
+
+	// One job per profile, and one per profile and account.
+	if got, want := len(jobs.jobs), 3; got != want {
+		t.Fatalf("jobs got:%d want:%d", got, want)
+	}
+	job := jobFor(config, jobs, profileDefault, "squee1945/self-hosted-runner")
+	got, err := job.getJob(context.Background())
+	if err != nil {
+		t.Fatalf("getJob() failed: %v", err)
+	}
+	if sa := got.Template.Template.ServiceAccount; sa != "ci@my-project.iam.gserviceaccount.com" {
+		t.Errorf("service account got:%q", sa)
+	}
+	if l := got.Labels[serviceAccountLabel]; l != "ci" {
+		t.Errorf("label got:%q want:%q", l, "ci")
+	}
+
+	h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL))}
+	if w := serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json"))); w.Code != http.StatusOK {
+		t.Fatalf("status got:%d (body %q)", w.Code, w.Body.String())
+	}
+	runs := jobs.runRequests()
+	if len(runs) != 1 || runs[0].Name != job.jobName() {
+		t.Errorf("runs got:%v want one of %q", runs, job.jobName())
+	}
+}
+
+func TestEnsureJobServiceAccount(t *testing.T) {
+	config := testConfig()
+	config.LockedServiceAccount = "locked@my-project.iam.gserviceaccount.com"
+	tests := []struct {
+		name    string
+		job     cloudRunJob
+		granted []string
+		wantErr string
+	}{
+		{name: "default compute account", job: cloudRunJob{profile: profileDefault}},
+		{name: "mapped", job: cloudRunJob{profile: profileDefault, account: "ci@my-project.iam.gserviceaccount.com"}, granted: []string{actAsPermission}},
+		{name: "mapped without actAs", job: cloudRunJob{profile: profileSmall, account: "ci@my-project.iam.gserviceaccount.com"}, wantErr: `as service account "ci@my-project.iam.gserviceaccount.com"; it is missing iam.serviceAccounts.actAs`},
+		{name: "locked without actAs", job: cloudRunJob{profile: profileLocked}, wantErr: `as service account "locked@my-project.iam.gserviceaccount.com"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			job := tc.job
+			job.config, job.client = config, newFakeJobsClient()
+			job.accounts = fakeServiceAccounts{job.serviceAccount(): tc.granted}
+			err := job.ensureJob(context.Background())
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("ensureJob() failed: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("ensureJob() error got:%v want:%q", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+const (
+	simRepo             = "sim/repo"
+	simSignatureSecret  = "sim-signature"
+	simRunnerPollPeriod = 2 * time.Second // Simulated time.
+)
+
+// simOptions control a simulation. Durations are in simulated time.
+type simOptions struct {
+	bursts        int
+	jobsPerBurst  int
+	burstInterval time.Duration
+	startDelay    time.Duration // Runner cold start: image pull, config.sh and registration.
+	slowStart     time.Duration // Extra start delay for slow starts.
+	runDuration   time.Duration
+	runnerIdle    time.Duration // How long a runner waits for a job before exiting.
+	dropRate      float64       // Fraction of webhook deliveries dropped.
+	runErrorRate  float64       // Fraction of RunJob calls that fail.
+	slowStartRate float64       // Fraction of runners that start slowly.
+	batchWindow   time.Duration // The service's $BATCH_WINDOW; zero disables batching.
+	speed         float64       // Simulated seconds per real second.
+	seed          int64
+}
+
+// simReport summarizes a simulation.
+type simReport struct {
+	jobs        int
+	completed   int
+	stuck       int // Still queued when the simulation ended.
+	deliveries  int
+	dropped     int
+	rejected    int // Deliveries that got a non-200 response.
+	runs        int // Successful RunJob calls.
+	runErrors   int
+	idleRunners int // Runners that exited without getting a job.
+	queueTimes  []time.Duration
+}
+
+func (r simReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Workflow jobs:      %d (%d completed, %d stuck in queue)\n", r.jobs, r.completed, r.stuck)
+	fmt.Fprintf(&b, "Webhook deliveries: %d (%d dropped, %d rejected)\n", r.deliveries, r.dropped, r.rejected)
+	fmt.Fprintf(&b, "RunJob calls:       %d succeeded, %d failed\n", r.runs, r.runErrors)
+	fmt.Fprintf(&b, "Idle runners:       %d\n", r.idleRunners)
+	if len(r.queueTimes) > 0 {
+		qt := append([]time.Duration(nil), r.queueTimes...)
+		sort.Slice(qt, func(a, b int) bool { return qt[a] < qt[b] })
+		fmt.Fprintf(&b, "Queue time:         p50 %v, p90 %v, max %v\n", qt[len(qt)/2], qt[len(qt)*9/10], qt[len(qt)-1])
+	}
+	return b.String()
+}
+
+// simulateMain implements the "simulate" subcommand.
+//
+//	webhook simulate -bursts 3 -jobs 20 -drop 0.05 -run-errors 0.1
+func simulateMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ExitOnError)
+	var opts simOptions
+	fs.IntVar(&opts.bursts, "bursts", 1, "Number of workflow bursts.")
+	fs.IntVar(&opts.jobsPerBurst, "jobs", 10, "Workflow jobs queued per burst (e.g., matrix legs).")
+	fs.DurationVar(&opts.burstInterval, "burst-interval", time.Minute, "Time between bursts.")
+	fs.DurationVar(&opts.startDelay, "start-delay", 20*time.Second, "Runner cold start time.")
+	fs.DurationVar(&opts.slowStart, "slow-start", 2*time.Minute, "Extra start time for slow starts.")
+	fs.DurationVar(&opts.runDuration, "run-duration", time.Minute, "How long each workflow job runs.")
+	fs.DurationVar(&opts.runnerIdle, "runner-idle", 5*time.Minute, "How long a runner waits for a job before exiting.")
+	fs.Float64Var(&opts.dropRate, "drop", 0, "Fraction of webhook deliveries to drop.")
+	fs.Float64Var(&opts.runErrorRate, "run-errors", 0, "Fraction of RunJob calls that fail.")
+	fs.Float64Var(&opts.slowStartRate, "slow-starts", 0, "Fraction of runners that start slowly.")
+	fs.DurationVar(&opts.batchWindow, "batch-window", 0, "Window to batch runners for jobs of the same run in (default: no batching).")
+	fs.Float64Var(&opts.speed, "speed", 60, "Simulated seconds per real second.")
+	fs.Int64Var(&opts.seed, "seed", time.Now().UnixNano(), "Random seed, for reproducible runs.")
+	verbose := fs.Bool("v", false, "Show the service's logs.")
+	fs.Parse(args)
+
+	if !*verbose {
+		logOutput = io.Discard
+		defer func() { logOutput = os.Stdout }()
+	}
+	report, err := simulate(ctx, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	return nil
+}
+
+// simulate runs the real webhook handlers against a simulated GitHub and a
+// fake Cloud Run backend whose runners take jobs from the simulated GitHub.
+func simulate(ctx context.Context, opts simOptions) (simReport, error) {
+	if opts.speed <= 0 {
+		opts.speed = 1
+	}
+	config := config{
+		RepositoryURL:       repoURL(simRepo),
+		RunnerImageURL:      "sim/actions-runner",
+		TokenSecretName:     "sim-token",
+		SignatureSecretName: simSignatureSecret,
+		JobID:               "runner-sim",
+		Project:             "sim-project",
+		Location:            "sim-region",
+		ForkPolicy:          forkPolicyDeny,
+		BatchWindow:         time.Duration(float64(opts.batchWindow) / opts.speed),
+		BatchMaxTasks:       50,
+	}
+	secret := []byte("sim-secret")
+
+	gh := &simGitHub{opts: opts, secret: secret, rand: rand.New(rand.NewSource(opts.seed)), start: time.Now()}
+	jobs := &simJobsClient{fakeJobsClient: newFakeJobsClient(), gh: gh}
+	clients := clients{
+		jobs:    jobs,
+		secrets: fakeSecrets{config.TokenSecretName: []byte("sim-token"), simSignatureSecret: secret},
+		github:  gh,
+	}
+	if err := (&cloudRunJob{config: config, client: jobs}).ensureJob(ctx); err != nil {
+		return simReport{}, fmt.Errorf("creating job: %v", err)
+	}
+
+	srv := httptest.NewServer(newServer(clients, config, nil, nil).mux())
+	defer srv.Close()
+	gh.webhookURL = srv.URL + "/webhook"
+
+	for b := 0; b < opts.bursts; b++ {
+		if b > 0 {
+			gh.sleep(opts.burstInterval)
+		}
+		runID := int64(1000 + b)
+		for i := 0; i < opts.jobsPerBurst; i++ {
+			gh.queueJob(runID)
+		}
+	}
+	// Every delivery and runner is tracked, so once they are done nothing
+	// else can happen.
+	gh.wg.Wait()
+	return gh.finish(), nil
+}
+
+type simJob struct {
+	id      int64
+	runID   int64
+	created time.Time
+	started time.Time
+	runner  string
+	done    bool
+}
+
+// simGitHub emulates GitHub's side of the runner lifecycle: it queues jobs,
+// hands them to runners that register, and sends the webhooks. It also
+// serves the GitHub API calls the service makes.
+type simGitHub struct {
+	fakeGitHub
+	opts       simOptions
+	secret     []byte
+	webhookURL string
+	start      time.Time
+	wg         sync.WaitGroup
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	nextID int64
+	queue  []*simJob
+	jobs   []*simJob
+	report simReport
+}
+
+// now is the simulated time.
+func (g *simGitHub) now() time.Time {
+	return g.start.Add(time.Duration(float64(time.Since(g.start)) * g.opts.speed))
+}
+
+// sleep waits for d of simulated time.
+func (g *simGitHub) sleep(d time.Duration) {
+	time.Sleep(time.Duration(float64(d) / g.opts.speed))
+}
+
+func (g *simGitHub) chance(p float64) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rand.Float64() < p
+}
+
+func (g *simGitHub) queueJob(runID int64) {
+	g.mu.Lock()
+	g.nextID++
+	job := &simJob{id: g.nextID, runID: runID, created: g.now()}
+	g.queue = append(g.queue, job)
+	g.jobs = append(g.jobs, job)
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		g.deliver(actionQueued, job)
+	}()
+}
+
+// startRunner simulates an ephemeral runner starting in a Cloud Run
+// execution, registering and waiting for a job.
+func (g *simGitHub) startRunner(name string) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		delay := g.opts.startDelay
+		if g.chance(g.opts.slowStartRate) {
+			delay += g.opts.slowStart
+		}
+		g.sleep(delay)
+
+		for waited := time.Duration(0); waited < g.opts.runnerIdle; waited += simRunnerPollPeriod {
+			if job := g.assign(name); job != nil {
+				g.deliver(actionInProgress, job)
+				g.sleep(g.opts.runDuration)
+				g.complete(job)
+				g.deliver(actionCompleted, job)
+				return
+			}
+			g.sleep(simRunnerPollPeriod)
+		}
+		g.mu.Lock()
+		g.report.idleRunners++
+		g.mu.Unlock()
+	}()
+}
+
+// assign gives the oldest queued job to the runner, like GitHub does for
+// runners with matching labels.
+func (g *simGitHub) assign(runner string) *simJob {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.queue) == 0 {
+		return nil
+	}
+	job := g.queue[0]
+	g.queue = g.queue[1:]
+	job.runner = runner
+	job.started = g.now()
+	g.report.queueTimes = append(g.report.queueTimes, job.started.Sub(job.created))
+	return job
+}
+
+func (g *simGitHub) complete(job *simJob) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	job.done = true
+	g.report.completed++
+}
+
+// deliver sends a signed workflow_job webhook, unless it is dropped.
+func (g *simGitHub) deliver(action string, job *simJob) {
+	g.mu.Lock()
+	g.report.deliveries++
+	drop := g.rand.Float64() < g.opts.dropRate
+	if drop {
+		g.report.dropped++
+	}
+	ev := g.payload(action, job)
+	g.mu.Unlock()
+	if drop {
+		return
+	}
+
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logError("Simulator: marshalling event: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, g.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		logError("Simulator: creating request: %v", err)
+		return
+	}
+	req.Header.Set(eventHeader, eventWorkFlowJob)
+	req.Header.Set(deliveryHeader, fmt.Sprintf("sim-%d-%s", job.id, action))
+	req.Header.Set(sig256Header, signature(g.secret, body))
+	res, err := http.DefaultClient.Do(req)
+	if err == nil {
+		res.Body.Close()
+	}
+	if err != nil || res.StatusCode != http.StatusOK {
+		g.mu.Lock()
+		g.report.rejected++
+		g.mu.Unlock()
+	}
+}
+
+// payload builds the workflow_job event for job. g.mu must be held.
+func (g *simGitHub) payload(action string, job *simJob) event {
+	wj := eventWorkflowJob{
+		ID:           int(job.id),
+		RunID:        job.runID,
+		WorkflowName: "Simulated",
+		HeadBranch:   "main",
+		RunURL:       fmt.Sprintf("%s/repos/%s/actions/runs/%d", gitHubAPIURL, simRepo, job.runID),
+		RunAttempt:   1,
+		Status:       status(action),
+		CreatedAt:    timestamp{job.created},
+		Name:         fmt.Sprintf("build (%d)", job.id),
+		Labels:       []string{"self-hosted"},
+		RunnerName:   job.runner,
+	}
+	if !job.started.IsZero() {
+		wj.StartedAt = timestamp{job.started}
+	}
+	if action == actionCompleted {
+		c := conclusionSuccess
+		wj.Conclusion = &c
+		wj.CompletedAt = &timestamp{g.now()}
+	}
+	return event{
+		Action:      action,
+		Repository:  eventRepository{Name: path.Base(simRepo), FullName: simRepo, HtmlURL: repoURL(simRepo)},
+		WorkflowJob: wj,
+	}
+}
+
+// getWorkflowRun returns a push-triggered run for any of the simulated runs.
+func (g *simGitHub) getWorkflowRun(ctx context.Context, runURL string) (*eventWorkflowRun, error) {
+	var id int64
+	if _, err := fmt.Sscanf(path.Base(runURL), "%d", &id); err != nil {
+		return nil, &gitHubError{StatusCode: http.StatusNotFound, Message: "Not Found"}
+	}
+	repo := eventRepository{FullName: simRepo}
+	return &eventWorkflowRun{ID: id, Event: "push", HeadBranch: "main", Repository: repo, HeadRepository: repo}, nil
+}
+
+func (g *simGitHub) finish() simReport {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	r := g.report
+	r.jobs = len(g.jobs)
+	r.stuck = len(g.queue)
+	return r
+}
+
+// simJobsClient is a fake Cloud Run backend: each execution starts a
+// simulated runner.
+type simJobsClient struct {
+	*fakeJobsClient
+	gh *simGitHub
+}
+
+func (c *simJobsClient) runJob(ctx context.Context, req *runpb.RunJobRequest) (*runpb.Execution, error) {
+	if c.gh.chance(c.gh.opts.runErrorRate) {
+		c.gh.mu.Lock()
+		c.gh.report.runErrors++
+		c.gh.mu.Unlock()
+		return nil, grpcstatus.Error(codes.ResourceExhausted, "simulated RunJob failure")
+	}
+	exec, err := c.fakeJobsClient.runJob(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	c.gh.mu.Lock()
+	c.gh.report.runs++
+	c.gh.mu.Unlock()
+	name := path.Base(exec.Name)
+	for _, co := range req.GetOverrides().GetContainerOverrides() {
+		for _, e := range co.Env {
+			if e.Name == runnerNameEnvVar {
+				name = e.GetValue()
+			}
+		}
+	}
+	if n := req.GetOverrides().GetTaskCount(); n > 1 {
+		for i := 0; i < int(n); i++ {
+			c.gh.startRunner(fmt.Sprintf("%s-%d", name, i))
+		}
+		return exec, nil
+	}
+	c.gh.startRunner(name)
+	return exec, nil
+}
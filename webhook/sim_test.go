@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSimulate(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+
+	base := simOptions{
+		bursts:        2,
+		jobsPerBurst:  10,
+		burstInterval: 10 * time.Second,
+		startDelay:    5 * time.Second,
+		slowStart:     30 * time.Second,
+		runDuration:   10 * time.Second,
+		runnerIdle:    20 * time.Second,
+		speed:         500,
+		seed:          1,
+	}
+	tests := []struct {
+		name        string
+		modify      func(*simOptions)
+		wantStuck   bool
+		wantBatched bool // Fewer RunJob calls than jobs.
+	}{
+		{name: "no faults", modify: func(*simOptions) {}},
+		{name: "slow starts", modify: func(o *simOptions) { o.slowStartRate = 0.5 }},
+		{name: "dropped deliveries", modify: func(o *simOptions) { o.dropRate = 0.5 }, wantStuck: true},
+		{name: "run errors", modify: func(o *simOptions) { o.runErrorRate = 1 }, wantStuck: true},
+		{name: "batched", modify: func(o *simOptions) { o.batchWindow = 25 * time.Second }, wantBatched: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := base
+			tc.modify(&opts)
+			r, err := simulate(context.Background(), opts)
+			if err != nil {
+				t.Fatalf("simulate() failed: %v", err)
+			}
+			if r.jobs != 20 {
+				t.Errorf("jobs got:%d want:20", r.jobs)
+			}
+			if r.completed+r.stuck != r.jobs {
+				t.Errorf("completed (%d) + stuck (%d) != jobs (%d)", r.completed, r.stuck, r.jobs)
+			}
+			if got := r.stuck > 0; got != tc.wantStuck {
+				t.Errorf("stuck got:%d wantStuck:%t\n%s", r.stuck, tc.wantStuck, r)
+			}
+			if tc.wantBatched && r.runs >= r.jobs {
+				t.Errorf("runs got:%d want fewer than %d\n%s", r.runs, r.jobs, r)
+			}
+		})
+	}
+}
@@ -7,28 +7,73 @@ import (
 
 	secretmanager "cloud.google.com/go/secretmanager/apiv1"
 	"cloud.google.com/go/secretmanager/apiv1/secretmanagerpb"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-func readSecret(ctx context.Context, config config, name string) ([]byte, error) {
+// secretReader reads secrets. Names are "{secret_name}" for the service's
+// project, or "projects/{project}/secrets/{secret_name}" for a different
+// project; the latest version is used unless one is given.
+type secretReader interface {
+	readSecret(ctx context.Context, name string) ([]byte, error)
+	// testPermissions returns the subset of perms that the caller holds on the secret.
+	testPermissions(ctx context.Context, name string, perms []string) ([]string, error)
+}
+
+// secretManager implements secretReader with Secret Manager.
+type secretManager struct {
+	client  *secretmanager.Client
+	project string
+}
+
+func newSecretManager(ctx context.Context, project string) (*secretManager, error) {
 	client, err := secretmanager.NewClient(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("creating client: %v", err)
 	}
-	defer client.Close()
+	return &secretManager{client: client, project: project}, nil
+}
 
-	if !strings.HasPrefix(name, "projects/") {
-		name = fmt.Sprintf("projects/%s/secrets/%s", config.Project, name)
-	}
+func (s *secretManager) close() error {
+	return s.client.Close()
+}
+
+func (s *secretManager) readSecret(ctx context.Context, name string) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "readSecret")
+	defer func() { endSpan(span, err) }()
+
+	name = secretResourceName(s.project, name)
 	parts := strings.Split(name, "/")
 	if len(parts) < 6 {
 		name += "/versions/latest"
 	}
 	logInfo("Accessing secret %q", name)
+	span.SetAttributes(attribute.String("secret.name", name))
 
 	accessRequest := &secretmanagerpb.AccessSecretVersionRequest{Name: name}
-	response, err := client.AccessSecretVersion(ctx, accessRequest)
+	response, err := s.client.AccessSecretVersion(ctx, accessRequest)
 	if err != nil {
 		return nil, fmt.Errorf("accessing secret: %v", err)
 	}
 	return response.Payload.Data, nil
 }
+
+func (s *secretManager) testPermissions(ctx context.Context, name string, perms []string) ([]string, error) {
+	// IAM is granted on the secret, not the version.
+	parts := strings.Split(secretResourceName(s.project, name), "/")
+	if len(parts) > 4 {
+		parts = parts[:4]
+	}
+	granted, err := s.client.IAM(strings.Join(parts, "/")).TestPermissions(ctx, perms)
+	if err != nil {
+		return nil, fmt.Errorf("testing permissions: %v", err)
+	}
+	return granted, nil
+}
+
+// secretResourceName expands "{secret_name}" to "projects/{project}/secrets/{secret_name}".
+func secretResourceName(project, name string) string {
+	if !strings.HasPrefix(name, "projects/") {
+		name = fmt.Sprintf("projects/%s/secrets/%s", project, name)
+	}
+	return name
+}
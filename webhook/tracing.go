@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/squee1945/cr-runner/webhook"
+	serviceName = "cr-runner-webhook"
+
+	// Env vars used to hand the trace context to the runner execution.
+	// See https://github.com/open-telemetry/opentelemetry-specification/issues/740.
+	traceParentEnvVar = "TRACEPARENT"
+	traceStateEnvVar  = "TRACESTATE"
+)
+
+var (
+	tracer = otel.Tracer(tracerName)
+)
+
+// initTracing installs the global tracer provider and propagator. If no OTLP
+// endpoint is configured, tracing is a no-op. The returned func flushes and
+// shuts down the exporter.
+func initTracing(ctx context.Context, config config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if config.OTLPEndpoint == "" {
+		logInfo("$OTEL_EXPORTER_OTLP_ENDPOINT not set, tracing disabled.")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// The exporter reads $OTEL_EXPORTER_OTLP_ENDPOINT, $OTEL_EXPORTER_OTLP_INSECURE, etc. itself.
+	exporter, err := otlptracegrpc.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.CloudProviderGCP,
+		semconv.CloudPlatformGCPCloudRun,
+		semconv.CloudAccountID(config.Project),
+		semconv.CloudRegion(config.Location),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %v", err)
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	logInfo("Exporting traces to %q", config.OTLPEndpoint)
+	return tp.Shutdown, nil
+}
+
+// endSpan records err (if any) on span and ends it. Intended to be deferred
+// with a named error return value.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceEnv returns the current trace context as env vars, suitable for
+// passing to the runner execution so that runner-side hooks can continue the
+// trace.
+func traceEnv(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	env := map[string]string{}
+	if v := carrier.Get("traceparent"); v != "" {
+		env[traceParentEnvVar] = v
+	}
+	if v := carrier.Get("tracestate"); v != "" {
+		env[traceStateEnvVar] = v
+	}
+	return env
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+var (
+	// usageInterval is how often running executions are checked for completion.
+	usageInterval = time.Minute
+	// usageLookback is how far back to look for executions still running;
+	// Cloud Run tasks cannot run longer than maxTaskTimeout.
+	usageLookback = maxTaskTimeout + time.Hour
+
+	// usageGroups are the dimensions usage can be grouped by. Cloud Run
+	// cannot label an execution, so billing exports only see the job's
+	// labels, and these stand in for the repository, organization, workflow
+	// and profile labels of each execution.
+	usageGroups = []string{"org", "repo", "workflow", "profile", "day"}
+	// defaultUsageGroups are those a report is grouped by by default.
+	defaultUsageGroups = []string{"repo", "workflow", "day"}
+)
+
+// newJobRecord describes an execution just started for the workflow job in
+// ev, whose runner registers as runner.
+func newJobRecord(ev *event, exec *runpb.Execution, job *cloudRunJob, runner string, now time.Time) jobRecord {
+	cpuLimit, memLimit := job.resources()
+	cpu, _ := parseCPU(cpuLimit)
+	mem, _ := parseMemoryGiB(memLimit)
+	return jobRecord{
+		Execution:      exec.Name,
+		Job:            job.jobID(),
+		Profile:        string(job.profileOrDefault()),
+		Repository:     ev.Repository.FullName,
+		Organization:   ev.Organization.Login,
+		Workflow:       ev.WorkflowJob.WorkflowName,
+		WorkflowJob:    ev.WorkflowJob.Name,
+		WorkflowJobID:  ev.WorkflowJob.ID,
+		RunID:          ev.WorkflowJob.RunID,
+		RunAttempt:     ev.WorkflowJob.RunAttempt,
+		Runner:         runner,
+		ServiceAccount: job.account,
+		CPU:            cpu,
+		MemoryGiB:      mem,
+		Dispatched:     now,
+	}
+}
+
+// complete fills in the usage of a finished execution; it reports false if
+// the execution is still running.
+func (r *jobRecord) complete(exec *runpb.Execution) bool {
+	if exec.GetCompletionTime() == nil {
+		return false
+	}
+	end := exec.CompletionTime.AsTime()
+	start := exec.GetCreateTime().AsTime()
+	if exec.StartTime != nil {
+		start = exec.StartTime.AsTime()
+	}
+	if start.IsZero() || start.After(end) {
+		start = end
+	}
+	r.Started, r.Completed = &start, &end
+	r.Succeeded = exec.SucceededCount > 0
+	// Tasks are charged for the whole execution, which overestimates
+	// batches whose tasks finish at different times.
+	seconds := end.Sub(start).Seconds() * float64(max(r.Tasks, 1))
+	r.VCPUSeconds = seconds * r.CPU
+	r.GiBSeconds = seconds * r.MemoryGiB
+	return true
+}
+
+// parseCPU parses a Cloud Run CPU limit, e.g., "2" or "1000m", into vCPUs.
+func parseCPU(s string) (float64, error) {
+	if m, ok := strings.CutSuffix(s, "m"); ok {
+		v, err := strconv.ParseFloat(m, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid CPU %q: %v", s, err)
+		}
+		return v / 1000, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid CPU %q: %v", s, err)
+	}
+	return v, nil
+}
+
+// parseMemoryGiB parses a Cloud Run memory limit, e.g., "512Mi" or "2G",
+// into GiB.
+func parseMemoryGiB(s string) (float64, error) {
+	units := []struct {
+		suffix string
+		bytes  float64
+	}{
+		{"Ki", 1 << 10}, {"Mi", 1 << 20}, {"Gi", 1 << 30}, {"Ti", 1 << 40},
+		{"k", 1e3}, {"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+	}
+	n, mult := s, 1.0
+	for _, u := range units {
+		if v, ok := strings.CutSuffix(s, u.suffix); ok {
+			n, mult = v, u.bytes
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(n, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory %q: %v", s, err)
+	}
+	return v * mult / (1 << 30), nil
+}
+
+// usageTracker completes job records as their executions finish.
+type usageTracker struct {
+	records *jobStore
+	client  jobsClient
+}
+
+// reconcile checks the executions of incomplete records and records the
+// usage of those that have finished.
+func (u usageTracker) reconcile(ctx context.Context) error {
+	now := time.Now()
+	records, err := u.records.incomplete(ctx)
+	if err != nil {
+		return err
+	}
+	completed := 0
+	for _, r := range records {
+		if r.Execution == "" {
+			continue
+		}
+		exec, err := u.client.getExecution(ctx, r.Execution)
+		if grpcstatus.Code(err) == codes.NotFound {
+			// Deleted before it was seen to complete; its usage is unknown.
+			logWarn("Execution %q no longer exists; usage not recorded.", r.Execution)
+			if err := u.records.update(ctx, r, func(r *jobRecord) { r.Completed = &now }); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("getting execution %q: %v", r.Execution, err)
+		}
+		if exec.GetCompletionTime() == nil {
+			continue
+		}
+		if err := u.records.update(ctx, r, func(r *jobRecord) { r.complete(exec) }); err != nil {
+			return err
+		}
+		completed++
+	}
+	if completed > 0 {
+		logInfo("Recorded usage of %d completed executions.", completed)
+	}
+	return nil
+}
+
+// loop reconciles periodically until ctx is done.
+func (u usageTracker) loop(ctx context.Context) {
+	t := time.NewTicker(usageInterval)
+	defer t.Stop()
+	for {
+		if err := u.reconcile(ctx); err != nil {
+			logError("Recording usage: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// usageQuery selects and groups job records for a usage report.
+type usageQuery struct {
+	from, to time.Time
+	by       []string
+	format   string // "json" or "csv".
+}
+
+// parseUsageQuery parses the report parameters; from and to are UTC days
+// ("2006-01-02"), by is a comma-separated list of usageGroups. By default
+// it reports the last 7 days by repo, workflow and day, as JSON.
+func parseUsageQuery(from, to, by, format string, now time.Time) (usageQuery, error) {
+	q := usageQuery{to: now.UTC(), by: defaultUsageGroups, format: "json"}
+	var err error
+	if to != "" {
+		if q.to, err = time.Parse("2006-01-02", to); err != nil {
+			return usageQuery{}, fmt.Errorf("invalid to %q: %v", to, err)
+		}
+	}
+	q.from = q.to.AddDate(0, 0, -6)
+	if from != "" {
+		if q.from, err = time.Parse("2006-01-02", from); err != nil {
+			return usageQuery{}, fmt.Errorf("invalid from %q: %v", from, err)
+		}
+	}
+	if q.from.After(q.to) {
+		return usageQuery{}, fmt.Errorf("from %s is after to %s", q.from.Format("2006-01-02"), q.to.Format("2006-01-02"))
+	}
+	if by != "" {
+		q.by = nil
+		for _, g := range strings.Split(by, ",") {
+			g = strings.TrimSpace(g)
+			if !slices.Contains(usageGroups, g) {
+				return usageQuery{}, fmt.Errorf("cannot group by %q; use %v", g, usageGroups)
+			}
+			q.by = append(q.by, g)
+		}
+	}
+	if format != "" {
+		q.format = format
+	}
+	if q.format != "json" && q.format != "csv" {
+		return usageQuery{}, fmt.Errorf("format %q must be json or csv", q.format)
+	}
+	return q, nil
+}
+
+// usageRow is the usage of a group of completed jobs.
+type usageRow struct {
+	Organization string  `json:"organization,omitempty"`
+	Repository   string  `json:"repository,omitempty"`
+	Workflow     string  `json:"workflow,omitempty"`
+	Profile      string  `json:"profile,omitempty"`
+	Day          string  `json:"day,omitempty"`
+	Jobs         int     `json:"jobs"`
+	Seconds      float64 `json:"seconds"`
+	VCPUSeconds  float64 `json:"vcpu_seconds"`
+	GiBSeconds   float64 `json:"gib_seconds"`
+}
+
+// aggregateUsage sums the usage of completed records by the groups in by.
+func aggregateUsage(records []jobRecord, by []string) []usageRow {
+	rows := map[usageRow]*usageRow{}
+	for _, r := range records {
+		if r.Completed == nil || r.Started == nil {
+			continue
+		}
+		var key usageRow
+		for _, g := range by {
+			switch g {
+			case "org":
+				key.Organization = r.owner()
+			case "repo":
+				key.Repository = r.Repository
+			case "workflow":
+				key.Workflow = r.Workflow
+			case "profile":
+				key.Profile = r.Profile
+			case "day":
+				key.Day = r.day()
+			}
+		}
+		row, ok := rows[key]
+		if !ok {
+			k := key
+			row = &k
+			rows[key] = row
+		}
+		row.Jobs++
+		row.Seconds += r.Completed.Sub(*r.Started).Seconds()
+		row.VCPUSeconds += r.VCPUSeconds
+		row.GiBSeconds += r.GiBSeconds
+	}
+	var out []usageRow
+	for _, row := range rows {
+		out = append(out, *row)
+	}
+	sort.Slice(out, func(a, b int) bool {
+		if out[a].Day != out[b].Day {
+			return out[a].Day < out[b].Day
+		}
+		if out[a].Organization != out[b].Organization {
+			return out[a].Organization < out[b].Organization
+		}
+		if out[a].Repository != out[b].Repository {
+			return out[a].Repository < out[b].Repository
+		}
+		if out[a].Workflow != out[b].Workflow {
+			return out[a].Workflow < out[b].Workflow
+		}
+		return out[a].Profile < out[b].Profile
+	})
+	return out
+}
+
+// usageReport runs q against the job records and writes the report to w.
+func usageReport(ctx context.Context, records *jobStore, q usageQuery, w io.Writer) error {
+	recs, err := records.list(ctx, q.from, q.to)
+	if err != nil {
+		return err
+	}
+	rows := aggregateUsage(recs, q.by)
+	if rows == nil {
+		rows = []usageRow{}
+	}
+	if q.format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	}
+
+	cw := csv.NewWriter(w)
+	header := append([]string(nil), q.by...)
+	header = append(header, "jobs", "seconds", "vcpu_seconds", "gib_seconds")
+	cw.Write(header)
+	for _, row := range rows {
+		var rec []string
+		for _, g := range q.by {
+			switch g {
+			case "org":
+				rec = append(rec, row.Organization)
+			case "repo":
+				rec = append(rec, row.Repository)
+			case "workflow":
+				rec = append(rec, row.Workflow)
+			case "profile":
+				rec = append(rec, row.Profile)
+			case "day":
+				rec = append(rec, row.Day)
+			}
+		}
+		rec = append(rec, strconv.Itoa(row.Jobs), formatFloat(row.Seconds), formatFloat(row.VCPUSeconds), formatFloat(row.GiBSeconds))
+		cw.Write(rec)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 1, 64)
+}
+
+// usageMain implements the "usage" subcommand, which prints a usage report
+// from the job records in a state store.
+//
+//	webhook usage -state gs://bucket/prefix -from 2023-07-01 -to 2023-07-31 -by repo -format csv
+func usageMain(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	stateURL := fs.String("state", os.Getenv("STATE_URL"), `State store holding the job records, "gs://bucket/prefix" or a local directory.`)
+	from := fs.String("from", "", "First day to report, YYYY-MM-DD (default: 6 days before -to).")
+	to := fs.String("to", "", "Last day to report, YYYY-MM-DD (default: today, UTC).")
+	by := fs.String("by", strings.Join(defaultUsageGroups, ","), "Comma-separated groups: org, repo, workflow, profile, day.")
+	format := fs.String("format", "csv", "Output format: csv or json.")
+	fs.Parse(args)
+
+	if *stateURL == "" {
+		return errors.New("-state is required")
+	}
+	q, err := parseUsageQuery(*from, *to, *by, *format, time.Now())
+	if err != nil {
+		return err
+	}
+	store, err := newBlobStore(ctx, *stateURL)
+	if err != nil {
+		return fmt.Errorf("opening state store: %v", err)
+	}
+	return usageReport(ctx, newJobStore(store), q, os.Stdout)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResources(t *testing.T) {
+	cpus := map[string]float64{"1": 1, "2": 2, "0.5": 0.5, "1000m": 1, "250m": 0.25}
+	for in, want := range cpus {
+		if got, err := parseCPU(in); err != nil || got != want {
+			t.Errorf("parseCPU(%q) got:%v, %v want:%v", in, got, err, want)
+		}
+	}
+	mems := map[string]float64{"1Gi": 1, "512Mi": 0.5, "2Gi": 2, "1073741824": 1, "1Ti": 1024}
+	for in, want := range mems {
+		if got, err := parseMemoryGiB(in); err != nil || got != want {
+			t.Errorf("parseMemoryGiB(%q) got:%v, %v want:%v", in, got, err, want)
+		}
+	}
+	for _, in := range []string{"", "one", "1x"} {
+		if _, err := parseCPU(in); err == nil {
+			t.Errorf("parseCPU(%q) succeeded, want error", in)
+		}
+		if _, err := parseMemoryGiB(in); err == nil {
+			t.Errorf("parseMemoryGiB(%q) succeeded, want error", in)
+		}
+	}
+}
+
+// dispatchAndRecord dispatches the queued fixture with a job store and
+// returns the store and the execution started.
+func dispatchAndRecord(t *testing.T, config config) (*jobStore, *fakeJobsClient, string) {
+	t.Helper()
+	store, err := newBlobStore(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	records := newJobStore(store)
+	clients, jobs := testClients(t, config)
+	h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL)), records: records}
+	if w := serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json"))); w.Code != http.StatusOK {
+		t.Fatalf("status got:%d want:%d (body %q)", w.Code, http.StatusOK, w.Body.String())
+	}
+	var name string
+	for n := range jobs.executions {
+		name = n
+	}
+	return records, jobs, name
+}
+
+func TestUsageTracker(t *testing.T) {
+	config := testConfig()
+	config.JobCpu, config.JobMemory = "2", "512Mi"
+	records, jobs, exec := dispatchAndRecord(t, config)
+	ctx := context.Background()
+	now := time.Now()
+
+	got, err := records.list(ctx, now, now)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("list() got:%v, %v want 1 record", got, err)
+	}
+	if r := got[0]; r.Execution != exec || r.Repository != "squee1945/self-hosted-runner" || r.Workflow != "Go" || r.Profile != "default" || r.Completed != nil {
+		t.Errorf("record got:%+v", r)
+	}
+	if running, err := records.incomplete(ctx); err != nil || len(running) != 1 || running[0].Execution != exec {
+		t.Errorf("incomplete() got:%v, %v want the record", running, err)
+	}
+
+	tracker := usageTracker{records: records, client: jobs}
+	if err := tracker.reconcile(ctx); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	if got, _ := records.list(ctx, now, now); got[0].Completed != nil {
+		t.Errorf("running execution was completed: %+v", got[0])
+	}
+
+	start := now.Add(-90 * time.Second)
+	jobs.finishExecution(exec, start, start.Add(60*time.Second), true)
+	if err := tracker.reconcile(ctx); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	got, _ = records.list(ctx, now, now)
+	if r := got[0]; r.Completed == nil || !r.Succeeded || r.VCPUSeconds != 120 || r.GiBSeconds != 30 {
+		t.Errorf("completed record got:%+v", r)
+	}
+	if running, err := records.incomplete(ctx); err != nil || len(running) != 0 {
+		t.Errorf("incomplete() after completion got:%v, %v want none", running, err)
+	}
+}
+
+func TestAggregateUsage(t *testing.T) {
+	day1 := time.Date(2023, 7, 25, 10, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+	rec := func(repo, workflow string, dispatched time.Time, seconds float64) jobRecord {
+		start := dispatched.Add(10 * time.Second)
+		end := start.Add(time.Duration(seconds * float64(time.Second)))
+		return jobRecord{Repository: repo, Workflow: workflow, Profile: "default", Dispatched: dispatched, Started: &start, Completed: &end, VCPUSeconds: seconds, GiBSeconds: seconds / 2}
+	}
+	small := rec("a/z", "build", day2, 40)
+	small.Organization, small.Profile = "a", "small"
+	records := []jobRecord{
+		rec("a/x", "build", day1, 60),
+		rec("a/x", "build", day1, 30),
+		rec("a/x", "test", day2, 10),
+		rec("b/y", "build", day2, 100),
+		small,
+		{Repository: "b/y", Workflow: "build", Dispatched: day2}, // Still running.
+	}
+
+	tests := []struct {
+		by   []string
+		want []usageRow
+	}{
+		{by: []string{"repo"}, want: []usageRow{
+			{Repository: "a/x", Jobs: 3, Seconds: 100, VCPUSeconds: 100, GiBSeconds: 50},
+			{Repository: "a/z", Jobs: 1, Seconds: 40, VCPUSeconds: 40, GiBSeconds: 20},
+			{Repository: "b/y", Jobs: 1, Seconds: 100, VCPUSeconds: 100, GiBSeconds: 50},
+		}},
+		{by: []string{"org", "profile"}, want: []usageRow{
+			{Organization: "a", Profile: "default", Jobs: 3, Seconds: 100, VCPUSeconds: 100, GiBSeconds: 50},
+			{Organization: "a", Profile: "small", Jobs: 1, Seconds: 40, VCPUSeconds: 40, GiBSeconds: 20},
+			{Organization: "b", Profile: "default", Jobs: 1, Seconds: 100, VCPUSeconds: 100, GiBSeconds: 50},
+		}},
+		{by: []string{"repo", "workflow", "day"}, want: []usageRow{
+			{Repository: "a/x", Workflow: "build", Day: "2023-07-25", Jobs: 2, Seconds: 90, VCPUSeconds: 90, GiBSeconds: 45},
+			{Repository: "a/x", Workflow: "test", Day: "2023-07-26", Jobs: 1, Seconds: 10, VCPUSeconds: 10, GiBSeconds: 5},
+			{Repository: "a/z", Workflow: "build", Day: "2023-07-26", Jobs: 1, Seconds: 40, VCPUSeconds: 40, GiBSeconds: 20},
+			{Repository: "b/y", Workflow: "build", Day: "2023-07-26", Jobs: 1, Seconds: 100, VCPUSeconds: 100, GiBSeconds: 50},
+		}},
+		{by: nil, want: []usageRow{{Jobs: 5, Seconds: 240, VCPUSeconds: 240, GiBSeconds: 120}}},
+	}
+	for _, tc := range tests {
+		t.Run(strings.Join(tc.by, ","), func(t *testing.T) {
+			got := aggregateUsage(records, tc.by)
+			if len(got) != len(tc.want) {
+				t.Fatalf("aggregateUsage() got:%+v want:%+v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("row %d got:%+v want:%+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseUsageQuery(t *testing.T) {
+	now := time.Date(2023, 7, 26, 15, 0, 0, 0, time.UTC)
+	q, err := parseUsageQuery("", "", "", "", now)
+	if err != nil {
+		t.Fatalf("parseUsageQuery() failed: %v", err)
+	}
+	if got := q.from.Format("2006-01-02"); got != "2023-07-20" {
+		t.Errorf("default from got:%s want:2023-07-20", got)
+	}
+	if q.format != "json" || strings.Join(q.by, ",") != "repo,workflow,day" {
+		t.Errorf("defaults got:%+v", q)
+	}
+	for _, bad := range [][4]string{
+		{"yesterday", "", "", ""},
+		{"2023-07-27", "2023-07-26", "", ""},
+		{"", "", "owner", ""},
+		{"", "", "", "xml"},
+	} {
+		if _, err := parseUsageQuery(bad[0], bad[1], bad[2], bad[3], now); err == nil {
+			t.Errorf("parseUsageQuery(%q) succeeded, want error", bad)
+		}
+	}
+}
+
+func TestAdminUsage(t *testing.T) {
+	config := testConfig()
+	config.AdminSecretName = testSignatureSecret
+	records, jobs, exec := dispatchAndRecord(t, config)
+	now := time.Now()
+	jobs.finishExecution(exec, now.Add(-time.Minute), now, true)
+	if err := (usageTracker{records: records, client: jobs}).reconcile(context.Background()); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	clients, _ := testClients(t, config)
+	mux := newServer(clients, config, nil, records).mux()
+
+	tests := []struct {
+		name       string
+		token      string
+		query      string
+		wantStatus int
+	}{
+		{name: "no token", wantStatus: http.StatusUnauthorized},
+		{name: "wrong token", token: "guess", wantStatus: http.StatusForbidden},
+		{name: "bad query", token: testSecretValue, query: "?by=owner", wantStatus: http.StatusBadRequest},
+		{name: "csv", token: testSecretValue, query: "?by=repo&format=csv", wantStatus: http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/usage"+tc.query, nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status got:%d want:%d (body %q)", w.Code, tc.wantStatus, w.Body.String())
+			}
+			if tc.wantStatus != http.StatusOK {
+				return
+			}
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			if err != nil {
+				t.Fatalf("reading CSV: %v", err)
+			}
+			want := [][]string{
+				{"repo", "jobs", "seconds", "vcpu_seconds", "gib_seconds"},
+				{"squee1945/self-hosted-runner", "1", "60.0", "0.0", "0.0"},
+			}
+			if len(rows) != 2 || strings.Join(rows[0], ",") != strings.Join(want[0], ",") || strings.Join(rows[1][:3], ",") != strings.Join(want[1][:3], ",") {
+				t.Errorf("CSV got:%v want:%v", rows, want)
+			}
+		})
+	}
+
+	// Disabled without $ADMIN_SECRET.
+	config.AdminSecretName = ""
+	w := httptest.NewRecorder()
+	newServer(clients, config, nil, records).mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/usage", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("disabled status got:%d want:%d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+const (
+	// Scopes of a volume's caches; see volumeSpec.
+	cacheScopeRepository   = "repository"
+	cacheScopeOrganization = "organization"
+	cacheScopeShared       = "shared"
+)
+
+var (
+	volumeNameRE = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+	envNameRE    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+	// reservedEnvVars are set by the service, so caches cannot use them.
+	reservedEnvVars = []string{
+		tokenSecretEnvVar, runnerTokenEnvVar, repositoryURLEnvVar, runnerNameEnvVar, runnerLabelsEnvVar,
+		repositoryEnvVar, runIDEnvVar, jobIDEnvVar, runAttemptEnvVar, headSHAEnvVar, actionsCacheURLEnvVar,
+		runnerEventsURLEnvVar, runnerEventsScriptEnvVar, runnerEventsTokenEnvVar, containerStartedEnvVar, registeredEnvVar, runnerDiagURLEnvVar,
+	}
+)
+
+// volumeFile is the format of $VOLUME_FILE. Each volume is mounted in the
+// runner container of the jobs of its profiles, and can hold caches, which
+// env vars set per execution point at. For example:
+//
+//	{
+//	  "volumes": [
+//	    {
+//	      "name": "cache", "mountPath": "/cache", "gcs": {"bucket": "acme-ci-cache", "readOnly": true},
+//	      "caches": {"GOMODCACHE": "go/mod", "npm_config_cache": "npm"}
+//	    },
+//	    {
+//	      "name": "tools", "mountPath": "/tools", "scope": "shared",
+//	      "nfs": {"server": "10.0.0.2", "path": "/tools", "readOnly": true},
+//	      "caches": {"RUNNER_TOOL_CACHE": "hostedtoolcache"}
+//	    },
+//	    {"name": "scratch", "mountPath": "/scratch", "memory": {"sizeLimit": "2Gi"}, "profiles": ["default"]}
+//	  ]
+//	}
+//
+// With the default "repository" scope, GOMODCACHE above is
+// "/cache/{owner}/{repo}/go/mod"; "organization" points at an owner's
+// directory and "shared" at the volume's. Every job of a profile mounts the
+// whole volume, so the prefixes only pick the directory, and a runner could
+// write to any repository's: Cloud Storage and NFS volumes must be
+// read-only, filled by another process, until jobs mount only the
+// repository's directory.
+type volumeFile struct {
+	Volumes []volumeSpec `json:"volumes"`
+}
+
+type volumeSpec struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	// Profiles are the profiles whose jobs mount the volume. Defaults to
+	// the default and small profiles; the locked profile, which runs
+	// untrusted code, only gets volumes that name it.
+	Profiles []profile `json:"profiles"`
+
+	// Exactly one of GCS, NFS and Memory.
+	GCS    *gcsVolume    `json:"gcs"`
+	NFS    *nfsVolume    `json:"nfs"`
+	Memory *memoryVolume `json:"memory"`
+
+	// Caches are env vars to set to directories on the volume, by path
+	// relative to the scope's directory.
+	Caches map[string]string `json:"caches"`
+	Scope  string            `json:"scope"` // One of: repository (default), organization, shared.
+}
+
+// gcsVolume is a Cloud Storage bucket mounted with Cloud Storage FUSE.
+type gcsVolume struct {
+	Bucket   string `json:"bucket"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+// nfsVolume is an NFS share, e.g., a Filestore instance.
+type nfsVolume struct {
+	Server   string `json:"server"`
+	Path     string `json:"path"`
+	ReadOnly bool   `json:"readOnly"`
+}
+
+// memoryVolume is an in-memory emptyDir, which lasts as long as the task;
+// its contents count towards the task's memory.
+type memoryVolume struct {
+	SizeLimit string `json:"sizeLimit"` // E.g., "2Gi". Defaults to half of the task's memory.
+}
+
+// mountedBy reports whether jobs of the profile mount the volume.
+func (v volumeSpec) mountedBy(p profile) bool {
+	if len(v.Profiles) == 0 {
+		return p != profileLocked
+	}
+	return slices.Contains(v.Profiles, p)
+}
+
+// writable reports whether runners can write to the volume and have
+// later executions, of any repository, read it. Memory volumes last only as
+// long as the task.
+func (v volumeSpec) writable() bool {
+	return v.GCS != nil && !v.GCS.ReadOnly || v.NFS != nil && !v.NFS.ReadOnly
+}
+
+func (v volumeSpec) volume() *runpb.Volume {
+	vol := &runpb.Volume{Name: v.Name}
+	switch {
+	case v.GCS != nil:
+		vol.VolumeType = &runpb.Volume_Gcs{Gcs: &runpb.GCSVolumeSource{Bucket: v.GCS.Bucket, ReadOnly: v.GCS.ReadOnly}}
+	case v.NFS != nil:
+		vol.VolumeType = &runpb.Volume_Nfs{Nfs: &runpb.NFSVolumeSource{Server: v.NFS.Server, Path: v.NFS.Path, ReadOnly: v.NFS.ReadOnly}}
+	case v.Memory != nil:
+		vol.VolumeType = &runpb.Volume_EmptyDir{EmptyDir: &runpb.EmptyDirVolumeSource{Medium: runpb.EmptyDirVolumeSource_MEMORY, SizeLimit: v.Memory.SizeLimit}}
+	}
+	return vol
+}
+
+// cacheDir is the directory of the cache at rel for the repository.
+func (v volumeSpec) cacheDir(repo, rel string) string {
+	switch v.Scope {
+	case cacheScopeShared:
+		return path.Join(v.MountPath, rel)
+	case cacheScopeOrganization:
+		owner, _, _ := strings.Cut(strings.ToLower(repo), "/")
+		return path.Join(v.MountPath, owner, rel)
+	}
+	return path.Join(v.MountPath, strings.ToLower(repo), rel)
+}
+
+// volumeSet is a parsed $VOLUME_FILE.
+type volumeSet struct {
+	volumes []volumeSpec
+}
+
+func loadVolumeSet(path string) (*volumeSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading volume file: %v", err)
+	}
+	return parseVolumeSet(b)
+}
+
+func parseVolumeSet(b []byte) (*volumeSet, error) {
+	var vf volumeFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&vf); err != nil {
+		return nil, fmt.Errorf("parsing volumes: %v", err)
+	}
+	names, mounts, envs := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for i, v := range vf.Volumes {
+		if !volumeNameRE.MatchString(v.Name) {
+			return nil, fmt.Errorf("volume %d: name %q must match %s", i+1, v.Name, volumeNameRE)
+		}
+		if names[v.Name] {
+			return nil, fmt.Errorf("volume %q: duplicate name", v.Name)
+		}
+		names[v.Name] = true
+		if !path.IsAbs(v.MountPath) || path.Clean(v.MountPath) != v.MountPath || v.MountPath == "/" {
+			return nil, fmt.Errorf("volume %q: mountPath %q must be a clean absolute path other than /", v.Name, v.MountPath)
+		}
+		if mounts[v.MountPath] {
+			return nil, fmt.Errorf("volume %q: mountPath %q is used by another volume", v.Name, v.MountPath)
+		}
+		mounts[v.MountPath] = true
+		for _, p := range v.Profiles {
+			if p != profileDefault && p != profileSmall && p != profileLocked {
+				return nil, fmt.Errorf("volume %q: profile %q must be one of %q, %q or %q", v.Name, p, profileDefault, profileSmall, profileLocked)
+			}
+		}
+
+		sources := 0
+		for _, set := range []bool{v.GCS != nil, v.NFS != nil, v.Memory != nil} {
+			if set {
+				sources++
+			}
+		}
+		switch {
+		case sources != 1:
+			return nil, fmt.Errorf("volume %q: exactly one of gcs, nfs and memory must be set", v.Name)
+		case v.GCS != nil && v.GCS.Bucket == "":
+			return nil, fmt.Errorf("volume %q: gcs.bucket must be set", v.Name)
+		case v.NFS != nil && (v.NFS.Server == "" || !path.IsAbs(v.NFS.Path)):
+			return nil, fmt.Errorf("volume %q: nfs.server and an absolute nfs.path must be set", v.Name)
+		case v.Memory != nil && v.Memory.SizeLimit != "":
+			if _, err := parseMemoryGiB(v.Memory.SizeLimit); err != nil {
+				return nil, fmt.Errorf("volume %q: memory.sizeLimit: %v", v.Name, err)
+			}
+		}
+
+		switch v.Scope {
+		case "":
+			vf.Volumes[i].Scope = cacheScopeRepository
+		case cacheScopeRepository, cacheScopeOrganization, cacheScopeShared:
+		default:
+			return nil, fmt.Errorf("volume %q: scope %q must be one of %q, %q or %q", v.Name, v.Scope, cacheScopeRepository, cacheScopeOrganization, cacheScopeShared)
+		}
+		if v.writable() {
+			return nil, fmt.Errorf("volume %q: must be read-only, since every repository's runners mount all of it", v.Name)
+		}
+		for env, rel := range v.Caches {
+			if !envNameRE.MatchString(env) || slices.Contains(reservedEnvVars, env) {
+				return nil, fmt.Errorf("volume %q: cache env var %q is not a valid name, or is set by the service", v.Name, env)
+			}
+			if envs[env] {
+				return nil, fmt.Errorf("volume %q: cache env var %q is set by another volume", v.Name, env)
+			}
+			envs[env] = true
+			if !filepath.IsLocal(rel) {
+				return nil, fmt.Errorf("volume %q: cache %q path %q must be relative and stay within the volume", v.Name, env, rel)
+			}
+		}
+	}
+	return &volumeSet{volumes: vf.Volumes}, nil
+}
+
+// forProfile returns the volumes that jobs of the profile mount.
+func (s *volumeSet) forProfile(p profile) []volumeSpec {
+	if s == nil {
+		return nil
+	}
+	var vols []volumeSpec
+	for _, v := range s.volumes {
+		if v.mountedBy(p) {
+			vols = append(vols, v)
+		}
+	}
+	return vols
+}
+
+// volumes returns the job's volumes and the runner container's mounts.
+func (j *cloudRunJob) volumes() ([]*runpb.Volume, []*runpb.VolumeMount) {
+	var vols []*runpb.Volume
+	var mounts []*runpb.VolumeMount
+	for _, v := range j.config.volumes.forProfile(j.profileOrDefault()) {
+		vols = append(vols, v.volume())
+		mounts = append(mounts, &runpb.VolumeMount{Name: v.Name, MountPath: v.MountPath})
+	}
+	return vols, mounts
+}
+
+// cacheEnv returns the env vars that point the runner's caches at the
+// repository's directories on the job's volumes, sorted by name.
+func (j *cloudRunJob) cacheEnv(repo string) []*runpb.EnvVar {
+	if repo == "" {
+		return nil
+	}
+	var env []*runpb.EnvVar
+	for _, v := range j.config.volumes.forProfile(j.profileOrDefault()) {
+		for name, rel := range v.Caches {
+			env = append(env, &runpb.EnvVar{Name: name, Values: &runpb.EnvVar_Value{Value: v.cacheDir(repo, rel)}})
+		}
+	}
+	sort.Slice(env, func(a, b int) bool { return env[a].Name < env[b].Name })
+	return env
+}
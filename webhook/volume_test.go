@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+func TestVolumes(t *testing.T) {
+	volumes, err := loadVolumeSet("testdata/volumes.json")
+	if err != nil {
+		t.Fatalf("loadVolumeSet() failed: %v", err)
+	}
+	config := testConfig()
+	config.volumes = volumes
+
+	tests := []struct {
+		profile     profile
+		wantVolumes []string
+		wantEnv     map[string]string
+	}{
+		{
+			profile:     profileDefault,
+			wantVolumes: []string{"cache /cache", "tools /tools", "org /org", "scratch /scratch"},
+			wantEnv: map[string]string{
+				"GOMODCACHE":        "/cache/owner/repo/go/mod",
+				"npm_config_cache":  "/cache/owner/repo/npm",
+				"RUNNER_TOOL_CACHE": "/tools/hostedtoolcache",
+				"PIP_CACHE_DIR":     "/org/owner/pip",
+			},
+		},
+		{
+			profile:     profileLocked,
+			wantVolumes: []string{"tools /tools"},
+			wantEnv:     map[string]string{"RUNNER_TOOL_CACHE": "/tools/hostedtoolcache"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.profile), func(t *testing.T) {
+			job := cloudRunJob{config: config, client: newFakeJobsClient(), profile: tc.profile}
+			req, err := job.createJobRequest()
+			if err != nil {
+				t.Fatalf("createJobRequest() failed: %v", err)
+			}
+			task := req.Job.Template.Template
+			var got []string
+			for i, v := range task.Volumes {
+				got = append(got, v.Name+" "+task.Containers[0].VolumeMounts[i].MountPath)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.wantVolumes, ",") {
+				t.Errorf("volumes got:%q want:%q", got, tc.wantVolumes)
+			}
+
+			run, err := job.runJobRequest(context.Background(), runOptions{repoURL: "https://github.com/Owner/Repo", repo: "Owner/Repo", runnerToken: "token"})
+			if err != nil {
+				t.Fatalf("runJobRequest() failed: %v", err)
+			}
+			env := overrideEnv(run)
+			for name, want := range tc.wantEnv {
+				if env[name] != want {
+					t.Errorf("$%s got:%q want:%q", name, env[name], want)
+				}
+			}
+			if tc.profile == profileLocked && env["GOMODCACHE"] != "" {
+				t.Errorf("locked profile got $GOMODCACHE %q", env["GOMODCACHE"])
+			}
+		})
+	}
+
+	scratch := volumes.forProfile(profileDefault)[3].volume()
+	if got := scratch.GetEmptyDir(); got.GetMedium() != runpb.EmptyDirVolumeSource_MEMORY || got.GetSizeLimit() != "2Gi" {
+		t.Errorf("scratch volume got:%v", scratch)
+	}
+}
+
+func TestParseVolumeSetErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "unknown field", content: `{"volumes": [{"name": "a", "bucket": "b"}]}`, wantErr: "unknown field"},
+		{name: "bad name", content: `{"volumes": [{"name": "A_1", "mountPath": "/a", "gcs": {"bucket": "b", "readOnly": true}}]}`, wantErr: "name \"A_1\" must match"},
+		{name: "relative mount", content: `{"volumes": [{"name": "a", "mountPath": "a", "gcs": {"bucket": "b", "readOnly": true}}]}`, wantErr: "must be a clean absolute path"},
+		{name: "same mount", content: `{"volumes": [{"name": "a", "mountPath": "/a", "gcs": {"bucket": "b", "readOnly": true}}, {"name": "b", "mountPath": "/a", "gcs": {"bucket": "b", "readOnly": true}}]}`, wantErr: "used by another volume"},
+		{name: "two sources", content: `{"volumes": [{"name": "a", "mountPath": "/a", "gcs": {"bucket": "b", "readOnly": true}, "memory": {}}]}`, wantErr: "exactly one of gcs, nfs and memory"},
+		{name: "nfs path", content: `{"volumes": [{"name": "a", "mountPath": "/a", "nfs": {"server": "10.0.0.2"}}]}`, wantErr: "nfs.server and an absolute nfs.path"},
+		{name: "size limit", content: `{"volumes": [{"name": "a", "mountPath": "/a", "memory": {"sizeLimit": "lots"}}]}`, wantErr: "memory.sizeLimit"},
+		{name: "scope", content: `{"volumes": [{"name": "a", "mountPath": "/a", "gcs": {"bucket": "b", "readOnly": true}, "scope": "global"}]}`, wantErr: `scope "global"`},
+		{name: "writable gcs", content: `{"volumes": [{"name": "a", "mountPath": "/a", "gcs": {"bucket": "b"}}]}`, wantErr: "must be read-only"},
+		{name: "writable nfs", content: `{"volumes": [{"name": "a", "mountPath": "/a", "nfs": {"server": "10.0.0.2", "path": "/a"}, "scope": "shared"}]}`, wantErr: "must be read-only"},
+		{name: "reserved env", content: `{"volumes": [{"name": "a", "mountPath": "/a", "gcs": {"bucket": "b", "readOnly": true}, "caches": {"RUNNER_NAME": "x"}}]}`, wantErr: "set by the service"},
+		{name: "escaping cache", content: `{"volumes": [{"name": "a", "mountPath": "/a", "gcs": {"bucket": "b", "readOnly": true}, "caches": {"GOMODCACHE": "../x"}}]}`, wantErr: "stay within the volume"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := parseVolumeSet([]byte(tc.content)); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("error got:%v want:%q", err, tc.wantErr)
+			}
+		})
+	}
+}
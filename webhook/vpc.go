@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	vpcaccess "google.golang.org/api/vpcaccess/v1"
+)
+
+// vpcEgress is which of the runners' traffic goes through the VPC network.
+type vpcEgress string
+
+const (
+	vpcEgressAll     vpcEgress = "all-traffic"
+	vpcEgressPrivate vpcEgress = "private-ranges-only"
+)
+
+// vpcConfig is how a profile's runners reach a VPC network: Direct VPC
+// egress through Network and/or Subnetwork, or a Serverless VPC Access
+// connector. Network, Subnetwork and Connector are names, or full resource
+// names for networks in another project, e.g., a Shared VPC host project.
+type vpcConfig struct {
+	Network    string    `env:"VPC_NETWORK"`
+	Subnetwork string    `env:"VPC_SUBNETWORK"`
+	Tags       []string  `env:"VPC_NETWORK_TAGS"` // Network tags for firewall rules; Direct VPC egress only.
+	Connector  string    `env:"VPC_CONNECTOR"`
+	Egress     vpcEgress `env:"VPC_EGRESS"` // One of: all-traffic, private-ranges-only. Defaults to private-ranges-only.
+}
+
+// set reports whether any of the settings are.
+func (v vpcConfig) set() bool {
+	return v.Network != "" || v.Subnetwork != "" || len(v.Tags) > 0 || v.Connector != "" || v.Egress != ""
+}
+
+// validate checks that the settings, read from env vars starting with
+// prefix, make sense together.
+func (v vpcConfig) validate(prefix string) error {
+	direct := v.Network != "" || v.Subnetwork != ""
+	switch {
+	case direct && v.Connector != "":
+		return fmt.Errorf("$%sVPC_CONNECTOR cannot be used with $%sVPC_NETWORK or $%sVPC_SUBNETWORK", prefix, prefix, prefix)
+	case len(v.Tags) > 0 && !direct:
+		return fmt.Errorf("$%sVPC_NETWORK_TAGS requires $%sVPC_NETWORK or $%sVPC_SUBNETWORK", prefix, prefix, prefix)
+	case v.Egress != "" && !direct && v.Connector == "":
+		return fmt.Errorf("$%sVPC_EGRESS requires $%sVPC_NETWORK, $%sVPC_SUBNETWORK or $%sVPC_CONNECTOR", prefix, prefix, prefix, prefix)
+	case v.Egress != "" && v.Egress != vpcEgressAll && v.Egress != vpcEgressPrivate:
+		return fmt.Errorf("$%sVPC_EGRESS %q must be %q or %q", prefix, v.Egress, vpcEgressAll, vpcEgressPrivate)
+	}
+	return nil
+}
+
+// vpcAccess is the Cloud Run VPC access for the settings; nil if unset.
+func (v vpcConfig) vpcAccess() *runpb.VpcAccess {
+	if !v.set() {
+		return nil
+	}
+	access := &runpb.VpcAccess{Connector: v.Connector, Egress: runpb.VpcAccess_PRIVATE_RANGES_ONLY}
+	if v.Egress == vpcEgressAll {
+		access.Egress = runpb.VpcAccess_ALL_TRAFFIC
+	}
+	if v.Network != "" || v.Subnetwork != "" {
+		access.NetworkInterfaces = []*runpb.VpcAccess_NetworkInterface{{Network: v.Network, Subnetwork: v.Subnetwork, Tags: v.Tags}}
+	}
+	return access
+}
+
+// networkClient looks up the networks that runners egress through, so that
+// ensureJob can report a missing one clearly. The lookups return an error
+// satisfying isNotFound if the resource does not exist.
+type networkClient interface {
+	getNetwork(ctx context.Context, project, name string) error
+	getSubnetwork(ctx context.Context, project, region, name string) error
+	// getConnector looks up the connector with the full resource name
+	// "projects/{project}/locations/{location}/connectors/{name}".
+	getConnector(ctx context.Context, name string) error
+}
+
+// cloudNetworkClient implements networkClient with the Compute Engine and
+// Serverless VPC Access APIs.
+type cloudNetworkClient struct {
+	compute   *compute.Service
+	vpcaccess *vpcaccess.Service
+}
+
+func newCloudNetworkClient(ctx context.Context) (*cloudNetworkClient, error) {
+	c, err := compute.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating Compute Engine client: %v", err)
+	}
+	v, err := vpcaccess.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("creating Serverless VPC Access client: %v", err)
+	}
+	return &cloudNetworkClient{compute: c, vpcaccess: v}, nil
+}
+
+func (c *cloudNetworkClient) getNetwork(ctx context.Context, project, name string) error {
+	_, err := c.compute.Networks.Get(project, name).Context(ctx).Do()
+	return err
+}
+
+func (c *cloudNetworkClient) getSubnetwork(ctx context.Context, project, region, name string) error {
+	_, err := c.compute.Subnetworks.Get(project, region, name).Context(ctx).Do()
+	return err
+}
+
+func (c *cloudNetworkClient) getConnector(ctx context.Context, name string) error {
+	_, err := c.vpcaccess.Projects.Locations.Connectors.Get(name).Context(ctx).Do()
+	return err
+}
+
+func isNotFound(err error) bool {
+	var gerr *googleapi.Error
+	return errors.As(err, &gerr) && gerr.Code == http.StatusNotFound
+}
+
+// splitRef returns the project, region and name in ref, which is a name or
+// a resource name like "projects/{project}/regions/{region}/subnetworks/{name}",
+// possibly as a URL. The parts ref leaves out are the defaults.
+func splitRef(ref, project, region string) (string, string, string) {
+	if i := strings.Index(ref, "projects/"); i >= 0 {
+		ref = ref[i:]
+	}
+	parts := strings.Split(ref, "/")
+	if len(parts) >= 2 && parts[0] == "projects" {
+		project = parts[1]
+	}
+	if len(parts) >= 4 && parts[2] != "global" {
+		region = parts[3]
+	}
+	return project, region, parts[len(parts)-1]
+}
+
+// vpc returns the profile's VPC settings, and the prefix of the env vars
+// they were read from. The small profile shares the default profile's
+// settings unless it has its own; the locked profile never does, since
+// untrusted code should not reach private networks by default.
+func (j *cloudRunJob) vpc() (vpcConfig, string) {
+	switch j.profile {
+	case profileLocked:
+		return j.config.LockedVPC, "LOCKED_"
+	case profileSmall:
+		if j.config.SmallVPC.set() {
+			return j.config.SmallVPC, "SMALL_"
+		}
+	}
+	return j.config.VPC, ""
+}
+
+// checkVPC checks that the profile's network, subnetwork or connector
+// exists in the job's region. Failing lookups that are not a NotFound,
+// e.g., for want of compute.networks.get, are only logged.
+func (j *cloudRunJob) checkVPC(ctx context.Context) error {
+	v, prefix := j.vpc()
+	if j.networks == nil || !v.set() {
+		return nil
+	}
+	check := func(env, desc string, err error) error {
+		switch {
+		case err == nil:
+			return nil
+		case isNotFound(err):
+			return fmt.Errorf("$%s%s: %s not found", prefix, env, desc)
+		}
+		logWarn("Could not check $%s%s, %s: %v", prefix, env, desc, err)
+		return nil
+	}
+
+	if v.Network != "" {
+		project, _, name := splitRef(v.Network, j.config.Project, j.config.Location)
+		desc := fmt.Sprintf("network %q in project %q", name, project)
+		if err := check("VPC_NETWORK", desc, j.networks.getNetwork(ctx, project, name)); err != nil {
+			return err
+		}
+	}
+	if v.Subnetwork != "" {
+		project, region, name := splitRef(v.Subnetwork, j.config.Project, j.config.Location)
+		if region != j.config.Location {
+			return fmt.Errorf("$%sVPC_SUBNETWORK: subnetwork %q is in region %q, not the job's region %q", prefix, name, region, j.config.Location)
+		}
+		desc := fmt.Sprintf("subnetwork %q in project %q, region %q", name, project, region)
+		if err := check("VPC_SUBNETWORK", desc, j.networks.getSubnetwork(ctx, project, region, name)); err != nil {
+			return err
+		}
+	}
+	if v.Connector != "" {
+		project, region, name := splitRef(v.Connector, j.config.Project, j.config.Location)
+		if region != j.config.Location {
+			return fmt.Errorf("$%sVPC_CONNECTOR: connector %q is in region %q, not the job's region %q", prefix, name, region, j.config.Location)
+		}
+		desc := fmt.Sprintf("connector %q in project %q, region %q", name, project, region)
+		full := fmt.Sprintf("projects/%s/locations/%s/connectors/%s", project, region, name)
+		if err := check("VPC_CONNECTOR", desc, j.networks.getConnector(ctx, full)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
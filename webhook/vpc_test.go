@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+	"github.com/sethvargo/go-envconfig"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestVPCConfigEnv(t *testing.T) {
+	var c config
+	env := envconfig.MapLookuper(map[string]string{
+		"REPOSITORY_URL":      "https://github.com/owner/repo",
+		"RUNNER_IMAGE_URL":    "image",
+		"GITHUB_TOKEN_SECRET": "secret",
+		"VPC_NETWORK":         "ci",
+		"VPC_NETWORK_TAGS":    "runner,egress",
+		"VPC_EGRESS":          "all-traffic",
+		"LOCKED_VPC_NETWORK":  "untrusted",
+	})
+	if err := envconfig.ProcessWith(context.Background(), &c, env); err != nil {
+		t.Fatalf("ProcessWith() failed: %v", err)
+	}
+	if c.VPC.Network != "ci" || len(c.VPC.Tags) != 2 || c.VPC.Egress != vpcEgressAll {
+		t.Errorf("VPC got:%+v", c.VPC)
+	}
+	if c.LockedVPC.Network != "untrusted" || c.LockedVPC.Egress != "" || c.SmallVPC.set() {
+		t.Errorf("LockedVPC, SmallVPC got:%+v, %+v", c.LockedVPC, c.SmallVPC)
+	}
+}
+
+func TestVPCConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		vpc     vpcConfig
+		wantErr string
+	}{
+		{name: "unset"},
+		{name: "network", vpc: vpcConfig{Network: "ci", Tags: []string{"runner"}, Egress: vpcEgressAll}},
+		{name: "connector", vpc: vpcConfig{Connector: "ci", Egress: vpcEgressPrivate}},
+		{name: "network and connector", vpc: vpcConfig{Subnetwork: "ci", Connector: "ci"}, wantErr: "$LOCKED_VPC_CONNECTOR cannot be used"},
+		{name: "tags without network", vpc: vpcConfig{Connector: "ci", Tags: []string{"runner"}}, wantErr: "$LOCKED_VPC_NETWORK_TAGS requires"},
+		{name: "egress alone", vpc: vpcConfig{Egress: vpcEgressAll}, wantErr: "$LOCKED_VPC_EGRESS requires"},
+		{name: "bad egress", vpc: vpcConfig{Network: "ci", Egress: "all"}, wantErr: `$LOCKED_VPC_EGRESS "all" must be`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.vpc.validate("LOCKED_")
+			if tc.wantErr == "" && err != nil {
+				t.Errorf("validate() failed: %v", err)
+			}
+			if tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Errorf("validate() error got:%v want:%q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestEnsureJobVPC(t *testing.T) {
+	networks := fakeNetworks{
+		"projects/my-project/global/networks/ci":                         true,
+		"projects/host-project/regions/us-central1/subnetworks/shared":   true,
+		"projects/my-project/locations/us-central1/connectors/untrusted": true,
+	}
+	tests := []struct {
+		name    string
+		profile profile
+		vpc     vpcConfig // $VPC_*
+		small   vpcConfig // $SMALL_VPC_*
+		locked  vpcConfig // $LOCKED_VPC_*
+		want    *runpb.VpcAccess
+		wantErr string
+	}{
+		{
+			name: "none",
+		},
+		{
+			name: "network",
+			vpc:  vpcConfig{Network: "ci", Tags: []string{"runner"}, Egress: vpcEgressAll},
+			want: &runpb.VpcAccess{Egress: runpb.VpcAccess_ALL_TRAFFIC, NetworkInterfaces: []*runpb.VpcAccess_NetworkInterface{{Network: "ci", Tags: []string{"runner"}}}},
+		},
+		{
+			name:    "small shares the default",
+			profile: profileSmall,
+			vpc:     vpcConfig{Network: "ci"},
+			want:    &runpb.VpcAccess{Egress: runpb.VpcAccess_PRIVATE_RANGES_ONLY, NetworkInterfaces: []*runpb.VpcAccess_NetworkInterface{{Network: "ci"}}},
+		},
+		{
+			name:    "shared VPC subnetwork",
+			profile: profileSmall,
+			vpc:     vpcConfig{Network: "ci"},
+			small:   vpcConfig{Subnetwork: "projects/host-project/regions/us-central1/subnetworks/shared"},
+			want:    &runpb.VpcAccess{Egress: runpb.VpcAccess_PRIVATE_RANGES_ONLY, NetworkInterfaces: []*runpb.VpcAccess_NetworkInterface{{Subnetwork: "projects/host-project/regions/us-central1/subnetworks/shared"}}},
+		},
+		{
+			name:    "locked does not share the default",
+			profile: profileLocked,
+			vpc:     vpcConfig{Network: "ci"},
+		},
+		{
+			name:    "locked connector",
+			profile: profileLocked,
+			locked:  vpcConfig{Connector: "untrusted"},
+			want:    &runpb.VpcAccess{Connector: "untrusted", Egress: runpb.VpcAccess_PRIVATE_RANGES_ONLY},
+		},
+		{
+			name:    "missing network",
+			vpc:     vpcConfig{Network: "projects/host-project/global/networks/ci"},
+			wantErr: `$VPC_NETWORK: network "ci" in project "host-project" not found`,
+		},
+		{
+			name:    "missing connector",
+			profile: profileLocked,
+			locked:  vpcConfig{Connector: "ci"},
+			wantErr: `$LOCKED_VPC_CONNECTOR: connector "ci" in project "my-project", region "us-central1" not found`,
+		},
+		{
+			name:    "subnetwork in another region",
+			vpc:     vpcConfig{Subnetwork: "projects/my-project/regions/europe-west1/subnetworks/ci"},
+			wantErr: `$VPC_SUBNETWORK: subnetwork "ci" is in region "europe-west1"`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.VPC, config.SmallVPC, config.LockedVPC = tc.vpc, tc.small, tc.locked
+			config.LockedServiceAccount = "locked@my-project.iam.gserviceaccount.com"
+			jobs := newFakeJobsClient()
+			job := cloudRunJob{config: config, client: jobs, profile: tc.profile, networks: networks}
+			err := job.ensureJob(context.Background())
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("ensureJob() error got:%v want:%q", err, tc.wantErr)
+				}
+				if len(jobs.jobs) != 0 {
+					t.Errorf("job created despite the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ensureJob() failed: %v", err)
+			}
+			got, err := job.getJob(context.Background())
+			if err != nil {
+				t.Fatalf("getJob() failed: %v", err)
+			}
+			if access := got.Template.Template.VpcAccess; !proto.Equal(access, tc.want) {
+				t.Errorf("VPC access got:%v want:%v", access, tc.want)
+			}
+		})
+	}
+}
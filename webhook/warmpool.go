@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+const (
+	// warmRunnerPrefix prefixes the names of warm runners, which are
+	// "cloud-run-warm-{pool}-{started, in Unix milliseconds}".
+	warmRunnerPrefix = runnerNamePrefix + "warm-"
+
+	// warmClaimPrefix holds the claims on warm runners in $STATE_URL, as
+	// "warm/claims/{runner name}", so that instances do not claim the same
+	// runner.
+	warmClaimPrefix = "warm/claims/"
+)
+
+var (
+	// warmInterval is how often the pools are reconciled with GitHub's runners.
+	warmInterval = 30 * time.Second
+	// warmStartTimeout is how long a warm runner has to register before it is
+	// given up on.
+	warmStartTimeout = 10 * time.Minute
+	// warmClaimTimeout is how long a runner claimed for a queued job can
+	// stay idle before it is returned to the pool; GitHub may have given the
+	// job to another runner.
+	warmClaimTimeout = 2 * time.Minute
+	// defaultWarmIdleTTL is how long a warm runner waits for a job.
+	defaultWarmIdleTTL = 30 * time.Minute
+
+	// defaultRunnerLabels are the labels every runner has. Runner images are
+	// assumed to be Linux on x64.
+	defaultRunnerLabels = []string{"self-hosted", "linux", "x64"}
+
+	weekdays = map[string]time.Weekday{"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday}
+)
+
+// warmPoolFile is the format of $WARM_POOL_FILE. Each pool keeps a number
+// of idle runners registered during its hours, for queued jobs whose labels
+// it has. For example:
+//
+//	{
+//	  "timezone": "America/New_York",
+//	  "pools": [
+//	    {"name": "linux", "size": 2, "hours": "08:00-18:00", "days": ["mon", "tue", "wed", "thu", "fri"], "idleTTL": "30m"},
+//	    {"name": "gpu", "labels": ["gpu"], "size": 1}
+//	  ]
+//	}
+type warmPoolFile struct {
+	Timezone string         `json:"timezone"` // IANA name for hours and days; defaults to UTC.
+	Pools    []warmPoolSpec `json:"pools"`
+}
+
+type warmPoolSpec struct {
+	Name       string   `json:"name"`
+	Repository string   `json:"repository"` // "owner/repo"; defaults to the repository of $REPOSITORY_URL.
+	Profile    profile  `json:"profile"`    // "default" (if empty) or "small".
+	Labels     []string `json:"labels"`     // In addition to defaultRunnerLabels.
+	Size       int      `json:"size"`
+	Hours      string   `json:"hours"`   // "HH:MM-HH:MM"; all day if empty.
+	Days       []string `json:"days"`    // "mon" to "sun"; every day if empty.
+	IdleTTL    string   `json:"idleTTL"` // A Go duration; defaults to defaultWarmIdleTTL.
+
+	from, to int // Minutes since midnight; equal for all day.
+	days     []time.Weekday
+	idleTTL  time.Duration
+}
+
+// active reports whether the pool should be kept warm at t, in loc.
+func (p warmPoolSpec) active(t time.Time, loc *time.Location) bool {
+	t = t.In(loc)
+	if len(p.days) > 0 && !slices.Contains(p.days, t.Weekday()) {
+		return false
+	}
+	m := t.Hour()*60 + t.Minute()
+	switch {
+	case p.from == p.to:
+		return true
+	case p.from < p.to:
+		return m >= p.from && m < p.to
+	default: // Overnight, e.g., "22:00-06:00".
+		return m >= p.from || m < p.to
+	}
+}
+
+// serves reports whether the pool's runners can run a workflow job with
+// labels in repo.
+func (p warmPoolSpec) serves(repo string, labels []string) bool {
+	if !strings.EqualFold(p.Repository, repo) {
+		return false
+	}
+	for _, l := range labels {
+		match := func(have string) bool { return strings.EqualFold(have, l) }
+		if !slices.ContainsFunc(defaultRunnerLabels, match) && !slices.ContainsFunc(p.Labels, match) {
+			return false
+		}
+	}
+	return true
+}
+
+// runnerName names a warm runner started at t.
+func (p warmPoolSpec) runnerName(t time.Time) string {
+	return fmt.Sprintf("%s%s-%d", warmRunnerPrefix, p.Name, t.UnixMilli())
+}
+
+// startedAt parses a runner name from runnerName; ok is false if the runner
+// is not from this pool.
+func (p warmPoolSpec) startedAt(name string) (time.Time, bool) {
+	rest, ok := strings.CutPrefix(name, warmRunnerPrefix+p.Name+"-")
+	if !ok {
+		return time.Time{}, false
+	}
+	ms, err := strconv.ParseInt(rest, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(ms), true
+}
+
+// warmPoolSet is a parsed $WARM_POOL_FILE.
+type warmPoolSet struct {
+	pools []warmPoolSpec
+	loc   *time.Location
+}
+
+// loadWarmPoolSet reads the pools at path; pools without a repository are
+// for defaultRepo.
+func loadWarmPoolSet(path, defaultRepo string) (*warmPoolSet, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading warm pool file: %v", err)
+	}
+	return parseWarmPoolSet(b, defaultRepo)
+}
+
+func parseWarmPoolSet(b []byte, defaultRepo string) (*warmPoolSet, error) {
+	var wf warmPoolFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&wf); err != nil {
+		return nil, fmt.Errorf("parsing warm pools: %v", err)
+	}
+
+	ws := &warmPoolSet{loc: time.UTC}
+	if wf.Timezone != "" {
+		loc, err := time.LoadLocation(wf.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("timezone: %v", err)
+		}
+		ws.loc = loc
+	}
+	names := map[string]bool{}
+	for i, spec := range wf.Pools {
+		if !budgetNameRE.MatchString(spec.Name) {
+			return nil, fmt.Errorf("pool %d: name %q must match %s", i+1, spec.Name, budgetNameRE)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("pool %q: duplicate name", spec.Name)
+		}
+		names[spec.Name] = true
+		if spec.Repository == "" {
+			spec.Repository = defaultRepo
+		}
+		switch spec.Profile {
+		case "":
+			spec.Profile = profileDefault
+		case profileDefault, profileSmall:
+		default:
+			// The locked profile needs a registration token per execution.
+			return nil, fmt.Errorf("pool %q: profile %q must be %q or %q", spec.Name, spec.Profile, profileDefault, profileSmall)
+		}
+		if spec.Size < 1 {
+			return nil, fmt.Errorf("pool %q: size must be at least 1", spec.Name)
+		}
+		if spec.Hours != "" {
+			from, to, ok := strings.Cut(spec.Hours, "-")
+			var err1, err2 error
+			spec.from, err1 = parseClock(from)
+			spec.to, err2 = parseClock(to)
+			if !ok || err1 != nil || err2 != nil {
+				return nil, fmt.Errorf("pool %q: hours %q must be \"HH:MM-HH:MM\"", spec.Name, spec.Hours)
+			}
+		}
+		for _, d := range spec.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("pool %q: day %q must be one of mon, tue, wed, thu, fri, sat, sun", spec.Name, d)
+			}
+			spec.days = append(spec.days, wd)
+		}
+		spec.idleTTL = defaultWarmIdleTTL
+		if spec.IdleTTL != "" {
+			d, err := time.ParseDuration(spec.IdleTTL)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("pool %q: idleTTL %q must be a positive duration", spec.Name, spec.IdleTTL)
+			}
+			spec.idleTTL = d
+		}
+		ws.pools = append(ws.pools, spec)
+	}
+	return ws, nil
+}
+
+// parseClock parses "HH:MM" into minutes since midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// usesProfile reports whether any pool runs on profile p. It is safe to
+// call on a nil pool set.
+func (ws *warmPoolSet) usesProfile(p profile) bool {
+	return ws != nil && slices.ContainsFunc(ws.pools, func(s warmPoolSpec) bool { return s.Profile == p })
+}
+
+// warmState is the state of a warm runner.
+type warmState int
+
+const (
+	warmStarting warmState = iota // Execution started; not yet registered.
+	warmIdle                      // Registered and waiting for a job.
+	warmClaimed                   // Expected to take a queued job.
+)
+
+// warmRunner is a runner in a warm pool.
+type warmRunner struct {
+	pool      *warmPoolSpec
+	name      string
+	id        int64  // GitHub's runner ID, once registered.
+	execution string // Empty if started by another instance.
+	started   time.Time
+	state     warmState
+	claimed   time.Time
+}
+
+// warmPools keeps the warm pools topped up. Runners are tracked in memory
+// and reconciled with the runners registered with GitHub, so that runners
+// started by other instances, or before a restart, are adopted. Claims are
+// shared through the state store.
+type warmPools struct {
+	clients
+	set     *warmPoolSet
+	config  config
+	records *jobStore // Optional; without it, no runner is claimed.
+	budgets *budgeter // Optional.
+
+	mu      sync.Mutex
+	runners map[string]*warmRunner // By runner name.
+	last    time.Time              // When the last runner was named, to keep names unique.
+}
+
+func newWarmPools(clients clients, config config, records *jobStore, budgets *budgeter) *warmPools {
+	return &warmPools{clients: clients, set: config.warmPools, config: config, records: records, budgets: budgets, runners: map[string]*warmRunner{}}
+}
+
+// loop reconciles periodically until ctx is done.
+func (w *warmPools) loop(ctx context.Context) {
+	t := time.NewTicker(warmInterval)
+	defer t.Stop()
+	for {
+		if err := w.reconcile(ctx, time.Now()); err != nil {
+			logError("Reconciling warm pools: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// reconcile updates the runners from GitHub, drains those that have been
+// idle too long or are outside their pool's hours, and tops up the pools.
+func (w *warmPools) reconcile(ctx context.Context, now time.Time) error {
+	var errs []error
+	repos := map[string][]selfHostedRunner{}
+	for i := range w.set.pools {
+		pool := &w.set.pools[i]
+		registered, ok := repos[pool.Repository]
+		if !ok {
+			var err error
+			if registered, err = w.github.listRunners(ctx, pool.Repository); err != nil {
+				errs = append(errs, fmt.Errorf("listing runners of %q: %v", pool.Repository, err))
+				continue
+			}
+			repos[pool.Repository] = registered
+		}
+		for _, r := range w.update(pool, registered, now) {
+			w.drain(ctx, r)
+		}
+		if err := w.releaseClaims(ctx, pool, registered); err != nil {
+			errs = append(errs, err)
+		}
+		if err := w.topUp(ctx, pool, now); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// update applies the registered runners to the pool's tracked runners and
+// returns those to drain.
+func (w *warmPools) update(pool *warmPoolSpec, registered []selfHostedRunner, now time.Time) []*warmRunner {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, gr := range registered {
+		started, ok := pool.startedAt(gr.Name)
+		if !ok {
+			continue
+		}
+		seen[gr.Name] = true
+		r, ok := w.runners[gr.Name]
+		if !ok {
+			r = &warmRunner{pool: pool, name: gr.Name, started: started, state: warmIdle}
+			w.runners[gr.Name] = r
+		}
+		r.id = gr.ID
+		switch {
+		case gr.Busy:
+			// Consumed; ephemeral runners exit after their job.
+			delete(w.runners, gr.Name)
+		case r.state == warmStarting:
+			r.state = warmIdle
+		case r.state == warmClaimed && now.Sub(r.claimed) > warmClaimTimeout:
+			r.state = warmIdle
+		}
+	}
+
+	active := pool.active(now, w.set.loc)
+	var drain, idle []*warmRunner
+	for name, r := range w.runners {
+		if r.pool.Name != pool.Name {
+			continue
+		}
+		switch {
+		case !seen[name] && r.id == 0 && now.Sub(r.started) <= warmStartTimeout:
+			// Not registered yet.
+		case !seen[name] && r.id == 0:
+			logWarn("Warm runner %q did not register within %v.", name, warmStartTimeout)
+			drain = append(drain, r)
+		case !seen[name]:
+			// Gone: it took a job, or its execution ended.
+			delete(w.runners, name)
+		case r.state == warmClaimed:
+		case !active || now.Sub(r.started) >= pool.idleTTL:
+			drain = append(drain, r)
+		default:
+			idle = append(idle, r)
+		}
+	}
+	// Each instance tops the pool up with runners the others only see once
+	// they register, so drain the newest beyond the pool's size. Every
+	// instance sees the same runners, and so drains the same ones.
+	sort.Slice(idle, func(a, b int) bool { return idle[a].started.After(idle[b].started) })
+	for i := 0; i < len(idle)-pool.Size; i++ {
+		drain = append(drain, idle[i])
+	}
+	for _, r := range drain {
+		delete(w.runners, r.name)
+	}
+	return drain
+}
+
+// drain removes an idle runner from GitHub, so that it cannot take a job,
+// and then stops its execution.
+func (w *warmPools) drain(ctx context.Context, r *warmRunner) {
+	if r.id != 0 {
+		err := w.github.deleteRunner(ctx, r.pool.Repository, r.id)
+		var ghErr *gitHubError
+		switch {
+		case errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusUnprocessableEntity:
+			logInfo("Warm runner %q took a job before it could be drained.", r.name)
+			return
+		case errors.As(err, &ghErr) && ghErr.StatusCode == http.StatusNotFound:
+		case err != nil:
+			logError("Removing warm runner %q: %v", r.name, err)
+			return
+		}
+	}
+	if r.execution != "" {
+		// The runner exits once it is removed; cancelling stops a runner
+		// that had not registered yet.
+		if err := w.jobs.cancelExecution(ctx, r.execution); err != nil {
+			logError("Cancelling execution %q of warm runner %q: %v", r.execution, r.name, err)
+		}
+	}
+	logInfo("Drained warm runner %q from pool %q.", r.name, r.pool.Name)
+}
+
+// topUp starts runners until the pool has its size in idle and starting
+// runners, if it is active and its repository is within budget.
+func (w *warmPools) topUp(ctx context.Context, pool *warmPoolSpec, now time.Time) error {
+	if !pool.active(now, w.set.loc) {
+		return nil
+	}
+	if w.budgets != nil {
+		if d := w.budgets.apply(pool.Repository, decision{allow: true, profile: pool.Profile}, now); !d.allow || d.profile != pool.Profile {
+			logInfo("Not topping up warm pool %q: %s.", pool.Name, d.reason)
+			return nil
+		}
+	}
+
+	w.mu.Lock()
+	have := 0
+	for _, r := range w.runners {
+		if r.pool.Name == pool.Name && r.state != warmClaimed {
+			have++
+		}
+	}
+	var start []*warmRunner
+	for i := have; i < pool.Size; i++ {
+		// Names have millisecond precision.
+		t := now.Truncate(time.Millisecond)
+		if !t.After(w.last) {
+			t = w.last.Add(time.Millisecond)
+		}
+		w.last = t
+		r := &warmRunner{pool: pool, name: pool.runnerName(t), started: t, state: warmStarting}
+		w.runners[r.name] = r
+		start = append(start, r)
+	}
+	w.mu.Unlock()
+
+	var errs []error
+	for _, r := range start {
+		exec, err := w.start(ctx, r)
+		w.mu.Lock()
+		if err != nil {
+			delete(w.runners, r.name)
+		} else {
+			r.execution = exec
+		}
+		w.mu.Unlock()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("starting warm runner %q: %v", r.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// start runs an execution for the warm runner and returns its name.
+func (w *warmPools) start(ctx context.Context, r *warmRunner) (string, error) {
+	job := jobFor(w.config, w.jobs, r.pool.Profile, r.pool.Repository)
+	opts := runOptions{
+		repoURL: repoURL(r.pool.Repository),
+		name:    r.name,
+		repo:    r.pool.Repository,
+		labels:  r.pool.Labels,
+		// Drained runners are removed before this; it bounds a runner that
+		// could not be.
+		timeout: min(r.pool.idleTTL+warmInterval+w.config.JobTimeout, maxTaskTimeout),
+	}
+	exec, err := job.runJob(ctx, opts)
+	if err != nil {
+		return "", err
+	}
+	logInfo("Started warm runner %q for pool %q.", r.name, r.pool.Name)
+	if w.records != nil && exec.Name != "" {
+		if err := w.records.put(ctx, newWarmRecord(r, exec, &job, r.started)); err != nil {
+			logError("Recording execution %q: %v", exec.Name, err)
+		}
+	}
+	return exec.Name, nil
+}
+
+// claim assigns a registered, idle warm runner to a queued workflow job that
+// would run on profile p, and tops up its pool. A runner that is still
+// starting may never register, so it is not claimed. It returns the
+// runner's name, or "" if none is available, or the claim cannot be
+// shared with other instances, and the job should be dispatched.
+func (w *warmPools) claim(ctx context.Context, ev *event, p profile) string {
+	if w.records == nil {
+		return ""
+	}
+	now := time.Now()
+	for {
+		r := w.reserve(ev, p, now)
+		if r == nil {
+			return ""
+		}
+		err := w.records.store.create(ctx, warmClaimPrefix+r.name, []byte(now.UTC().Format(time.RFC3339)))
+		if errors.Is(err, errBlobExists) {
+			// Claimed by another instance; it stays reserved here until the
+			// claim times out.
+			continue
+		}
+		if err != nil {
+			logError("Claiming warm runner %q: %v", r.name, err)
+			w.mu.Lock()
+			r.state = warmIdle
+			w.mu.Unlock()
+			return ""
+		}
+		if err := w.topUp(ctx, r.pool, now); err != nil {
+			logError("Topping up warm pool %q: %v", r.pool.Name, err)
+		}
+		return r.name
+	}
+}
+
+// reserve marks the oldest idle runner that can run the job, which would be
+// drained first, as claimed, and returns it; nil if there is none.
+func (w *warmPools) reserve(ev *event, p profile, now time.Time) *warmRunner {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var oldest *warmRunner
+	for _, r := range w.runners {
+		if r.state == warmIdle && r.pool.Profile == p && r.pool.serves(ev.Repository.FullName, ev.WorkflowJob.Labels) &&
+			(oldest == nil || r.started.Before(oldest.started)) {
+			oldest = r
+		}
+	}
+	if oldest != nil {
+		oldest.state, oldest.claimed = warmClaimed, now
+	}
+	return oldest
+}
+
+// releaseClaims deletes the claims on the pool's runners that are no longer
+// registered and idle: they have taken a job, or are gone.
+func (w *warmPools) releaseClaims(ctx context.Context, pool *warmPoolSpec, registered []selfHostedRunner) error {
+	if w.records == nil {
+		return nil
+	}
+	idle := map[string]bool{}
+	for _, r := range registered {
+		idle[r.Name] = !r.Busy
+	}
+	claims, err := w.records.store.list(ctx, warmClaimPrefix+warmRunnerPrefix+pool.Name+"-")
+	if err != nil {
+		return fmt.Errorf("listing claims on warm pool %q: %v", pool.Name, err)
+	}
+	var errs []error
+	for _, c := range claims {
+		name := strings.TrimPrefix(c.key, warmClaimPrefix)
+		if _, ok := pool.startedAt(name); !ok || idle[name] {
+			continue
+		}
+		if err := w.records.store.delete(ctx, c.key); err != nil {
+			errs = append(errs, fmt.Errorf("releasing claim on warm runner %q: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// consumed records that a warm runner has taken a job and tops up its pool.
+func (w *warmPools) consumed(ctx context.Context, runnerName string) {
+	if !strings.HasPrefix(runnerName, warmRunnerPrefix) {
+		return
+	}
+	w.mu.Lock()
+	r, ok := w.runners[runnerName]
+	delete(w.runners, runnerName)
+	w.mu.Unlock()
+	if !ok {
+		return
+	}
+	logInfo("Warm runner %q from pool %q took a job.", runnerName, r.pool.Name)
+	if err := w.topUp(ctx, r.pool, time.Now()); err != nil {
+		logError("Topping up warm pool %q: %v", r.pool.Name, err)
+	}
+}
+
+// newWarmRecord describes an execution started for a warm runner; it is
+// attributed to the pool's repository, with no workflow.
+func newWarmRecord(r *warmRunner, exec *runpb.Execution, job *cloudRunJob, now time.Time) jobRecord {
+	cpuLimit, memLimit := job.resources()
+	cpu, _ := parseCPU(cpuLimit)
+	mem, _ := parseMemoryGiB(memLimit)
+	owner, _, _ := strings.Cut(r.pool.Repository, "/")
+	return jobRecord{
+		Execution:      exec.Name,
+		Job:            job.jobID(),
+		Profile:        string(job.profileOrDefault()),
+		Repository:     r.pool.Repository,
+		Organization:   owner,
+		WorkflowJob:    r.name,
+		Runner:         r.name,
+		ServiceAccount: job.account,
+		CPU:            cpu,
+		MemoryGiB:      mem,
+		Dispatched:     now,
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/run/apiv2/runpb"
+)
+
+func TestParseWarmPoolSet(t *testing.T) {
+	ws, err := parseWarmPoolSet([]byte(`{
+	  "timezone": "America/New_York",
+	  "pools": [
+	    {"name": "linux", "size": 2, "hours": "08:00-18:00", "days": ["mon", "Fri"], "idleTTL": "10m"},
+	    {"name": "gpu", "repository": "acme/gpu", "profile": "small", "labels": ["gpu"], "size": 1}
+	  ]
+	}`), "squee1945/self-hosted-runner")
+	if err != nil {
+		t.Fatalf("parseWarmPoolSet() failed: %v", err)
+	}
+	linux, gpu := ws.pools[0], ws.pools[1]
+	if linux.Repository != "squee1945/self-hosted-runner" || linux.Profile != profileDefault || linux.from != 8*60 || linux.to != 18*60 || len(linux.days) != 2 || linux.idleTTL != 10*time.Minute {
+		t.Errorf("linux pool got:%+v", linux)
+	}
+	if gpu.Repository != "acme/gpu" || gpu.idleTTL != defaultWarmIdleTTL || !ws.usesProfile(profileSmall) {
+		t.Errorf("gpu pool got:%+v", gpu)
+	}
+
+	bad := map[string]string{
+		"unknown field": `{"pools": [{"name": "a", "size": 1, "min": 1}]}`,
+		"bad timezone":  `{"timezone": "Mars/Olympus", "pools": []}`,
+		"bad name":      `{"pools": [{"name": "a b", "size": 1}]}`,
+		"duplicate":     `{"pools": [{"name": "a", "size": 1}, {"name": "a", "size": 2}]}`,
+		"locked":        `{"pools": [{"name": "a", "size": 1, "profile": "locked"}]}`,
+		"no size":       `{"pools": [{"name": "a"}]}`,
+		"bad hours":     `{"pools": [{"name": "a", "size": 1, "hours": "8-18"}]}`,
+		"bad day":       `{"pools": [{"name": "a", "size": 1, "days": ["monday"]}]}`,
+		"bad ttl":       `{"pools": [{"name": "a", "size": 1, "idleTTL": "-1m"}]}`,
+	}
+	for name, in := range bad {
+		if _, err := parseWarmPoolSet([]byte(in), "o/r"); err == nil {
+			t.Errorf("%s: parseWarmPoolSet() succeeded, want error", name)
+		}
+	}
+}
+
+func TestWarmPoolActive(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone data: %v", err)
+	}
+	weekdays := warmPoolSpec{from: 8 * 60, to: 18 * 60, days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}}
+	overnight := warmPoolSpec{from: 22 * 60, to: 6 * 60}
+	always := warmPoolSpec{}
+
+	tests := []struct {
+		name string
+		pool warmPoolSpec
+		at   time.Time
+		want bool
+	}{
+		{"weekday morning", weekdays, time.Date(2023, 7, 26, 8, 0, 0, 0, ny), true},
+		{"weekday evening", weekdays, time.Date(2023, 7, 26, 18, 0, 0, 0, ny), false},
+		{"weekday in UTC", weekdays, time.Date(2023, 7, 26, 12, 30, 0, 0, time.UTC), true},
+		{"weekday early in UTC", weekdays, time.Date(2023, 7, 26, 11, 30, 0, 0, time.UTC), false},
+		{"weekend", weekdays, time.Date(2023, 7, 29, 12, 0, 0, 0, ny), false},
+		{"overnight late", overnight, time.Date(2023, 7, 26, 23, 0, 0, 0, ny), true},
+		{"overnight early", overnight, time.Date(2023, 7, 26, 5, 59, 0, 0, ny), true},
+		{"overnight day", overnight, time.Date(2023, 7, 26, 12, 0, 0, 0, ny), false},
+		{"always", always, time.Date(2023, 7, 29, 3, 0, 0, 0, ny), true},
+	}
+	for _, tc := range tests {
+		if got := tc.pool.active(tc.at, ny); got != tc.want {
+			t.Errorf("%s: active() got:%t want:%t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWarmPoolServes(t *testing.T) {
+	p := warmPoolSpec{Repository: "acme/widgets", Labels: []string{"gpu"}}
+	tests := []struct {
+		repo   string
+		labels []string
+		want   bool
+	}{
+		{"acme/widgets", []string{"self-hosted"}, true},
+		{"Acme/Widgets", []string{"self-hosted", "Linux", "X64", "GPU"}, true},
+		{"acme/widgets", nil, true},
+		{"acme/widgets", []string{"self-hosted", "arm64"}, false},
+		{"acme/other", []string{"self-hosted"}, false},
+	}
+	for _, tc := range tests {
+		if got := p.serves(tc.repo, tc.labels); got != tc.want {
+			t.Errorf("serves(%q, %v) got:%t want:%t", tc.repo, tc.labels, got, tc.want)
+		}
+	}
+}
+
+// runnerNames returns the RUNNER_NAME of each RunJob request.
+func runnerNames(reqs []*runpb.RunJobRequest) []string {
+	var names []string
+	for _, req := range reqs {
+		name := ""
+		for _, e := range req.Overrides.ContainerOverrides[0].Env {
+			if e.Name == runnerNameEnvVar {
+				name = e.GetValue()
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestWarmPools(t *testing.T) {
+	const repo = "squee1945/self-hosted-runner"
+	config := testConfig()
+	set, err := parseWarmPoolSet([]byte(`{"pools": [{"name": "linux", "size": 2, "hours": "08:00-18:00", "idleTTL": "30m"}]}`), repo)
+	if err != nil {
+		t.Fatalf("parseWarmPoolSet() failed: %v", err)
+	}
+	config.warmPools = set
+	clients, jobs := testClients(t, config)
+	gh := clients.github.(*fakeGitHub)
+	w := newWarmPools(clients, config, nil, nil)
+	ctx := context.Background()
+	morning := time.Date(2023, 7, 26, 9, 0, 0, 0, time.UTC)
+
+	// Fill the pool.
+	if err := w.reconcile(ctx, morning); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	names := runnerNames(jobs.runRequests())
+	if len(names) != 2 || !strings.HasPrefix(names[0], "cloud-run-warm-linux-") || names[0] == names[1] {
+		t.Fatalf("started runners got:%q", names)
+	}
+	if to := jobs.runRequests()[0].Overrides.Timeout.AsDuration(); to != 30*time.Minute+warmInterval+config.JobTimeout {
+		t.Errorf("timeout got:%v", to)
+	}
+
+	// Starting runners count towards the pool until they register.
+	if err := w.reconcile(ctx, morning.Add(time.Minute)); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	gh.setRunners(repo,
+		selfHostedRunner{ID: 1, Name: names[0], Status: "online"},
+		selfHostedRunner{ID: 2, Name: names[1], Status: "online"},
+		selfHostedRunner{ID: 3, Name: "someone-elses-runner", Status: "online"},
+	)
+	if err := w.reconcile(ctx, morning.Add(2*time.Minute)); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	if got := len(jobs.runRequests()); got != 2 {
+		t.Fatalf("runs after registration got:%d want:2", got)
+	}
+
+	// One takes a job and is replaced.
+	gh.setRunners(repo,
+		selfHostedRunner{ID: 1, Name: names[0], Status: "online", Busy: true},
+		selfHostedRunner{ID: 2, Name: names[1], Status: "online"},
+	)
+	if err := w.reconcile(ctx, morning.Add(3*time.Minute)); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	names = runnerNames(jobs.runRequests())
+	if len(names) != 3 {
+		t.Fatalf("runs after a job got:%d want:3", len(names))
+	}
+
+	// Idle runners are drained after the TTL, and replaced.
+	gh.setRunners(repo,
+		selfHostedRunner{ID: 2, Name: names[1], Status: "online"},
+		selfHostedRunner{ID: 4, Name: names[2], Status: "online"},
+	)
+	if err := w.reconcile(ctx, morning.Add(31*time.Minute)); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	registered, _ := gh.listRunners(ctx, repo)
+	if len(registered) != 1 || registered[0].ID != 4 {
+		t.Errorf("registered after TTL got:%+v", registered)
+	}
+	if got := len(jobs.runRequests()); got != 4 {
+		t.Errorf("runs after TTL got:%d want:4", got)
+	}
+	var cancelled int
+	for _, e := range jobs.executions {
+		cancelled += int(e.CancelledCount)
+	}
+	if cancelled != 1 {
+		t.Errorf("cancelled executions got:%d want:1", cancelled)
+	}
+
+	// Outside the pool's hours, idle runners are drained and not replaced,
+	// but a busy one is left alone.
+	gh.setRunners(repo,
+		selfHostedRunner{ID: 4, Name: names[2], Status: "online", Busy: true},
+		selfHostedRunner{ID: 5, Name: runnerNames(jobs.runRequests())[3], Status: "online"},
+	)
+	if err := w.reconcile(ctx, morning.Add(10*time.Hour)); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	registered, _ = gh.listRunners(ctx, repo)
+	if len(registered) != 1 || registered[0].ID != 4 {
+		t.Errorf("registered after hours got:%+v", registered)
+	}
+	if got := len(jobs.runRequests()); got != 4 {
+		t.Errorf("runs after hours got:%d want:4", got)
+	}
+}
+
+func TestHandlerWarmPool(t *testing.T) {
+	const repo = "squee1945/self-hosted-runner"
+	config := testConfig()
+	set, err := parseWarmPoolSet([]byte(`{"pools": [{"name": "linux", "labels": ["ubuntu-latest"], "size": 1}]}`), repo)
+	if err != nil {
+		t.Fatalf("parseWarmPoolSet() failed: %v", err)
+	}
+	config.warmPools = set
+	store, err := newBlobStore(context.Background(), t.TempDir())
+	if err != nil {
+		t.Fatalf("newBlobStore() failed: %v", err)
+	}
+	clients, jobs := testClients(t, config)
+	gh := clients.github.(*fakeGitHub)
+	w := newWarmPools(clients, config, newJobStore(store), nil)
+	h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL)), warm: w}
+	if err := w.reconcile(context.Background(), time.Now()); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	warm := runnerNames(jobs.runRequests())[0]
+
+	// A starting runner may never register, so the job is dispatched.
+	serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json")))
+	names := runnerNames(jobs.runRequests())
+	if len(names) != 2 || strings.HasPrefix(names[1], warmRunnerPrefix) {
+		t.Fatalf("runs after queued with a starting runner got:%q", names)
+	}
+
+	// Once registered, the queued job is left to the warm runner, which is
+	// replaced.
+	gh.setRunners(repo, selfHostedRunner{ID: 1, Name: warm, Status: "online"})
+	if err := w.reconcile(context.Background(), time.Now()); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	if w := serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json"))); w.Code != http.StatusOK {
+		t.Fatalf("status got:%d want:%d", w.Code, http.StatusOK)
+	}
+	names = runnerNames(jobs.runRequests())
+	if len(names) != 3 || !strings.HasPrefix(names[2], warmRunnerPrefix) {
+		t.Fatalf("runs after queued got:%q", names)
+	}
+
+	// Another instance cannot claim the same runner, and dispatches.
+	other := newWarmPools(clients, config, newJobStore(store), nil)
+	other.update(&set.pools[0], []selfHostedRunner{{ID: 1, Name: warm, Status: "online"}}, time.Now())
+	ev, err := parseEvent(readFixture(t, "workflow_job_queued.json"))
+	if err != nil {
+		t.Fatalf("parseEvent() failed: %v", err)
+	}
+	if got := other.claim(context.Background(), ev, profileDefault); got != "" {
+		t.Errorf("second instance claimed %q", got)
+	}
+
+	// When the warm runner takes the job, the pool is already full, and the
+	// claim is released.
+	serve(h, newDelivery(eventWorkFlowJob, inProgressDelivery(t, warm)))
+	if got := len(jobs.runRequests()); got != 3 {
+		t.Errorf("runs after in_progress got:%d want:3", got)
+	}
+	w.mu.Lock()
+	_, tracked := w.runners[warm]
+	w.mu.Unlock()
+	if tracked {
+		t.Errorf("consumed runner %q is still tracked", warm)
+	}
+	gh.setRunners(repo, selfHostedRunner{ID: 1, Name: warm, Status: "online", Busy: true})
+	if err := w.reconcile(context.Background(), time.Now()); err != nil {
+		t.Fatalf("reconcile() failed: %v", err)
+	}
+	if claims, _ := store.list(context.Background(), warmClaimPrefix); len(claims) != 0 {
+		t.Errorf("claims after in_progress got:%v", claims)
+	}
+}
+
+func TestWarmPoolsDrainExcess(t *testing.T) {
+	const repo = "squee1945/self-hosted-runner"
+	config := testConfig()
+	set, err := parseWarmPoolSet([]byte(`{"pools": [{"name": "linux", "size": 1}]}`), repo)
+	if err != nil {
+		t.Fatalf("parseWarmPoolSet() failed: %v", err)
+	}
+	config.warmPools = set
+	clients, _ := testClients(t, config)
+	gh := clients.github.(*fakeGitHub)
+	now := time.Now()
+	pool := &set.pools[0]
+	older, newer := pool.runnerName(now.Add(-2*time.Minute)), pool.runnerName(now.Add(-time.Minute))
+
+	// Two instances each filled the pool; both drain the newer runner.
+	gh.setRunners(repo, selfHostedRunner{ID: 1, Name: older, Status: "online"}, selfHostedRunner{ID: 2, Name: newer, Status: "online"})
+	for i := 0; i < 2; i++ {
+		w := newWarmPools(clients, config, nil, nil)
+		drain := w.update(pool, []selfHostedRunner{{ID: 1, Name: older, Status: "online"}, {ID: 2, Name: newer, Status: "online"}}, now)
+		if len(drain) != 1 || drain[0].name != newer {
+			t.Errorf("instance %d drains got:%v want:%q", i, drain, newer)
+		}
+	}
+}
+
+// inProgressDelivery returns an in_progress workflow_job payload for a
+// job taken by runnerName, made from the completed fixture.
+func inProgressDelivery(t *testing.T, runnerName string) []byte {
+	t.Helper()
+	body := string(readFixture(t, "workflow_job_completed.json"))
+	body = strings.Replace(body, `"action": "completed"`, `"action": "in_progress"`, 1)
+	return []byte(strings.Replace(body, "runner-0f2b1c6e0a9d7f4c8e3b5a1d2c4e6f80-9q8zx", runnerName, 1))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// watchdogInterval is how often dispatched jobs are checked.
+	watchdogInterval = 30 * time.Second
+)
+
+// watchedJob is a workflow job a runner was started for, which has not been
+// seen to start.
+type watchedJob struct {
+	ev         *event
+	profile    profile
+	execution  string // Of the latest runner.
+	dispatched time.Time
+	retries    int
+}
+
+// watchdog replaces the runners of dispatched workflow jobs that stay
+// queued: the execution failed before the runner took a job, or the job has
+// not started within $STUCK_JOB_TIMEOUT, e.g., because the runner could not
+// register. Jobs that still do not start after $STUCK_JOB_RETRIES
+// replacements are flagged as failed.
+//
+// Jobs are watched by the instance that dispatched them, which may not get
+// their in_progress event, so GitHub is asked whether a job is still queued
+// before its runner is replaced.
+type watchdog struct {
+	clients
+	config  config
+	records *jobStore // Optional.
+
+	mu      sync.Mutex
+	watched map[int]*watchedJob // By workflow job ID.
+}
+
+func newWatchdog(clients clients, config config, records *jobStore) *watchdog {
+	return &watchdog{clients: clients, config: config, records: records, watched: map[int]*watchedJob{}}
+}
+
+// watch starts watching the workflow job in ev, whose runner was started in
+// execution.
+func (wd *watchdog) watch(ev *event, p profile, execution string, now time.Time) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.watched[ev.WorkflowJob.ID] = &watchedJob{ev: ev, profile: p, execution: execution, dispatched: now}
+}
+
+// started stops watching workflow job id.
+func (wd *watchdog) started(id int) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	delete(wd.watched, id)
+}
+
+func (wd *watchdog) loop(ctx context.Context) {
+	t := time.NewTicker(watchdogInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		wd.check(ctx, time.Now())
+	}
+}
+
+// check replaces the runners of the watched jobs that are stuck.
+func (wd *watchdog) check(ctx context.Context, now time.Time) {
+	wd.mu.Lock()
+	jobs := make(map[int]watchedJob, len(wd.watched))
+	for id, j := range wd.watched {
+		jobs[id] = *j
+	}
+	wd.mu.Unlock()
+
+	for id, j := range jobs {
+		reason := ""
+		if now.Sub(j.dispatched) >= wd.config.StuckJobTimeout {
+			reason = fmt.Sprintf("not started after %v", wd.config.StuckJobTimeout)
+		} else if wd.executionDone(ctx, j.execution) {
+			reason = fmt.Sprintf("execution %q finished before it started", j.execution)
+		}
+		if reason == "" {
+			continue
+		}
+
+		repo := j.ev.Repository.FullName
+		ghJob, err := wd.github.getWorkflowJob(ctx, repo, id)
+		if err != nil {
+			logWarn("Checking stuck workflow job %d in %q: %v", id, repo, err)
+			continue
+		}
+		switch ghJob.Status {
+		case statusQueued:
+		case statusWaiting:
+			// Waiting for a deployment approval; no runner can take it yet.
+			continue
+		default:
+			wd.started(id)
+			continue
+		}
+
+		if j.retries >= wd.config.StuckJobRetries {
+			logError("Workflow job %d (%q) in %q failed: %s, after %d replacement runners.", id, j.ev.WorkflowJob.Name, repo, reason, j.retries)
+			stuckJobsFailed.inc(repo)
+			wd.started(id)
+			continue
+		}
+		execution, err := wd.redispatch(ctx, j)
+		if err != nil {
+			// Retried on the next check.
+			logError("Replacing the runner of stuck workflow job %d (%q) in %q: %v", id, j.ev.WorkflowJob.Name, repo, err)
+			continue
+		}
+		logWarn("Workflow job %d (%q) in %q is stuck: %s. Started replacement runner %d of %d in execution %q.", id, j.ev.WorkflowJob.Name, repo, reason, j.retries+1, wd.config.StuckJobRetries, execution)
+		stuckJobsRedispatched.inc(repo)
+
+		wd.mu.Lock()
+		if w, ok := wd.watched[id]; ok {
+			w.execution, w.dispatched = execution, now
+			w.retries++
+		}
+		wd.mu.Unlock()
+	}
+}
+
+// executionDone reports whether the execution has finished. Errors are
+// logged and treated as still running.
+func (wd *watchdog) executionDone(ctx context.Context, name string) bool {
+	if name == "" {
+		return false
+	}
+	exec, err := wd.jobs.getExecution(ctx, name)
+	if err != nil {
+		logWarn("Getting execution %q: %v", name, err)
+		return false
+	}
+	return exec.GetCompletionTime() != nil
+}
+
+// redispatch starts another runner for the job and returns its execution.
+func (wd *watchdog) redispatch(ctx context.Context, j watchedJob) (string, error) {
+	ev := j.ev
+	opts := runOptionsFor(wd.config, ev)
+	// A runner that registered before failing leaves its registration
+	// behind, and a runner with the same name could not register.
+	opts.name = fmt.Sprintf("%s-retry-%d", opts.runnerName(), j.retries+1)
+	if j.profile == profileLocked {
+		token, err := wd.github.registrationToken(ctx, ev.Repository.FullName)
+		if err != nil {
+			return "", fmt.Errorf("creating registration token for %q: %v", ev.Repository.FullName, err)
+		}
+		opts.runnerToken = token
+	}
+	crJob := jobFor(wd.config, wd.jobs, j.profile, ev.Repository.FullName)
+	exec, err := crJob.runJob(ctx, opts)
+	if err != nil {
+		return "", fmt.Errorf("running job %q: %v", crJob.jobID(), err)
+	}
+	if wd.records != nil && exec.Name != "" {
+		if err := wd.records.put(ctx, newJobRecord(ev, exec, &crJob, opts.runnerName(), time.Now())); err != nil {
+			logError("Recording execution %q: %v", exec.Name, err)
+		}
+	}
+	return exec.Name, nil
+}
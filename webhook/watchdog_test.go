@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	const jobID = 42
+	repo := "owner/" + strings.ReplaceAll(t.Name(), "/", "-")
+	ev := &event{
+		Action:      actionQueued,
+		Repository:  eventRepository{FullName: repo},
+		WorkflowJob: eventWorkflowJob{ID: jobID, RunID: 7, RunAttempt: 1, Name: "build", Labels: []string{"self-hosted"}},
+	}
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		age           time.Duration // Since dispatch.
+		execDone      bool
+		started       bool // The in_progress event arrived.
+		status        status
+		statusErr     error
+		retries       int
+		wantRuns      int // Replacement runners started.
+		wantFailed    bool
+		wantWatched   bool
+		wantRetriesAt int // Retries of the job, if still watched.
+	}{
+		{name: "not yet due", age: time.Minute, status: statusQueued, wantWatched: true},
+		{name: "started", age: time.Hour, started: true, status: statusQueued},
+		{name: "overdue", age: 10 * time.Minute, status: statusQueued, wantRuns: 1, wantWatched: true, wantRetriesAt: 1},
+		{name: "execution failed", age: time.Minute, execDone: true, status: statusQueued, wantRuns: 1, wantWatched: true, wantRetriesAt: 1},
+		{name: "in progress on GitHub", age: 10 * time.Minute, status: statusInProgress},
+		{name: "completed on GitHub", age: 10 * time.Minute, execDone: true, status: statusCompleted},
+		{name: "waiting on GitHub", age: 10 * time.Minute, status: statusWaiting, wantWatched: true},
+		{name: "GitHub error", age: 10 * time.Minute, statusErr: errors.New("boom"), wantWatched: true},
+		{name: "retries exhausted", age: 10 * time.Minute, status: statusQueued, retries: 2, wantFailed: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := testConfig()
+			config.StuckJobTimeout = 5 * time.Minute
+			config.StuckJobRetries = 2
+			clients, jobs := testClients(t, config)
+			gh := clients.github.(*fakeGitHub)
+			gh.setWorkflowJobStatus(jobID, tc.status)
+			gh.workflowJobErr = tc.statusErr
+
+			job := cloudRunJob{config: config, client: jobs}
+			exec, err := job.runJob(context.Background(), runOptionsFor(config, ev))
+			if err != nil {
+				t.Fatalf("runJob() failed: %v", err)
+			}
+			if tc.execDone {
+				jobs.finishExecution(exec.Name, now.Add(-tc.age), now.Add(-time.Second), false)
+			}
+
+			wd := newWatchdog(clients, config, nil)
+			wd.watch(ev, profileDefault, exec.Name, now.Add(-tc.age))
+			wd.watched[jobID].retries = tc.retries
+			if tc.started {
+				wd.started(jobID)
+			}
+			redispatched, failed := stuckJobsRedispatched.value(repo), stuckJobsFailed.value(repo)
+
+			wd.check(context.Background(), now)
+
+			if got := len(jobs.runRequests()) - 1; got != tc.wantRuns {
+				t.Errorf("replacement runs got:%d want:%d", got, tc.wantRuns)
+			}
+			if got := stuckJobsRedispatched.value(repo) - redispatched; got != float64(tc.wantRuns) {
+				t.Errorf("redispatched counter got:+%g want:+%d", got, tc.wantRuns)
+			}
+			if got := stuckJobsFailed.value(repo) - failed; (got == 1) != tc.wantFailed {
+				t.Errorf("failed counter got:+%g wantFailed:%t", got, tc.wantFailed)
+			}
+			w, watched := wd.watched[jobID]
+			if watched != tc.wantWatched {
+				t.Fatalf("watched got:%t want:%t", watched, tc.wantWatched)
+			}
+			if watched && w.retries != tc.wantRetriesAt {
+				t.Errorf("retries got:%d want:%d", w.retries, tc.wantRetriesAt)
+			}
+			if tc.wantRuns > 0 {
+				if w.execution == exec.Name || !w.dispatched.Equal(now) {
+					t.Errorf("replacement not tracked: execution %q, dispatched %v", w.execution, w.dispatched)
+				}
+				reqs := jobs.runRequests()
+				if got, want := overrideEnv(reqs[len(reqs)-1])[runnerNameEnvVar], "cloud-run-42-retry-1"; got != want {
+					t.Errorf("replacement runner name got:%q want:%q", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerWatchdog(t *testing.T) {
+	config := testConfig()
+	config.ForkPolicy = forkPolicyAllow
+	config.StuckJobTimeout = 5 * time.Minute
+	clients, _ := testClients(t, config)
+	wd := newWatchdog(clients, config, nil)
+	h := handler{clients: clients, config: config, repos: newRepoSet(nil, repoFromURL(config.RepositoryURL)), watchdog: wd}
+
+	if w := serve(h, newDelivery(eventWorkFlowJob, readFixture(t, "workflow_job_queued.json"))); w.Code != http.StatusOK {
+		t.Fatalf("status got:%d want:%d", w.Code, http.StatusOK)
+	}
+	if got := len(wd.watched); got != 1 {
+		t.Fatalf("watched after queued got:%d want:1", got)
+	}
+
+	serve(h, newDelivery(eventWorkFlowJob, inProgressDelivery(t, "cloud-run-123")))
+	if got := len(wd.watched); got != 0 {
+		t.Errorf("watched after in_progress got:%d want:0", got)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	stuckJobsFailed.inc(`owner/"quoted"`)
+	s := &server{}
+	w := httptest.NewRecorder()
+	s.mux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status got:%d want:%d", w.Code, http.StatusOK)
+	}
+	for _, want := range []string{
+		"# TYPE cr_runner_stuck_jobs_redispatched_total counter\n",
+		"# TYPE cr_runner_stuck_jobs_failed_total counter\n",
+		`cr_runner_stuck_jobs_failed_total{repository="owner/\"quoted\""} `,
+	} {
+		if !bytes.Contains(w.Body.Bytes(), []byte(want)) {
+			t.Errorf("metrics missing %q:\n%s", want, w.Body)
+		}
+	}
+}